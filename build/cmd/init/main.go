@@ -3,6 +3,7 @@ package main
 import (
 	. "github.com/outofforest/cloudless" //nolint:staticcheck
 	"github.com/outofforest/cloudless/pkg/dev"
+	"github.com/outofforest/cloudless/pkg/ssh"
 )
 
 var deployment = Deployment(
@@ -13,5 +14,8 @@ var deployment = Deployment(
 )
 
 func main() {
+	if ssh.IsSFTP() {
+		ssh.SFTP()
+	}
 	Main(deployment...)
 }
@@ -26,6 +26,7 @@ var HostService = Join(
 		shield.Open("tcp4", "igw", eye.MetricPort),
 		eye.MetricsServer(eye.Addresses("10.255.255.2", "10.255.255.3", "10.255.255.4", "10.255.255.5")),
 		shield.Expose("udp", "10.255.0.2", dns.Port, "10.255.255.3", dns.Port),
+		shield.Expose("tcp", "10.255.0.2", dns.Port, "10.255.255.3", dns.Port),
 		shield.Masquerade("brint", "igw"),
 		Bridge("brint", "02:00:00:00:01:01", IPs("10.255.255.1/24")),
 		container.New("wave",
@@ -51,6 +52,7 @@ var HostService = Join(
 		Network("02:00:00:00:01:03", "igw", IPs("10.255.255.3/24")),
 		Gateway("10.255.255.1"),
 		shield.Open("udp4", "igw", dns.Port),
+		shield.Open("tcp4", "igw", dns.Port),
 		dns.Service(
 			dns.ACME(waveConfig),
 			dns.DKIM(waveConfig),
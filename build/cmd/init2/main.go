@@ -61,6 +61,7 @@ var (
 	// HostDNS configures DNS virtual machine.
 	HostDNS = ExtendBoxFactory(Host,
 		shield.Open("udp4", "igw", dns.Port),
+		shield.Open("tcp4", "igw", dns.Port),
 		shield.Open("tcp4", "igw", dnsdkim.Port),
 		dns.Service(
 			dns.ACME(waveConfig),
@@ -121,7 +122,9 @@ var deployment = Deployment(
 		shield.Masquerade("brdns", "igw"),
 		shield.Forward("brdns", "brmon"),
 		shield.Expose("udp", "93.179.253.130", dns.Port, "10.0.3.2", dns.Port),
+		shield.Expose("tcp", "93.179.253.130", dns.Port, "10.0.3.2", dns.Port),
 		shield.Expose("udp", "93.179.253.131", dns.Port, "10.0.3.3", dns.Port),
+		shield.Expose("tcp", "93.179.253.131", dns.Port, "10.0.3.3", dns.Port),
 		vm.New("dns01", 2, 2, vm.Bridge("brdns", "vdns01", "02:00:00:00:03:02")),
 		vm.New("dns02", 2, 2, vm.Bridge("brdns", "vdns02", "02:00:00:00:03:03")),
 
@@ -246,5 +249,8 @@ var deployment = Deployment(
 )
 
 func main() {
+	if ssh.IsSFTP() {
+		ssh.SFTP()
+	}
 	Main(deployment...)
 }
@@ -62,6 +62,16 @@ func Service(appName, email string, dirConfig DirectoryConfig, waveConfig cwave.
 		if len(config.Domains) == 0 {
 			return errors.New("no domains defined")
 		}
+		for d, challengeType := range config.Challenges {
+			switch challengeType {
+			case ChallengeDNS01, ChallengeHTTP01, ChallengeTLSALPN01:
+			default:
+				return errors.Errorf("unsupported challenge type %q", challengeType)
+			}
+			if strings.HasPrefix(d, "*.") && challengeType != ChallengeDNS01 {
+				return errors.Errorf("wildcard domain %s must be validated using dns-01 challenge", d)
+			}
+		}
 
 		return runACME(ctx, config)
 	})
@@ -202,8 +212,17 @@ func runIssuer(ctx context.Context, config Config, waveClient *wave.Client) erro
 						continue
 					}
 
+					domain := authZ.Identifier.Value
+					if authZ.Wildcard {
+						domain = "*." + domain
+					}
+					challengeType := config.Challenges[domain]
+					if challengeType == "" {
+						challengeType = ChallengeDNS01
+					}
+
 					for _, acmeChallenge := range authZ.Challenges {
-						if acmeChallenge.Status != "pending" || acmeChallenge.Type != "dns-01" {
+						if acmeChallenge.Status != "pending" || acmeChallenge.Type != string(challengeType) {
 							continue
 						}
 
@@ -215,28 +234,59 @@ func runIssuer(ctx context.Context, config Config, waveClient *wave.Client) erro
 					}
 				}
 
-				req := &dnsacmewire.MsgRequest{
+				dnsReq := &dnsacmewire.MsgRequest{
 					Provider:   config.Directory.Provider,
 					AccountURI: string(client.KID),
-					Challenges: make([]dnsacmewire.Challenge, 0, len(o.Challenges)),
 				}
+				challengeMsg := &wire.MsgChallenge{}
 				for _, ch := range o.Challenges {
-					auth, err := client.DNS01ChallengeRecord(ch.Challenge.Token)
-					if err != nil {
-						return errors.WithStack(err)
-					}
+					switch ChallengeType(ch.Challenge.Type) {
+					case ChallengeDNS01:
+						auth, err := client.DNS01ChallengeRecord(ch.Challenge.Token)
+						if err != nil {
+							return errors.WithStack(err)
+						}
 
-					req.Challenges = append(req.Challenges, dnsacmewire.Challenge{
-						Domain: ch.Domain,
-						Value:  auth,
-					})
+						dnsReq.Challenges = append(dnsReq.Challenges, dnsacmewire.Challenge{
+							Domain: ch.Domain,
+							Value:  auth,
+						})
+					case ChallengeHTTP01:
+						auth, err := client.HTTP01ChallengeResponse(ch.Challenge.Token)
+						if err != nil {
+							return errors.WithStack(err)
+						}
+
+						challengeMsg.HTTP = append(challengeMsg.HTTP, wire.HTTPChallenge{
+							Domain:           ch.Domain,
+							Token:            ch.Challenge.Token,
+							KeyAuthorization: auth,
+						})
+					case ChallengeTLSALPN01:
+						cert, err := tlsALPNCertificate(client, ch.Challenge.Token, ch.Domain)
+						if err != nil {
+							return err
+						}
+
+						challengeMsg.TLSALPN = append(challengeMsg.TLSALPN, wire.TLSALPNChallenge{
+							Domain:      ch.Domain,
+							Certificate: cert,
+						})
+					}
 				}
 
-				if err := waveClient.Send(req, mDNSACME); err != nil {
-					return err
+				if len(dnsReq.Challenges) > 0 {
+					if err := waveClient.Send(dnsReq, mDNSACME); err != nil {
+						return err
+					}
+				}
+				if len(challengeMsg.HTTP) > 0 || len(challengeMsg.TLSALPN) > 0 {
+					if err := waveClient.Send(challengeMsg, mACME); err != nil {
+						return err
+					}
 				}
 
-				// Wait for DNS to set up.
+				// Wait for DNS and ingresses to set up.
 				// FIXME:wojciech Query DNS for records.
 				select {
 				case <-ctx.Done():
@@ -431,6 +481,19 @@ func storeCertificate(certFile string, key *ecdsa.PrivateKey, chain [][]byte) ([
 		return nil, errors.WithStack(err)
 	}
 
+	certRaw, err := encodeCertificate(key, chain)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(certFile, certRaw, 0o600); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return certRaw, nil
+}
+
+func encodeCertificate(key *ecdsa.PrivateKey, chain [][]byte) ([]byte, error) {
 	keyRaw, err := x509.MarshalECPrivateKey(key)
 	if err != nil {
 		return nil, errors.WithStack(err)
@@ -447,11 +510,22 @@ func storeCertificate(certFile string, key *ecdsa.PrivateKey, chain [][]byte) ([
 		}
 	}
 
-	if err := os.WriteFile(certFile, buf.Bytes(), 0o600); err != nil {
+	return buf.Bytes(), nil
+}
+
+// tlsALPNCertificate returns self-signed certificate presented in response to TLS-ALPN-01 challenge.
+func tlsALPNCertificate(client *goacme.Client, token, domain string) ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	cert, err := client.TLSALPN01ChallengeCert(token, domain, goacme.WithKey(key))
+	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	return buf.Bytes(), nil
+	return encodeCertificate(key, cert.Certificate)
 }
 
 func certificateExpirationTime(cert []byte) (time.Time, error) {
@@ -0,0 +1,170 @@
+package certificate
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/outofforest/cloudless/pkg/acme/wire"
+	cwave "github.com/outofforest/cloudless/pkg/wave"
+	"github.com/outofforest/parallel"
+	"github.com/outofforest/wave"
+)
+
+// NewStore creates new store of certificates for the domains.
+func NewStore(waveConfig cwave.Config, domains []string) *Store {
+	return &Store{
+		waveConfig: waveConfig,
+		domains:    domains,
+		certs:      map[string]*tls.Certificate{},
+	}
+}
+
+// Store keeps the latest certificates delivered over wave for the domains.
+type Store struct {
+	waveConfig cwave.Config
+	domains    []string
+
+	mu    sync.RWMutex
+	certs map[string]*tls.Certificate
+}
+
+// Run receives certificates.
+func (s *Store) Run(ctx context.Context) error {
+	waveClient, waveCh, err := wave.NewClient(wave.ClientConfig{
+		CA:             s.waveConfig.CA,
+		Servers:        s.waveConfig.Servers,
+		MaxMessageSize: s.waveConfig.MaxMessageSize,
+		Requests: []wave.RequestConfig{
+			{
+				Marshaller: wire.NewMarshaller(),
+				Messages:   []any{&wire.MsgCertificate{}},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		spawn("wave", parallel.Fail, waveClient.Run)
+		spawn("certificate", parallel.Fail, func(ctx context.Context) error {
+			for {
+				select {
+				case <-ctx.Done():
+					return errors.WithStack(ctx.Err())
+				case msg := <-waveCh:
+					certMsg, ok := msg.(*wire.MsgCertificate)
+					if !ok {
+						return errors.New("unexpected message type")
+					}
+
+					if err := s.Set(certMsg.Certificate); err != nil {
+						return err
+					}
+				}
+			}
+		})
+
+		return nil
+	})
+}
+
+// Set stores PEM-encoded certificate for the domains it is valid for, unless newer one is already stored.
+func (s *Store) Set(cert []byte) error {
+	tlsCert, err := Parse(cert)
+	if err != nil {
+		return err
+	}
+
+	supportedDomains := map[string]struct{}{}
+	if tlsCert.Leaf.Subject.CommonName != "" {
+		supportedDomains[tlsCert.Leaf.Subject.CommonName] = struct{}{}
+	}
+	for _, n := range tlsCert.Leaf.DNSNames {
+		if n != "" {
+			supportedDomains[n] = struct{}{}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range s.domains {
+		if containsDomain(d, supportedDomains) {
+			existingCert, exists := s.certs[d]
+			if !exists || tlsCert.Leaf.NotAfter.After(existingCert.Leaf.NotAfter) {
+				s.certs[d] = tlsCert
+			}
+		}
+	}
+
+	return nil
+}
+
+// GetCertificate returns certificate for the server name requested by the client.
+func (s *Store) GetCertificate(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.certs[info.ServerName], nil
+}
+
+// Parse parses PEM-encoded certificate chain and its private key.
+func Parse(cert []byte) (*tls.Certificate, error) {
+	tlsCert := &tls.Certificate{}
+	for {
+		var block *pem.Block
+		block, cert = pem.Decode(cert)
+		if block == nil {
+			break
+		}
+
+		switch block.Type {
+		case "EC PRIVATE KEY":
+			var err error
+			tlsCert.PrivateKey, err = x509.ParseECPrivateKey(block.Bytes)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+		case "CERTIFICATE":
+			tlsCert.Certificate = append(tlsCert.Certificate, block.Bytes)
+		}
+	}
+
+	if tlsCert.PrivateKey == nil {
+		return nil, errors.New("private key not present")
+	}
+	if len(tlsCert.Certificate) == 0 {
+		return nil, errors.New("certificate chain not present")
+	}
+
+	var err error
+	tlsCert.Leaf, err = x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return tlsCert, nil
+}
+
+func containsDomain(domain string, domains map[string]struct{}) bool {
+	if _, exists := domains[domain]; exists {
+		return true
+	}
+	for {
+		pos := strings.Index(domain, ".")
+		if pos < 0 {
+			return false
+		}
+		domain = domain[pos+1:]
+		if _, exists := domains["*."+domain]; exists {
+			return true
+		}
+	}
+}
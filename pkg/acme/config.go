@@ -17,8 +17,25 @@ type Config struct {
 	Directory   DirectoryConfig
 	WaveConfig  wave.Config
 	Domains     []string
+
+	// Challenges map domains to the types of challenges used to validate them. DNS-01 is used by default.
+	Challenges map[string]ChallengeType
 }
 
+// ChallengeType is the type of ACME challenge.
+type ChallengeType string
+
+const (
+	// ChallengeDNS01 is validated by the TXT record served by our DNS servers.
+	ChallengeDNS01 ChallengeType = "dns-01"
+
+	// ChallengeHTTP01 is validated by the HTTP request sent to the ingress on port 80.
+	ChallengeHTTP01 ChallengeType = "http-01"
+
+	// ChallengeTLSALPN01 is validated by the TLS handshake with the ingress TLS listener.
+	ChallengeTLSALPN01 ChallengeType = "tls-alpn-01"
+)
+
 // Configurator defines function setting the dns configuration.
 type Configurator func(c *Config)
 
@@ -60,11 +77,22 @@ func Pebble(host string) DirectoryConfig {
 	}
 }
 
-// Domains adds domains to issue certificate for.
+// Domains adds domains to issue certificate for. They are validated using DNS-01 challenge.
 func Domains(domains ...string) Configurator {
+	return ChallengeDomains(ChallengeDNS01, domains...)
+}
+
+// ChallengeDomains adds domains to issue certificate for, validated using the challenge type.
+// Wildcard domains might be validated using DNS-01 challenge only.
+func ChallengeDomains(challengeType ChallengeType, domains ...string) Configurator {
 	return func(c *Config) {
+		if c.Challenges == nil {
+			c.Challenges = map[string]ChallengeType{}
+		}
 		for _, d := range domains {
-			c.Domains = append(c.Domains, strings.ToLower(d))
+			d = strings.ToLower(d)
+			c.Domains = append(c.Domains, d)
+			c.Challenges[d] = challengeType
 		}
 	}
 }
@@ -9,5 +9,6 @@ import (
 func main() {
 	proton.Generate("../types.proton.go",
 		proton.Message[wire.MsgCertificate](),
+		proton.Message[wire.MsgChallenge](),
 	)
 }
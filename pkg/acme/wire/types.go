@@ -4,3 +4,22 @@ package wire
 type MsgCertificate struct {
 	Certificate []byte
 }
+
+// MsgChallenge is used to deliver responses to HTTP-01 and TLS-ALPN-01 ACME challenges to HTTP ingresses.
+type MsgChallenge struct {
+	HTTP    []HTTPChallenge
+	TLSALPN []TLSALPNChallenge
+}
+
+// HTTPChallenge is the response to HTTP-01 challenge.
+type HTTPChallenge struct {
+	Domain           string
+	Token            string
+	KeyAuthorization string
+}
+
+// TLSALPNChallenge is the certificate presented in response to TLS-ALPN-01 challenge.
+type TLSALPNChallenge struct {
+	Domain      string
+	Certificate []byte
+}
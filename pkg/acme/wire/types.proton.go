@@ -10,7 +10,8 @@ import (
 )
 
 const (
-	id0 uint64 = iota + 1
+	id3 uint64 = iota + 1
+	id2
 )
 
 var _ proton.Marshaller = Marshaller{}
@@ -28,6 +29,7 @@ type Marshaller struct {
 func (m Marshaller) Messages() []any {
 	return []any {
 		MsgCertificate{},
+		MsgChallenge{},
 	}
 }
 
@@ -35,7 +37,9 @@ func (m Marshaller) Messages() []any {
 func (m Marshaller) ID(msg any) (uint64, error) {
 	switch msg.(type) {
 	case *MsgCertificate:
-		return id0, nil
+		return id3, nil
+	case *MsgChallenge:
+		return id2, nil
 	default:
 		return 0, errors.Errorf("unknown message type %T", msg)
 	}
@@ -45,7 +49,9 @@ func (m Marshaller) ID(msg any) (uint64, error) {
 func (m Marshaller) Size(msg any) (uint64, error) {
 	switch msg2 := msg.(type) {
 	case *MsgCertificate:
-		return size0(msg2), nil
+		return size3(msg2), nil
+	case *MsgChallenge:
+		return size2(msg2), nil
 	default:
 		return 0, errors.Errorf("unknown message type %T", msg)
 	}
@@ -57,7 +63,9 @@ func (m Marshaller) Marshal(msg any, buf []byte) (retID, retSize uint64, retErr
 
 	switch msg2 := msg.(type) {
 	case *MsgCertificate:
-		return id0, marshal0(msg2, buf), nil
+		return id3, marshal3(msg2, buf), nil
+	case *MsgChallenge:
+		return id2, marshal2(msg2, buf), nil
 	default:
 		return 0, 0, errors.Errorf("unknown message type %T", msg)
 	}
@@ -68,9 +76,12 @@ func (m Marshaller) Unmarshal(id uint64, buf []byte) (retMsg any, retSize uint64
 	defer helpers.RecoverUnmarshal(&retErr)
 
 	switch id {
-	case id0:
+	case id3:
 		msg := &MsgCertificate{}
-		return msg, unmarshal0(msg, buf), nil
+		return msg, unmarshal3(msg, buf), nil
+	case id2:
+		msg := &MsgChallenge{}
+		return msg, unmarshal2(msg, buf), nil
 	default:
 		return nil, 0, errors.Errorf("unknown ID %d", id)
 	}
@@ -80,7 +91,9 @@ func (m Marshaller) Unmarshal(id uint64, buf []byte) (retMsg any, retSize uint64
 func (m Marshaller) IsPatchNeeded(msgDst, msgSrc any) (bool, error) {
 	switch msg2 := msgDst.(type) {
 	case *MsgCertificate:
-		return isPatchNeeded0(msg2, msgSrc.(*MsgCertificate)), nil
+		return isPatchNeeded3(msg2, msgSrc.(*MsgCertificate)), nil
+	case *MsgChallenge:
+		return isPatchNeeded2(msg2, msgSrc.(*MsgChallenge)), nil
 	default:
 		return false, errors.Errorf("unknown message type %T", msgDst)
 	}
@@ -92,7 +105,9 @@ func (m Marshaller) MakePatch(msgDst, msgSrc any, buf []byte) (retID, retSize ui
 
 	switch msg2 := msgDst.(type) {
 	case *MsgCertificate:
-		return id0, makePatch0(msg2, msgSrc.(*MsgCertificate), buf), nil
+		return id3, makePatch3(msg2, msgSrc.(*MsgCertificate), buf), nil
+	case *MsgChallenge:
+		return id2, makePatch2(msg2, msgSrc.(*MsgChallenge), buf), nil
 	default:
 		return 0, 0, errors.Errorf("unknown message type %T", msgDst)
 	}
@@ -104,13 +119,363 @@ func (m Marshaller) ApplyPatch(msg any, buf []byte) (retSize uint64, retErr erro
 
 	switch msg2 := msg.(type) {
 	case *MsgCertificate:
-		return applyPatch0(msg2, buf), nil
+		return applyPatch3(msg2, buf), nil
+	case *MsgChallenge:
+		return applyPatch2(msg2, buf), nil
 	default:
 		return 0, errors.Errorf("unknown message type %T", msg)
 	}
 }
 
-func size0(m *MsgCertificate) uint64 {
+func size2(m *MsgChallenge) uint64 {
+	var n uint64 = 2
+	{
+		// HTTP
+
+		l := uint64(len(m.HTTP))
+		helpers.UInt64Size(l, &n)
+		for _, sv1 := range m.HTTP {
+			n += size0(&sv1)
+		}
+	}
+	{
+		// TLSALPN
+
+		l := uint64(len(m.TLSALPN))
+		helpers.UInt64Size(l, &n)
+		for _, sv1 := range m.TLSALPN {
+			n += size1(&sv1)
+		}
+	}
+	return n
+}
+
+func marshal2(m *MsgChallenge, b []byte) uint64 {
+	var o uint64
+	{
+		// HTTP
+
+		helpers.UInt64Marshal(uint64(len(m.HTTP)), b, &o)
+		for _, sv1 := range m.HTTP {
+			o += marshal0(&sv1, b[o:])
+		}
+	}
+	{
+		// TLSALPN
+
+		helpers.UInt64Marshal(uint64(len(m.TLSALPN)), b, &o)
+		for _, sv1 := range m.TLSALPN {
+			o += marshal1(&sv1, b[o:])
+		}
+	}
+
+	return o
+}
+
+func unmarshal2(m *MsgChallenge, b []byte) uint64 {
+	var o uint64
+	{
+		// HTTP
+
+		var l uint64
+		helpers.UInt64Unmarshal(&l, b, &o)
+		if l > 0 {
+			m.HTTP = make([]HTTPChallenge, l)
+			for i1 := range l {
+				o += unmarshal0(&m.HTTP[i1], b[o:])
+			}
+		}
+	}
+	{
+		// TLSALPN
+
+		var l uint64
+		helpers.UInt64Unmarshal(&l, b, &o)
+		if l > 0 {
+			m.TLSALPN = make([]TLSALPNChallenge, l)
+			for i1 := range l {
+				o += unmarshal1(&m.TLSALPN[i1], b[o:])
+			}
+		}
+	}
+
+	return o
+}
+
+func isPatchNeeded2(m, mSrc *MsgChallenge) bool {
+	{
+		// HTTP
+
+		if !reflect.DeepEqual(m.HTTP, mSrc.HTTP) {
+			return true
+		}
+
+	}
+	{
+		// TLSALPN
+
+		if !reflect.DeepEqual(m.TLSALPN, mSrc.TLSALPN) {
+			return true
+		}
+
+	}
+
+	return false
+}
+
+func makePatch2(m, mSrc *MsgChallenge, b []byte) uint64 {
+	var o uint64 = 1
+	{
+		// HTTP
+
+		if reflect.DeepEqual(m.HTTP, mSrc.HTTP) {
+			b[0] &= 0xFE
+		} else {
+			b[0] |= 0x01
+			helpers.UInt64Marshal(uint64(len(m.HTTP)), b, &o)
+			for _, sv1 := range m.HTTP {
+				o += marshal0(&sv1, b[o:])
+			}
+		}
+	}
+	{
+		// TLSALPN
+
+		if reflect.DeepEqual(m.TLSALPN, mSrc.TLSALPN) {
+			b[0] &= 0xFD
+		} else {
+			b[0] |= 0x02
+			helpers.UInt64Marshal(uint64(len(m.TLSALPN)), b, &o)
+			for _, sv1 := range m.TLSALPN {
+				o += marshal1(&sv1, b[o:])
+			}
+		}
+	}
+
+	return o
+}
+
+func applyPatch2(m *MsgChallenge, b []byte) uint64 {
+	var o uint64 = 1
+	{
+		// HTTP
+
+		if b[0]&0x01 != 0 {
+			var l uint64
+			helpers.UInt64Unmarshal(&l, b, &o)
+			if l > 0 {
+				m.HTTP = make([]HTTPChallenge, l)
+				for i1 := range l {
+					o += unmarshal0(&m.HTTP[i1], b[o:])
+				}
+			}
+		}
+	}
+	{
+		// TLSALPN
+
+		if b[0]&0x02 != 0 {
+			var l uint64
+			helpers.UInt64Unmarshal(&l, b, &o)
+			if l > 0 {
+				m.TLSALPN = make([]TLSALPNChallenge, l)
+				for i1 := range l {
+					o += unmarshal1(&m.TLSALPN[i1], b[o:])
+				}
+			}
+		}
+	}
+
+	return o
+}
+
+func size1(m *TLSALPNChallenge) uint64 {
+	var n uint64 = 2
+	{
+		// Domain
+
+		{
+			l := uint64(len(m.Domain))
+			helpers.UInt64Size(l, &n)
+			n += l
+		}
+	}
+	{
+		// Certificate
+
+		l := uint64(len(m.Certificate))
+		helpers.UInt64Size(l, &n)
+		n += l
+	}
+	return n
+}
+
+func marshal1(m *TLSALPNChallenge, b []byte) uint64 {
+	var o uint64
+	{
+		// Domain
+
+		{
+			l := uint64(len(m.Domain))
+			helpers.UInt64Marshal(l, b, &o)
+			copy(b[o:o+l], m.Domain)
+			o += l
+		}
+	}
+	{
+		// Certificate
+
+		l := uint64(len(m.Certificate))
+		helpers.UInt64Marshal(l, b, &o)
+		if l > 0 {
+			copy(b[o:o+l], unsafe.Slice(&m.Certificate[0], l))
+			o += l
+		}
+	}
+
+	return o
+}
+
+func unmarshal1(m *TLSALPNChallenge, b []byte) uint64 {
+	var o uint64
+	{
+		// Domain
+
+		{
+			var l uint64
+			helpers.UInt64Unmarshal(&l, b, &o)
+			if l > 0 {
+				m.Domain = string(b[o:o+l])
+				o += l
+			}
+		}
+	}
+	{
+		// Certificate
+
+		var l uint64
+		helpers.UInt64Unmarshal(&l, b, &o)
+		if l > 0 {
+			m.Certificate = make([]uint8, l)
+			copy(m.Certificate, b[o:o+l])
+			o += l
+		}
+	}
+
+	return o
+}
+
+func size0(m *HTTPChallenge) uint64 {
+	var n uint64 = 3
+	{
+		// Domain
+
+		{
+			l := uint64(len(m.Domain))
+			helpers.UInt64Size(l, &n)
+			n += l
+		}
+	}
+	{
+		// Token
+
+		{
+			l := uint64(len(m.Token))
+			helpers.UInt64Size(l, &n)
+			n += l
+		}
+	}
+	{
+		// KeyAuthorization
+
+		{
+			l := uint64(len(m.KeyAuthorization))
+			helpers.UInt64Size(l, &n)
+			n += l
+		}
+	}
+	return n
+}
+
+func marshal0(m *HTTPChallenge, b []byte) uint64 {
+	var o uint64
+	{
+		// Domain
+
+		{
+			l := uint64(len(m.Domain))
+			helpers.UInt64Marshal(l, b, &o)
+			copy(b[o:o+l], m.Domain)
+			o += l
+		}
+	}
+	{
+		// Token
+
+		{
+			l := uint64(len(m.Token))
+			helpers.UInt64Marshal(l, b, &o)
+			copy(b[o:o+l], m.Token)
+			o += l
+		}
+	}
+	{
+		// KeyAuthorization
+
+		{
+			l := uint64(len(m.KeyAuthorization))
+			helpers.UInt64Marshal(l, b, &o)
+			copy(b[o:o+l], m.KeyAuthorization)
+			o += l
+		}
+	}
+
+	return o
+}
+
+func unmarshal0(m *HTTPChallenge, b []byte) uint64 {
+	var o uint64
+	{
+		// Domain
+
+		{
+			var l uint64
+			helpers.UInt64Unmarshal(&l, b, &o)
+			if l > 0 {
+				m.Domain = string(b[o:o+l])
+				o += l
+			}
+		}
+	}
+	{
+		// Token
+
+		{
+			var l uint64
+			helpers.UInt64Unmarshal(&l, b, &o)
+			if l > 0 {
+				m.Token = string(b[o:o+l])
+				o += l
+			}
+		}
+	}
+	{
+		// KeyAuthorization
+
+		{
+			var l uint64
+			helpers.UInt64Unmarshal(&l, b, &o)
+			if l > 0 {
+				m.KeyAuthorization = string(b[o:o+l])
+				o += l
+			}
+		}
+	}
+
+	return o
+}
+
+func size3(m *MsgCertificate) uint64 {
 	var n uint64 = 1
 	{
 		// Certificate
@@ -122,7 +487,7 @@ func size0(m *MsgCertificate) uint64 {
 	return n
 }
 
-func marshal0(m *MsgCertificate, b []byte) uint64 {
+func marshal3(m *MsgCertificate, b []byte) uint64 {
 	var o uint64
 	{
 		// Certificate
@@ -138,7 +503,7 @@ func marshal0(m *MsgCertificate, b []byte) uint64 {
 	return o
 }
 
-func unmarshal0(m *MsgCertificate, b []byte) uint64 {
+func unmarshal3(m *MsgCertificate, b []byte) uint64 {
 	var o uint64
 	{
 		// Certificate
@@ -155,7 +520,7 @@ func unmarshal0(m *MsgCertificate, b []byte) uint64 {
 	return o
 }
 
-func isPatchNeeded0(m, mSrc *MsgCertificate) bool {
+func isPatchNeeded3(m, mSrc *MsgCertificate) bool {
 	{
 		// Certificate
 
@@ -168,7 +533,7 @@ func isPatchNeeded0(m, mSrc *MsgCertificate) bool {
 	return false
 }
 
-func makePatch0(m, mSrc *MsgCertificate, b []byte) uint64 {
+func makePatch3(m, mSrc *MsgCertificate, b []byte) uint64 {
 	var o uint64 = 1
 	{
 		// Certificate
@@ -189,7 +554,7 @@ func makePatch0(m, mSrc *MsgCertificate, b []byte) uint64 {
 	return o
 }
 
-func applyPatch0(m *MsgCertificate, b []byte) uint64 {
+func applyPatch3(m *MsgCertificate, b []byte) uint64 {
 	var o uint64 = 1
 	{
 		// Certificate
@@ -2,12 +2,11 @@ package cache
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"hash"
 	"io"
+	"io/fs"
 	"net"
 	"net/http"
 	"os"
@@ -21,16 +20,33 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/outofforest/cloudless"
+	"github.com/outofforest/cloudless/pkg/eye/metrics"
 	"github.com/outofforest/cloudless/pkg/host"
 	"github.com/outofforest/cloudless/pkg/retry"
 	"github.com/outofforest/cloudless/pkg/thttp"
 	"github.com/outofforest/logger"
+	"github.com/outofforest/parallel"
 )
 
-// Port is the port cache listens on.
-const Port = 81
+const (
+	// Port is the port cache listens on.
+	Port = 81
+
+	defaultRegistry = "registry-1.docker.io"
+
+	namespace         = "containercache"
+	subsystemRequests = "requests"
+	subsystemStore    = "store"
+	storeDir          = "store"
+
+	gcInterval = time.Hour
+)
 
 var (
+	indexMediaTypes = map[string]struct{}{
+		"application/vnd.oci.image.index.v1+json":                   {},
+		"application/vnd.docker.distribution.manifest.list.v2+json": {},
+	}
 	manifestMediaTypes = map[string]struct{}{
 		"application/vnd.oci.image.manifest.v1+json":           {},
 		"application/vnd.docker.distribution.manifest.v2+json": {},
@@ -40,27 +56,54 @@ var (
 		"application/vnd.docker.container.image.v1+json": {},
 	}
 	layerMediaTypes = map[string]struct{}{
+		"application/vnd.oci.image.layer.v1.tar":            {},
 		"application/vnd.oci.image.layer.v1.tar+gzip":       {},
+		"application/vnd.oci.image.layer.v1.tar+zstd":       {},
+		"application/vnd.docker.image.rootfs.diff.tar":      {},
 		"application/vnd.docker.image.rootfs.diff.tar.gzip": {},
 	}
 
 	removeCharacters = []string{":", "/", ".", "?", "&", "#", "%", "\\"}
 )
 
-// Service returns new yum repo service.
-func Service(appName string, release uint64) host.Configurator {
+// Service returns new container cache service.
+func Service(appName string, release uint64, configurators ...Configurator) host.Configurator {
+	config := Config{
+		Credentials:     map[string]Credentials{},
+		CredentialFiles: map[string]string{},
+	}
+	for _, configurator := range configurators {
+		configurator(&config)
+	}
+
 	var c host.SealedConfiguration
+	set := metrics.NewSet()
 	return cloudless.Join(
 		cloudless.Configuration(&c),
+		cloudless.Metrics(set),
 		cloudless.Service("containercache", func(ctx context.Context) error {
+			if err := config.Verification.Validate(); err != nil {
+				return err
+			}
+			if config.PullThrough && len(config.PullThroughRepositories) == 0 {
+				return errors.New("no repositories allowed for pull-through")
+			}
+
 			images := c.ContainerImages()
-			if len(images) == 0 {
+			if len(images) == 0 && !config.PullThrough {
 				return nil
 			}
 
-			repoDir := filepath.Join(cloudless.AppDir(appName), strconv.FormatUint(release, 10))
-			if err := run(ctx, repoDir, images); err != nil {
-				return err
+			if config.Incremental {
+				if err := runIncremental(ctx, config, filepath.Join(cloudless.AppDir(appName), storeDir), images,
+					set); err != nil {
+					return err
+				}
+			} else {
+				repoDir := filepath.Join(cloudless.AppDir(appName), strconv.FormatUint(release, 10))
+				if err := run(ctx, config, repoDir, images, set); err != nil {
+					return err
+				}
 			}
 			<-ctx.Done()
 			return errors.WithStack(ctx.Err())
@@ -76,11 +119,81 @@ func Mirrors(mirrors ...string) host.Configurator {
 	}
 }
 
-func run(ctx context.Context, repoDir string, images []string) error {
-	if err := createRepo(ctx, repoDir, images); err != nil {
+func run(ctx context.Context, config Config, repoDir string, images []string, set *metrics.Set) error {
+	if err := createRepo(ctx, config, repoDir, images); err != nil {
 		return err
 	}
 
+	size, err := dirSize(repoDir)
+	if err != nil {
+		return err
+	}
+	// "Size of the cache in bytes".
+	set.GetOrCreateGauge(metrics.N(namespace, subsystemStore, "size")).Set(float64(size))
+
+	return serve(ctx, newHandler(repoDir, nil, set))
+}
+
+func runIncremental(ctx context.Context, config Config, storeDir string, images []string, set *metrics.Set) error {
+	s := newStore(storeDir, config)
+	if err := s.Sync(ctx, images); err != nil {
+		return err
+	}
+
+	// "Size of the cache in bytes".
+	mSize := set.GetOrCreateGauge(metrics.N(namespace, subsystemStore, "size"))
+	mSize.Set(float64(s.Size()))
+
+	if !config.PullThrough {
+		return serve(ctx, newHandler(s.RefsDir(), nil, set))
+	}
+
+	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		spawn("server", parallel.Fail, func(ctx context.Context) error {
+			return serve(ctx, newHandler(s.RefsDir(), meteredStore{
+				store: s,
+				onPull: func() {
+					mSize.Set(float64(s.Size()))
+				},
+			}, set))
+		})
+		spawn("gc", parallel.Fail, func(ctx context.Context) error {
+			ticker := time.NewTicker(gcInterval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return errors.WithStack(ctx.Err())
+				case <-ticker.C:
+				}
+
+				if err := s.Refresh(ctx, time.Now()); err != nil {
+					return err
+				}
+				if err := s.CollectGarbage(ctx, time.Now()); err != nil {
+					return err
+				}
+				mSize.Set(float64(s.Size()))
+			}
+		})
+		return nil
+	})
+}
+
+// meteredStore reports size of the store once image is pulled on demand.
+type meteredStore struct {
+	*store
+
+	onPull func()
+}
+
+func (s meteredStore) Pull(ctx context.Context, imageTag string) error {
+	defer s.onPull()
+	return s.store.Pull(ctx, imageTag)
+}
+
+func serve(ctx context.Context, handler http.Handler) error {
 	l, err := net.ListenTCP("tcp", &net.TCPAddr{Port: Port})
 	if err != nil {
 		return errors.WithStack(err)
@@ -88,12 +201,31 @@ func run(ctx context.Context, repoDir string, images []string) error {
 	defer l.Close()
 
 	server := thttp.NewServer(l, thttp.Config{
-		Handler: http.FileServer(http.Dir(repoDir)),
+		Handler: handler,
 	})
 	return server.Run(ctx)
 }
 
-func createRepo(ctx context.Context, repoDir string, images []string) error {
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+func createRepo(ctx context.Context, config Config, repoDir string, images []string) error {
 	repoInfo, err := os.Stat(repoDir)
 	if err == nil && repoInfo.IsDir() {
 		return nil
@@ -111,54 +243,198 @@ func createRepo(ctx context.Context, repoDir string, images []string) error {
 		return errors.WithStack(err)
 	}
 
+	repo := dirRepository{dir: repoDirTmp}
 	for _, imageTag := range images {
-		repoURL, imageTag := resolveImageTag(imageTag)
+		if err := pullImage(ctx, repo, config, imageTag); err != nil {
+			return err
+		}
+	}
+
+	return errors.WithStack(os.Rename(repoDirTmp, repoDir))
+}
+
+// repository stores manifests and blobs fetched from the registry.
+type repository interface {
+	FetchManifest(ctx context.Context, repoURL string, creds Credentials, image, tag string) (Manifest, string, error)
+	FetchBlob(ctx context.Context, repoURL string, creds Credentials, authHeader, image, digest string) (string, error)
+	ManifestFile(repoURL, image, tag string) string
+	BlobFile(repoURL, image, digest string) string
+}
+
+func pullImage(ctx context.Context, repo repository, config Config, imageTag string) error {
+	repoURL, imageTag := resolveImageTag(imageTag)
+
+	creds, err := config.credentials(repoURL)
+	if err != nil {
+		return err
+	}
 
-		m, authToken, err := fetchManifest(ctx, repoDirTmp, repoURL, imageTag)
+	image, tag, err := splitImageTag(imageTag)
+	if err != nil {
+		return err
+	}
+
+	// Signatures are pulled on demand when container verifies the image.
+	if isSignatureTag(tag) {
+		return pullSignature(ctx, repo, repoURL, creds, image, tag)
+	}
+
+	if err := config.Verification.CheckReference(imageTag); err != nil {
+		return err
+	}
+
+	m, authHeader, err := repo.FetchManifest(ctx, repoURL, creds, image, tag)
+	if err != nil {
+		return err
+	}
+	if config.Verification.SignatureRequired() {
+		authHeader, err = verifyImage(ctx, repo, config.Verification, repoURL, creds, authHeader, image, tag)
 		if err != nil {
 			return err
 		}
+	}
 
-		if _, exists := manifestMediaTypes[m.MediaType]; !exists {
-			return errors.Errorf("unsupported media type %s for manifest", m.MediaType)
+	if m.IsIndex() {
+		imageTag, err = ResolvePlatform(imageTag, m)
+		if err != nil {
+			return err
 		}
-		if _, exists := configMediaTypes[m.Config.MediaType]; !exists {
-			return errors.Errorf("unsupported config media type %s for config", m.Config.MediaType)
+		_, tag, err = splitImageTag(imageTag)
+		if err != nil {
+			return err
 		}
 
-		image, _, err := splitImageTag(imageTag)
+		m, authHeader, err = repo.FetchManifest(ctx, repoURL, creds, image, tag)
 		if err != nil {
 			return err
 		}
+	}
+
+	if _, exists := manifestMediaTypes[m.MediaType]; !exists {
+		return errors.Errorf("unsupported media type %s for manifest", m.MediaType)
+	}
+	if _, exists := configMediaTypes[m.Config.MediaType]; !exists {
+		return errors.Errorf("unsupported config media type %s for config", m.Config.MediaType)
+	}
 
-		authToken, err = fetchBlob(ctx, repoDirTmp, repoURL, authToken, image, m.Config.Digest)
+	authHeader, err = repo.FetchBlob(ctx, repoURL, creds, authHeader, image, m.Config.Digest)
+	if err != nil {
+		return err
+	}
+
+	for _, layer := range m.Layers {
+		if _, exists := layerMediaTypes[layer.MediaType]; !exists {
+			return errors.Errorf("unsupported layer media type %s for layer", layer.MediaType)
+		}
+
+		authHeader, err = repo.FetchBlob(ctx, repoURL, creds, authHeader, image, layer.Digest)
 		if err != nil {
 			return err
 		}
+	}
 
-		for _, layer := range m.Layers {
-			if _, exists := layerMediaTypes[layer.MediaType]; !exists {
-				return errors.Errorf("unsupported layer media type %s for layer", layer.MediaType)
-			}
+	return nil
+}
 
-			authToken, err = fetchBlob(ctx, repoDirTmp, repoURL, authToken, image, layer.Digest)
-			if err != nil {
-				return err
-			}
+// pullSignature fetches signature manifest and blobs storing signatures. Other blobs are skipped, so signature tag
+// can't be used to pull an image bypassing verification.
+func pullSignature(
+	ctx context.Context,
+	repo repository,
+	repoURL string,
+	creds Credentials,
+	image, tag string,
+) error {
+	m, authHeader, err := repo.FetchManifest(ctx, repoURL, creds, image, tag)
+	if err != nil {
+		return err
+	}
+	for _, layer := range m.Layers {
+		if !isSignatureMediaType(layer.MediaType) {
+			continue
+		}
+		authHeader, err = repo.FetchBlob(ctx, repoURL, creds, authHeader, image, layer.Digest)
+		if err != nil {
+			return err
 		}
 	}
-
-	return errors.WithStack(os.Rename(repoDirTmp, repoDir))
+	return nil
 }
 
-func fetchManifest(ctx context.Context, repoRoot, repoURL, imageTag string) (Manifest, string, error) {
-	image, tag, err := splitImageTag(imageTag)
+// verifyImage fetches signatures of the manifest and verifies them. Signatures are stored in the repository
+// so containers might verify the image too.
+func verifyImage(
+	ctx context.Context,
+	repo repository,
+	config VerificationConfig,
+	repoURL string,
+	creds Credentials,
+	authHeader, image, tag string,
+) (string, error) {
+	digest := tag
+	if !IsDigest(digest) {
+		var err error
+		digest, err = computeDigest(repo.ManifestFile(repoURL, image, tag))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	sigManifest, authHeader, err := repo.FetchManifest(ctx, repoURL, creds, image, SignatureTag(digest))
 	if err != nil {
-		return Manifest{}, "", err
+		return "", err
 	}
+	for _, layer := range sigManifest.Layers {
+		authHeader, err = repo.FetchBlob(ctx, repoURL, creds, authHeader, image, layer.Digest)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return authHeader, config.VerifySignature(image+"@"+tag, digest, sigManifest, func(digest string) ([]byte, error) {
+		content, err := os.ReadFile(repo.BlobFile(repoURL, image, digest))
+		return content, errors.WithStack(err)
+	})
+}
+
+// dirRepository stores files in the directory created for the release.
+type dirRepository struct {
+	dir string
+}
+
+func (r dirRepository) FetchManifest(
+	ctx context.Context,
+	repoURL string,
+	creds Credentials,
+	image, tag string,
+) (Manifest, string, error) {
+	return fetchManifest(ctx, r.ManifestFile(repoURL, image, tag), repoURL, creds, image, tag)
+}
+
+func (r dirRepository) FetchBlob(
+	ctx context.Context,
+	repoURL string,
+	creds Credentials,
+	authHeader, image, digest string,
+) (string, error) {
+	return fetchBlob(ctx, r.BlobFile(repoURL, image, digest), repoURL, creds, authHeader, image, digest)
+}
+
+func (r dirRepository) ManifestFile(repoURL, image, tag string) string {
+	return filepath.Join(r.dir, sanitizeURL(buildManifestURL(repoURL, image, tag)))
+}
 
+func (r dirRepository) BlobFile(repoURL, image, digest string) string {
+	return filepath.Join(r.dir, sanitizeURL(buildBlobURL(repoURL, image, digest)))
+}
+
+func fetchManifest(
+	ctx context.Context,
+	manifestFile, repoURL string,
+	creds Credentials,
+	image, tag string,
+) (Manifest, string, error) {
 	manifestURL := buildManifestURL(repoURL, image, tag)
-	manifestFile := filepath.Join(repoRoot, sanitizeURL(manifestURL))
 	manifestTmpFile := manifestFile + ".tmp"
 
 	logger.Get(ctx).Info("Fetching manifest", zap.String("url", manifestURL))
@@ -173,7 +449,7 @@ func fetchManifest(ctx context.Context, repoRoot, repoURL, imageTag string) (Man
 	}
 	defer f.Close()
 
-	var authToken string
+	authHeader := staticAuthHeader(creds)
 	err = retry.Do(ctx, retry.FixedConfig{RetryAfter: 5 * time.Second, MaxAttempts: 10}, func() error {
 		if _, err := f.Seek(0, io.SeekStart); err != nil {
 			return errors.WithStack(err)
@@ -183,11 +459,14 @@ func fetchManifest(ctx context.Context, repoRoot, repoURL, imageTag string) (Man
 		}
 
 		req := lo.Must(http.NewRequestWithContext(ctx, http.MethodGet, manifestURL, nil))
+		for mime := range indexMediaTypes {
+			req.Header.Add("Accept", mime)
+		}
 		for mime := range manifestMediaTypes {
 			req.Header.Add("Accept", mime)
 		}
-		if authToken != "" {
-			req.Header.Add("Authorization", "Bearer "+authToken)
+		if authHeader != "" {
+			req.Header.Add("Authorization", authHeader)
 		}
 
 		resp, err := http.DefaultClient.Do(req)
@@ -199,7 +478,7 @@ func fetchManifest(ctx context.Context, repoRoot, repoURL, imageTag string) (Man
 		switch resp.StatusCode {
 		case http.StatusUnauthorized:
 			var err error
-			authToken, err = authorize(ctx, resp.Header.Get("www-authenticate"))
+			authHeader, err = authorize(ctx, resp.Header.Get("www-authenticate"), creds)
 			if err != nil {
 				return err
 			}
@@ -211,24 +490,23 @@ func fetchManifest(ctx context.Context, repoRoot, repoURL, imageTag string) (Man
 		}
 
 		var r io.Reader = resp.Body
-		var hasher hash.Hash
-		if strings.HasPrefix(tag, "sha256:") {
-			hasher = sha256.New()
-			r = io.TeeReader(r, hasher)
+		var verifier *Verifier
+		if IsDigest(tag) {
+			var err error
+			verifier, err = NewVerifier(tag)
+			if err != nil {
+				return err
+			}
+			r = io.TeeReader(r, verifier)
 		}
 
 		if _, err := io.Copy(f, r); err != nil {
 			return retry.Retriable(errors.WithStack(err))
 		}
 
-		if hasher != nil {
-			computedDigest := "sha256:" + hex.EncodeToString(hasher.Sum(nil))
-			if computedDigest != tag {
-				if err := os.Remove(manifestTmpFile); err != nil {
-					return errors.WithStack(err)
-				}
-				return retry.Retriable(errors.Errorf("digest doesn't match, expected: %s, got: %s", tag,
-					computedDigest))
+		if verifier != nil {
+			if err := verifier.Verify(); err != nil {
+				return retry.Retriable(err)
 			}
 		}
 
@@ -252,12 +530,16 @@ func fetchManifest(ctx context.Context, repoRoot, repoURL, imageTag string) (Man
 		return Manifest{}, "", errors.WithStack(err)
 	}
 
-	return m, authToken, nil
+	return m, authHeader, nil
 }
 
-func fetchBlob(ctx context.Context, repoRoot, repoURL, authToken, image, digest string) (string, error) {
+func fetchBlob(
+	ctx context.Context,
+	blobFile, repoURL string,
+	creds Credentials,
+	authHeader, image, digest string,
+) (string, error) {
 	blobURL := buildBlobURL(repoURL, image, digest)
-	blobFile := filepath.Join(repoRoot, sanitizeURL(blobURL))
 	blobTmpFile := blobFile + ".tmp"
 
 	logger.Get(ctx).Info("Fetching blob", zap.String("url", blobURL))
@@ -281,7 +563,9 @@ func fetchBlob(ctx context.Context, repoRoot, repoURL, authToken, image, digest
 		}
 
 		req := lo.Must(http.NewRequestWithContext(ctx, http.MethodGet, blobURL, nil))
-		req.Header.Add("Authorization", "Bearer "+authToken)
+		if authHeader != "" {
+			req.Header.Add("Authorization", authHeader)
+		}
 
 		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
@@ -292,7 +576,7 @@ func fetchBlob(ctx context.Context, repoRoot, repoURL, authToken, image, digest
 		switch resp.StatusCode {
 		case http.StatusUnauthorized:
 			var err error
-			authToken, err = authorize(ctx, resp.Header.Get("www-authenticate"))
+			authHeader, err = authorize(ctx, resp.Header.Get("www-authenticate"), creds)
 			if err != nil {
 				return err
 			}
@@ -303,22 +587,16 @@ func fetchBlob(ctx context.Context, repoRoot, repoURL, authToken, image, digest
 			return retry.Retriable(errors.Errorf("unexpected response status: %d, %q", resp.StatusCode, blobURL))
 		}
 
-		hasher := sha256.New()
-		r := io.TeeReader(resp.Body, hasher)
+		verifier, err := NewVerifier(digest)
+		if err != nil {
+			return err
+		}
+		r := io.TeeReader(resp.Body, verifier)
 		if _, err := io.Copy(f, r); err != nil {
 			return retry.Retriable(errors.WithStack(err))
 		}
 
-		computedDigest := "sha256:" + hex.EncodeToString(hasher.Sum(nil))
-		if computedDigest != digest {
-			if err := os.Remove(blobTmpFile); err != nil {
-				return errors.WithStack(err)
-			}
-			return retry.Retriable(errors.Errorf("digest doesn't match, expected: %s, got: %s", digest,
-				computedDigest))
-		}
-
-		return nil
+		return retry.Retriable(verifier.Verify())
 	})
 
 	if err != nil {
@@ -329,11 +607,34 @@ func fetchBlob(ctx context.Context, repoRoot, repoURL, authToken, image, digest
 		return "", errors.WithStack(err)
 	}
 
-	return authToken, nil
+	return authHeader, nil
 }
 
-func authorize(ctx context.Context, authSetup string) (string, error) {
-	url, err := authURL(authSetup)
+func staticAuthHeader(creds Credentials) string {
+	if creds.Token == "" {
+		return ""
+	}
+	return "Bearer " + creds.Token
+}
+
+func authorize(ctx context.Context, authSetup string, creds Credentials) (string, error) {
+	if creds.Token != "" {
+		return "", errors.New("static bearer token has been rejected")
+	}
+
+	authMethod, authParams, _ := strings.Cut(authSetup, " ")
+	switch strings.ToLower(authMethod) {
+	case "basic":
+		if creds.Username == "" {
+			return "", errors.New("registry requires credentials")
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(creds.Username+":"+creds.Password)), nil
+	case "bearer":
+	default:
+		return "", errors.Errorf("unsupported auth method %q", authMethod)
+	}
+
+	url, err := authURL(authParams)
 	if err != nil {
 		return "", errors.WithStack(err)
 	}
@@ -342,7 +643,12 @@ func authorize(ctx context.Context, authSetup string) (string, error) {
 
 	var authToken string
 	err = retry.Do(ctx, retry.FixedConfig{RetryAfter: 5 * time.Second, MaxAttempts: 10}, func() error {
-		resp, err := http.DefaultClient.Do(lo.Must(http.NewRequestWithContext(ctx, http.MethodGet, url, nil)))
+		req := lo.Must(http.NewRequestWithContext(ctx, http.MethodGet, url, nil))
+		if creds.Username != "" {
+			req.SetBasicAuth(creds.Username, creds.Password)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
 			return retry.Retriable(err)
 		}
@@ -373,23 +679,17 @@ func authorize(ctx context.Context, authSetup string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	return authToken, nil
+	return "Bearer " + authToken, nil
 }
 
-func authURL(authSetup string) (string, error) {
-	spacePos := strings.Index(authSetup, " ")
-	if spacePos < 0 {
+func authURL(authParams string) (string, error) {
+	if authParams == "" {
 		return "", errors.New("invalid auth setup format")
 	}
 
-	authMethod := authSetup[:spacePos]
-	if strings.ToLower(authMethod) != "bearer" {
-		return "", errors.Errorf("unsupported auth method %q", authMethod)
-	}
-
 	var authURL string
 	first := true
-	for kv := range strings.SplitSeq(authSetup[spacePos+1:], ",") {
+	for kv := range strings.SplitSeq(authParams, ",") {
 		parts := strings.Split(kv, "=")
 		if len(parts) != 2 {
 			return "", errors.Errorf("invalid key-value %q", kv)
@@ -412,8 +712,6 @@ func authURL(authSetup string) (string, error) {
 }
 
 func resolveImageTag(imageTag string) (string, string) {
-	const defaultRegistry = "registry-1.docker.io"
-
 	switch strings.Count(imageTag, "/") {
 	case 0:
 		return defaultRegistry, "library/" + imageTag
@@ -422,11 +720,15 @@ func resolveImageTag(imageTag string) (string, string) {
 	default:
 		slashPos := strings.Index(imageTag, "/")
 		url := imageTag[:slashPos] //nolint:gocritic // It is guaranteed here that / is there.
-		if url == "docker.io" {
-			url = defaultRegistry
-		}
-		return url, imageTag[slashPos+1:]
+		return normalizeRegistry(url), imageTag[slashPos+1:]
+	}
+}
+
+func normalizeRegistry(registry string) string {
+	if registry == "docker.io" {
+		return defaultRegistry
 	}
+	return registry
 }
 
 func sanitizeURL(url string) string {
@@ -0,0 +1,162 @@
+package cache
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Config stores container cache configuration.
+type Config struct {
+	// Incremental enables content-addressed store fetching only missing blobs instead of creating a release
+	// directory.
+	Incremental bool
+
+	// PullThrough enables fetching images missing in the cache from upstream registries on demand.
+	PullThrough bool
+
+	// PullThroughRepositories are the registries and repositories images might be pulled on demand from.
+	PullThroughRepositories []string
+
+	// Credentials map registry hosts to credentials used to access them.
+	Credentials map[string]Credentials
+
+	// CredentialFiles map registry hosts to files containing credentials used to access them.
+	CredentialFiles map[string]string
+
+	// Verification configures verification of image signatures.
+	Verification VerificationConfig
+}
+
+// Credentials stores credentials used to access registry.
+type Credentials struct {
+	// Username is used for basic authentication and to obtain bearer token.
+	Username string `json:"username"`
+
+	// Password is used for basic authentication and to obtain bearer token.
+	Password string `json:"password"`
+
+	// Token is the static bearer token sent with every request.
+	Token string `json:"token"`
+}
+
+// Configurator defines function setting the container cache configuration.
+type Configurator func(c *Config)
+
+// Incremental enables content-addressed store fetching only blobs missing in the cache. Blobs are shared by all
+// the images and the ones not used by required images are garbage-collected. Release number is ignored.
+func Incremental() Configurator {
+	return func(c *Config) {
+		c.Incremental = true
+	}
+}
+
+// PullThrough enables fetching images missing in the cache from upstream registries on demand.
+// It turns on incremental mode. Only images from the listed repositories are pulled. Each of them is either
+// the registry host (e.g. "ghcr.io") or the registry host followed by the repository prefix
+// (e.g. "docker.io/library").
+func PullThrough(repositories ...string) Configurator {
+	return func(c *Config) {
+		c.Incremental = true
+		c.PullThrough = true
+		for _, repo := range repositories {
+			registry, prefix, _ := strings.Cut(strings.Trim(repo, "/"), "/")
+			registry = normalizeRegistry(registry)
+			if prefix != "" {
+				registry += "/" + prefix
+			}
+			c.PullThroughRepositories = append(c.PullThroughRepositories, registry)
+		}
+	}
+}
+
+// Verify enables verification of image signatures before images are cached.
+func Verify(configurators ...VerificationConfigurator) Configurator {
+	return func(c *Config) {
+		for _, configurator := range configurators {
+			configurator(&c.Verification)
+		}
+	}
+}
+
+// pullAllowed returns true if image might be pulled on demand.
+func (c Config) pullAllowed(imageTag string) bool {
+	repoURL, imageTag := resolveImageTag(imageTag)
+	image, _, err := splitImageTag(imageTag)
+	if err != nil {
+		return false
+	}
+
+	for _, repo := range c.PullThroughRepositories {
+		registry, prefix, _ := strings.Cut(repo, "/")
+		if registry != repoURL {
+			continue
+		}
+		if prefix == "" || image == prefix || strings.HasPrefix(image, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// credentials returns credentials configured for the registry.
+func (c Config) credentials(registry string) (Credentials, error) {
+	if creds, exists := c.Credentials[registry]; exists {
+		return creds, nil
+	}
+
+	file, exists := c.CredentialFiles[registry]
+	if !exists {
+		return Credentials{}, nil
+	}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return Credentials{}, errors.WithStack(err)
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		return Credentials{}, errors.Errorf("credentials file %q must not be accessible by group and others", file)
+	}
+
+	credsRaw, err := os.ReadFile(file)
+	if err != nil {
+		return Credentials{}, errors.WithStack(err)
+	}
+
+	var creds Credentials
+	if err := json.Unmarshal(credsRaw, &creds); err != nil {
+		return Credentials{}, errors.Wrapf(err, "parsing credentials file %q failed", file)
+	}
+	return creds, nil
+}
+
+// BasicAuth sets username and password used to access the registry. They are used for basic authentication
+// or to obtain bearer token, depending on what registry requires.
+func BasicAuth(registry, username, password string) Configurator {
+	return func(c *Config) {
+		c.Credentials[normalizeRegistry(registry)] = Credentials{
+			Username: username,
+			Password: password,
+		}
+	}
+}
+
+// BearerToken sets static bearer token used to access the registry.
+func BearerToken(registry, token string) Configurator {
+	return func(c *Config) {
+		c.Credentials[normalizeRegistry(registry)] = Credentials{
+			Token: token,
+		}
+	}
+}
+
+// CredentialsFile sets file containing credentials used to access the registry. File is read when cache is
+// created, so secrets don't need to be compiled into the image. It is a plaintext JSON document with fields
+// "username" and "password", or "token". File must not be accessible by group and others.
+func CredentialsFile(registry, file string) Configurator {
+	return func(c *Config) {
+		c.CredentialFiles[normalizeRegistry(registry)] = file
+	}
+}
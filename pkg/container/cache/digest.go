@@ -0,0 +1,62 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Verifier computes digest of the content written to it and compares it with the expected one.
+type Verifier struct {
+	hash.Hash
+
+	algorithm string
+	digest    string
+}
+
+// NewVerifier creates verifier of the digest.
+func NewVerifier(digest string) (*Verifier, error) {
+	algorithm, _, ok := strings.Cut(digest, ":")
+	if !ok {
+		return nil, errors.Errorf("invalid digest %q", digest)
+	}
+
+	var h hash.Hash
+	switch algorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return nil, errors.Errorf("unsupported digest algorithm %q", algorithm)
+	}
+
+	return &Verifier{
+		Hash:      h,
+		algorithm: algorithm,
+		digest:    digest,
+	}, nil
+}
+
+// Digest returns digest of the content.
+func (v *Verifier) Digest() string {
+	return v.algorithm + ":" + hex.EncodeToString(v.Sum(nil))
+}
+
+// Verify verifies that digest of the content matches the expected one.
+func (v *Verifier) Verify() error {
+	computedDigest := v.Digest()
+	if computedDigest != v.digest {
+		return errors.Errorf("digest doesn't match, expected: %s, got: %s", v.digest, computedDigest)
+	}
+	return nil
+}
+
+// IsDigest returns true if reference is a digest.
+func IsDigest(reference string) bool {
+	return strings.HasPrefix(reference, "sha256:") || strings.HasPrefix(reference, "sha512:")
+}
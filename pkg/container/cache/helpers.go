@@ -1,5 +1,14 @@
 package cache
 
+import (
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+)
+
 // ManifestFile creates Manifest filename to be requested from the cache server.
 func ManifestFile(imageTag string) (string, error) {
 	repoURL, imageTag := resolveImageTag(imageTag)
@@ -23,3 +32,61 @@ func BlobFile(imageTag, digest string) (string, error) {
 
 	return sanitizeURL(buildBlobURL(repoURL, image, digest)), nil
 }
+
+// ResolvePlatform returns image tag referencing the manifest matching the host platform in the image index.
+func ResolvePlatform(imageTag string, index Manifest) (string, error) {
+	return resolvePlatform(imageTag, index, hostPlatform())
+}
+
+func resolvePlatform(imageTag string, index Manifest, platform Platform) (string, error) {
+	tagPos := strings.Index(imageTag, "@")
+	if tagPos < 0 {
+		return "", errors.Errorf("invalid imageTag name %q", imageTag)
+	}
+
+	// Manifest built for the exact variant is preferred over the one not specifying it. Variant is not compared
+	// if it is not defined for the platform.
+	var digest string
+	for _, m := range index.Manifests {
+		if m.Platform.OS != platform.OS || m.Platform.Architecture != platform.Architecture {
+			continue
+		}
+		if _, exists := manifestMediaTypes[m.MediaType]; !exists {
+			continue
+		}
+		switch {
+		case platform.Variant == "" || m.Platform.Variant == platform.Variant:
+			return imageTag[:tagPos+1] + m.Digest, nil
+		case m.Platform.Variant == "" && digest == "":
+			digest = m.Digest
+		}
+	}
+	if digest != "" {
+		return imageTag[:tagPos+1] + digest, nil
+	}
+
+	return "", errors.Errorf("no manifest for platform %s/%s%s found in image index of %q", platform.OS,
+		platform.Architecture, lo.Ternary(platform.Variant == "", "", "/"+platform.Variant), imageTag)
+}
+
+// hostPlatform returns the platform of the host.
+func hostPlatform() Platform {
+	platform := Platform{
+		OS:           runtime.GOOS,
+		Architecture: runtime.GOARCH,
+	}
+	switch runtime.GOARCH {
+	case "arm64":
+		platform.Variant = "v8"
+	case "arm":
+		platform.Variant = "v7"
+		if info, ok := debug.ReadBuildInfo(); ok {
+			for _, s := range info.Settings {
+				if s.Key == "GOARM" {
+					platform.Variant = "v" + strings.Split(s.Value, ",")[0]
+				}
+			}
+		}
+	}
+	return platform
+}
@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testIndex = `{
+	"mediaType": "application/vnd.oci.image.index.v1+json",
+	"manifests": [
+		{
+			"mediaType": "application/vnd.oci.image.manifest.v1+json",
+			"digest": "sha256:amd64",
+			"platform": {"os": "linux", "architecture": "amd64"}
+		},
+		{
+			"mediaType": "application/vnd.oci.image.manifest.v1+json",
+			"digest": "sha256:armv6",
+			"platform": {"os": "linux", "architecture": "arm", "variant": "v6"}
+		},
+		{
+			"mediaType": "application/vnd.oci.image.manifest.v1+json",
+			"digest": "sha256:armv7",
+			"platform": {"os": "linux", "architecture": "arm", "variant": "v7"}
+		},
+		{
+			"mediaType": "application/vnd.oci.image.manifest.v1+json",
+			"digest": "sha256:arm64",
+			"platform": {"os": "linux", "architecture": "arm64"}
+		},
+		{
+			"mediaType": "application/vnd.oci.image.manifest.v1+json",
+			"digest": "sha256:arm64v8",
+			"platform": {"os": "linux", "architecture": "arm64", "variant": "v8"}
+		},
+		{
+			"mediaType": "application/vnd.in-toto+json",
+			"digest": "sha256:attestation",
+			"platform": {"os": "unknown", "architecture": "unknown"}
+		}
+	]
+}`
+
+func TestResolvePlatform(t *testing.T) {
+	var index Manifest
+	require.NoError(t, json.Unmarshal([]byte(testIndex), &index))
+
+	tests := []struct {
+		Name     string
+		Platform Platform
+		Digest   string
+	}{
+		{
+			Name:     "amd64",
+			Platform: Platform{OS: "linux", Architecture: "amd64"},
+			Digest:   "sha256:amd64",
+		},
+		{
+			Name:     "armv6",
+			Platform: Platform{OS: "linux", Architecture: "arm", Variant: "v6"},
+			Digest:   "sha256:armv6",
+		},
+		{
+			Name:     "armv7",
+			Platform: Platform{OS: "linux", Architecture: "arm", Variant: "v7"},
+			Digest:   "sha256:armv7",
+		},
+		{
+			Name:     "armv5",
+			Platform: Platform{OS: "linux", Architecture: "arm", Variant: "v5"},
+		},
+		{
+			Name:     "arm64v8",
+			Platform: Platform{OS: "linux", Architecture: "arm64", Variant: "v8"},
+			Digest:   "sha256:arm64v8",
+		},
+		{
+			Name:     "arm64v9",
+			Platform: Platform{OS: "linux", Architecture: "arm64", Variant: "v9"},
+			Digest:   "sha256:arm64",
+		},
+		{
+			Name:     "riscv64",
+			Platform: Platform{OS: "linux", Architecture: "riscv64"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			imageTag, err := resolvePlatform("docker.io/library/alpine@sha256:index", index, test.Platform)
+			if test.Digest == "" {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "docker.io/library/alpine@"+test.Digest, imageTag)
+		})
+	}
+
+	_, err := resolvePlatform("docker.io/library/alpine:latest", index, hostPlatform())
+	require.Error(t, err)
+}
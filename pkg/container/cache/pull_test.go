@@ -0,0 +1,214 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/outofforest/logger"
+)
+
+// testRegistry starts registry serving single image with one layer of the provided media type. Handler might be
+// wrapped to require authorization. Image tag is returned.
+func testRegistry(
+	t *testing.T,
+	layerMediaType string,
+	wrap func(server *httptest.Server, next http.Handler) http.Handler,
+) string {
+	const (
+		config = `{"architecture":"amd64","os":"linux"}`
+		layer  = "layer"
+	)
+
+	m := Manifest{
+		MediaType: "application/vnd.docker.distribution.manifest.v2+json",
+		Config: Descriptor{
+			MediaType: "application/vnd.docker.container.image.v1+json",
+			Digest:    digest(config),
+		},
+		Layers: []Descriptor{
+			{
+				MediaType: layerMediaType,
+				Digest:    digest(layer),
+			},
+		},
+	}
+	manifestRaw, err := json.Marshal(m)
+	require.NoError(t, err)
+	manifestDigest := digest(string(manifestRaw))
+
+	files := map[string][]byte{
+		"/v2/org/app/manifests/" + manifestDigest: manifestRaw,
+		"/v2/org/app/manifests/latest":            manifestRaw,
+		"/v2/org/app/blobs/" + digest(config):     []byte(config),
+		"/v2/org/app/blobs/" + digest(layer):      []byte(layer),
+	}
+
+	var server *httptest.Server
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, exists := files[r.URL.Path]
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if strings.Contains(r.URL.Path, "/manifests/") {
+			w.Header().Set("Content-Type", m.MediaType)
+		}
+		_, _ = w.Write(content)
+	})
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wrap == nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		wrap(server, handler).ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	transport := http.DefaultClient.Transport
+	http.DefaultClient.Transport = server.Client().Transport
+	t.Cleanup(func() {
+		http.DefaultClient.Transport = transport
+	})
+
+	return strings.TrimPrefix(server.URL, "https://") + "/org/app@" + manifestDigest
+}
+
+func pull(t *testing.T, config Config, imageTag string) (string, error) {
+	ctx := logger.WithLogger(context.Background(), zap.NewNop())
+	repoDir := filepath.Join(t.TempDir(), "repo")
+	return repoDir, createRepo(ctx, config, repoDir, []string{imageTag})
+}
+
+func TestPullDockerUncompressedLayer(t *testing.T) {
+	requireT := require.New(t)
+
+	imageTag := testRegistry(t, "application/vnd.docker.image.rootfs.diff.tar", nil)
+	repoDir, err := pull(t, Config{}, imageTag)
+	requireT.NoError(err)
+
+	blobFile, err := BlobFile(imageTag, digest("layer"))
+	requireT.NoError(err)
+	content, err := os.ReadFile(filepath.Join(repoDir, blobFile))
+	requireT.NoError(err)
+	requireT.Equal("layer", string(content))
+
+	_, err = pull(t, Config{}, testRegistry(t, "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip", nil))
+	requireT.Error(err)
+}
+
+func TestPullBasicAuth(t *testing.T) {
+	requireT := require.New(t)
+
+	imageTag := testRegistry(t, "application/vnd.oci.image.layer.v1.tar",
+		func(server *httptest.Server, next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if username, password, ok := r.BasicAuth(); !ok || username != "user" || password != "pass" {
+					w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				next.ServeHTTP(w, r)
+			})
+		})
+	registry, _, _ := strings.Cut(imageTag, "/")
+
+	_, err := pull(t, testConfig(BasicAuth(registry, "user", "pass")), imageTag)
+	requireT.NoError(err)
+
+	_, err = pull(t, testConfig(), imageTag)
+	requireT.Error(err)
+}
+
+func TestPullBearerChallenge(t *testing.T) {
+	requireT := require.New(t)
+
+	imageTag := testRegistry(t, "application/vnd.oci.image.layer.v1.tar",
+		func(server *httptest.Server, next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/token" {
+					username, password, ok := r.BasicAuth()
+					if !ok || username != "user" || password != "pass" ||
+						r.URL.Query().Get("service") != "registry.test" ||
+						r.URL.Query().Get("scope") != "repository:org/app:pull" {
+						w.WriteHeader(http.StatusForbidden)
+						return
+					}
+					_, _ = w.Write([]byte(`{"token":"token"}`))
+					return
+				}
+				if r.Header.Get("Authorization") != "Bearer token" {
+					w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+
+						`/token",service="registry.test",scope="repository:org/app:pull"`)
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				next.ServeHTTP(w, r)
+			})
+		})
+	registry, _, _ := strings.Cut(imageTag, "/")
+
+	_, err := pull(t, testConfig(BasicAuth(registry, "user", "pass")), imageTag)
+	requireT.NoError(err)
+}
+
+func TestPullStaticToken(t *testing.T) {
+	requireT := require.New(t)
+
+	imageTag := testRegistry(t, "application/vnd.oci.image.layer.v1.tar", requireToken)
+	registry, _, _ := strings.Cut(imageTag, "/")
+
+	_, err := pull(t, testConfig(BearerToken(registry, "token")), imageTag)
+	requireT.NoError(err)
+
+	_, err = pull(t, testConfig(BearerToken(registry, "invalid")), imageTag)
+	requireT.Error(err)
+}
+
+func TestPullCredentialsFile(t *testing.T) {
+	requireT := require.New(t)
+
+	imageTag := testRegistry(t, "application/vnd.oci.image.layer.v1.tar", requireToken)
+	registry, _, _ := strings.Cut(imageTag, "/")
+
+	file := filepath.Join(t.TempDir(), "credentials.json")
+	requireT.NoError(os.WriteFile(file, []byte(`{"token":"token"}`), 0o600))
+
+	_, err := pull(t, testConfig(CredentialsFile(registry, file)), imageTag)
+	requireT.NoError(err)
+
+	// File accessible by others is rejected.
+	requireT.NoError(os.Chmod(file, 0o644))
+	_, err = pull(t, testConfig(CredentialsFile(registry, file)), imageTag)
+	requireT.Error(err)
+}
+
+func testConfig(configurators ...Configurator) Config {
+	config := Config{
+		Credentials:     map[string]Credentials{},
+		CredentialFiles: map[string]string{},
+	}
+	for _, configurator := range configurators {
+		configurator(&config)
+	}
+	return config
+}
+
+func requireToken(_ *httptest.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="https://auth.example.com/token"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
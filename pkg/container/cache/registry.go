@@ -0,0 +1,224 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/outofforest/cloudless/pkg/eye/metrics"
+	"github.com/outofforest/cloudless/pkg/thttp"
+	"github.com/outofforest/logger"
+)
+
+const (
+	registryPrefix = "/v2/"
+
+	headerAPIVersion    = "Docker-Distribution-API-Version"
+	headerContentDigest = "Docker-Content-Digest"
+	apiVersion          = "registry/2.0"
+
+	// Media types assumed for manifests not declaring them, as required by the OCI image spec.
+	defaultManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	defaultIndexMediaType    = "application/vnd.oci.image.index.v1+json"
+
+	errCodeNameUnknown     = "NAME_UNKNOWN"
+	errCodeManifestUnknown = "MANIFEST_UNKNOWN"
+	errCodeBlobUnknown     = "BLOB_UNKNOWN"
+	errCodeUnsupported     = "UNSUPPORTED"
+)
+
+// puller fetches images missing in the cache from upstream registries.
+type puller interface {
+	// Pull fetches the image.
+	Pull(ctx context.Context, imageTag string) error
+
+	// Access records that image has been requested.
+	Access(imageTag string, now time.Time)
+}
+
+// newHandler returns handler serving cached files both to cloudless and to standard OCI clients
+// through the read side of the OCI Distribution API.
+func newHandler(repoDir string, pull puller, set *metrics.Set) http.Handler {
+	fileServer := http.FileServer(http.Dir(repoDir))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var status int
+		w = thttp.CaptureStatus(w, &status)
+		defer func() {
+			switch status {
+			case http.StatusOK, http.StatusPartialContent, http.StatusNotModified:
+				// "Number of requests served from the cache".
+				set.GetOrCreateCounter(metrics.N(namespace, subsystemRequests, "hits")).Inc()
+			case http.StatusNotFound:
+				// "Number of requests for content missing in the cache".
+				set.GetOrCreateCounter(metrics.N(namespace, subsystemRequests, "misses")).Inc()
+			}
+		}()
+
+		if !strings.HasPrefix(r.URL.Path+"/", registryPrefix) {
+			fileServer.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set(headerAPIVersion, apiVersion)
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			sendRegistryError(w, http.StatusMethodNotAllowed, errCodeUnsupported, "registry is read-only")
+			return
+		}
+
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path+"/", registryPrefix), "/")
+		if path == "" {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte("{}"))
+			return
+		}
+
+		if pos := strings.LastIndex(path, "/manifests/"); pos >= 0 {
+			name, reference := path[:pos], path[pos+len("/manifests/"):]
+			if pull != nil {
+				if err := pullMissing(r.Context(), repoDir, name, reference, pull, set); err != nil {
+					logger.Get(r.Context()).Error("Pulling image failed", zap.Error(err))
+				}
+				pull.Access(name+"@"+reference, time.Now())
+			}
+			serveManifest(w, r, repoDir, name, reference)
+			return
+		}
+		if pos := strings.LastIndex(path, "/blobs/"); pos >= 0 {
+			serveBlob(w, r, repoDir, path[:pos], path[pos+len("/blobs/"):])
+			return
+		}
+
+		sendRegistryError(w, http.StatusNotFound, errCodeNameUnknown, "unknown endpoint")
+	})
+}
+
+func pullMissing(ctx context.Context, repoDir, name, reference string, pull puller, set *metrics.Set) error {
+	imageTag := name + "@" + reference
+	manifestFile, err := ManifestFile(imageTag)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stat(filepath.Join(repoDir, manifestFile))
+	switch {
+	case err == nil:
+		return nil
+	case !os.IsNotExist(err):
+		return errors.WithStack(err)
+	}
+
+	logger.Get(ctx).Info("Pulling missing image", zap.String("image", imageTag))
+
+	// "Number of images pulled on demand from upstream registries".
+	set.GetOrCreateCounter(metrics.N(namespace, subsystemRequests, "pulls")).Inc()
+	return pull.Pull(ctx, imageTag)
+}
+
+func serveManifest(w http.ResponseWriter, r *http.Request, repoDir, name, reference string) {
+	manifestFile, err := ManifestFile(name + "@" + reference)
+	if err != nil {
+		sendRegistryError(w, http.StatusNotFound, errCodeManifestUnknown, err.Error())
+		return
+	}
+
+	content, err := os.ReadFile(filepath.Join(repoDir, manifestFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			sendRegistryError(w, http.StatusNotFound, errCodeManifestUnknown, "manifest unknown")
+			return
+		}
+		logger.Get(r.Context()).Error("Reading manifest failed", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(content, &m); err != nil {
+		logger.Get(r.Context()).Error("Parsing manifest failed", zap.Error(errors.WithStack(err)))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	digest := reference
+	if !IsDigest(digest) {
+		hash := sha256.Sum256(content)
+		digest = "sha256:" + hex.EncodeToString(hash[:])
+	}
+
+	mediaType := m.MediaType
+	switch {
+	case mediaType != "":
+	case len(m.Manifests) > 0:
+		mediaType = defaultIndexMediaType
+	default:
+		mediaType = defaultManifestMediaType
+	}
+
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set(headerContentDigest, digest)
+	w.Header().Set("Etag", `"`+digest+`"`)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+}
+
+func serveBlob(w http.ResponseWriter, r *http.Request, repoDir, name, digest string) {
+	if !IsDigest(digest) {
+		sendRegistryError(w, http.StatusNotFound, errCodeBlobUnknown, "invalid digest")
+		return
+	}
+
+	blobFile, err := BlobFile(name+"@"+digest, digest)
+	if err != nil {
+		sendRegistryError(w, http.StatusNotFound, errCodeBlobUnknown, err.Error())
+		return
+	}
+
+	f, err := os.Open(filepath.Join(repoDir, blobFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			sendRegistryError(w, http.StatusNotFound, errCodeBlobUnknown, "blob unknown")
+			return
+		}
+		logger.Get(r.Context()).Error("Opening blob failed", zap.Error(errors.WithStack(err)))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(headerContentDigest, digest)
+	w.Header().Set("Etag", `"`+digest+`"`)
+	http.ServeContent(w, r, "", time.Time{}, f)
+}
+
+func sendRegistryError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(registryErrors{
+		Errors: []registryError{
+			{
+				Code:    code,
+				Message: message,
+			},
+		},
+	})
+}
+
+type registryErrors struct {
+	Errors []registryError `json:"errors"`
+}
+
+type registryError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/outofforest/cloudless/pkg/eye/metrics"
+)
+
+const testManifest = `{"mediaType":"application/vnd.oci.image.manifest.v1+json"}`
+
+func digest(content string) string {
+	hash := sha256.Sum256([]byte(content))
+	return "sha256:" + hex.EncodeToString(hash[:])
+}
+
+func testRepo(t *testing.T) string {
+	repoDir := t.TempDir()
+
+	manifestDigest := digest(testManifest)
+	manifestFile, err := ManifestFile("library/alpine@" + manifestDigest)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(repoDir, manifestFile), []byte(testManifest), 0o600))
+
+	blobDigest := digest("blob")
+	blobFile, err := BlobFile("library/alpine@"+manifestDigest, blobDigest)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(repoDir, blobFile), []byte("blob"), 0o600))
+
+	return repoDir
+}
+
+func request(t *testing.T, handler http.Handler, method, path string) (*http.Response, string) {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	resp := w.Result()
+	t.Cleanup(func() {
+		_ = resp.Body.Close()
+	})
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestRegistryBase(t *testing.T) {
+	handler := newHandler(testRepo(t), nil, metrics.NewSet())
+
+	resp, body := request(t, handler, http.MethodGet, "/v2/")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, apiVersion, resp.Header.Get(headerAPIVersion))
+	require.Equal(t, "{}", body)
+}
+
+func TestRegistryManifest(t *testing.T) {
+	handler := newHandler(testRepo(t), nil, metrics.NewSet())
+	manifestDigest := digest(testManifest)
+
+	resp, body := request(t, handler, http.MethodGet, "/v2/library/alpine/manifests/"+manifestDigest)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, manifestDigest, resp.Header.Get(headerContentDigest))
+	require.Equal(t, "application/vnd.oci.image.manifest.v1+json", resp.Header.Get("Content-Type"))
+	require.Equal(t, testManifest, body)
+
+	resp, body = request(t, handler, http.MethodHead, "/v2/docker.io/library/alpine/manifests/"+manifestDigest)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, manifestDigest, resp.Header.Get(headerContentDigest))
+	require.Empty(t, body)
+
+	resp, _ = request(t, handler, http.MethodGet, "/v2/library/alpine/manifests/"+digest("missing"))
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestRegistryManifestDefaultMediaType(t *testing.T) {
+	repoDir := t.TempDir()
+	for content, mediaType := range map[string]string{
+		`{"layers":[]}`:                         "application/vnd.oci.image.manifest.v1+json",
+		`{"manifests":[{"digest":"sha256:1"}]}`: "application/vnd.oci.image.index.v1+json",
+	} {
+		manifestDigest := digest(content)
+		manifestFile, err := ManifestFile("library/alpine@" + manifestDigest)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(repoDir, manifestFile), []byte(content), 0o600))
+
+		resp, _ := request(t, newHandler(repoDir, nil, metrics.NewSet()), http.MethodGet,
+			"/v2/library/alpine/manifests/"+manifestDigest)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, mediaType, resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestRegistryBlob(t *testing.T) {
+	handler := newHandler(testRepo(t), nil, metrics.NewSet())
+	blobDigest := digest("blob")
+
+	resp, body := request(t, handler, http.MethodGet, "/v2/alpine/blobs/"+blobDigest)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, blobDigest, resp.Header.Get(headerContentDigest))
+	require.Equal(t, "blob", body)
+
+	resp, _ = request(t, handler, http.MethodGet, "/v2/alpine/blobs/latest")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, _ = request(t, handler, http.MethodPut, "/v2/alpine/blobs/"+blobDigest)
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
@@ -0,0 +1,319 @@
+package cache
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	signatureTagSuffix = ".sig"
+
+	simpleSigningMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	bundleMediaTypePrefix  = "application/vnd.dev.sigstore.bundle"
+	signatureAnnotation    = "dev.cosignproject.cosign/signature"
+	simpleSigningType      = "cosign container image signature"
+	bundleDigestAlgorithm  = "SHA2_256"
+)
+
+// ErrVerificationFailed is returned if image signature can't be verified.
+var ErrVerificationFailed = errors.New("image verification failed")
+
+// VerificationConfig configures verification of image signatures.
+type VerificationConfig struct {
+	// PublicKeys are the keys image must be signed with. Signatures are verified only if keys are provided.
+	PublicKeys []crypto.PublicKey
+
+	// RequireDigest requires images to be referenced by digest.
+	RequireDigest bool
+
+	err error
+}
+
+// VerificationConfigurator defines function setting the verification configuration.
+type VerificationConfigurator func(c *VerificationConfig)
+
+// PublicKey adds PEM-encoded public key trusted to sign images. Invalid key is reported by Validate.
+func PublicKey(pemKey string) VerificationConfigurator {
+	return func(c *VerificationConfig) {
+		key, err := parsePublicKey(pemKey)
+		if err != nil {
+			if c.err == nil {
+				c.err = err
+			}
+			return
+		}
+		c.PublicKeys = append(c.PublicKeys, key)
+	}
+}
+
+func parsePublicKey(pemKey string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, errors.New("invalid PEM block of the public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return key, nil
+}
+
+// RequireDigest requires images to be referenced by digest instead of tag.
+func RequireDigest() VerificationConfigurator {
+	return func(c *VerificationConfig) {
+		c.RequireDigest = true
+	}
+}
+
+// NewVerificationConfig creates verification config.
+func NewVerificationConfig(configurators ...VerificationConfigurator) VerificationConfig {
+	var config VerificationConfig
+	for _, configurator := range configurators {
+		configurator(&config)
+	}
+	return config
+}
+
+// Validate returns error if configuration is invalid.
+func (c VerificationConfig) Validate() error {
+	return c.err
+}
+
+// SignatureRequired returns true if image signature must be verified.
+func (c VerificationConfig) SignatureRequired() bool {
+	return len(c.PublicKeys) > 0
+}
+
+// CheckReference verifies that image is referenced by digest if required.
+func (c VerificationConfig) CheckReference(imageTag string) error {
+	if !c.RequireDigest {
+		return nil
+	}
+	if _, tag, _ := strings.Cut(imageTag, "@"); !IsDigest(tag) {
+		return errors.Wrapf(ErrVerificationFailed, "image %q is not pinned by digest", imageTag)
+	}
+	return nil
+}
+
+// VerifySignature verifies that at least one of the signatures stored in the signature manifest is made for the
+// image manifest by one of the trusted keys. Signatures are stored as cosign simple signing payloads with the
+// detached signature in the layer annotation, or as sigstore bundles.
+func (c VerificationConfig) VerifySignature(
+	imageTag, digest string,
+	sigManifest Manifest,
+	readBlob func(digest string) ([]byte, error),
+) error {
+	reason := "no signatures found"
+	for _, layer := range sigManifest.Layers {
+		var verifyFn func(digest string, payload []byte, signature string) error
+		switch {
+		case layer.MediaType == simpleSigningMediaType:
+			verifyFn = c.verifySimpleSigning
+		case strings.HasPrefix(layer.MediaType, bundleMediaTypePrefix):
+			verifyFn = c.verifyBundle
+		default:
+			continue
+		}
+
+		payload, err := readBlob(layer.Digest)
+		if err != nil {
+			return err
+		}
+		verifier, err := NewVerifier(layer.Digest)
+		if err != nil {
+			return err
+		}
+		if _, err := verifier.Write(payload); err != nil {
+			return errors.WithStack(err)
+		}
+		if err := verifier.Verify(); err != nil {
+			return err
+		}
+
+		if err := verifyFn(digest, payload, layer.Annotations[signatureAnnotation]); err != nil {
+			reason = err.Error()
+			continue
+		}
+		return nil
+	}
+
+	return errors.Wrapf(ErrVerificationFailed, "signature of image %q (%s) is invalid: %s", imageTag, digest,
+		reason)
+}
+
+func (c VerificationConfig) verifySimpleSigning(digest string, payload []byte, signature string) error {
+	var p simpleSigningPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return errors.WithStack(err)
+	}
+	if p.Critical.Type != simpleSigningType {
+		return errors.Errorf("unexpected payload type %q", p.Critical.Type)
+	}
+	if p.Critical.Image.DockerManifestDigest != digest {
+		return errors.Errorf("payload is signed for digest %s", p.Critical.Image.DockerManifestDigest)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return c.verify(payload, sig)
+}
+
+func (c VerificationConfig) verifyBundle(digest string, payload []byte, _ string) error {
+	var b bundle
+	if err := json.Unmarshal(payload, &b); err != nil {
+		return errors.WithStack(err)
+	}
+
+	algorithm, hash, _ := strings.Cut(digest, ":")
+	switch {
+	case b.MessageSignature != nil:
+		if algorithm != "sha256" || b.MessageSignature.MessageDigest.Algorithm != bundleDigestAlgorithm {
+			return errors.Errorf("unsupported digest algorithm %q", b.MessageSignature.MessageDigest.Algorithm)
+		}
+		if hex.EncodeToString(b.MessageSignature.MessageDigest.Digest) != hash {
+			return errors.New("bundle is signed for another digest")
+		}
+		return c.verifyDigest(b.MessageSignature.MessageDigest.Digest, b.MessageSignature.Signature)
+	case b.DSSEEnvelope != nil:
+		var statement inTotoStatement
+		if err := json.Unmarshal(b.DSSEEnvelope.Payload, &statement); err != nil {
+			return errors.WithStack(err)
+		}
+		var found bool
+		for _, s := range statement.Subject {
+			if s.Digest[algorithm] == hash {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.New("bundle is signed for another digest")
+		}
+
+		pae := fmt.Sprintf("DSSEv1 %d %s %d %s", len(b.DSSEEnvelope.PayloadType), b.DSSEEnvelope.PayloadType,
+			len(b.DSSEEnvelope.Payload), b.DSSEEnvelope.Payload)
+		for _, sig := range b.DSSEEnvelope.Signatures {
+			if err := c.verify([]byte(pae), sig.Sig); err == nil {
+				return nil
+			}
+		}
+		return errors.New("no valid DSSE signature")
+	default:
+		return errors.New("bundle contains no signature")
+	}
+}
+
+// verify verifies signature of the message.
+func (c VerificationConfig) verify(message, signature []byte) error {
+	hash := sha256.Sum256(message)
+	for _, key := range c.PublicKeys {
+		if k, ok := key.(ed25519.PublicKey); ok {
+			if ed25519.Verify(k, message, signature) {
+				return nil
+			}
+			continue
+		}
+		if verifyDigest(key, hash[:], signature) {
+			return nil
+		}
+	}
+	return errors.New("signature does not match any trusted key")
+}
+
+// verifyDigest verifies signature of the message represented by its SHA-256 digest.
+func (c VerificationConfig) verifyDigest(hash, signature []byte) error {
+	for _, key := range c.PublicKeys {
+		if verifyDigest(key, hash, signature) {
+			return nil
+		}
+	}
+	return errors.New("signature does not match any trusted key")
+}
+
+func verifyDigest(key crypto.PublicKey, hash, signature []byte) bool {
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, hash, signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, hash, signature) == nil
+	default:
+		return false
+	}
+}
+
+// SignatureTag returns tag under which cosign stores signatures of the manifest.
+func SignatureTag(digest string) string {
+	return strings.Replace(digest, ":", "-", 1) + signatureTagSuffix
+}
+
+// isSignatureMediaType returns true if layer of the signature manifest stores the signature.
+func isSignatureMediaType(mediaType string) bool {
+	return mediaType == simpleSigningMediaType || strings.HasPrefix(mediaType, bundleMediaTypePrefix)
+}
+
+// isSignatureTag returns true if tag is the one produced by SignatureTag for the sha256 digest.
+func isSignatureTag(tag string) bool {
+	hash, ok := strings.CutPrefix(tag, "sha256-")
+	if !ok {
+		return false
+	}
+	hash, ok = strings.CutSuffix(hash, signatureTagSuffix)
+	if !ok || len(hash) != 2*sha256.Size {
+		return false
+	}
+	for _, c := range hash {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+type simpleSigningPayload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+type bundle struct {
+	MessageSignature *struct {
+		MessageDigest struct {
+			Algorithm string `json:"algorithm"`
+			Digest    []byte `json:"digest"`
+		} `json:"messageDigest"`
+		Signature []byte `json:"signature"`
+	} `json:"messageSignature"`
+	DSSEEnvelope *struct {
+		Payload     []byte `json:"payload"`
+		PayloadType string `json:"payloadType"`
+		Signatures  []struct {
+			Sig []byte `json:"sig"`
+		} `json:"signatures"`
+	} `json:"dsseEnvelope"`
+}
+
+type inTotoStatement struct {
+	Subject []struct {
+		Digest map[string]string `json:"digest"`
+	} `json:"subject"`
+}
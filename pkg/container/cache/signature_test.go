@@ -0,0 +1,245 @@
+package cache
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/outofforest/logger"
+)
+
+func testKey(t *testing.T) (*ecdsa.PrivateKey, VerificationConfigurator) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+
+	return key, PublicKey(string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+}
+
+func sign(t *testing.T, key *ecdsa.PrivateKey, message []byte) []byte {
+	hash := sha256.Sum256(message)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	require.NoError(t, err)
+	return sig
+}
+
+func signatureManifest(mediaType, payload, signature string) Manifest {
+	return Manifest{
+		Layers: []Descriptor{
+			{
+				MediaType: mediaType,
+				Digest:    digest(payload),
+				Annotations: map[string]string{
+					signatureAnnotation: signature,
+				},
+			},
+		},
+	}
+}
+
+func blobs(contents ...string) func(digest string) ([]byte, error) {
+	return func(d string) ([]byte, error) {
+		for _, c := range contents {
+			if digest(c) == d {
+				return []byte(c), nil
+			}
+		}
+		return nil, fmt.Errorf("blob %s not found", d)
+	}
+}
+
+func TestVerifySimpleSigning(t *testing.T) {
+	key, keyConfigurator := testKey(t)
+	_, otherKeyConfigurator := testKey(t)
+	imageDigest := digest("manifest")
+
+	payload := fmt.Sprintf(
+		`{"critical":{"identity":{"docker-reference":"alpine"},"image":{"docker-manifest-digest":%q},"type":%q}}`,
+		imageDigest, simpleSigningType)
+	m := signatureManifest(simpleSigningMediaType, payload,
+		base64.StdEncoding.EncodeToString(sign(t, key, []byte(payload))))
+
+	config := NewVerificationConfig(keyConfigurator)
+	require.NoError(t, config.VerifySignature("alpine@latest", imageDigest, m, blobs(payload)))
+
+	err := config.VerifySignature("alpine@latest", digest("other"), m, blobs(payload))
+	require.ErrorIs(t, err, ErrVerificationFailed)
+
+	config = NewVerificationConfig(otherKeyConfigurator)
+	err = config.VerifySignature("alpine@latest", imageDigest, m, blobs(payload))
+	require.ErrorIs(t, err, ErrVerificationFailed)
+
+	err = config.VerifySignature("alpine@latest", imageDigest, Manifest{}, blobs())
+	require.ErrorIs(t, err, ErrVerificationFailed)
+}
+
+func TestVerifyBundle(t *testing.T) {
+	key, keyConfigurator := testKey(t)
+	imageDigest := digest("manifest")
+	config := NewVerificationConfig(keyConfigurator)
+
+	hash, err := hex.DecodeString(strings.TrimPrefix(imageDigest, "sha256:"))
+	require.NoError(t, err)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, hash)
+	require.NoError(t, err)
+
+	messageBundle, err := json.Marshal(map[string]any{
+		"messageSignature": map[string]any{
+			"messageDigest": map[string]any{
+				"algorithm": bundleDigestAlgorithm,
+				"digest":    hash,
+			},
+			"signature": sig,
+		},
+	})
+	require.NoError(t, err)
+
+	m := signatureManifest(bundleMediaTypePrefix+".v0.3+json", string(messageBundle), "")
+	require.NoError(t, config.VerifySignature("alpine@latest", imageDigest, m, blobs(string(messageBundle))))
+
+	statement := fmt.Sprintf(`{"subject":[{"name":"alpine","digest":{"sha256":%q}}]}`,
+		strings.TrimPrefix(imageDigest, "sha256:"))
+	payloadType := "application/vnd.in-toto+json"
+	pae := fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(statement), statement)
+	dsseBundle, err := json.Marshal(map[string]any{
+		"dsseEnvelope": map[string]any{
+			"payload":     []byte(statement),
+			"payloadType": payloadType,
+			"signatures": []map[string]any{
+				{"sig": sign(t, key, []byte(pae))},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	m = signatureManifest(bundleMediaTypePrefix+".v0.3+json", string(dsseBundle), "")
+	require.NoError(t, config.VerifySignature("alpine@latest", imageDigest, m, blobs(string(dsseBundle))))
+
+	err = config.VerifySignature("alpine@latest", digest("other"), m, blobs(string(dsseBundle)))
+	require.ErrorIs(t, err, ErrVerificationFailed)
+}
+
+func TestCheckReference(t *testing.T) {
+	config := NewVerificationConfig()
+	require.NoError(t, config.CheckReference("alpine@latest"))
+
+	config = NewVerificationConfig(RequireDigest())
+	require.ErrorIs(t, config.CheckReference("alpine@latest"), ErrVerificationFailed)
+	require.NoError(t, config.CheckReference("alpine@"+digest("manifest")))
+}
+
+func TestIsSignatureTag(t *testing.T) {
+	imageDigest := digest("manifest")
+	require.True(t, isSignatureTag(SignatureTag(imageDigest)))
+
+	for _, tag := range []string{
+		"latest.sig",
+		"sha256-.sig",
+		"sha256-" + strings.Repeat("a", 63) + ".sig",
+		"sha256-" + strings.Repeat("A", 64) + ".sig",
+		"sha256-" + strings.Repeat("g", 64) + ".sig",
+		"sha512-" + strings.Repeat("a", 64) + ".sig",
+		strings.TrimSuffix(SignatureTag(imageDigest), signatureTagSuffix),
+		imageDigest,
+	} {
+		require.False(t, isSignatureTag(tag), tag)
+	}
+}
+
+func TestPublicKeyInvalid(t *testing.T) {
+	_, keyConfigurator := testKey(t)
+	config := NewVerificationConfig(keyConfigurator)
+	require.NoError(t, config.Validate())
+
+	config = NewVerificationConfig(keyConfigurator, PublicKey("invalid"))
+	require.Error(t, config.Validate())
+	require.Len(t, config.PublicKeys, 1)
+
+	config = NewVerificationConfig(PublicKey(string(pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: []byte("invalid"),
+	}))))
+	require.Error(t, config.Validate())
+}
+
+type fakeRepository struct {
+	manifests map[string]Manifest
+	blobs     []string
+}
+
+func (r *fakeRepository) FetchManifest(
+	ctx context.Context,
+	repoURL string,
+	creds Credentials,
+	image, tag string,
+) (Manifest, string, error) {
+	m, exists := r.manifests[tag]
+	if !exists {
+		return Manifest{}, "", errors.Errorf("manifest %s does not exist", tag)
+	}
+	return m, "", nil
+}
+
+func (r *fakeRepository) FetchBlob(
+	ctx context.Context,
+	repoURL string,
+	creds Credentials,
+	authHeader, image, digest string,
+) (string, error) {
+	r.blobs = append(r.blobs, digest)
+	return "", nil
+}
+
+func (r *fakeRepository) ManifestFile(repoURL, image, tag string) string {
+	return ""
+}
+
+func (r *fakeRepository) BlobFile(repoURL, image, digest string) string {
+	return ""
+}
+
+func TestPullImageSignatureTag(t *testing.T) {
+	ctx := logger.WithLogger(context.Background(), zap.NewNop())
+	_, keyConfigurator := testKey(t)
+	config := Config{
+		Verification: NewVerificationConfig(keyConfigurator, RequireDigest()),
+	}
+
+	sigTag := SignatureTag(digest("manifest"))
+	sigManifest := signatureManifest(simpleSigningMediaType, "payload", "signature")
+	sigManifest.Layers = append(sigManifest.Layers, Descriptor{
+		MediaType: "application/vnd.oci.image.layer.v1.tar",
+		Digest:    digest("layer"),
+	})
+	repo := &fakeRepository{
+		manifests: map[string]Manifest{
+			sigTag:       sigManifest,
+			"latest.sig": {Layers: []Descriptor{{Digest: digest("layer")}}},
+		},
+	}
+
+	// Only blobs storing signatures are pulled using signature tag.
+	require.NoError(t, pullImage(ctx, repo, config, "registry.example.com/image@"+sigTag))
+	require.Equal(t, []string{sigManifest.Layers[0].Digest}, repo.blobs)
+
+	// Tags looking like signature tags are verified.
+	require.ErrorIs(t, pullImage(ctx, repo, config, "registry.example.com/image@latest.sig"),
+		ErrVerificationFailed)
+	require.Len(t, repo.blobs, 1)
+}
@@ -0,0 +1,630 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/outofforest/logger"
+	"github.com/outofforest/parallel"
+)
+
+const (
+	refsDir   = "refs"
+	blobsDir  = "blobs"
+	tmpDir    = "tmp"
+	pullsFile = "pulls.json"
+
+	// pullRetention is the time images pulled on demand are kept in the store since they were requested last time.
+	// They are pulled again if requested after being garbage-collected.
+	pullRetention = 7 * 24 * time.Hour
+
+	// pullRefreshInterval is the time after which images pulled on demand by tag are fetched again, so they follow
+	// the upstream registry.
+	pullRefreshInterval = 24 * time.Hour
+)
+
+// newStore creates content-addressed store of manifests and blobs. Blobs are stored once, by digest, and are shared
+// by all the images. Files requested by clients are symlinks to blobs.
+func newStore(dir string, config Config) *store {
+	return &store{
+		dir:    dir,
+		config: config,
+		locks: keyedMutex{
+			locks: map[string]*keyedLock{},
+		},
+		syncRefs: map[string]struct{}{},
+		pulls:    map[string]pullRecord{},
+	}
+}
+
+// pullRecord stores references of the image pulled on demand. Records are stored next to the blobs, so they
+// survive restarts.
+type pullRecord struct {
+	// Accessed is the time image was requested last time. Access times are persisted by garbage collector.
+	Accessed time.Time
+
+	// Pulled is the time image was fetched from the upstream registry.
+	Pulled time.Time
+
+	// Refs are the references of the image.
+	Refs map[string]struct{}
+}
+
+type store struct {
+	dir    string
+	config Config
+
+	// mu is locked exclusively by sync and garbage collector, pulls share it.
+	mu    sync.RWMutex
+	locks keyedMutex
+	size  atomic.Int64
+
+	pullsMu  sync.Mutex
+	syncRefs map[string]struct{}
+	pulls    map[string]pullRecord
+}
+
+// RefsDir returns directory containing files requested by clients.
+func (s *store) RefsDir() string {
+	return filepath.Join(s.dir, refsDir)
+}
+
+// Size returns size of the blobs stored.
+func (s *store) Size() int64 {
+	return s.size.Load()
+}
+
+// Sync fetches blobs missing for the images concurrently and removes the ones not referenced by them and by
+// images pulled on demand anymore.
+func (s *store) Sync(ctx context.Context, images []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.prepare(); err != nil {
+		return err
+	}
+	pulls, err := s.loadPulls()
+	if err != nil {
+		return err
+	}
+
+	var refsMu sync.Mutex
+	refs := map[string]struct{}{}
+	err = parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		for _, imageTag := range images {
+			spawn("image", parallel.Continue, func(ctx context.Context) error {
+				imageRefs := map[string]struct{}{}
+				if err := pullImage(ctx, pullSession{store: s, refs: imageRefs}, s.config, imageTag); err != nil {
+					return err
+				}
+
+				refsMu.Lock()
+				defer refsMu.Unlock()
+
+				maps.Copy(refs, imageRefs)
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.pullsMu.Lock()
+	s.syncRefs = refs
+	s.pulls = pulls
+	live := s.liveRefs(time.Now())
+	err = s.storePulls()
+	s.pullsMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := s.collectGarbage(ctx, live); err != nil {
+		return err
+	}
+
+	size, err := dirSize(s.BlobsDir())
+	if err != nil {
+		return err
+	}
+	s.size.Store(size)
+	return nil
+}
+
+// Pull fetches the image on demand. Only images from allowed repositories are pulled.
+func (s *store) Pull(ctx context.Context, imageTag string) error {
+	if !s.config.pullAllowed(imageTag) {
+		return errors.Errorf("pulling image %q is not allowed", imageTag)
+	}
+
+	manifestFile, err := ManifestFile(imageTag)
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Image might be pulled by another request in the meantime.
+	defer s.locks.Lock(imageTag)()
+	_, err = os.Stat(filepath.Join(s.RefsDir(), manifestFile))
+	switch {
+	case err == nil:
+		return nil
+	case !os.IsNotExist(err):
+		return errors.WithStack(err)
+	}
+
+	refs := map[string]struct{}{}
+	if err := pullImage(ctx, pullSession{store: s, refs: refs}, s.config, imageTag); err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	s.pullsMu.Lock()
+	defer s.pullsMu.Unlock()
+
+	s.pulls[imageTag] = pullRecord{
+		Accessed: now,
+		Pulled:   now,
+		Refs:     refs,
+	}
+	return s.storePulls()
+}
+
+// Access records that image pulled on demand has been requested, so it is not garbage-collected.
+func (s *store) Access(imageTag string, now time.Time) {
+	s.pullsMu.Lock()
+	defer s.pullsMu.Unlock()
+
+	if p, exists := s.pulls[imageTag]; exists {
+		p.Accessed = now
+		s.pulls[imageTag] = p
+	}
+}
+
+// Refresh fetches again images pulled on demand by tag, if they haven't been fetched for the refresh interval.
+// Images which can't be fetched are kept unchanged.
+func (s *store) Refresh(ctx context.Context, now time.Time) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	s.pullsMu.Lock()
+	var images []string
+	for imageTag, p := range s.pulls {
+		if _, tag, err := splitImageTag(imageTag); err == nil && !IsDigest(tag) &&
+			now.Sub(p.Pulled) > pullRefreshInterval {
+			images = append(images, imageTag)
+		}
+	}
+	s.pullsMu.Unlock()
+
+	for _, imageTag := range images {
+		if err := s.refresh(ctx, imageTag, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CollectGarbage removes images pulled on demand which are older than retention period, together with blobs
+// not referenced anymore. Garbage collection is skipped if images are being pulled, so clients are not blocked.
+func (s *store) CollectGarbage(ctx context.Context, now time.Time) error {
+	if !s.mu.TryLock() {
+		logger.Get(ctx).Debug("Images are being pulled, garbage collection skipped")
+		return nil
+	}
+	defer s.mu.Unlock()
+
+	s.pullsMu.Lock()
+	live := s.liveRefs(now)
+	err := s.storePulls()
+	s.pullsMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return s.collectGarbage(ctx, live)
+}
+
+// BlobsDir returns directory containing blobs.
+func (s *store) BlobsDir() string {
+	return filepath.Join(s.dir, blobsDir)
+}
+
+func (s *store) FetchManifest(
+	ctx context.Context,
+	repoURL string,
+	creds Credentials,
+	image, tag string,
+) (Manifest, string, error) {
+	ref := manifestRef(repoURL, image, tag)
+	defer s.locks.Lock(ref)()
+
+	refFile := filepath.Join(s.RefsDir(), ref)
+
+	// Manifests referenced by digest never change so there is no need to fetch them again.
+	if IsDigest(tag) {
+		m, err := readManifest(refFile)
+		switch {
+		case err == nil:
+			return m, staticAuthHeader(creds), nil
+		case !errors.Is(err, fs.ErrNotExist):
+			return Manifest{}, "", err
+		}
+	}
+
+	manifestTmpFile := filepath.Join(s.dir, tmpDir, ref)
+	m, authHeader, err := fetchManifest(ctx, manifestTmpFile, repoURL, creds, image, tag)
+	if err != nil {
+		return Manifest{}, "", err
+	}
+
+	digest, err := computeDigest(manifestTmpFile)
+	if err != nil {
+		return Manifest{}, "", err
+	}
+
+	if err := s.storeBlob(manifestTmpFile, digest); err != nil {
+		return Manifest{}, "", err
+	}
+	if err := s.link(ref, digest); err != nil {
+		return Manifest{}, "", err
+	}
+
+	return m, authHeader, nil
+}
+
+func (s *store) FetchBlob(
+	ctx context.Context,
+	repoURL string,
+	creds Credentials,
+	authHeader, image, digest string,
+) (string, error) {
+	if !IsDigest(digest) {
+		return "", errors.Errorf("invalid digest %q", digest)
+	}
+
+	authHeader, err := func() (string, error) {
+		defer s.locks.Lock(digest)()
+
+		blobFile := s.blobFile(digest)
+		_, err := os.Stat(blobFile)
+		switch {
+		case err == nil:
+			return authHeader, nil
+		case !os.IsNotExist(err):
+			return "", errors.WithStack(err)
+		}
+
+		authHeader, err = fetchBlob(ctx, blobFile, repoURL, creds, authHeader, image, digest)
+		if err != nil {
+			return "", err
+		}
+		info, err := os.Stat(blobFile)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		s.size.Add(info.Size())
+		return authHeader, nil
+	}()
+	if err != nil {
+		return "", err
+	}
+
+	ref := blobRef(repoURL, image, digest)
+	defer s.locks.Lock(ref)()
+
+	return authHeader, s.link(ref, digest)
+}
+
+func (s *store) ManifestFile(repoURL, image, tag string) string {
+	return filepath.Join(s.RefsDir(), manifestRef(repoURL, image, tag))
+}
+
+func (s *store) BlobFile(_, _, digest string) string {
+	return s.blobFile(digest)
+}
+
+func (s *store) refresh(ctx context.Context, imageTag string, now time.Time) error {
+	defer s.locks.Lock(imageTag)()
+
+	refs := map[string]struct{}{}
+	if err := pullImage(ctx, pullSession{store: s, refs: refs}, s.config, imageTag); err != nil {
+		if ctx.Err() != nil {
+			return errors.WithStack(ctx.Err())
+		}
+		logger.Get(ctx).Warn("Refreshing image failed", zap.String("image", imageTag), zap.Error(err))
+		return nil
+	}
+
+	s.pullsMu.Lock()
+	defer s.pullsMu.Unlock()
+
+	p, exists := s.pulls[imageTag]
+	if !exists {
+		return nil
+	}
+
+	// Blobs of the previous version are removed by garbage collector.
+	p.Refs = refs
+	p.Pulled = now
+	s.pulls[imageTag] = p
+	return s.storePulls()
+}
+
+// liveRefs returns references of synced images and images pulled on demand. Records of images pulled on demand
+// which haven't been requested during retention period are removed. It must be called with pullsMu locked.
+func (s *store) liveRefs(now time.Time) map[string]struct{} {
+	live := maps.Clone(s.syncRefs)
+	for imageTag, p := range s.pulls {
+		if now.Sub(p.Accessed) > pullRetention {
+			delete(s.pulls, imageTag)
+			continue
+		}
+		maps.Copy(live, p.Refs)
+	}
+	return live
+}
+
+func (s *store) loadPulls() (map[string]pullRecord, error) {
+	pulls := map[string]pullRecord{}
+	pullsRaw, err := os.ReadFile(filepath.Join(s.dir, pullsFile))
+	switch {
+	case err == nil:
+	case os.IsNotExist(err):
+		return pulls, nil
+	default:
+		return nil, errors.WithStack(err)
+	}
+
+	if err := json.Unmarshal(pullsRaw, &pulls); err != nil {
+		return nil, errors.Wrap(err, "parsing records of pulled images failed")
+	}
+	return pulls, nil
+}
+
+// storePulls stores records of images pulled on demand. It must be called with pullsMu locked.
+func (s *store) storePulls() error {
+	pullsRaw, err := json.Marshal(s.pulls)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	pullsTmpFile := filepath.Join(s.dir, tmpDir, pullsFile)
+	if err := os.WriteFile(pullsTmpFile, pullsRaw, 0o600); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(pullsTmpFile, filepath.Join(s.dir, pullsFile)))
+}
+
+func (s *store) prepare() error {
+	if err := os.RemoveAll(filepath.Join(s.dir, tmpDir)); err != nil {
+		return errors.WithStack(err)
+	}
+	for _, dir := range []string{refsDir, blobsDir, tmpDir} {
+		if err := os.MkdirAll(filepath.Join(s.dir, dir), 0o700); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// storeBlob moves the file to the blob store unless blob exists already.
+func (s *store) storeBlob(file, digest string) error {
+	defer s.locks.Lock(digest)()
+
+	blobFile := s.blobFile(digest)
+	_, err := os.Stat(blobFile)
+	switch {
+	case err == nil:
+		return errors.WithStack(os.Remove(file))
+	case !os.IsNotExist(err):
+		return errors.WithStack(err)
+	}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(blobFile), 0o700); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := os.Rename(file, blobFile); err != nil {
+		return errors.WithStack(err)
+	}
+	s.size.Add(info.Size())
+	return nil
+}
+
+func (s *store) blobFile(digest string) string {
+	algorithm, hash, _ := strings.Cut(digest, ":")
+	return filepath.Join(s.dir, blobsDir, algorithm, hash)
+}
+
+func (s *store) link(ref, digest string) error {
+	refFile := filepath.Join(s.RefsDir(), ref)
+	target, err := filepath.Rel(filepath.Dir(refFile), s.blobFile(digest))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if current, err := os.Readlink(refFile); err == nil && current == target {
+		return nil
+	}
+
+	refTmpFile := filepath.Join(s.dir, tmpDir, ref+".link")
+	if err := os.Symlink(target, refTmpFile); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(refTmpFile, refFile))
+}
+
+func (s *store) collectGarbage(ctx context.Context, live map[string]struct{}) error {
+	log := logger.Get(ctx)
+
+	refs, err := os.ReadDir(s.RefsDir())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	liveBlobs := map[string]struct{}{}
+	for _, ref := range refs {
+		refFile := filepath.Join(s.RefsDir(), ref.Name())
+		if _, exists := live[ref.Name()]; !exists {
+			log.Info("Removing unused reference", zap.String("ref", ref.Name()))
+			if err := os.Remove(refFile); err != nil {
+				return errors.WithStack(err)
+			}
+			continue
+		}
+
+		target, err := os.Readlink(refFile)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		liveBlobs[filepath.Clean(filepath.Join(s.RefsDir(), target))] = struct{}{}
+	}
+
+	return errors.WithStack(filepath.WalkDir(filepath.Join(s.dir, blobsDir),
+		func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if d.IsDir() {
+				return nil
+			}
+			if _, exists := liveBlobs[path]; exists {
+				return nil
+			}
+
+			info, err := d.Info()
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			log.Info("Removing unused blob", zap.String("path", path))
+			if err := os.Remove(path); err != nil {
+				return errors.WithStack(err)
+			}
+			s.size.Add(-info.Size())
+			return nil
+		}))
+}
+
+// pullSession records references of the image pulled into the store.
+type pullSession struct {
+	*store
+
+	refs map[string]struct{}
+}
+
+func (p pullSession) FetchManifest(
+	ctx context.Context,
+	repoURL string,
+	creds Credentials,
+	image, tag string,
+) (Manifest, string, error) {
+	p.refs[manifestRef(repoURL, image, tag)] = struct{}{}
+	return p.store.FetchManifest(ctx, repoURL, creds, image, tag)
+}
+
+func (p pullSession) FetchBlob(
+	ctx context.Context,
+	repoURL string,
+	creds Credentials,
+	authHeader, image, digest string,
+) (string, error) {
+	p.refs[blobRef(repoURL, image, digest)] = struct{}{}
+	return p.store.FetchBlob(ctx, repoURL, creds, authHeader, image, digest)
+}
+
+type keyedLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// keyedMutex serializes operations on the same key, like file of the particular reference or blob.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+// Lock locks the key and returns function unlocking it.
+func (km *keyedMutex) Lock(key string) func() {
+	km.mu.Lock()
+	l, exists := km.locks[key]
+	if !exists {
+		l = &keyedLock{}
+		km.locks[key] = l
+	}
+	l.refs++
+	km.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+
+		km.mu.Lock()
+		defer km.mu.Unlock()
+
+		l.refs--
+		if l.refs == 0 {
+			delete(km.locks, key)
+		}
+	}
+}
+
+func manifestRef(repoURL, image, tag string) string {
+	return sanitizeURL(buildManifestURL(repoURL, image, tag))
+}
+
+func blobRef(repoURL, image, digest string) string {
+	return sanitizeURL(buildBlobURL(repoURL, image, digest))
+}
+
+func readManifest(file string) (Manifest, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return Manifest{}, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	var m Manifest
+	if err := json.NewDecoder(f).Decode(&m); err != nil {
+		return Manifest{}, errors.WithStack(err)
+	}
+	return m, nil
+}
+
+func computeDigest(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer f.Close()
+
+	verifier, err := NewVerifier("sha256:")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(verifier, f); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return verifier.Digest(), nil
+}
@@ -0,0 +1,178 @@
+package cache
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/outofforest/logger"
+)
+
+func TestStoreCollectGarbage(t *testing.T) {
+	ctx := logger.WithLogger(context.Background(), zap.NewNop())
+	s := newStore(t.TempDir(), Config{})
+	require.NoError(t, s.prepare())
+
+	liveDigest := digest("live")
+	pulledDigest := digest("pulled")
+	staleDigest := digest("stale")
+	for content, d := range map[string]string{"live": liveDigest, "pulled": pulledDigest, "stale": staleDigest} {
+		blobFile := s.blobFile(d)
+		require.NoError(t, os.MkdirAll(filepath.Dir(blobFile), 0o700))
+		require.NoError(t, os.WriteFile(blobFile, []byte(content), 0o600))
+	}
+	size, err := dirSize(s.BlobsDir())
+	require.NoError(t, err)
+	s.size.Store(size)
+
+	// Blob already exists in the store, so it is not fetched from the registry.
+	_, err = s.FetchBlob(ctx, "registry.example.com", Credentials{}, "", "image", staleDigest)
+	require.NoError(t, err)
+
+	syncRefs := map[string]struct{}{}
+	_, err = pullSession{store: s, refs: syncRefs}.FetchBlob(ctx, "registry.example.com", Credentials{}, "", "image",
+		liveDigest)
+	require.NoError(t, err)
+	pulledRefs := map[string]struct{}{}
+	_, err = pullSession{store: s, refs: pulledRefs}.FetchBlob(ctx, "registry.example.com", Credentials{}, "",
+		"pulled", pulledDigest)
+	require.NoError(t, err)
+
+	now := time.Now()
+	s.syncRefs = syncRefs
+	s.pulls["registry.example.com/pulled@"+pulledDigest] = pullRecord{Accessed: now, Pulled: now, Refs: pulledRefs}
+
+	requireBlob := func(repo, d, content string) {
+		ref := filepath.Join(s.RefsDir(), blobRef("registry.example.com", repo, d))
+		c, err := os.ReadFile(ref)
+		require.NoError(t, err)
+		require.Equal(t, content, string(c))
+	}
+	requireNoBlob := func(repo, d string) {
+		ref := filepath.Join(s.RefsDir(), blobRef("registry.example.com", repo, d))
+		_, err := os.Lstat(ref)
+		require.True(t, os.IsNotExist(err))
+		_, err = os.Stat(s.blobFile(d))
+		require.True(t, os.IsNotExist(err))
+	}
+
+	require.NoError(t, s.CollectGarbage(ctx, now))
+	requireBlob("image", liveDigest, "live")
+	requireBlob("pulled", pulledDigest, "pulled")
+	requireNoBlob("image", staleDigest)
+	require.EqualValues(t, len("live")+len("pulled"), s.Size())
+
+	// Retention period starts when image is requested last time.
+	s.Access("registry.example.com/pulled@"+pulledDigest, now.Add(pullRetention))
+	require.NoError(t, s.CollectGarbage(ctx, now.Add(pullRetention+time.Second)))
+	requireBlob("pulled", pulledDigest, "pulled")
+
+	// Images pulled on demand are removed after retention period.
+	require.NoError(t, s.CollectGarbage(ctx, now.Add(2*pullRetention+time.Second)))
+	requireBlob("image", liveDigest, "live")
+	requireNoBlob("pulled", pulledDigest)
+	require.Empty(t, s.pulls)
+	require.EqualValues(t, len("live"), s.Size())
+
+	// Garbage collection is skipped while images are pulled.
+	s.mu.RLock()
+	require.NoError(t, s.CollectGarbage(ctx, now))
+	s.mu.RUnlock()
+}
+
+func TestPullAllowed(t *testing.T) {
+	config := Config{}
+	PullThrough("docker.io/library", "ghcr.io", "quay.io/org/")(&config)
+	require.Equal(t, []string{"registry-1.docker.io/library", "ghcr.io", "quay.io/org"},
+		config.PullThroughRepositories)
+
+	for imageTag, allowed := range map[string]bool{
+		"alpine@sha256:1":                          true,
+		"library/alpine@sha256:1":                  true,
+		"docker.io/library/alpine@latest":          true,
+		"docker.io/other/alpine@latest":            false,
+		"ghcr.io/any/image@latest":                 true,
+		"quay.io/org/image@latest":                 true,
+		"quay.io/org2/image@latest":                false,
+		"internal.example.com/org/image@latest":    false,
+		"169.254.169.254/latest/meta-data@latest":  false,
+		"registry.example.com/library/alpine@tag1": false,
+	} {
+		require.Equal(t, allowed, config.pullAllowed(imageTag), imageTag)
+	}
+
+	s := newStore(t.TempDir(), config)
+	require.Error(t, s.Pull(logger.WithLogger(context.Background(), zap.NewNop()),
+		"internal.example.com/image@latest"))
+}
+
+func TestStorePersistPulls(t *testing.T) {
+	requireT := require.New(t)
+	ctx := logger.WithLogger(context.Background(), zap.NewNop())
+
+	imageTag := testRegistry(t, "application/vnd.oci.image.layer.v1.tar", nil)
+	registry, _, _ := strings.Cut(imageTag, "/")
+	config := Config{}
+	PullThrough(registry)(&config)
+
+	dir := t.TempDir()
+	s := newStore(dir, config)
+	requireT.NoError(s.Sync(ctx, nil))
+	requireT.NoError(s.Pull(ctx, imageTag))
+
+	blobFile := s.blobFile(digest("layer"))
+	_, err := os.Stat(blobFile)
+	requireT.NoError(err)
+
+	// Images pulled on demand are not removed by sync after restart.
+	s = newStore(dir, config)
+	requireT.NoError(s.Sync(ctx, nil))
+	requireT.NoError(s.CollectGarbage(ctx, time.Now()))
+	_, err = os.Stat(blobFile)
+	requireT.NoError(err)
+	requireT.Contains(s.pulls, imageTag)
+
+	requireT.NoError(s.CollectGarbage(ctx, time.Now().Add(pullRetention+time.Second)))
+	_, err = os.Stat(blobFile)
+	requireT.True(os.IsNotExist(err))
+
+	s = newStore(dir, config)
+	requireT.NoError(s.Sync(ctx, nil))
+	requireT.Empty(s.pulls)
+}
+
+func TestStoreRefreshTags(t *testing.T) {
+	requireT := require.New(t)
+	ctx := logger.WithLogger(context.Background(), zap.NewNop())
+
+	imageTag := testRegistry(t, "application/vnd.oci.image.layer.v1.tar", nil)
+	registry, _, _ := strings.Cut(imageTag, "/")
+	config := Config{}
+	PullThrough(registry)(&config)
+
+	s := newStore(t.TempDir(), config)
+	requireT.NoError(s.Sync(ctx, nil))
+
+	tagged := registry + "/org/app@latest"
+	requireT.NoError(s.Pull(ctx, tagged))
+	requireT.NoError(s.Pull(ctx, imageTag))
+	pulled := s.pulls[tagged].Pulled
+
+	// Images are not refreshed before refresh interval passes.
+	requireT.NoError(s.Refresh(ctx, pulled.Add(time.Second)))
+	requireT.Equal(pulled, s.pulls[tagged].Pulled)
+
+	now := pulled.Add(pullRefreshInterval + time.Second)
+	requireT.NoError(s.Refresh(ctx, now))
+	requireT.Equal(now, s.pulls[tagged].Pulled)
+	requireT.NotEmpty(s.pulls[tagged].Refs)
+
+	// Images pulled by digest never change.
+	requireT.NotEqual(now, s.pulls[imageTag].Pulled)
+}
@@ -1,14 +1,33 @@
 package cache
 
-// Manifest represents container image manifest.
+// Manifest represents container image manifest or image index.
 type Manifest struct {
-	MediaType string `json:"mediaType"`
-	Config    struct {
-		MediaType string `json:"mediaType"`
-		Digest    string `json:"digest"`
-	} `json:"config"`
-	Layers []struct {
-		MediaType string `json:"mediaType"`
-		Digest    string `json:"digest"`
-	} `json:"layers"`
+	MediaType string       `json:"mediaType"`
+	Config    Descriptor   `json:"config"`
+	Layers    []Descriptor `json:"layers"`
+	Manifests []struct {
+		MediaType string   `json:"mediaType"`
+		Digest    string   `json:"digest"`
+		Platform  Platform `json:"platform"`
+	} `json:"manifests"`
+}
+
+// Descriptor references content stored in the registry.
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// IsIndex returns true if manifest is an image index referencing platform-specific manifests.
+func (m Manifest) IsIndex() bool {
+	_, exists := indexMediaTypes[m.MediaType]
+	return exists
+}
+
+// Platform describes the platform image is built for.
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant"`
 }
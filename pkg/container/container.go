@@ -1,11 +1,9 @@
 package container
 
 import (
-	"archive/tar"
 	"compress/gzip"
 	"context"
 	"encoding/json"
-	"fmt"
 	"io"
 	"math/rand"
 	"net"
@@ -14,26 +12,36 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/pkg/errors"
 	"github.com/vishvananda/netlink"
-	"go.uber.org/zap"
 	"golang.org/x/sys/unix"
 
 	"github.com/outofforest/cloudless"
 	"github.com/outofforest/cloudless/pkg/container/cache"
+	"github.com/outofforest/cloudless/pkg/eye/metrics"
 	"github.com/outofforest/cloudless/pkg/host"
+	"github.com/outofforest/cloudless/pkg/host/nsexec"
 	"github.com/outofforest/cloudless/pkg/kernel"
+	"github.com/outofforest/cloudless/pkg/mount"
 	"github.com/outofforest/cloudless/pkg/parse"
 	"github.com/outofforest/cloudless/pkg/retry"
 	"github.com/outofforest/cloudless/pkg/wait"
-	"github.com/outofforest/libexec"
-	"github.com/outofforest/logger"
 )
 
-const containersDir = cloudless.BaseDir + "/containers"
+const (
+	containersDir = cloudless.BaseDir + "/containers"
+
+	// containerRootDir is the directory inside container directory used as the root of the container.
+	containerRootDir = "root"
+
+	// overlayDir is the directory inside container root keeping the writable layer of the overlay filesystem.
+	overlayDir = ".overlay"
+)
 
 var protectedFiles = map[string]struct{}{
 	"/etc/resolv.conf":  {},
@@ -42,6 +50,17 @@ var protectedFiles = map[string]struct{}{
 	"/etc/ssl/cert.pem": {},
 }
 
+var (
+	rootMu    sync.Mutex
+	rootImage *rootImageConfig
+
+	// layers is the layer store used inside the container.
+	layers = layerStore{
+		Dir:         layersDir,
+		WritableDir: layersWritableDir,
+	}
+)
+
 // Config represents container configuration.
 type Config struct {
 	Name     string
@@ -71,6 +90,21 @@ type RunImageConfig struct {
 
 	// Cmd sets command to execute inside container.
 	Cmd []string
+
+	// HealthCheck configures health check of the process.
+	HealthCheck *HealthCheckConfig
+
+	// Restart defines when process is restarted.
+	Restart RestartPolicy
+
+	// StopPriority defines when process is stopped on shutdown, relative to other processes.
+	StopPriority uint
+
+	// Processes are additional processes running inside container.
+	Processes []ProcessConfig
+
+	// Verification configures verification of the image signature.
+	Verification cache.VerificationConfig
 }
 
 // RunImageConfigurator defines function setting the container image execution configuration.
@@ -88,15 +122,35 @@ func New(name string, configurators ...Configurator) host.Configurator {
 
 	return cloudless.Join(
 		cloudless.KernelModules(kernel.Module{Name: "veth"}),
+		cloudless.Prepare(func(ctx context.Context) error {
+			// Containers are not running yet, so layers not used by installed images might be removed.
+			return layerStore{
+				Dir:         layersDir,
+				WritableDir: layersDir,
+			}.CollectGarbage(ctx, containersDir)
+		}),
 		cloudless.Service("container-"+name, func(ctx context.Context) error {
 			cmd, stdInCloser, err := command(ctx, config)
 			if err != nil {
 				return err
 			}
-			if err := cmd.Start(); err != nil {
+
+			control, containerControl, err := nsexec.NewControl()
+			if err != nil {
+				return err
+			}
+			defer control.Close()
+
+			cmd.ExtraFiles = []*os.File{containerControl}
+			err = cmd.Start()
+			_ = containerControl.Close()
+			if err != nil {
 				return errors.WithStack(err)
 			}
 
+			containers.Register(config, cmd.Process.Pid, control)
+			defer containers.Unregister(name)
+
 			if err := joinNetworks(cmd.Process.Pid, config); err != nil {
 				return err
 			}
@@ -122,16 +176,22 @@ func Network(bridgeName, ifaceName, mac string) Configurator {
 }
 
 // InstallImage installs image.
-func InstallImage(imageTag string) host.Configurator {
+func InstallImage(imageTag string, configurators ...cache.VerificationConfigurator) host.Configurator {
 	var c host.SealedConfiguration
+	verification := cache.NewVerificationConfig(configurators...)
 
 	return cloudless.Join(
 		cloudless.Configuration(&c),
 		cloudless.RequireContainers(imageTag),
 		cloudless.IsContainer(),
+		cloudless.Mount(layersDir, layersDir, false),
+		cloudless.Mount(layersDir, layersWritableDir, true),
 		cloudless.Prune(prune(imageTag)),
 		cloudless.Prepare(func(ctx context.Context) error {
-			_, err := installImage(ctx, imageTag, c.ContainerMirrors())
+			if err := verification.Validate(); err != nil {
+				return err
+			}
+			_, err := installImage(ctx, imageTag, c.ContainerMirrors(), verification)
 			return err
 		}),
 	)
@@ -140,79 +200,70 @@ func InstallImage(imageTag string) host.Configurator {
 // RunImage runs image.
 func RunImage(imageTag string, configurators ...RunImageConfigurator) host.Configurator {
 	var c host.SealedConfiguration
+	set := metrics.NewSet()
 
 	return cloudless.Join(
 		cloudless.Configuration(&c),
+		cloudless.Metrics(set),
 		cloudless.RequireContainers(imageTag),
 		cloudless.IsContainer(),
+		cloudless.Mount(layersDir, layersDir, false),
+		cloudless.Mount(layersDir, layersWritableDir, true),
 		cloudless.Prune(prune(imageTag)),
 		cloudless.Service("containerImage", func(ctx context.Context) error {
-			log := logger.Get(ctx)
+			// Verification must be known before the image is installed.
+			verification := newRunImageConfig(imageConfig{}, configurators...).Verification
+			if err := verification.Validate(); err != nil {
+				return err
+			}
 
-			ic, err := installImage(ctx, imageTag, c.ContainerMirrors())
+			ic, err := installImage(ctx, imageTag, c.ContainerMirrors(), verification)
 			if err != nil {
 				return err
 			}
 
-			config := RunImageConfig{
-				Entrypoint: ic.Config.Entrypoint,
-				Cmd:        ic.Config.Cmd,
-				WorkingDir: ic.Config.WorkingDir,
-				EnvVars:    map[string]string{},
+			processes, err := processConfigs(newRunImageConfig(ic, configurators...))
+			if err != nil {
+				return err
 			}
+			return runProcesses(ctx, processes, set)
+		}),
+	)
+}
 
-			for _, ev := range ic.Config.Env {
-				pos := strings.Index(ev, "=")
-				if pos < 0 {
-					continue
-				}
-
-				evName := strings.TrimSpace(ev[:pos])
-				if evName == "" {
-					continue
-				}
-				evValue := strings.TrimSpace(ev[pos+1:])
-				if evValue == "" {
-					delete(config.EnvVars, evName)
-					continue
-				}
-
-				config.EnvVars[evName] = evValue
-			}
+// newRunImageConfig builds execution config from the image config. Configurators override settings of the image.
+func newRunImageConfig(ic imageConfig, configurators ...RunImageConfigurator) RunImageConfig {
+	config := RunImageConfig{
+		Entrypoint: ic.Config.Entrypoint,
+		Cmd:        ic.Config.Cmd,
+		WorkingDir: ic.Config.WorkingDir,
+		EnvVars:    map[string]string{},
+	}
 
-			for _, configurator := range configurators {
-				configurator(&config)
-			}
+	for _, ev := range ic.Config.Env {
+		pos := strings.Index(ev, "=")
+		if pos < 0 {
+			continue
+		}
 
-			args := append(append([]string{}, config.Entrypoint...), config.Cmd...)
-			if len(args) == 0 {
-				return errors.Errorf("no command specified")
-			}
-			envVars := make([]string, 0, len(config.EnvVars))
-			for k, v := range config.EnvVars {
-				envVars = append(envVars, fmt.Sprintf("%s=%s", k, v))
-			}
+		evName := strings.TrimSpace(ev[:pos])
+		if evName == "" {
+			continue
+		}
+		evValue := strings.TrimSpace(ev[pos+1:])
+		if evValue == "" {
+			delete(config.EnvVars, evName)
+			continue
+		}
 
-			stdoutLogger := newStreamLogger(log)
-			stderrLogger := newStreamLogger(log)
-			for {
-				err := libexec.Exec(ctx, &exec.Cmd{
-					Path:   args[0],
-					Args:   args,
-					Env:    envVars,
-					Dir:    config.WorkingDir,
-					Stdout: stdoutLogger,
-					Stderr: stderrLogger,
-				})
-				if ctx.Err() != nil {
-					return errors.WithStack(ctx.Err())
-				}
-				if err != nil {
-					log.Error("Container failed", zap.Error(err))
-				}
-			}
-		}),
-	)
+		config.EnvVars[evName] = evValue
+	}
+
+	for _, configurator := range configurators {
+		configurator(&config)
+	}
+
+	return config
 }
 
 // EnvVar sets environment variable inside container.
@@ -243,6 +294,15 @@ func Cmd(args ...string) RunImageConfigurator {
 	}
 }
 
+// Verify enables verification of the image signature before it is installed.
+func Verify(configurators ...cache.VerificationConfigurator) RunImageConfigurator {
+	return func(config *RunImageConfig) {
+		for _, configurator := range configurators {
+			configurator(&config.Verification)
+		}
+	}
+}
+
 // AppMount returns docker volume definition for app's directory.
 func AppMount(appName string) host.Configurator {
 	appDir := cloudless.AppDir(appName)
@@ -346,13 +406,90 @@ func joinNetworks(pid int, config Config) error {
 	return nil
 }
 
-func fetchManifest(ctx context.Context, imageTag string, mirrors []string) (cache.Manifest, error) {
+func fetchManifest(
+	ctx context.Context,
+	imageTag string,
+	mirrors []string,
+	verification cache.VerificationConfig,
+) (cache.Manifest, string, error) {
+	if err := verification.CheckReference(imageTag); err != nil {
+		return cache.Manifest{}, "", err
+	}
+
+	m, digest, err := fetchManifestFile(ctx, imageTag, mirrors)
+	if err != nil {
+		return cache.Manifest{}, "", err
+	}
+	if verification.SignatureRequired() {
+		if err := verifyImage(ctx, imageTag, digest, mirrors, verification); err != nil {
+			return cache.Manifest{}, "", err
+		}
+	}
+	if !m.IsIndex() {
+		return m, digest, nil
+	}
+
+	platformImageTag, err := cache.ResolvePlatform(imageTag, m)
+	if err != nil {
+		return cache.Manifest{}, "", err
+	}
+	m, _, err = fetchManifestFile(ctx, platformImageTag, mirrors)
+	return m, digest, err
+}
+
+// verifyInstalledImage verifies that image installed earlier satisfies the verification config.
+func verifyInstalledImage(
+	ctx context.Context,
+	imageTag, digest string,
+	mirrors []string,
+	verification cache.VerificationConfig,
+) error {
+	if err := verification.CheckReference(imageTag); err != nil {
+		return err
+	}
+	if !verification.SignatureRequired() {
+		return nil
+	}
+	if digest == "" {
+		return errors.Errorf("digest of the installed image %s is unknown, signature can't be verified", imageTag)
+	}
+	if err := wait.HTTP(ctx, mirrors...); err != nil {
+		return err
+	}
+	return verifyImage(ctx, imageTag, digest, mirrors, verification)
+}
+
+func verifyImage(
+	ctx context.Context,
+	imageTag, digest string,
+	mirrors []string,
+	verification cache.VerificationConfig,
+) error {
+	image, _, _ := strings.Cut(imageTag, "@")
+	sigManifest, _, err := fetchManifestFile(ctx, image+"@"+cache.SignatureTag(digest), mirrors)
+	if err != nil {
+		return err
+	}
+
+	return verification.VerifySignature(imageTag, digest, sigManifest, func(digest string) ([]byte, error) {
+		return fetchBlob(ctx, imageTag, digest, mirrors)
+	})
+}
+
+func fetchManifestFile(ctx context.Context, imageTag string, mirrors []string) (cache.Manifest, string, error) {
 	manifestFile, err := cache.ManifestFile(imageTag)
 	if err != nil {
-		return cache.Manifest{}, err
+		return cache.Manifest{}, "", err
+	}
+	_, tag, _ := strings.Cut(imageTag, "@")
+
+	expectedDigest := "sha256:"
+	if cache.IsDigest(tag) {
+		expectedDigest = tag
 	}
 
 	var m cache.Manifest
+	var digest string
 	if err := retry.Do(ctx, retry.FixedConfig{RetryAfter: 5 * time.Second, MaxAttempts: 10}, func() error {
 		mirror, err := selectMirror(mirrors)
 		if err != nil {
@@ -374,12 +511,68 @@ func fetchManifest(ctx context.Context, imageTag string, mirrors []string) (cach
 			return retry.Retriable(errors.Errorf("unexpected status code %d", resp.StatusCode))
 		}
 
-		return retry.Retriable(json.NewDecoder(resp.Body).Decode(&m))
+		verifier, err := cache.NewVerifier(expectedDigest)
+		if err != nil {
+			return err
+		}
+		r := io.TeeReader(resp.Body, verifier)
+
+		m = cache.Manifest{}
+		if err := json.NewDecoder(r).Decode(&m); err != nil {
+			return retry.Retriable(errors.WithStack(err))
+		}
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return retry.Retriable(errors.WithStack(err))
+		}
+		if cache.IsDigest(tag) {
+			if err := verifier.Verify(); err != nil {
+				return retry.Retriable(err)
+			}
+		}
+		digest = verifier.Digest()
+		return nil
 	}); err != nil {
-		return cache.Manifest{}, err
+		return cache.Manifest{}, "", err
 	}
 
-	return m, nil
+	return m, digest, nil
+}
+
+func fetchBlob(ctx context.Context, imageTag, digest string, mirrors []string) ([]byte, error) {
+	blobFile, err := cache.BlobFile(imageTag, digest)
+	if err != nil {
+		return nil, err
+	}
+
+	var content []byte
+	if err := retry.Do(ctx, retry.FixedConfig{RetryAfter: 5 * time.Second, MaxAttempts: 10}, func() error {
+		mirror, err := selectMirror(mirrors)
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, mirror+"/"+blobFile, nil)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return retry.Retriable(errors.WithStack(err))
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return retry.Retriable(errors.Errorf("unexpected status code %d", resp.StatusCode))
+		}
+
+		content, err = io.ReadAll(resp.Body)
+		return retry.Retriable(errors.WithStack(err))
+	}); err != nil {
+		return nil, err
+	}
+
+	return content, nil
 }
 
 func fetchConfig(ctx context.Context, imageTag string, m cache.Manifest, mirrors []string) (imageConfig, error) {
@@ -410,7 +603,20 @@ func fetchConfig(ctx context.Context, imageTag string, m cache.Manifest, mirrors
 			return retry.Retriable(errors.Errorf("unexpected status code %d", resp.StatusCode))
 		}
 
-		return retry.Retriable(json.NewDecoder(resp.Body).Decode(&ic))
+		verifier, err := cache.NewVerifier(m.Config.Digest)
+		if err != nil {
+			return err
+		}
+		r := io.TeeReader(resp.Body, verifier)
+
+		ic = imageConfig{}
+		if err := json.NewDecoder(r).Decode(&ic); err != nil {
+			return retry.Retriable(errors.WithStack(err))
+		}
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return retry.Retriable(errors.WithStack(err))
+		}
+		return retry.Retriable(verifier.Verify())
 	}); err != nil {
 		return imageConfig{}, err
 	}
@@ -418,13 +624,16 @@ func fetchConfig(ctx context.Context, imageTag string, m cache.Manifest, mirrors
 	return ic, nil
 }
 
-func icFileName(imageTag string) string {
-	return strings.ReplaceAll(imageTag, "/", "-")
+// icFileName returns path of the file storing information about the image installed in the container root.
+func icFileName(root, imageTag string) string {
+	return filepath.Join(root, overlayDir, strings.ReplaceAll(imageTag, "/", "-"))
 }
 
 func prune(imageTag string) host.PruneFn {
 	return func() (bool, error) {
-		_, err := os.Stat(icFileName(imageTag))
+		// Prune functions are called before root of the container is changed.
+		root := filepath.Join(containersDir, os.Getenv(host.ContainerEnvVar), containerRootDir)
+		_, err := os.Stat(icFileName(root, imageTag))
 		switch {
 		case err == nil:
 			return false, nil
@@ -436,16 +645,43 @@ func prune(imageTag string) host.PruneFn {
 	}
 }
 
-func installImage(ctx context.Context, imageTag string, mirrors []string) (imageConfig, error) {
-	icFileName := icFileName(imageTag)
+// installImage extracts layers of the image and replaces root filesystem of the container with overlay built
+// on top of them.
+func installImage(
+	ctx context.Context,
+	imageTag string,
+	mirrors []string,
+	verification cache.VerificationConfig,
+) (imageConfig, error) {
+	rootMu.Lock()
+	defer rootMu.Unlock()
+
+	if rootImage != nil {
+		if rootImage.ImageTag != imageTag {
+			return imageConfig{}, errors.Errorf("container root has been already built from image %s",
+				rootImage.ImageTag)
+		}
+		if err := verifyInstalledImage(ctx, imageTag, rootImage.Digest, mirrors, verification); err != nil {
+			return imageConfig{}, err
+		}
+		return rootImage.Config, nil
+	}
 
-	var ic imageConfig
+	icFileName := icFileName("/", imageTag)
+
+	var ii installedImage
 	icRaw, err := os.ReadFile(icFileName)
 	switch {
 	case err == nil:
-		if err := json.Unmarshal(icRaw, &ic); err != nil {
+		if err := json.Unmarshal(icRaw, &ii); err != nil {
 			return imageConfig{}, errors.WithStack(err)
 		}
+		if err := verifyInstalledImage(ctx, imageTag, ii.Digest, mirrors, verification); err != nil {
+			return imageConfig{}, err
+		}
+		if err := layers.Install(ctx, imageTag, ii.Manifest, mirrors); err != nil {
+			return imageConfig{}, err
+		}
 	case !os.IsNotExist(err):
 		return imageConfig{}, errors.WithStack(err)
 	default:
@@ -453,24 +689,27 @@ func installImage(ctx context.Context, imageTag string, mirrors []string) (image
 			return imageConfig{}, err
 		}
 
-		m, err := fetchManifest(ctx, imageTag, mirrors)
+		ii.Manifest, ii.Digest, err = fetchManifest(ctx, imageTag, mirrors, verification)
 		if err != nil {
 			return imageConfig{}, err
 		}
 
-		ic, err = fetchConfig(ctx, imageTag, m, mirrors)
+		ii.Config, err = fetchConfig(ctx, imageTag, ii.Manifest, mirrors)
 		if err != nil {
 			return imageConfig{}, err
 		}
 
-		if err := inflateImage(ctx, imageTag, m, mirrors); err != nil {
+		if err := layers.Install(ctx, imageTag, ii.Manifest, mirrors); err != nil {
 			return imageConfig{}, err
 		}
 
-		if icRaw, err = json.Marshal(ic); err != nil {
+		if icRaw, err = json.Marshal(ii); err != nil {
 			return imageConfig{}, errors.WithStack(err)
 		}
 
+		if err := os.MkdirAll(filepath.Dir(icFileName), 0o700); err != nil {
+			return imageConfig{}, errors.WithStack(err)
+		}
 		icFileNameTmp := icFileName + ".tmp"
 		if err := os.WriteFile(icFileNameTmp, icRaw, 0o600); err != nil {
 			return imageConfig{}, errors.WithStack(err)
@@ -480,173 +719,79 @@ func installImage(ctx context.Context, imageTag string, mirrors []string) (image
 		}
 	}
 
-	return ic, nil
-}
-
-func inflateImage(ctx context.Context, imageTag string, m cache.Manifest, mirrors []string) error {
-	for _, layer := range m.Layers {
-		blobFile, err := cache.BlobFile(imageTag, layer.Digest)
-		if err != nil {
-			return err
-		}
-
-		if err := retry.Do(ctx, retry.FixedConfig{RetryAfter: 5 * time.Second, MaxAttempts: 10}, func() error {
-			mirror, err := selectMirror(mirrors)
-			if err != nil {
-				return err
-			}
-
-			req, err := http.NewRequestWithContext(ctx, http.MethodGet, mirror+"/"+blobFile, nil)
-			if err != nil {
-				return errors.WithStack(err)
-			}
-
-			resp, err := http.DefaultClient.Do(req)
-			if err != nil {
-				return retry.Retriable(errors.WithStack(err))
-			}
-			defer resp.Body.Close()
-
-			if resp.StatusCode != http.StatusOK {
-				return retry.Retriable(errors.Errorf("unexpected status code %d", resp.StatusCode))
-			}
-
-			return inflateBlob(resp.Body)
-		}); err != nil {
-			return err
-		}
+	if err := sealLayers(); err != nil {
+		return imageConfig{}, err
+	}
+	if err := mountRoot(ii.Manifest); err != nil {
+		return imageConfig{}, err
 	}
 
-	return nil
+	rootImage = &rootImageConfig{
+		ImageTag: imageTag,
+		Digest:   ii.Digest,
+		Config:   ii.Config,
+	}
+	return ii.Config, nil
 }
 
-//nolint:gocyclo
-func inflateBlob(r io.Reader) error {
-	gr, err := gzip.NewReader(r)
-	if err != nil {
-		return errors.WithStack(err)
+func mountRoot(m cache.Manifest) error {
+	if len(m.Layers) == 0 {
+		return errors.New("image has no layers")
 	}
-	defer gr.Close()
 
-	tr := tar.NewReader(gr)
-	del := map[string]bool{}
-	added := map[string]bool{}
-loop:
-	for {
-		header, err := tr.Next()
-		switch {
-		case errors.Is(err, io.EOF):
-			break loop
-		case err != nil:
-			return retry.Retriable(err)
-		case header == nil:
-			continue
-		}
+	// Overlay expects the top layer to be the first one.
+	lowerDirs := make([]string, 0, len(m.Layers))
+	for i := len(m.Layers) - 1; i >= 0; i-- {
+		lowerDirs = append(lowerDirs, layers.LayerDir(m.Layers[i].Digest))
+	}
 
-		absPath, err := filepath.Abs(header.Name)
+	dir := filepath.Join("/", overlayDir)
+	rootDir := filepath.Join(dir, "root")
+	if err := mount.Overlay(rootDir, lowerDirs, filepath.Join(dir, "upper"), filepath.Join(dir, "work")); err != nil {
+		return err
+	}
+
+	// Files generated for the container must be visible in the new root.
+	for file := range protectedFiles {
+		content, err := os.ReadFile(file)
 		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
 			return errors.WithStack(err)
 		}
-		if _, exists := protectedFiles[absPath]; exists {
-			continue
-		}
 
-		// We take mode from header.FileInfo().Mode(), not from header.Mode because they may be in different formats
-		// (meaning of bits may be different). header.FileInfo().Mode() returns compatible value.
-		mode := header.FileInfo().Mode()
-
-		switch {
-		case filepath.Base(header.Name) == ".wh..wh..plnk":
-			// just ignore this
-			continue
-		case filepath.Base(header.Name) == ".wh..wh..opq":
-			// It means that content in this directory created by earlier layers should not be visible,
-			// so content created earlier must be deleted.
-			dir := filepath.Dir(header.Name)
-			files, err := os.ReadDir(dir)
-			if err != nil {
-				return errors.WithStack(err)
-			}
-			for _, f := range files {
-				toDelete := filepath.Join(dir, f.Name())
-				if added[toDelete] {
-					continue
-				}
-				if err := os.RemoveAll(toDelete); err != nil {
-					return errors.WithStack(err)
-				}
-			}
-			continue
-		case strings.HasPrefix(filepath.Base(header.Name), ".wh."):
-			// delete or mark to delete corresponding file
-			toDelete := filepath.Join(filepath.Dir(header.Name), strings.TrimPrefix(filepath.Base(header.Name), ".wh."))
-			delete(added, toDelete)
-			if err := os.RemoveAll(toDelete); err != nil {
-				if os.IsNotExist(err) {
-					del[toDelete] = true
-					continue
-				}
-				return errors.WithStack(err)
-			}
-			continue
-		case del[header.Name]:
-			delete(del, header.Name)
-			delete(added, header.Name)
-			continue
-		case header.Typeflag == tar.TypeDir:
-			if err := os.MkdirAll(header.Name, mode); err != nil {
-				return errors.WithStack(err)
-			}
-		case header.Typeflag == tar.TypeReg:
-			f, err := os.OpenFile(header.Name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
-			if err != nil {
-				return errors.WithStack(err)
-			}
-			_, err = io.Copy(f, tr)
-			_ = f.Close()
-			if err != nil {
-				return errors.WithStack(err)
-			}
-		case header.Typeflag == tar.TypeSymlink:
-			if err := os.Symlink(header.Linkname, header.Name); err != nil {
-				return errors.WithStack(err)
-			}
-		case header.Typeflag == tar.TypeLink:
-			// linked file may not exist yet, so let's create it - it will be overwritten later
-			if err := os.MkdirAll(filepath.Dir(header.Linkname), 0o700); err != nil {
-				return errors.WithStack(err)
-			}
-			f, err := os.OpenFile(header.Linkname, os.O_CREATE|os.O_EXCL, mode)
-			if err != nil {
-				if !os.IsExist(err) {
-					return errors.WithStack(err)
-				}
-			} else {
-				_ = f.Close()
-			}
-			if err := os.Link(header.Linkname, header.Name); err != nil {
-				return errors.WithStack(err)
-			}
-		default:
-			return errors.Errorf("unsupported file type: %d", header.Typeflag)
+		dstFile := filepath.Join(rootDir, file)
+		if err := os.MkdirAll(filepath.Dir(dstFile), 0o755); err != nil {
+			return errors.WithStack(err)
 		}
-
-		added[header.Name] = true
-		if err := os.Lchown(header.Name, header.Uid, header.Gid); err != nil {
+		if err := os.WriteFile(dstFile, content, 0o644); err != nil {
 			return errors.WithStack(err)
 		}
+	}
 
-		// Unless CAP_FSETID capability is set for the process every operation modifying the file/dir will reset
-		// setuid, setgid nd sticky bits. After saving those files/dirs the mode has to be set once again to set those
-		// bits. This has to be the last operation on the file/dir.
-		// On linux mode is not supported for symlinks, mode is always taken from target location.
-		if header.Typeflag != tar.TypeSymlink {
-			if err := os.Chmod(header.Name, mode); err != nil {
-				return errors.WithStack(err)
-			}
+	return mount.ContainerPivotRoot(rootDir)
+}
+
+func decompress(r io.Reader, mediaType string) (io.ReadCloser, error) {
+	switch {
+	case strings.HasSuffix(mediaType, "gzip"):
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, retry.Retriable(errors.WithStack(err))
+		}
+		return gr, nil
+	case strings.HasSuffix(mediaType, "zstd"):
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, retry.Retriable(errors.WithStack(err))
 		}
+		return zr.IOReadCloser(), nil
+	case strings.HasSuffix(mediaType, "tar"):
+		return io.NopCloser(r), nil
+	default:
+		return nil, errors.Errorf("unsupported layer media type %s", mediaType)
 	}
-	return nil
 }
 
 func selectMirror(mirrors []string) (string, error) {
@@ -656,6 +801,18 @@ func selectMirror(mirrors []string) (string, error) {
 	return mirrors[rand.Intn(len(mirrors))], nil
 }
 
+type installedImage struct {
+	Manifest cache.Manifest `json:"manifest"`
+	Digest   string         `json:"digest"`
+	Config   imageConfig    `json:"imageConfig"`
+}
+
+type rootImageConfig struct {
+	ImageTag string
+	Digest   string
+	Config   imageConfig
+}
+
 type imageConfig struct {
 	Config struct {
 		Env        []string
@@ -0,0 +1,30 @@
+package container
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRunImageConfig(t *testing.T) {
+	requireT := require.New(t)
+
+	var ic imageConfig
+	ic.Config.Entrypoint = []string{"/bin/entrypoint"}
+	ic.Config.Cmd = []string{"arg"}
+	ic.Config.WorkingDir = "/app"
+	ic.Config.Env = []string{"IMAGE=image", "OVERRIDDEN=image", "EMPTY="}
+
+	config := newRunImageConfig(ic)
+	requireT.Equal([]string{"/bin/entrypoint"}, config.Entrypoint)
+	requireT.Equal([]string{"arg"}, config.Cmd)
+	requireT.Equal("/app", config.WorkingDir)
+	requireT.Equal(map[string]string{"IMAGE": "image", "OVERRIDDEN": "image"}, config.EnvVars)
+
+	// Configurators are applied on top of the image config, so entrypoint of the image might be cleared.
+	config = newRunImageConfig(ic, Entrypoint(), Cmd("/bin/app"), WorkingDir("/"), EnvVar("OVERRIDDEN", "config"))
+	requireT.Empty(config.Entrypoint)
+	requireT.Equal([]string{"/bin/app"}, config.Cmd)
+	requireT.Equal("/", config.WorkingDir)
+	requireT.Equal(map[string]string{"IMAGE": "image", "OVERRIDDEN": "config"}, config.EnvVars)
+}
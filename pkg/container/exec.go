@@ -0,0 +1,101 @@
+package container
+
+import (
+	"context"
+	"net"
+	"os/exec"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/outofforest/cloudless/pkg/host/nsexec"
+)
+
+// execPath is the value of PATH environment variable set for commands executed inside container.
+const execPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+var containers = newRegistry()
+
+// PID returns PID of the process started for the running container.
+func PID(name string) (int, error) {
+	c, err := containers.Get(name)
+	if err != nil {
+		return 0, err
+	}
+	return c.PID, nil
+}
+
+// Exec executes command inside namespaces of the running container and terminates it gracefully if context is
+// canceled. If environment of the command is not set, the minimal one is used, so variables of the host are not
+// passed to the container. Command is started by the agent running inside container, because user namespace
+// can't be joined by the host process.
+func Exec(ctx context.Context, name string, cmd *exec.Cmd) error {
+	c, err := containers.Get(name)
+	if err != nil {
+		return err
+	}
+
+	if cmd.Env == nil {
+		cmd.Env = execEnv(c.Config)
+	}
+	return nsexec.Exec(ctx, c.Control, cmd)
+}
+
+func execEnv(config Config) []string {
+	return []string{
+		"PATH=" + execPath,
+		"HOME=/root",
+		"HOSTNAME=" + config.Name,
+	}
+}
+
+// runningContainer represents running container.
+type runningContainer struct {
+	PID     int
+	Config  Config
+	Control *net.UnixConn
+}
+
+func newRegistry() *registry {
+	return &registry{
+		containers: map[string]runningContainer{},
+	}
+}
+
+// registry keeps track of running containers.
+type registry struct {
+	mu         sync.Mutex
+	containers map[string]runningContainer
+}
+
+// Register registers running container.
+func (r *registry) Register(config Config, pid int, control *net.UnixConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.containers[config.Name] = runningContainer{
+		PID:     pid,
+		Config:  config,
+		Control: control,
+	}
+}
+
+// Unregister unregisters container.
+func (r *registry) Unregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.containers, name)
+}
+
+// Get returns running container.
+func (r *registry) Get(name string) (runningContainer, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, exists := r.containers[name]
+	if !exists {
+		return runningContainer{}, errors.Errorf("container %q is not running", name)
+	}
+	return c, nil
+}
@@ -0,0 +1,141 @@
+package container
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/outofforest/cloudless/pkg/host/nsexec"
+	"github.com/outofforest/logger"
+)
+
+func TestMain(m *testing.M) {
+	// Test binary is started as the agent of the fake container.
+	if nsexec.IsAgent() {
+		if err := nsexec.Agent(newContext()); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestRegistry(t *testing.T) {
+	requireT := require.New(t)
+
+	r := newRegistry()
+	_, err := r.Get("app")
+	requireT.Error(err)
+
+	r.Register(Config{Name: "app"}, 123, nil)
+	c, err := r.Get("app")
+	requireT.NoError(err)
+	requireT.Equal(123, c.PID)
+	requireT.Equal("app", c.Config.Name)
+
+	r.Unregister("app")
+	_, err = r.Get("app")
+	requireT.Error(err)
+}
+
+func TestExecEnv(t *testing.T) {
+	requireT := require.New(t)
+
+	t.Setenv("SECRET", "secret")
+	requireT.Equal([]string{
+		"PATH=" + execPath,
+		"HOME=/root",
+		"HOSTNAME=app",
+	}, execEnv(Config{Name: "app"}))
+
+	requireT.Error(Exec(context.Background(), "missing", exec.Command("/bin/true")))
+}
+
+func TestExecUserNamespace(t *testing.T) {
+	requireT := require.New(t)
+
+	const hostID = 100000
+
+	// Directories must be accessible by the user of the fake container.
+	dir := t.TempDir()
+	requireT.NoError(os.Chmod(filepath.Dir(dir), 0o755))
+	requireT.NoError(os.Chmod(dir, 0o777))
+
+	agentPath := filepath.Join(dir, "agent")
+	copyFile(t, agentPath)
+
+	control, containerControl, err := nsexec.NewControl()
+	requireT.NoError(err)
+	defer control.Close()
+
+	agent := exec.Command(agentPath)
+	agent.Env = []string{nsexec.EnvVar + "=1"}
+	agent.ExtraFiles = []*os.File{containerControl}
+	agent.SysProcAttr = &syscall.SysProcAttr{
+		Pdeathsig: syscall.SIGKILL,
+		Cloneflags: syscall.CLONE_NEWPID |
+			syscall.CLONE_NEWNS |
+			syscall.CLONE_NEWUSER |
+			syscall.CLONE_NEWUTS |
+			syscall.CLONE_NEWNET,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: hostID, Size: 65536}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: hostID, Size: 65536}},
+		Credential:  &syscall.Credential{Uid: 0, Gid: 0, NoSetGroups: true},
+	}
+	requireT.NoError(agent.Start())
+	_ = containerControl.Close()
+	defer func() {
+		_ = control.Close()
+		_ = agent.Wait()
+	}()
+
+	containers.Register(Config{Name: "app"}, agent.Process.Pid, control)
+	defer containers.Unregister("app")
+
+	file := filepath.Join(dir, "file")
+	requireT.NoError(Exec(newContext(), "app", exec.Command("touch", file)))
+
+	info, err := os.Stat(file)
+	requireT.NoError(err)
+	stat := info.Sys().(*syscall.Stat_t)
+	requireT.EqualValues(hostID, stat.Uid)
+	requireT.EqualValues(hostID, stat.Gid)
+
+	buf := &bytes.Buffer{}
+	cmd := exec.Command("id", "-u")
+	cmd.Stdout = buf
+	requireT.NoError(Exec(newContext(), "app", cmd))
+	requireT.Equal("0\n", buf.String())
+
+	requireT.Error(Exec(newContext(), "app", exec.Command("false")))
+}
+
+func newContext() context.Context {
+	return logger.WithLogger(context.Background(), zap.NewNop())
+}
+
+func copyFile(t *testing.T, dst string) {
+	requireT := require.New(t)
+
+	src, err := os.Executable()
+	requireT.NoError(err)
+
+	srcF, err := os.Open(src)
+	requireT.NoError(err)
+	defer srcF.Close()
+
+	dstF, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY, 0o755)
+	requireT.NoError(err)
+	defer dstF.Close()
+
+	_, err = io.Copy(dstF, srcF)
+	requireT.NoError(err)
+}
@@ -0,0 +1,211 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/outofforest/cloudless/pkg/eye/metrics"
+	"github.com/outofforest/libexec"
+	"github.com/outofforest/logger"
+	"github.com/outofforest/parallel"
+)
+
+const (
+	namespace    = "container"
+	subsystem    = "process"
+	labelProcess = "process"
+
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 5 * time.Second
+)
+
+var errUnhealthy = errors.New("process is unhealthy")
+
+// Probe checks if process running inside container is healthy.
+type Probe func(ctx context.Context) error
+
+// HealthCheckConfig represents health check configuration.
+type HealthCheckConfig struct {
+	// Probe is the function checking the health.
+	Probe Probe
+
+	// Interval is the time between consecutive probes.
+	Interval time.Duration
+
+	// Timeout is the maximum time single probe may take.
+	Timeout time.Duration
+
+	// Retries is the number of consecutive failed probes after which process is restarted.
+	Retries uint64
+}
+
+// HealthCheck configures health check restarting the process if it becomes unhealthy. Default interval and timeout
+// are used if zero values are passed.
+func HealthCheck(probe Probe, interval, timeout time.Duration, retries uint64) RunImageConfigurator {
+	return func(config *RunImageConfig) {
+		config.HealthCheck = newHealthCheckConfig(probe, interval, timeout, retries)
+	}
+}
+
+func newHealthCheckConfig(probe Probe, interval, timeout time.Duration, retries uint64) *HealthCheckConfig {
+	if interval == 0 {
+		interval = defaultHealthCheckInterval
+	}
+	if timeout == 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+	return &HealthCheckConfig{
+		Probe:    probe,
+		Interval: interval,
+		Timeout:  timeout,
+		Retries:  retries,
+	}
+}
+
+func validateHealthCheck(hc *HealthCheckConfig) error {
+	if hc == nil {
+		return nil
+	}
+	if hc.Probe == nil {
+		return errors.New("health check probe is not specified")
+	}
+	if hc.Interval <= 0 {
+		return errors.Errorf("invalid health check interval %s", hc.Interval)
+	}
+	if hc.Timeout <= 0 {
+		return errors.Errorf("invalid health check timeout %s", hc.Timeout)
+	}
+	return nil
+}
+
+// ExecProbe returns probe executing command inside container. Process is healthy if command exits with code 0.
+func ExecProbe(args ...string) Probe {
+	return func(ctx context.Context) error {
+		if len(args) == 0 {
+			return errors.New("no command specified")
+		}
+		out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+		if err != nil {
+			return errors.Wrapf(err, "health check command failed: %q", out)
+		}
+		return nil
+	}
+}
+
+// HTTPProbe returns probe sending GET request to the URL. Process is healthy if status code is 2xx or 3xx.
+func HTTPProbe(url string) Probe {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
+			return errors.Errorf("unexpected status code %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// TCPProbe returns probe connecting to the local TCP port. Process is healthy if connection is accepted.
+func TCPProbe(port uint16) Probe {
+	return func(ctx context.Context) error {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return errors.WithStack(conn.Close())
+	}
+}
+
+// runCommand runs the command and kills it if it becomes unhealthy. Command must be created with kill context,
+// canceling it kills the process.
+func runCommand(
+	ctx context.Context,
+	cmd *exec.Cmd,
+	kill context.CancelFunc,
+	hc *HealthCheckConfig,
+	set *metrics.Set,
+	process string,
+) error {
+	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		spawn("cmd", parallel.Exit, func(ctx context.Context) error {
+			return libexec.Exec(ctx, cmd)
+		})
+		if hc != nil {
+			spawn("healthCheck", parallel.Fail, func(ctx context.Context) error {
+				err := runHealthCheck(ctx, *hc, set, process)
+				if errors.Is(err, errUnhealthy) {
+					// Process might not respond to SIGTERM if it hangs.
+					kill()
+				}
+				return err
+			})
+		}
+		return nil
+	})
+}
+
+func runHealthCheck(ctx context.Context, hc HealthCheckConfig, set *metrics.Set, process string) error {
+	log := logger.Get(ctx)
+
+	// "Health of the container process".
+	mHealthy := set.GetOrCreateGauge(metrics.N(namespace, subsystem, "healthy"), metrics.L(labelProcess, process))
+
+	// Process is considered healthy until probes fail.
+	mHealthy.Set(1)
+
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+
+	var failures uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return errors.WithStack(ctx.Err())
+		case <-ticker.C:
+		}
+
+		err := func() error {
+			ctx, cancel := context.WithTimeout(ctx, hc.Timeout)
+			defer cancel()
+
+			return hc.Probe(ctx)
+		}()
+		if ctx.Err() != nil {
+			return errors.WithStack(ctx.Err())
+		}
+
+		if err == nil {
+			if failures > 0 {
+				log.Info("Container process is healthy")
+			}
+			failures = 0
+			mHealthy.Set(1)
+			continue
+		}
+
+		failures++
+		log.Warn("Container health check failed", zap.Uint64("failures", failures), zap.Error(err))
+		if failures < hc.Retries {
+			continue
+		}
+
+		mHealthy.Set(0)
+		log.Error("Container process is unhealthy, restarting", zap.Uint64("failures", failures))
+		return errors.WithStack(errUnhealthy)
+	}
+}
@@ -0,0 +1,98 @@
+package container
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/outofforest/cloudless/pkg/eye/metrics"
+	"github.com/outofforest/logger"
+)
+
+func newTestContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithCancel(logger.WithLogger(context.Background(), zap.NewNop()))
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestHealthCheckTransitions(t *testing.T) {
+	requireT := require.New(t)
+
+	set := metrics.NewSet()
+	mHealthy := set.GetOrCreateGauge(metrics.N(namespace, subsystem, "healthy"), metrics.L(labelProcess, "main"))
+
+	// Single failure is tolerated, two consecutive ones are not.
+	results := []error{nil, errors.New("failure"), nil, errors.New("failure"), errors.New("failure")}
+	var probes atomic.Int64
+	hc := newHealthCheckConfig(func(ctx context.Context) error {
+		n := probes.Add(1)
+		if n == 1 {
+			requireT.InDelta(1, mHealthy.Get(), 0)
+		}
+		return results[n-1]
+	}, 10*time.Millisecond, 0, 2)
+	requireT.Equal(defaultHealthCheckTimeout, hc.Timeout)
+
+	err := runHealthCheck(newTestContext(t), *hc, set, "main")
+	requireT.ErrorIs(err, errUnhealthy)
+	requireT.EqualValues(len(results), probes.Load())
+	requireT.InDelta(0, mHealthy.Get(), 0)
+}
+
+func TestHealthCheckRestartsProcess(t *testing.T) {
+	requireT := require.New(t)
+
+	startsFile := filepath.Join(t.TempDir(), "starts")
+	p := ProcessConfig{
+		Name:        mainProcess,
+		Args:        []string{"/bin/sh", "-c", "echo started >> " + startsFile + " && exec sleep 100"},
+		StreamLabel: mainProcess,
+		HealthCheck: newHealthCheckConfig(func(ctx context.Context) error {
+			return errors.New("failure")
+		}, 10*time.Millisecond, 0, 1),
+	}
+
+	ctx, cancel := context.WithCancel(newTestContext(t))
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- superviseProcess(ctx, p, metrics.NewSet())
+	}()
+
+	// Hanging process is killed and started again.
+	requireT.Eventually(func() bool {
+		starts, _ := os.ReadFile(startsFile)
+		return strings.Count(string(starts), "started") >= 2
+	}, 10*time.Second, 10*time.Millisecond)
+
+	cancel()
+	requireT.ErrorIs(<-errCh, context.Canceled)
+}
+
+func TestHealthCheckValidation(t *testing.T) {
+	requireT := require.New(t)
+
+	config := RunImageConfig{
+		Cmd: []string{"/bin/app"},
+	}
+	HealthCheck(TCPProbe(80), 0, 0, 3)(&config)
+	processes, err := processConfigs(config)
+	requireT.NoError(err)
+	requireT.Equal(defaultHealthCheckInterval, processes[0].HealthCheck.Interval)
+	requireT.Equal(defaultHealthCheckTimeout, processes[0].HealthCheck.Timeout)
+
+	config.HealthCheck.Interval = -time.Second
+	_, err = processConfigs(config)
+	requireT.Error(err)
+
+	config.HealthCheck = &HealthCheckConfig{Interval: time.Second, Timeout: time.Second}
+	_, err = processConfigs(config)
+	requireT.Error(err)
+}
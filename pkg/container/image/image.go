@@ -0,0 +1,358 @@
+package image
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/outofforest/cloudless/pkg/container/cache"
+	"github.com/outofforest/logger"
+)
+
+const (
+	manifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	configMediaType   = "application/vnd.oci.image.config.v1+json"
+	layerMediaType    = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+	// appDir is the directory where binary is stored inside image.
+	appDir = "app"
+)
+
+// baseFiles are the files of the minimal base layer shared by all the images.
+var baseFiles = map[string]string{
+	"etc/passwd": "root:x:0:0:root:/root:/sbin/nologin\n" +
+		"nobody:x:65534:65534:nobody:/nonexistent:/sbin/nologin\n",
+	"etc/group":         "root:x:0:\nnobody:x:65534:\n",
+	"etc/nsswitch.conf": "hosts: files dns\n",
+}
+
+// Config is the configuration of the image builder.
+type Config struct {
+	// Image is the name of the image, e.g. "cloudless/app".
+	Image string
+
+	// Binary is the path to the binary packaged into the image. It is built by the caller, e.g. by golang.Build
+	// of the build pipeline.
+	Binary string
+
+	// OutputDir is the directory where image is stored using the layout of the container cache.
+	OutputDir string
+
+	// Args are the arguments passed to the binary.
+	Args []string
+
+	// EnvVars are environment variables set in the image.
+	EnvVars map[string]string
+
+	// Files are additional files stored in the image. Key is the path inside the image, value is the local path.
+	Files map[string]string
+}
+
+// Build packages the binary into the OCI image stored in the layout of the container cache. The same binary
+// always produces the same image digest. Image reference pinned to the digest is returned, so it might be passed
+// to container.RunImage.
+func Build(ctx context.Context, config Config) (string, error) {
+	imageTag, err := writeImage(config)
+	if err != nil {
+		return "", err
+	}
+
+	logger.Get(ctx).Info("Image built", zap.String("image", imageTag))
+	return imageTag, nil
+}
+
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+type manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Config        descriptor   `json:"config"`
+	Layers        []descriptor `json:"layers"`
+}
+
+type imageConfig struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Config       struct {
+		Env        []string `json:"Env,omitempty"`
+		Entrypoint []string `json:"Entrypoint"`
+		Cmd        []string `json:"Cmd,omitempty"`
+		WorkingDir string   `json:"WorkingDir"`
+	} `json:"config"`
+	RootFS struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// layerEntry is the file or directory stored in the layer.
+type layerEntry struct {
+	// Dir is true if entry is a directory.
+	Dir bool
+
+	// Mode is the permission mode of the entry.
+	Mode int64
+
+	// Content is the content of the file.
+	Content []byte
+
+	// Source is the local file copied to the layer if set.
+	Source string
+}
+
+func writeImage(config Config) (string, error) {
+	if err := os.MkdirAll(config.OutputDir, 0o700); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	base := map[string]layerEntry{
+		"tmp": {Dir: true, Mode: 0o1777},
+	}
+	for p, content := range baseFiles {
+		base[p] = layerEntry{Mode: 0o644, Content: []byte(content)}
+	}
+
+	binPath := path.Join(appDir, filepath.Base(config.Binary))
+	app := map[string]layerEntry{
+		binPath: {Mode: 0o755, Source: config.Binary},
+	}
+	for p, source := range config.Files {
+		app[strings.TrimPrefix(path.Clean(p), "/")] = layerEntry{Mode: 0o644, Source: source}
+	}
+
+	var ic imageConfig
+	// Binary is expected to be built for the local architecture.
+	ic.Architecture = runtime.GOARCH
+	ic.OS = "linux"
+	ic.Config.Entrypoint = []string{"/" + binPath}
+	ic.Config.Cmd = config.Args
+	ic.Config.WorkingDir = "/"
+	for _, k := range slices.Sorted(maps.Keys(config.EnvVars)) {
+		ic.Config.Env = append(ic.Config.Env, fmt.Sprintf("%s=%s", k, config.EnvVars[k]))
+	}
+	ic.RootFS.Type = "layers"
+
+	m := manifest{
+		SchemaVersion: 2,
+		MediaType:     manifestMediaType,
+	}
+	for _, entries := range []map[string]layerEntry{base, app} {
+		layer, diffID, err := writeLayer(config, entries)
+		if err != nil {
+			return "", err
+		}
+		m.Layers = append(m.Layers, layer)
+		ic.RootFS.DiffIDs = append(ic.RootFS.DiffIDs, diffID)
+	}
+
+	var err error
+	m.Config, err = writeJSONBlob(config, configMediaType, ic)
+	if err != nil {
+		return "", err
+	}
+	manifestDesc, err := writeJSONBlob(config, manifestMediaType, m)
+	if err != nil {
+		return "", err
+	}
+
+	imageTag := config.Image + "@" + manifestDesc.Digest
+	manifestFile, err := cache.ManifestFile(imageTag)
+	if err != nil {
+		return "", err
+	}
+	blobFile, err := cache.BlobFile(imageTag, manifestDesc.Digest)
+	if err != nil {
+		return "", err
+	}
+	if err := copyFile(filepath.Join(config.OutputDir, blobFile),
+		filepath.Join(config.OutputDir, manifestFile)); err != nil {
+		return "", err
+	}
+
+	return imageTag, nil
+}
+
+// writeLayer writes reproducible layer containing the entries and returns its descriptor and diff ID.
+func writeLayer(config Config, entries map[string]layerEntry) (descriptor, string, error) {
+	entries = withParentDirs(entries)
+
+	f, err := os.CreateTemp(config.OutputDir, "layer-*.tmp")
+	if err != nil {
+		return descriptor{}, "", errors.WithStack(err)
+	}
+	defer os.Remove(f.Name()) //nolint:errcheck
+	defer f.Close()
+
+	digestHasher := sha256.New()
+	diffIDHasher := sha256.New()
+	counter := &countingWriter{}
+
+	gzW, err := gzip.NewWriterLevel(io.MultiWriter(f, digestHasher, counter), gzip.BestCompression)
+	if err != nil {
+		return descriptor{}, "", errors.WithStack(err)
+	}
+	tarW := tar.NewWriter(io.MultiWriter(gzW, diffIDHasher))
+
+	for _, p := range slices.Sorted(maps.Keys(entries)) {
+		if err := writeEntry(tarW, p, entries[p]); err != nil {
+			return descriptor{}, "", err
+		}
+	}
+
+	if err := tarW.Close(); err != nil {
+		return descriptor{}, "", errors.WithStack(err)
+	}
+	if err := gzW.Close(); err != nil {
+		return descriptor{}, "", errors.WithStack(err)
+	}
+	if err := f.Close(); err != nil {
+		return descriptor{}, "", errors.WithStack(err)
+	}
+
+	layer := descriptor{
+		MediaType: layerMediaType,
+		Digest:    digest(digestHasher),
+		Size:      counter.size,
+	}
+	if err := storeBlob(config, f.Name(), layer.Digest); err != nil {
+		return descriptor{}, "", err
+	}
+	return layer, digest(diffIDHasher), nil
+}
+
+func writeEntry(w *tar.Writer, p string, entry layerEntry) error {
+	header := &tar.Header{
+		Name:     p,
+		Mode:     entry.Mode,
+		ModTime:  time.Unix(0, 0),
+		Typeflag: tar.TypeReg,
+		Format:   tar.FormatPAX,
+	}
+	if entry.Dir {
+		header.Name += "/"
+		header.Typeflag = tar.TypeDir
+		return errors.WithStack(w.WriteHeader(header))
+	}
+
+	if entry.Source == "" {
+		header.Size = int64(len(entry.Content))
+		if err := w.WriteHeader(header); err != nil {
+			return errors.WithStack(err)
+		}
+		_, err := w.Write(entry.Content)
+		return errors.WithStack(err)
+	}
+
+	f, err := os.Open(entry.Source)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	header.Size = info.Size()
+	if err := w.WriteHeader(header); err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = io.Copy(w, f)
+	return errors.WithStack(err)
+}
+
+// withParentDirs adds entries for parent directories missing in the layer.
+func withParentDirs(entries map[string]layerEntry) map[string]layerEntry {
+	result := maps.Clone(entries)
+	for p := range entries {
+		for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+			if _, exists := result[dir]; !exists {
+				result[dir] = layerEntry{Dir: true, Mode: 0o755}
+			}
+		}
+	}
+	return result
+}
+
+func writeJSONBlob(config Config, mediaType string, v any) (descriptor, error) {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return descriptor{}, errors.WithStack(err)
+	}
+
+	f, err := os.CreateTemp(config.OutputDir, "blob-*.tmp")
+	if err != nil {
+		return descriptor{}, errors.WithStack(err)
+	}
+	defer os.Remove(f.Name()) //nolint:errcheck
+	defer f.Close()
+
+	if _, err := f.Write(content); err != nil {
+		return descriptor{}, errors.WithStack(err)
+	}
+	if err := f.Close(); err != nil {
+		return descriptor{}, errors.WithStack(err)
+	}
+
+	hash := sha256.Sum256(content)
+	desc := descriptor{
+		MediaType: mediaType,
+		Digest:    "sha256:" + hex.EncodeToString(hash[:]),
+		Size:      int64(len(content)),
+	}
+	return desc, storeBlob(config, f.Name(), desc.Digest)
+}
+
+func storeBlob(config Config, file, digest string) error {
+	blobFile, err := cache.BlobFile(config.Image+"@"+digest, digest)
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(os.Rename(file, filepath.Join(config.OutputDir, blobFile)))
+}
+
+func copyFile(src, dst string) error {
+	content, err := os.ReadFile(src)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmp := dst + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o600); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp, dst))
+}
+
+func digest(h hash.Hash) string {
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+type countingWriter struct {
+	size int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.size += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,61 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/outofforest/cloudless/pkg/container/cache"
+	"github.com/outofforest/logger"
+)
+
+func TestBuildReproducible(t *testing.T) {
+	ctx := logger.WithLogger(context.Background(), zap.NewNop())
+	binFile := filepath.Join(t.TempDir(), "app")
+	require.NoError(t, os.WriteFile(binFile, []byte("binary"), 0o700))
+
+	config := Config{
+		Image:  "cloudless/app",
+		Binary: binFile,
+		Args:   []string{"--flag"},
+		EnvVars: map[string]string{
+			"B": "b",
+			"A": "a",
+		},
+	}
+
+	config.OutputDir = t.TempDir()
+	imageTag1, err := Build(ctx, config)
+	require.NoError(t, err)
+
+	config.OutputDir = t.TempDir()
+	imageTag2, err := Build(ctx, config)
+	require.NoError(t, err)
+	require.Equal(t, imageTag1, imageTag2)
+
+	manifestFile, err := cache.ManifestFile(imageTag2)
+	require.NoError(t, err)
+	content, err := os.ReadFile(filepath.Join(config.OutputDir, manifestFile))
+	require.NoError(t, err)
+
+	var m cache.Manifest
+	require.NoError(t, json.Unmarshal(content, &m))
+	require.Len(t, m.Layers, 2)
+	for _, d := range append([]cache.Descriptor{m.Config}, m.Layers...) {
+		blobFile, err := cache.BlobFile(imageTag2, d.Digest)
+		require.NoError(t, err)
+
+		verifier, err := cache.NewVerifier(d.Digest)
+		require.NoError(t, err)
+		content, err := os.ReadFile(filepath.Join(config.OutputDir, blobFile))
+		require.NoError(t, err)
+		_, err = verifier.Write(content)
+		require.NoError(t, err)
+		require.NoError(t, verifier.Verify())
+	}
+}
@@ -0,0 +1,420 @@
+package container
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+
+	"github.com/outofforest/cloudless"
+	"github.com/outofforest/cloudless/pkg/container/cache"
+	"github.com/outofforest/cloudless/pkg/retry"
+	"github.com/outofforest/logger"
+)
+
+const (
+	// layersDir is the directory where image layers are stored. It is shared by all the containers and mounted
+	// read-only into them.
+	layersDir = cloudless.BaseDir + "/layers"
+
+	// layersWritableDir is the writable view of the layer store used by the container to extract layers.
+	// It is unmounted before processes of the container are started.
+	layersWritableDir = cloudless.BaseDir + "/layers-writable"
+
+	layersTmpDir = "tmp"
+
+	opaqueXAttr = "user.overlay.opaque"
+)
+
+// layerStore keeps layers extracted from image blobs.
+type layerStore struct {
+	// Dir is the directory layers are read from.
+	Dir string
+
+	// WritableDir is the writable view of the same directory, used to extract layers.
+	WritableDir string
+}
+
+// LayerDir returns directory where layer is extracted.
+func (ls layerStore) LayerDir(digest string) string {
+	return layerDir(ls.Dir, digest)
+}
+
+// Install extracts layers of the image missing in the layer store.
+func (ls layerStore) Install(ctx context.Context, imageTag string, m cache.Manifest, mirrors []string) error {
+	for _, layer := range m.Layers {
+		if !cache.IsDigest(layer.Digest) {
+			return errors.Errorf("invalid layer digest %q", layer.Digest)
+		}
+
+		_, err := os.Stat(ls.LayerDir(layer.Digest))
+		switch {
+		case err == nil:
+			continue
+		case !os.IsNotExist(err):
+			return errors.WithStack(err)
+		}
+
+		if err := ls.installLayer(ctx, imageTag, layer.Digest, layer.MediaType, mirrors); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// installLayer downloads the blob, verifies it and only then extracts it into the temporary directory, which is
+// moved to the store once layer is complete.
+func (ls layerStore) installLayer(ctx context.Context, imageTag, digest, mediaType string, mirrors []string) error {
+	blobFile, err := cache.BlobFile(imageTag, digest)
+	if err != nil {
+		return err
+	}
+
+	tmpDir := filepath.Join(ls.WritableDir, layersTmpDir)
+	if err := os.MkdirAll(tmpDir, 0o700); err != nil {
+		return errors.WithStack(err)
+	}
+	f, err := os.CreateTemp(tmpDir, "blob-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := retry.Do(ctx, retry.FixedConfig{RetryAfter: 5 * time.Second, MaxAttempts: 10}, func() error {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return errors.WithStack(err)
+		}
+		if err := f.Truncate(0); err != nil {
+			return errors.WithStack(err)
+		}
+
+		mirror, err := selectMirror(mirrors)
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, mirror+"/"+blobFile, nil)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return retry.Retriable(errors.WithStack(err))
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return retry.Retriable(errors.Errorf("unexpected status code %d", resp.StatusCode))
+		}
+
+		verifier, err := cache.NewVerifier(digest)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, io.TeeReader(resp.Body, verifier)); err != nil {
+			return retry.Retriable(errors.WithStack(err))
+		}
+		return retry.Retriable(verifier.Verify())
+	}); err != nil {
+		return err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return errors.WithStack(err)
+	}
+
+	layerTmpDir, err := os.MkdirTemp(tmpDir, "layer-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.RemoveAll(layerTmpDir)
+
+	if err := inflateBlob(f, mediaType, layerTmpDir); err != nil {
+		return err
+	}
+
+	dir := layerDir(ls.WritableDir, digest)
+	if err := os.MkdirAll(filepath.Dir(dir), 0o700); err != nil {
+		return errors.WithStack(err)
+	}
+
+	// Layer might be extracted by another container in the meantime.
+	if err := os.Rename(layerTmpDir, dir); err != nil && !errors.Is(err, unix.EEXIST) &&
+		!errors.Is(err, unix.ENOTEMPTY) {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// CollectGarbage removes layers not used by images installed in containers. It must be called when containers are
+// not running, so layers being extracted are not removed.
+func (ls layerStore) CollectGarbage(ctx context.Context, containersDir string) error {
+	log := logger.Get(ctx)
+
+	if err := os.RemoveAll(filepath.Join(ls.WritableDir, layersTmpDir)); err != nil {
+		return errors.WithStack(err)
+	}
+
+	live := map[string]struct{}{}
+	icFiles, err := filepath.Glob(filepath.Join(containersDir, "*", containerRootDir, overlayDir, "*"))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, icFile := range icFiles {
+		info, err := os.Lstat(icFile)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		icRaw, err := os.ReadFile(icFile)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		var ii installedImage
+		if err := json.Unmarshal(icRaw, &ii); err != nil {
+			// Files left after interrupted installation are ignored.
+			continue
+		}
+		for _, layer := range ii.Manifest.Layers {
+			live[layerDir(ls.WritableDir, layer.Digest)] = struct{}{}
+		}
+	}
+
+	algorithms, err := os.ReadDir(ls.WritableDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.WithStack(err)
+	}
+	for _, algorithm := range algorithms {
+		if !algorithm.IsDir() {
+			continue
+		}
+		layers, err := os.ReadDir(filepath.Join(ls.WritableDir, algorithm.Name()))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		for _, layer := range layers {
+			dir := filepath.Join(ls.WritableDir, algorithm.Name(), layer.Name())
+			if _, exists := live[dir]; exists {
+				continue
+			}
+
+			log.Info("Removing unused layer", zap.String("layer", algorithm.Name()+":"+layer.Name()))
+			if err := os.RemoveAll(dir); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+	return nil
+}
+
+// sealLayers unmounts the writable view of the layer store, so processes of the container can't modify layers.
+func sealLayers() error {
+	// Image might be installed and run by the same container, so the store might be mounted more than once.
+	for {
+		if err := unix.Unmount(layersWritableDir, unix.MNT_DETACH); err != nil {
+			if errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOENT) {
+				return nil
+			}
+			return errors.WithStack(err)
+		}
+	}
+}
+
+// layerDir returns directory where layer is extracted.
+func layerDir(dir, digest string) string {
+	algorithm, hash, _ := strings.Cut(digest, ":")
+	return filepath.Join(dir, algorithm, hash)
+}
+
+// inflateBlob extracts layer into the directory. Whiteouts are converted to the format understood by overlayfs.
+// Paths are resolved inside the directory, so symlinks coming from the archive can't be used to write outside.
+//
+//nolint:gocyclo
+func inflateBlob(r io.Reader, mediaType, dir string) error {
+	dr, err := decompress(r, mediaType)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer root.Close()
+
+	tr := tar.NewReader(dr)
+	for {
+		header, err := tr.Next()
+		switch {
+		case errors.Is(err, io.EOF):
+			return nil
+		case err != nil:
+			return errors.WithStack(err)
+		case header == nil:
+			continue
+		}
+
+		absPath := filepath.Join("/", header.Name)
+		if _, exists := protectedFiles[absPath]; exists {
+			continue
+		}
+		if absPath == "/" {
+			continue
+		}
+		path := absPath[1:]
+		parent, base := filepath.Dir(path), filepath.Base(path)
+
+		// We take mode from header.FileInfo().Mode(), not from header.Mode because they may be in different formats
+		// (meaning of bits may be different). header.FileInfo().Mode() returns compatible value.
+		mode := header.FileInfo().Mode()
+
+		switch {
+		case base == ".wh..wh..plnk":
+			// just ignore this
+			continue
+		case base == ".wh..wh..opq":
+			// It means that content in this directory created by earlier layers should not be visible.
+			if err := root.MkdirAll(parent, 0o755); err != nil {
+				return errors.WithStack(err)
+			}
+			if err := withDir(root, parent, func(fd int) error {
+				return unix.Fsetxattr(fd, opaqueXAttr, []byte("y"), 0)
+			}); err != nil {
+				return err
+			}
+			continue
+		case strings.HasPrefix(base, ".wh."):
+			// File deleted by the layer is represented by character device with 0/0 device number.
+			toDelete := filepath.Join(parent, strings.TrimPrefix(base, ".wh."))
+			if err := root.RemoveAll(toDelete); err != nil {
+				return errors.WithStack(err)
+			}
+			if err := root.MkdirAll(parent, 0o755); err != nil {
+				return errors.WithStack(err)
+			}
+			if err := withDir(root, parent, func(fd int) error {
+				return unix.Mknodat(fd, filepath.Base(toDelete), unix.S_IFCHR, 0)
+			}); err != nil {
+				return err
+			}
+			continue
+		case header.Typeflag == tar.TypeDir:
+			if err := root.MkdirAll(path, mode.Perm()); err != nil {
+				return errors.WithStack(err)
+			}
+		case header.Typeflag == tar.TypeReg:
+			if err := removeFile(root, path); err != nil {
+				return err
+			}
+			f, err := root.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, mode.Perm())
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			_, err = io.Copy(f, tr)
+			_ = f.Close()
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		case header.Typeflag == tar.TypeSymlink:
+			if err := removeFile(root, path); err != nil {
+				return err
+			}
+			// Symlink is created, but never followed during extraction, so its target might be absolute.
+			if err := withDir(root, parent, func(fd int) error {
+				return unix.Symlinkat(header.Linkname, fd, base)
+			}); err != nil {
+				return err
+			}
+		case header.Typeflag == tar.TypeLink:
+			linkPath := filepath.Join("/", header.Linkname)[1:]
+
+			// linked file may not exist yet, so let's create it - it will be overwritten later
+			if err := root.MkdirAll(filepath.Dir(linkPath), 0o700); err != nil {
+				return errors.WithStack(err)
+			}
+			f, err := root.OpenFile(linkPath, os.O_CREATE|os.O_EXCL, mode.Perm())
+			if err != nil {
+				if !os.IsExist(err) {
+					return errors.WithStack(err)
+				}
+			} else {
+				_ = f.Close()
+			}
+			if err := removeFile(root, path); err != nil {
+				return err
+			}
+			if err := root.Link(linkPath, path); err != nil {
+				return errors.WithStack(err)
+			}
+		default:
+			return errors.Errorf("unsupported file type: %d", header.Typeflag)
+		}
+
+		if err := root.Lchown(path, header.Uid, header.Gid); err != nil {
+			return errors.WithStack(err)
+		}
+
+		// Unless CAP_FSETID capability is set for the process every operation modifying the file/dir will reset
+		// setuid, setgid nd sticky bits. After saving those files/dirs the mode has to be set once again to set those
+		// bits. This has to be the last operation on the file/dir.
+		// On linux mode is not supported for symlinks, mode is always taken from target location.
+		if header.Typeflag != tar.TypeSymlink {
+			if err := root.Chmod(path, mode); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+}
+
+// withDir opens directory inside root and passes its descriptor to the function.
+func withDir(root *os.Root, dir string, fn func(fd int) error) error {
+	d, err := root.Open(dir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer d.Close()
+
+	info, err := d.Stat()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if !info.IsDir() {
+		return errors.Errorf("%s is not a directory", dir)
+	}
+	return errors.WithStack(fn(int(d.Fd())))
+}
+
+// removeFile removes file existing in the path, so it is replaced instead of being followed if it is a symlink.
+func removeFile(root *os.Root, path string) error {
+	info, err := root.Lstat(path)
+	switch {
+	case err == nil:
+	case errors.Is(err, fs.ErrNotExist):
+		return nil
+	default:
+		return errors.WithStack(err)
+	}
+	if info.IsDir() {
+		return errors.Errorf("directory %s can't be replaced by file", path)
+	}
+	return errors.WithStack(root.Remove(path))
+}
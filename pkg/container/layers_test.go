@@ -0,0 +1,213 @@
+package container
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/outofforest/cloudless/pkg/container/cache"
+)
+
+const testImageTag = "registry.example.com/image@latest"
+
+type tarEntry struct {
+	Header  tar.Header
+	Content string
+}
+
+func newTar(t *testing.T, entries ...tarEntry) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		e.Header.Size = int64(len(e.Content))
+		if e.Header.Mode == 0 {
+			e.Header.Mode = 0o644
+		}
+		require.NoError(t, tw.WriteHeader(&e.Header))
+		_, err := tw.Write([]byte(e.Content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func testDigest(content []byte) string {
+	hash := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(hash[:])
+}
+
+func TestInflateBlob(t *testing.T) {
+	requireT := require.New(t)
+
+	dir := t.TempDir()
+	requireT.NoError(os.MkdirAll(filepath.Join(dir, "dir"), 0o755))
+	requireT.NoError(os.WriteFile(filepath.Join(dir, "dir", "deleted"), nil, 0o644))
+
+	requireT.NoError(inflateBlob(bytes.NewReader(newTar(t,
+		tarEntry{Header: tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0o755}},
+		tarEntry{Header: tar.Header{Name: "dir/file", Typeflag: tar.TypeReg}, Content: "content"},
+		tarEntry{Header: tar.Header{Name: "dir/hardlink", Typeflag: tar.TypeLink, Linkname: "dir/file"}},
+		tarEntry{Header: tar.Header{Name: "dir/symlink", Typeflag: tar.TypeSymlink, Linkname: "/dir/file"}},
+		tarEntry{Header: tar.Header{Name: "dir/.wh.deleted", Typeflag: tar.TypeReg}},
+		tarEntry{Header: tar.Header{Name: "etc/hosts", Typeflag: tar.TypeReg}, Content: "protected"},
+	)), "application/vnd.oci.image.layer.v1.tar", dir))
+
+	content, err := os.ReadFile(filepath.Join(dir, "dir", "hardlink"))
+	requireT.NoError(err)
+	requireT.Equal("content", string(content))
+
+	target, err := os.Readlink(filepath.Join(dir, "dir", "symlink"))
+	requireT.NoError(err)
+	requireT.Equal("/dir/file", target)
+
+	var stat unix.Stat_t
+	requireT.NoError(unix.Lstat(filepath.Join(dir, "dir", "deleted"), &stat))
+	requireT.EqualValues(unix.S_IFCHR, stat.Mode&unix.S_IFMT)
+	requireT.Zero(stat.Rdev)
+
+	_, err = os.Stat(filepath.Join(dir, "etc", "hosts"))
+	requireT.True(os.IsNotExist(err))
+}
+
+func TestInflateBlobDoesNotFollowSymlinks(t *testing.T) {
+	requireT := require.New(t)
+
+	outsideDir := t.TempDir()
+	outsideFile := filepath.Join(outsideDir, "file")
+	requireT.NoError(os.WriteFile(outsideFile, []byte("outside"), 0o644))
+
+	// File replacing the symlink must not overwrite its target.
+	dir := t.TempDir()
+	requireT.NoError(inflateBlob(bytes.NewReader(newTar(t,
+		tarEntry{Header: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: outsideFile}},
+		tarEntry{Header: tar.Header{Name: "link", Typeflag: tar.TypeReg}, Content: "inside"},
+	)), "application/vnd.oci.image.layer.v1.tar", dir))
+
+	content, err := os.ReadFile(filepath.Join(dir, "link"))
+	requireT.NoError(err)
+	requireT.Equal("inside", string(content))
+
+	// Symlinked directory must not be used to write outside.
+	for _, entries := range [][]tarEntry{
+		{
+			{Header: tar.Header{Name: "dir", Typeflag: tar.TypeSymlink, Linkname: outsideDir}},
+			{Header: tar.Header{Name: "dir/file", Typeflag: tar.TypeReg}, Content: "inside"},
+		},
+		{
+			{Header: tar.Header{Name: "dir", Typeflag: tar.TypeSymlink, Linkname: outsideDir}},
+			{Header: tar.Header{Name: "dir/.wh.file", Typeflag: tar.TypeReg}},
+		},
+		{
+			{Header: tar.Header{Name: "dir", Typeflag: tar.TypeSymlink, Linkname: "../../../../../../" + outsideDir}},
+			{Header: tar.Header{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "dir/file"}},
+		},
+	} {
+		requireT.Error(inflateBlob(bytes.NewReader(newTar(t, entries...)), "application/vnd.oci.image.layer.v1.tar",
+			t.TempDir()))
+	}
+
+	content, err = os.ReadFile(outsideFile)
+	requireT.NoError(err)
+	requireT.Equal("outside", string(content))
+}
+
+func TestInstallLayer(t *testing.T) {
+	requireT := require.New(t)
+
+	blob := newTar(t, tarEntry{Header: tar.Header{Name: "file", Typeflag: tar.TypeReg}, Content: "content"})
+	validDigest := testDigest(blob)
+	invalidDigest := testDigest([]byte("other"))
+
+	mux := http.NewServeMux()
+	for _, digest := range []string{validDigest, invalidDigest} {
+		blobFile, err := cache.BlobFile(testImageTag, digest)
+		requireT.NoError(err)
+		mux.HandleFunc("/"+blobFile, func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write(blob)
+		})
+	}
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	dir := t.TempDir()
+	ls := layerStore{Dir: dir, WritableDir: dir}
+
+	m := cache.Manifest{
+		Layers: []cache.Descriptor{{MediaType: "application/vnd.oci.image.layer.v1.tar", Digest: validDigest}},
+	}
+	requireT.NoError(ls.Install(newTestContext(t), testImageTag, m, []string{server.URL}))
+	content, err := os.ReadFile(filepath.Join(ls.LayerDir(validDigest), "file"))
+	requireT.NoError(err)
+	requireT.Equal("content", string(content))
+
+	// Blob not matching the digest is never extracted.
+	ctx, cancel := context.WithTimeout(newTestContext(t), time.Second)
+	defer cancel()
+
+	m.Layers[0].Digest = invalidDigest
+	requireT.Error(ls.Install(ctx, testImageTag, m, []string{server.URL}))
+	_, err = os.Stat(ls.LayerDir(invalidDigest))
+	requireT.True(os.IsNotExist(err))
+
+	tmpFiles, err := os.ReadDir(filepath.Join(dir, layersTmpDir))
+	requireT.NoError(err)
+	requireT.Empty(tmpFiles)
+}
+
+func TestLayerStoreCollectGarbage(t *testing.T) {
+	requireT := require.New(t)
+
+	containersDir := t.TempDir()
+	dir := t.TempDir()
+	ls := layerStore{Dir: dir, WritableDir: dir}
+
+	liveDigest := testDigest([]byte("live"))
+	staleDigest := testDigest([]byte("stale"))
+	for _, digest := range []string{liveDigest, staleDigest} {
+		requireT.NoError(os.MkdirAll(ls.LayerDir(digest), 0o700))
+	}
+	requireT.NoError(os.MkdirAll(filepath.Join(dir, layersTmpDir, "layer-1"), 0o700))
+
+	icRaw, err := json.Marshal(installedImage{
+		Manifest: cache.Manifest{
+			Layers: []cache.Descriptor{{Digest: liveDigest}},
+		},
+	})
+	requireT.NoError(err)
+	icFile := icFileName(filepath.Join(containersDir, "container", containerRootDir), testImageTag)
+	requireT.NoError(os.MkdirAll(filepath.Dir(icFile), 0o700))
+	requireT.NoError(os.WriteFile(icFile, icRaw, 0o600))
+
+	requireT.NoError(ls.CollectGarbage(newTestContext(t), containersDir))
+
+	_, err = os.Stat(ls.LayerDir(liveDigest))
+	requireT.NoError(err)
+	_, err = os.Stat(ls.LayerDir(staleDigest))
+	requireT.True(os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, layersTmpDir))
+	requireT.True(os.IsNotExist(err))
+
+	// Missing store is not an error.
+	requireT.NoError(layerStore{Dir: filepath.Join(dir, "missing"), WritableDir: filepath.Join(dir, "missing")}.
+		CollectGarbage(newTestContext(t), containersDir))
+}
+
+func TestICFileName(t *testing.T) {
+	requireT := require.New(t)
+
+	requireT.Equal("/.overlay/registry.example.com-image@latest", icFileName("/", testImageTag))
+	requireT.Equal(containersDir+"/container/root/.overlay/registry.example.com-image@latest",
+		icFileName(filepath.Join(containersDir, "container", containerRootDir), testImageTag))
+}
@@ -2,61 +2,259 @@ package container
 
 import (
 	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/pkg/errors"
+	vmetrics "github.com/VictoriaMetrics/metrics"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/outofforest/cloudless/pkg/eye/metrics"
 )
 
-const maxCapacity = 4 * 1024
+const (
+	// maxCapacity is the maximum length of the single line.
+	maxCapacity = 4 * 1024
+
+	// maxRecordSize is the maximum length of the record built by joining multiple lines.
+	maxRecordSize = 64 * 1024
+
+	// flushTimeout is the time after which pending record is logged if no more lines arrive.
+	flushTimeout = 100 * time.Millisecond
+
+	// logRate is the number of records per second process may log on average.
+	logRate = 100
+
+	// logBurst is the number of records process may log at once.
+	logBurst = 1000
+
+	subsystemLogs = "logs"
+	labelStream   = "stream"
+	fieldPrefix   = "app_"
+
+	// Keys of the log labels used to split output of processes into separate streams.
+	logLabelContainer = "cloudless_container"
+	logLabelProcess   = "cloudless_process"
+	logLabelStream    = "cloudless_stream"
+)
 
-func newStreamLogger(log *zap.Logger) *streamLogger {
-	return &streamLogger{
-		log: log,
-		buf: make([]byte, 0, maxCapacity),
+var (
+	messageKeys = []string{"msg", "message"}
+	levelKeys   = []string{"level", "severity"}
+
+	// Fields which can't be overwritten by fields parsed from JSON records, because logger or log sender use them.
+	reservedFields = map[string]struct{}{
+		"box":             {},
+		"process":         {},
+		logLabelContainer: {},
+		logLabelProcess:   {},
+		logLabelStream:    {},
+		"level":           {},
+		"ts":              {},
+		"logger":          {},
+		"msg":             {},
+		"caller":          {},
+		"stacktrace":      {},
 	}
+
+	// Prefixes of lines starting the stack trace which is continued until process exits.
+	tracePrefixes = []string{"panic: ", "fatal error: "}
+)
+
+// newStreamLogger returns writer logging output of the process. Lines are joined into multi-line records if they
+// belong to the stack trace, JSON records are parsed into fields and records are rate-limited.
+func newStreamLogger(log *zap.Logger, set *metrics.Set, process, stream string) *streamLogger {
+	sl := &streamLogger{
+		log: log.With(zap.String(logLabelProcess, process), zap.String(logLabelStream, stream)),
+		// "Number of log records dropped because process logged too much".
+		mDropped: set.GetOrCreateCounter(metrics.N(namespace, subsystemLogs, "dropped"),
+			metrics.L(labelProcess, process), metrics.L(labelStream, stream)),
+		buf:        make([]byte, 0, maxCapacity),
+		tokens:     logBurst,
+		lastRefill: time.Now(),
+	}
+	sl.timer = time.AfterFunc(flushTimeout, sl.Flush)
+	sl.timer.Stop()
+	return sl
 }
 
 type streamLogger struct {
-	log *zap.Logger
-	buf []byte
+	log      *zap.Logger
+	mDropped *vmetrics.Counter
+
+	mu         sync.Mutex
+	buf        []byte
+	record     []byte
+	trace      bool
+	timer      *time.Timer
+	tokens     float64
+	lastRefill time.Time
+	dropped    uint64
 }
 
 func (sl *streamLogger) Write(data []byte) (int, error) {
-	if len(data) == 0 {
-		return 0, nil
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	for remaining := data; len(remaining) > 0; {
+		pos := bytes.IndexByte(remaining, '\n')
+		newLine := pos >= 0
+		if !newLine {
+			pos = len(remaining)
+		}
+		if len(sl.buf)+pos > maxCapacity {
+			pos = maxCapacity - len(sl.buf)
+			newLine = true
+		}
+
+		sl.buf = append(sl.buf, remaining[:pos]...)
+		remaining = remaining[pos:]
+		if len(remaining) > 0 && remaining[0] == '\n' {
+			remaining = remaining[1:]
+		}
+
+		if newLine {
+			sl.addLine(sl.buf)
+			sl.buf = sl.buf[:0]
+		}
 	}
 
-	var dataRecord, dataReminder []byte
-	var newRecord bool
-	pos := bytes.IndexByte(data, '\n')
-	if pos < 0 {
-		pos = len(data)
+	if len(sl.buf) > 0 || len(sl.record) > 0 {
+		sl.timer.Reset(flushTimeout)
 	} else {
-		newRecord = true
+		sl.timer.Stop()
 	}
 
-	if len(sl.buf)+pos > maxCapacity {
-		pos = maxCapacity - len(sl.buf)
-		newRecord = true
+	return len(data), nil
+}
+
+// Flush logs the pending record.
+func (sl *streamLogger) Flush() {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	if len(sl.buf) > 0 {
+		sl.addLine(sl.buf)
+		sl.buf = sl.buf[:0]
 	}
-	dataRecord = data[:pos]
-	dataReminder = data[pos:]
-	if len(dataReminder) > 0 && dataReminder[0] == '\n' {
-		dataReminder = dataReminder[1:]
+	sl.emit()
+	sl.trace = false
+}
+
+func (sl *streamLogger) addLine(line []byte) {
+	if len(sl.record) > 0 && len(sl.record)+len(line)+1 <= maxRecordSize && (sl.trace || isContinuation(line)) {
+		sl.record = append(append(sl.record, '\n'), line...)
+		return
 	}
 
-	sl.buf = append(sl.buf, dataRecord...)
+	if len(bytes.TrimSpace(line)) == 0 {
+		return
+	}
 
-	if newRecord {
-		sl.log.Info(string(sl.buf))
-		sl.buf = sl.buf[:0]
+	sl.emit()
+	sl.record = append(sl.record, line...)
+	sl.trace = false
+	for _, prefix := range tracePrefixes {
+		if bytes.HasPrefix(line, []byte(prefix)) {
+			sl.trace = true
+			break
+		}
+	}
+}
+
+func (sl *streamLogger) emit() {
+	if len(sl.record) == 0 {
+		return
+	}
+	defer func() {
+		sl.record = sl.record[:0]
+	}()
+
+	now := time.Now()
+	sl.tokens = min(logBurst, sl.tokens+now.Sub(sl.lastRefill).Seconds()*logRate)
+	sl.lastRefill = now
+	if sl.tokens < 1 {
+		sl.dropped++
+		sl.mDropped.Inc()
+		return
+	}
+	sl.tokens--
+
+	if sl.dropped > 0 {
+		sl.log.Warn("Log records dropped", zap.Uint64("count", sl.dropped))
+		sl.dropped = 0
+	}
+
+	level, message, fields := parseRecord(sl.record)
+	if ce := sl.log.Check(level, message); ce != nil {
+		ce.Write(fields...)
+	}
+}
+
+func isContinuation(line []byte) bool {
+	return len(line) > 0 && (line[0] == ' ' || line[0] == '\t' || bytes.HasPrefix(line, []byte("Caused by:")))
+}
+
+// parseRecord parses JSON record into fields. Records which are not JSON objects are logged as they are.
+func parseRecord(record []byte) (zapcore.Level, string, []zap.Field) {
+	if record[0] != '{' {
+		return zapcore.InfoLevel, string(record), nil
 	}
 
-	if len(dataReminder) > 0 {
-		if _, err := sl.Write(dataReminder); err != nil {
-			return 0, errors.WithStack(err)
+	var data map[string]any
+	if err := json.Unmarshal(record, &data); err != nil {
+		return zapcore.InfoLevel, string(record), nil
+	}
+
+	message := ""
+	for _, k := range messageKeys {
+		if v, ok := data[k].(string); ok {
+			message = v
+			delete(data, k)
+			break
 		}
 	}
 
-	return len(data), nil
+	level := zapcore.InfoLevel
+	for _, k := range levelKeys {
+		if v, ok := data[k].(string); ok {
+			level = parseLevel(v)
+			delete(data, k)
+			break
+		}
+	}
+
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fields := make([]zap.Field, 0, len(keys))
+	for _, k := range keys {
+		name := k
+		if _, exists := reservedFields[name]; exists {
+			name = fieldPrefix + name
+		}
+		fields = append(fields, zap.Any(name, data[k]))
+	}
+
+	return level, message, fields
+}
+
+func parseLevel(level string) zapcore.Level {
+	switch strings.ToLower(level) {
+	case "debug", "trace":
+		return zapcore.DebugLevel
+	case "warn", "warning":
+		return zapcore.WarnLevel
+	// Levels above error are not used, because logger would terminate the app.
+	case "error", "err", "fatal", "panic", "critical", "crit", "alert", "emergency":
+		return zapcore.ErrorLevel
+	default:
+		return zapcore.InfoLevel
+	}
 }
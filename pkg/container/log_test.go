@@ -0,0 +1,114 @@
+package container
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/outofforest/cloudless/pkg/eye/metrics"
+)
+
+func newTestStreamLogger() (*streamLogger, *observer.ObservedLogs) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	return newStreamLogger(zap.New(core), metrics.NewSet(), "main", "stdout"), logs
+}
+
+func TestStreamLoggerLines(t *testing.T) {
+	sl, logs := newTestStreamLogger()
+
+	_, err := sl.Write([]byte("first\nsec"))
+	require.NoError(t, err)
+	_, err = sl.Write([]byte("ond\n\nthird"))
+	require.NoError(t, err)
+	sl.Flush()
+
+	entries := logs.AllUntimed()
+	require.Len(t, entries, 3)
+	require.Equal(t, "first", entries[0].Message)
+	require.Equal(t, "second", entries[1].Message)
+	require.Equal(t, "third", entries[2].Message)
+}
+
+func TestStreamLoggerMultiLine(t *testing.T) {
+	sl, logs := newTestStreamLogger()
+
+	_, err := sl.Write([]byte("Exception in thread \"main\"\n\tat Main.main(Main.java:1)\nCaused by: error\n" +
+		"next\npanic: boom\n\ngoroutine 1 [running]:\nmain.main()\n"))
+	require.NoError(t, err)
+	sl.Flush()
+
+	entries := logs.AllUntimed()
+	require.Len(t, entries, 3)
+	require.Equal(t, "Exception in thread \"main\"\n\tat Main.main(Main.java:1)\nCaused by: error", entries[0].Message)
+	require.Equal(t, "next", entries[1].Message)
+	require.Equal(t, "panic: boom\n\ngoroutine 1 [running]:\nmain.main()", entries[2].Message)
+}
+
+func TestStreamLoggerJSON(t *testing.T) {
+	sl, logs := newTestStreamLogger()
+
+	_, err := sl.Write([]byte(`{"level":"warning","msg":"disk full","free":0,"process":"app"}` + "\n"))
+	require.NoError(t, err)
+	sl.Flush()
+
+	entries := logs.AllUntimed()
+	require.Len(t, entries, 1)
+	require.Equal(t, zapcore.WarnLevel, entries[0].Level)
+	require.Equal(t, "disk full", entries[0].Message)
+	require.Equal(t, map[string]any{
+		"free":          float64(0),
+		"app_process":   "app",
+		logLabelProcess: "main",
+		logLabelStream:  "stdout",
+	}, entries[0].ContextMap())
+}
+
+func TestStreamLoggerRateLimit(t *testing.T) {
+	sl, logs := newTestStreamLogger()
+
+	for range logBurst + 10 {
+		_, err := sl.Write([]byte("line\n"))
+		require.NoError(t, err)
+	}
+	sl.Flush()
+
+	// Few tokens might be refilled while writing.
+	require.NotZero(t, sl.dropped)
+	require.Equal(t, logBurst+10, logs.Len()+int(sl.dropped))
+}
+
+func TestStreamLoggerLabels(t *testing.T) {
+	sl, logs := newTestStreamLogger()
+
+	_, err := sl.Write([]byte(`{"msg":"started","cloudless_process":{"name":"app"}}` + "\n"))
+	require.NoError(t, err)
+	sl.Flush()
+
+	entries := logs.AllUntimed()
+	require.Len(t, entries, 1)
+	require.Equal(t, map[string]any{
+		logLabelProcess:               "main",
+		logLabelStream:                "stdout",
+		fieldPrefix + logLabelProcess: map[string]any{"name": "app"},
+	}, entries[0].ContextMap())
+}
+
+func TestStreamLoggerFlushTimer(t *testing.T) {
+	sl, logs := newTestStreamLogger()
+
+	timer := sl.timer
+	for _, line := range []string{"first\n", "second"} {
+		_, err := sl.Write([]byte(line))
+		require.NoError(t, err)
+	}
+	require.Same(t, timer, sl.timer)
+
+	// Pending record is logged once no more lines arrive.
+	require.Eventually(t, func() bool {
+		return logs.Len() == 2
+	}, time.Second, 10*time.Millisecond)
+}
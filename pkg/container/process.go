@@ -0,0 +1,311 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/outofforest/cloudless/pkg/eye/metrics"
+	"github.com/outofforest/cloudless/pkg/host"
+	"github.com/outofforest/logger"
+	"github.com/outofforest/parallel"
+)
+
+const (
+	mainProcess  = "main"
+	restartDelay = time.Second
+)
+
+// RestartPolicy defines when process is restarted after it exits.
+type RestartPolicy int
+
+const (
+	// RestartAlways restarts process whenever it exits.
+	RestartAlways RestartPolicy = iota
+
+	// RestartOnFailure restarts process only if it exits with an error.
+	RestartOnFailure
+
+	// RestartNever never restarts the process.
+	RestartNever
+)
+
+// ProcessConfig represents configuration of the process running inside container next to the main one.
+type ProcessConfig struct {
+	// Name is the name of the process.
+	Name string
+
+	// Args are the command and its arguments.
+	Args []string
+
+	// EnvVars sets environment variables of the process. They override the ones set for the container.
+	EnvVars map[string]string
+
+	// WorkingDir specifies a path to working directory. Working directory of the container is used if empty.
+	WorkingDir string
+
+	// Restart defines when process is restarted.
+	Restart RestartPolicy
+
+	// StreamLabel is the value of the process label attached to stdout and stderr streams of the process in logs.
+	// Name is used if empty.
+	StreamLabel string
+
+	// StopPriority defines stop ordering on shutdown. Processes with lower priority are stopped first, the next
+	// ones are stopped after they exit.
+	StopPriority uint
+
+	// HealthCheck configures health check of the process.
+	HealthCheck *HealthCheckConfig
+}
+
+// ProcessConfigurator defines function setting the process configuration.
+type ProcessConfigurator func(config *ProcessConfig)
+
+// Process adds process running inside container next to the main one.
+func Process(name string, args []string, configurators ...ProcessConfigurator) RunImageConfigurator {
+	config := ProcessConfig{
+		Name:    name,
+		Args:    args,
+		EnvVars: map[string]string{},
+	}
+	for _, configurator := range configurators {
+		configurator(&config)
+	}
+
+	return func(c *RunImageConfig) {
+		c.Processes = append(c.Processes, config)
+	}
+}
+
+// ProcessEnvVar sets environment variable of the process.
+func ProcessEnvVar(name, value string) ProcessConfigurator {
+	return func(config *ProcessConfig) {
+		config.EnvVars[name] = value
+	}
+}
+
+// ProcessWorkingDir sets working directory of the process.
+func ProcessWorkingDir(workingDir string) ProcessConfigurator {
+	return func(config *ProcessConfig) {
+		config.WorkingDir = workingDir
+	}
+}
+
+// ProcessRestart sets restart policy of the process.
+func ProcessRestart(policy RestartPolicy) ProcessConfigurator {
+	return func(config *ProcessConfig) {
+		config.Restart = policy
+	}
+}
+
+// ProcessStreamLabel sets label of the process output in logs.
+func ProcessStreamLabel(label string) ProcessConfigurator {
+	return func(config *ProcessConfig) {
+		config.StreamLabel = label
+	}
+}
+
+// ProcessStopPriority sets stop priority of the process.
+func ProcessStopPriority(priority uint) ProcessConfigurator {
+	return func(config *ProcessConfig) {
+		config.StopPriority = priority
+	}
+}
+
+// ProcessHealthCheck configures health check restarting the process if it becomes unhealthy. Default interval
+// and timeout are used if zero values are passed.
+func ProcessHealthCheck(probe Probe, interval, timeout time.Duration, retries uint64) ProcessConfigurator {
+	return func(config *ProcessConfig) {
+		config.HealthCheck = newHealthCheckConfig(probe, interval, timeout, retries)
+	}
+}
+
+// Restart sets restart policy of the main process.
+func Restart(policy RestartPolicy) RunImageConfigurator {
+	return func(config *RunImageConfig) {
+		config.Restart = policy
+	}
+}
+
+// StopPriority sets stop priority of the main process.
+func StopPriority(priority uint) RunImageConfigurator {
+	return func(config *RunImageConfig) {
+		config.StopPriority = priority
+	}
+}
+
+// processConfigs returns configuration of all the processes to run inside container.
+func processConfigs(config RunImageConfig) ([]ProcessConfig, error) {
+	args := append(append([]string{}, config.Entrypoint...), config.Cmd...)
+	if len(args) == 0 {
+		return nil, errors.Errorf("no command specified")
+	}
+
+	processes := []ProcessConfig{
+		{
+			Name:         mainProcess,
+			Args:         args,
+			EnvVars:      config.EnvVars,
+			WorkingDir:   config.WorkingDir,
+			Restart:      config.Restart,
+			StopPriority: config.StopPriority,
+			HealthCheck:  config.HealthCheck,
+		},
+	}
+
+	names := map[string]struct{}{
+		mainProcess: {},
+	}
+	for _, p := range config.Processes {
+		if _, exists := names[p.Name]; exists {
+			return nil, errors.Errorf("duplicated process %q", p.Name)
+		}
+		names[p.Name] = struct{}{}
+
+		if len(p.Args) == 0 {
+			return nil, errors.Errorf("no command specified for process %q", p.Name)
+		}
+
+		envVars := maps.Clone(config.EnvVars)
+		maps.Copy(envVars, p.EnvVars)
+		p.EnvVars = envVars
+
+		if p.WorkingDir == "" {
+			p.WorkingDir = config.WorkingDir
+		}
+		processes = append(processes, p)
+	}
+
+	for i := range processes {
+		if err := validateHealthCheck(processes[i].HealthCheck); err != nil {
+			return nil, errors.WithMessagef(err, "process %q", processes[i].Name)
+		}
+		if processes[i].StreamLabel == "" {
+			processes[i].StreamLabel = processes[i].Name
+		}
+	}
+
+	return processes, nil
+}
+
+// runProcesses runs processes and stops them in the order defined by their stop priorities once context is
+// canceled.
+func runProcesses(ctx context.Context, processes []ProcessConfig, set *metrics.Set) error {
+	priorities := make([]uint, 0, len(processes))
+	for _, p := range processes {
+		if !slices.Contains(priorities, p.StopPriority) {
+			priorities = append(priorities, p.StopPriority)
+		}
+	}
+	slices.Sort(priorities)
+
+	// Processes are not stopped when context is canceled, but when their stop group is.
+	type stopGroup struct {
+		ctx    context.Context
+		cancel context.CancelFunc
+		wg     sync.WaitGroup
+	}
+	groups := map[uint]*stopGroup{}
+	for _, priority := range priorities {
+		groupCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		groups[priority] = &stopGroup{
+			ctx:    groupCtx,
+			cancel: cancel,
+		}
+	}
+
+	// Supervisor returns once all the processes exited without being restarted.
+	allExited := make(chan struct{})
+	var running atomic.Int64
+	running.Store(int64(len(processes)))
+
+	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		for _, p := range processes {
+			group := groups[p.StopPriority]
+			group.wg.Add(1)
+			spawn("process-"+p.Name, parallel.Continue, func(_ context.Context) error {
+				defer func() {
+					if running.Add(-1) == 0 {
+						close(allExited)
+					}
+				}()
+				defer group.wg.Done()
+
+				return superviseProcess(group.ctx, p, set)
+			})
+		}
+		spawn("stop", parallel.Exit, func(ctx context.Context) error {
+			select {
+			case <-ctx.Done():
+			case <-allExited:
+				return nil
+			}
+			for _, priority := range priorities {
+				groups[priority].cancel()
+				groups[priority].wg.Wait()
+			}
+			return errors.WithStack(ctx.Err())
+		})
+		return nil
+	})
+}
+
+func superviseProcess(ctx context.Context, p ProcessConfig, set *metrics.Set) error {
+	log := logger.Get(ctx).With(zap.String("process", p.Name))
+
+	envVars := make([]string, 0, len(p.EnvVars))
+	for k, v := range p.EnvVars {
+		envVars = append(envVars, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	outLog := log.With(zap.String(logLabelContainer, os.Getenv(host.ContainerEnvVar)))
+	stdoutLogger := newStreamLogger(outLog, set, p.StreamLabel, "stdout")
+	stderrLogger := newStreamLogger(outLog, set, p.StreamLabel, "stderr")
+	for {
+		killCtx, kill := context.WithCancel(context.Background())
+		cmd := exec.CommandContext(killCtx, p.Args[0], p.Args[1:]...)
+		// Path is not resolved using PATH of the host.
+		cmd.Path = p.Args[0]
+		cmd.Err = nil
+		cmd.Env = envVars
+		cmd.Dir = p.WorkingDir
+		cmd.Stdout = stdoutLogger
+		cmd.Stderr = stderrLogger
+
+		err := runCommand(ctx, cmd, kill, p.HealthCheck, set, p.Name)
+		kill()
+		stdoutLogger.Flush()
+		stderrLogger.Flush()
+		if ctx.Err() != nil {
+			return errors.WithStack(ctx.Err())
+		}
+		if err != nil {
+			log.Error("Container process failed", zap.Error(err))
+		}
+
+		switch {
+		case p.Restart == RestartNever:
+			log.Info("Container process exited")
+			return nil
+		case p.Restart == RestartOnFailure && err == nil:
+			log.Info("Container process completed")
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.WithStack(ctx.Err())
+		case <-time.After(restartDelay):
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package container
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/outofforest/cloudless/pkg/eye/metrics"
+)
+
+func TestProcesses(t *testing.T) {
+	config := RunImageConfig{
+		EnvVars: map[string]string{
+			"A": "container",
+			"B": "container",
+		},
+		WorkingDir: "/app",
+		Cmd:        []string{"/bin/app"},
+	}
+	Process("exporter", []string{"/bin/exporter"},
+		ProcessEnvVar("B", "exporter"),
+		ProcessRestart(RestartOnFailure),
+		ProcessStopPriority(1),
+	)(&config)
+	Process("tailer", []string{"/bin/tailer"},
+		ProcessWorkingDir("/logs"),
+		ProcessStreamLabel("logs"),
+	)(&config)
+
+	processes, err := processConfigs(config)
+	require.NoError(t, err)
+	require.Len(t, processes, 3)
+
+	require.Equal(t, mainProcess, processes[0].Name)
+	require.Equal(t, []string{"/bin/app"}, processes[0].Args)
+	require.Equal(t, mainProcess, processes[0].StreamLabel)
+
+	require.Equal(t, map[string]string{"A": "container", "B": "exporter"}, processes[1].EnvVars)
+	require.Equal(t, "/app", processes[1].WorkingDir)
+	require.Equal(t, RestartOnFailure, processes[1].Restart)
+	require.Equal(t, uint(1), processes[1].StopPriority)
+	require.Equal(t, "exporter", processes[1].StreamLabel)
+
+	require.Equal(t, map[string]string{"A": "container", "B": "container"}, processes[2].EnvVars)
+	require.Equal(t, "/logs", processes[2].WorkingDir)
+	require.Equal(t, "logs", processes[2].StreamLabel)
+
+	Process("tailer", []string{"/bin/tailer"})(&config)
+	_, err = processConfigs(config)
+	require.Error(t, err)
+}
+
+func TestRunProcessesReturnsWhenAllExited(t *testing.T) {
+	requireT := require.New(t)
+
+	processes := []ProcessConfig{
+		{
+			Name:        mainProcess,
+			Args:        []string{"/bin/sh", "-c", "exit 0"},
+			StreamLabel: mainProcess,
+			Restart:     RestartNever,
+		},
+		{
+			Name:        "failing",
+			Args:        []string{"/bin/sh", "-c", "exit 1"},
+			StreamLabel: "failing",
+			Restart:     RestartNever,
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(newTestContext(t), 10*time.Second)
+	defer cancel()
+
+	requireT.NoError(runProcesses(ctx, processes, metrics.NewSet()))
+	requireT.NoError(ctx.Err())
+
+	// Supervisor keeps running as long as any process is running.
+	processes = append(processes, ProcessConfig{
+		Name:        "sleeping",
+		Args:        []string{"/bin/sh", "-c", "exec sleep 100"},
+		StreamLabel: "sleeping",
+		Restart:     RestartNever,
+	})
+
+	ctx, cancel = context.WithTimeout(newTestContext(t), time.Second)
+	defer cancel()
+
+	requireT.ErrorIs(runProcesses(ctx, processes, metrics.NewSet()), context.Canceled)
+}
@@ -60,6 +60,7 @@ func devBox() host.Configurator {
 			shield.Expose("tcp", "10.255.0.254", smtp.SMTPPort, "10.255.255.3", smtp.SMTPPort),
 			shield.Expose("tcp", "10.255.0.254", containercache.Port, "10.255.255.6", containercache.Port),
 			shield.Expose("udp", "10.255.0.254", dns.Port, "10.255.255.7", dns.Port),
+			shield.Expose("tcp", "10.255.0.254", dns.Port, "10.255.255.7", dns.Port),
 			shield.Masquerade("brint", "igw"),
 			Bridge("brint", "fc:ff:ff:ff:01:01", IPs("10.255.255.1/24")),
 			container.New("pebble",
@@ -129,6 +130,7 @@ func devBox() host.Configurator {
 			Network("fc:ff:ff:ff:01:07", "igw", IPs("10.255.255.7/24")),
 			Gateway("10.255.255.1"),
 			shield.Open("udp4", "igw", dns.Port),
+			shield.Open("tcp4", "igw", dns.Port),
 			dns.Service(
 				dns.Zone("dev.test", "ns1.dev.test", "wojtek@app.test", 1,
 					dns.Nameservers("ns1.dev.test"),
@@ -76,7 +76,7 @@ func (h *Handler) Run(ctx context.Context) error {
 						return errors.New("unexpected message type")
 					}
 
-					if err := h.storeRequest(reqMsg); err != nil {
+					if err := h.StoreRequest(reqMsg); err != nil {
 						return err
 					}
 				}
@@ -127,7 +127,8 @@ func (h *Handler) QueryCAA(query string) []CAA {
 	return values
 }
 
-func (h *Handler) storeRequest(req *wire.MsgRequest) error {
+// StoreRequest stores challenges requested by the ACME client.
+func (h *Handler) StoreRequest(req *wire.MsgRequest) error {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
@@ -0,0 +1,164 @@
+package dns
+
+import (
+	"encoding/binary"
+	"slices"
+	"sync"
+	"time"
+
+	vmetrics "github.com/VictoriaMetrics/metrics"
+
+	"github.com/outofforest/cloudless/pkg/eye/metrics"
+)
+
+const (
+	cacheCapacity  = 10000
+	maxCacheTTL    = 24 * 60 * 60
+	maxNegativeTTL = 3 * 60 * 60
+
+	subsystemCache = "cache"
+)
+
+func newCache(set *metrics.Set) *cache {
+	return &cache{
+		entries: map[string]cacheEntry{},
+		// "Number of queries answered from the cache".
+		mHits: set.NewCounter(metrics.N(namespace, subsystemCache, "hits")),
+		// "Number of queries missing in the cache".
+		mMisses: set.NewCounter(metrics.N(namespace, subsystemCache, "misses")),
+		// "Number of responses stored in the cache".
+		mEntries: set.NewGauge(metrics.N(namespace, subsystemCache, "entries")),
+	}
+}
+
+// cache stores responses received from upstreams until their TTLs expire.
+type cache struct {
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+
+	mHits    *vmetrics.Counter
+	mMisses  *vmetrics.Counter
+	mEntries *vmetrics.Gauge
+}
+
+type cacheEntry struct {
+	Msg []byte
+
+	// TTLOffsets are the offsets of TTL fields in the message.
+	TTLOffsets []int
+
+	Stored  time.Time
+	Expires time.Time
+}
+
+// Get returns copy of the cached response with TTLs decreased by the time spent in the cache.
+func (c *cache) Get(key string, now time.Time) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, exists := c.entries[key]
+	if exists && !now.Before(entry.Expires) {
+		delete(c.entries, key)
+		c.mEntries.Set(float64(len(c.entries)))
+		exists = false
+	}
+	if !exists {
+		c.mMisses.Inc()
+		return nil, false
+	}
+	c.mHits.Inc()
+
+	msg := slices.Clone(entry.Msg)
+	elapsed := uint32(now.Sub(entry.Stored) / time.Second)
+	for _, offset := range entry.TTLOffsets {
+		ttl := binary.BigEndian.Uint32(msg[offset:])
+		binary.BigEndian.PutUint32(msg[offset:], ttl-min(ttl, elapsed))
+	}
+	return msg, true
+}
+
+// Put stores the response in the cache if it is cacheable.
+func (c *cache) Put(key string, msg []byte, now time.Time) {
+	ttl, offsets, ok := cacheTTL(msg)
+	if !ok {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= cacheCapacity {
+		for k, entry := range c.entries {
+			if !now.Before(entry.Expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	if len(c.entries) >= cacheCapacity {
+		// Random entry is evicted.
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+
+	c.entries[key] = cacheEntry{
+		Msg:        slices.Clone(msg),
+		TTLOffsets: offsets,
+		Stored:     now,
+		Expires:    now.Add(time.Duration(ttl) * time.Second),
+	}
+	c.mEntries.Set(float64(len(c.entries)))
+}
+
+// cacheTTL returns the period response might be cached for, and offsets of its TTL fields. Negative responses are
+// cached for the period defined by the SOA record in the authority section.
+func cacheTTL(msg []byte) (uint32, []int, bool) {
+	h, ok := readHeader(msg)
+	if !ok || h.TC || (h.RCode != rCodeOK && h.RCode != rCodeNameError) {
+		return 0, nil, false
+	}
+
+	r := &msgReader{msg: msg, offset: headerSize}
+	for range h.QDCount {
+		if _, ok := r.name(); !ok {
+			return 0, nil, false
+		}
+		if _, ok := r.bytes(4); !ok {
+			return 0, nil, false
+		}
+	}
+
+	var offsets []int
+	var ttl, negativeTTL uint32 = maxCacheTTL, 0
+	for i := range uint32(h.ANCount) + uint32(h.NSCount) + uint32(h.ARCount) {
+		rec, end, ok := r.record()
+		if !ok {
+			return 0, nil, false
+		}
+		if rec.Type == typeOPT {
+			r.offset = end
+			continue
+		}
+
+		// TTL and data length precede the data.
+		offsets = append(offsets, r.offset-6)
+
+		if i < uint32(h.ANCount)+uint32(h.NSCount) {
+			ttl = min(ttl, rec.TTL)
+		}
+		if i >= uint32(h.ANCount) && i < uint32(h.ANCount)+uint32(h.NSCount) && rec.Type == typeSOA {
+			soa, ok := r.soa()
+			if !ok {
+				return 0, nil, false
+			}
+			negativeTTL = min(rec.TTL, soa.Minimum, maxNegativeTTL)
+		}
+		r.offset = end
+	}
+
+	if h.ANCount == 0 || h.RCode == rCodeNameError {
+		ttl = negativeTTL
+	}
+	return ttl, offsets, ttl > 0
+}
@@ -1,9 +1,16 @@
 package dns
 
 import (
+	"encoding/base64"
+	"fmt"
 	"net"
+	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/samber/lo"
+
+	"github.com/outofforest/cloudless"
 	"github.com/outofforest/cloudless/pkg/parse"
 	"github.com/outofforest/cloudless/pkg/wave"
 )
@@ -17,6 +24,112 @@ type Config struct {
 	ForwardFor     []net.IPNet
 	ACMEWaveConfig *wave.Config
 	DKIMWaveConfig *wave.Config
+	Discovery      *DiscoveryConfig
+	DNSSEC         *DNSSECConfig
+	TransferTo     []net.IPNet
+	NotifyTo       []net.IP
+	Secondaries    map[string]SecondaryConfig
+	UpdatesDir     string
+	Views          []ViewConfig
+	RateLimit      *RateLimitConfig
+	Cookies        bool
+	QueryLog       QueryLogConfig
+	TLS            *TLSConfig
+}
+
+// TLSConfig stores configuration of DNS-over-TLS and DNS-over-HTTPS listeners.
+type TLSConfig struct {
+	// WaveConfig is the config of wave client receiving ACME certificates.
+	WaveConfig wave.Config
+
+	// Domains are the names of the server certificates are used for.
+	Domains []string
+
+	// DoTPort is the port of DNS-over-TLS listener. If zero, listener is disabled.
+	DoTPort uint16
+
+	// DoHPort is the port of DNS-over-HTTPS listener. If zero, listener is disabled.
+	DoHPort uint16
+}
+
+// QueryLogConfig stores configuration of query logging.
+type QueryLogConfig struct {
+	// SampleRate defines that every n-th query is logged. If zero, queries are not logged.
+	SampleRate uint32
+
+	// DnstapOutput is the file or unix socket, prefixed with "unix:", all the queries are written to in dnstap
+	// format. File is overwritten on start.
+	DnstapOutput string
+}
+
+// RateLimitConfig stores configuration of response rate limiting applied to UDP responses.
+type RateLimitConfig struct {
+	// ResponsesPerSecond is the number of identical responses sent to the client network per second.
+	ResponsesPerSecond uint32
+
+	// Slip defines that every n-th limited response is sent truncated instead of being dropped, so legitimate
+	// clients retry over TCP. If zero, all limited responses are dropped.
+	Slip uint32
+
+	// PrefixLength is the length of the prefix defining client network.
+	PrefixLength int
+}
+
+// ViewConfig stores configuration of the view served to the clients from specific networks.
+// Zones of the view are not transferred and can't be updated dynamically. If DNSSEC is enabled, they are signed
+// with the keys of the default zone having the same domain.
+type ViewConfig struct {
+	// Name is the name of the view.
+	Name string
+
+	// Networks are the networks of the clients the view is served to.
+	Networks []net.IPNet
+
+	// Zones are served instead of the default ones having the same domain. Default zones missing in the view are
+	// still served.
+	Zones map[string]ZoneConfig
+
+	// Forward allows clients of the view to use forwarders. It overrides the networks set by ForwardFor.
+	Forward bool
+}
+
+// SecondaryConfig stores configuration of the zone pulled from the primary nameserver.
+type SecondaryConfig struct {
+	// Domain is the domain name of the zone.
+	Domain string
+
+	// Primary is the address of the primary nameserver.
+	Primary net.IP
+}
+
+// DiscoveryConfig stores configuration of service discovery.
+type DiscoveryConfig struct {
+	// WaveConfig is the config of wave client receiving announced records.
+	WaveConfig wave.Config
+
+	// Domain is the domain announced records are served under. It must belong to one of the zones.
+	Domain string
+}
+
+// DNSSECConfig stores DNSSEC configuration.
+type DNSSECConfig struct {
+	// KeysDir is the directory where signing keys are stored.
+	KeysDir string
+
+	// NSEC3 enables NSEC3 records instead of NSEC ones to deny existence.
+	NSEC3 bool
+
+	// ZSKLifetime is the period after which zone signing key is rolled.
+	ZSKLifetime time.Duration
+
+	// KSKLifetime is the period after which key signing key is rolled. Keys are not rolled if it is zero.
+	// DS record at the registrar must be updated by the operator after new key is published, and confirmed
+	// using PublishedDS.
+	KSKLifetime time.Duration
+
+	// PublishedDS contains tags of key signing keys, per zone, whose DS records are published in the parent zone.
+	// Old key signing key is removed only after DS record of its successor is published.
+	PublishedDS map[string][]uint16
 }
 
 // ZoneConfig stores dns zone configuration.
@@ -36,9 +149,12 @@ type ZoneConfig struct {
 	// Nameservers is the list of nameservers for the zone
 	Nameservers []string
 
-	// Domains map domains to IP addresses
+	// Domains map domains to IPv4 addresses
 	Domains map[string][]net.IP
 
+	// Domains6 map domains to IPv6 addresses
+	Domains6 map[string][]net.IP
+
 	// Aliases map one domain to another
 	Aliases map[string]AliasConfig
 
@@ -47,12 +163,64 @@ type ZoneConfig struct {
 
 	// Texts stores values of TXT records.
 	Texts map[string][]string
+
+	// ServiceLocators stores SRV records.
+	ServiceLocators map[string][]ServiceLocatorConfig
+
+	// Pointers map reverse names to domains.
+	Pointers map[string][]string
+
+	// CAAs stores CAA records.
+	CAAs map[string][]CAAConfig
+
+	// UpdateKeys are the TSIG keys allowed to update the zone dynamically.
+	UpdateKeys map[string]UpdateKeyConfig
+
+	// HealthChecks map domains to health checks probing their addresses.
+	HealthChecks map[string]HealthCheckConfig
+}
+
+// HealthCheckConfig stores configuration of health check probing addresses of the domain.
+// Unhealthy addresses are not returned in answers.
+type HealthCheckConfig struct {
+	// Port is the port probed on each address.
+	Port uint16
+
+	// Path is the path requested over HTTP. If empty, only TCP connection is established.
+	Path string
+}
+
+// UpdateKeyConfig stores configuration of TSIG key used to authenticate dynamic updates.
+type UpdateKeyConfig struct {
+	// Name is the name of the key.
+	Name string
+
+	// Secret is the HMAC secret.
+	Secret []byte
+
+	// Names are the names key is allowed to modify. Name starting with "*." matches all the names below it.
+	// If empty, key is allowed to modify any name in the zone.
+	Names []string
+}
+
+// ServiceLocatorConfig stores configuration of SRV record.
+type ServiceLocatorConfig struct {
+	Target   string
+	Port     uint16
+	Priority uint16
+	Weight   uint16
+}
+
+// CAAConfig stores configuration of CAA record.
+type CAAConfig struct {
+	Flags uint8
+	Tag   string
+	Value string
 }
 
 // AliasConfig stores configuration of CNAME alias.
 type AliasConfig struct {
-	Target  string
-	QueryID uint64
+	Target string
 }
 
 type (
@@ -61,22 +229,60 @@ type (
 
 	// ZoneConfigurator defines function setting the dns zone configuration.
 	ZoneConfigurator func(c *ZoneConfig)
+
+	// ViewConfigurator defines function setting the view configuration.
+	ViewConfigurator func(c *ViewConfig)
+
+	// DNSSECConfigurator defines function setting the DNSSEC configuration.
+	DNSSECConfigurator func(c *DNSSECConfig)
 )
 
 // Zone creates new DNS zone.
 func Zone(domain, nameserver, email string, serialNumber uint32, configurators ...ZoneConfigurator) Configurator {
 	return func(c *Config) {
-		zoneConfig := ZoneConfig{
-			Domain:         strings.ToLower(domain),
-			SerialNumber:   serialNumber,
-			MainNameserver: strings.ToLower(nameserver),
-			Email:          strings.ToLower(email),
-			Domains:        map[string][]net.IP{},
-			Aliases:        map[string]AliasConfig{},
-			MailExchanges:  map[string]uint16{},
-			Texts:          map[string][]string{},
+		zoneConfig := newZoneConfig(domain, nameserver, email, serialNumber)
+		for _, configurator := range configurators {
+			configurator(&zoneConfig)
 		}
 
+		c.Zones[zoneConfig.Domain] = zoneConfig
+	}
+}
+
+// View serves different zone data to the clients from the networks. Views are matched in the order of definition.
+func View(name string, configurators ...ViewConfigurator) Configurator {
+	return func(c *Config) {
+		viewConfig := ViewConfig{
+			Name:  name,
+			Zones: map[string]ZoneConfig{},
+		}
+		for _, configurator := range configurators {
+			configurator(&viewConfig)
+		}
+
+		c.Views = append(c.Views, viewConfig)
+	}
+}
+
+// Networks sets networks of the clients the view is served to.
+func Networks(networks ...string) ViewConfigurator {
+	parsedNetworks := make([]net.IPNet, 0, len(networks))
+	for _, n := range networks {
+		parsedNetworks = append(parsedNetworks, parse.IPNet4(n))
+	}
+	return func(c *ViewConfig) {
+		c.Networks = append(c.Networks, parsedNetworks...)
+	}
+}
+
+// ViewZone creates DNS zone served in the view.
+func ViewZone(
+	domain, nameserver, email string,
+	serialNumber uint32,
+	configurators ...ZoneConfigurator,
+) ViewConfigurator {
+	return func(c *ViewConfig) {
+		zoneConfig := newZoneConfig(domain, nameserver, email, serialNumber)
 		for _, configurator := range configurators {
 			configurator(&zoneConfig)
 		}
@@ -85,6 +291,13 @@ func Zone(domain, nameserver, email string, serialNumber uint32, configurators .
 	}
 }
 
+// ViewForward allows clients of the view to use forwarders.
+func ViewForward() ViewConfigurator {
+	return func(c *ViewConfig) {
+		c.Forward = true
+	}
+}
+
 // Nameservers add nameservers to the zone.
 func Nameservers(nameservers ...string) ZoneConfigurator {
 	return func(c *ZoneConfig) {
@@ -94,15 +307,25 @@ func Nameservers(nameservers ...string) ZoneConfigurator {
 	}
 }
 
-// Domain adds A records to the zone.
+// Domain adds A and AAAA records to the zone. Domain starting with "*." defines wildcard records.
 func Domain(domain string, ips ...string) ZoneConfigurator {
-	parsedIPs := make([]net.IP, 0, len(ips))
+	var ips4, ips6 []net.IP
 	for _, ip := range ips {
-		parsedIPs = append(parsedIPs, parse.IP4(ip))
+		parsedIP := parse.IP(ip)
+		if ip4 := parsedIP.To4(); ip4 != nil {
+			ips4 = append(ips4, ip4)
+		} else {
+			ips6 = append(ips6, parsedIP)
+		}
 	}
 	return func(c *ZoneConfig) {
 		domain = strings.ToLower(domain)
-		c.Domains[domain] = append(c.Domains[domain], parsedIPs...)
+		if len(ips4) > 0 {
+			c.Domains[domain] = append(c.Domains[domain], ips4...)
+		}
+		if len(ips6) > 0 {
+			c.Domains6[domain] = append(c.Domains6[domain], ips6...)
+		}
 	}
 }
 
@@ -128,6 +351,86 @@ func Text(domain string, values ...string) ZoneConfigurator {
 	}
 }
 
+// ServiceLocator adds SRV record to the zone.
+func ServiceLocator(domain, target string, port, priority, weight uint16) ZoneConfigurator {
+	return func(c *ZoneConfig) {
+		domain = strings.ToLower(domain)
+		c.ServiceLocators[domain] = append(c.ServiceLocators[domain], ServiceLocatorConfig{
+			Target:   strings.ToLower(target),
+			Port:     port,
+			Priority: priority,
+			Weight:   weight,
+		})
+	}
+}
+
+// Pointer adds PTR record mapping IP address to the domain. Zone must be the in-addr.arpa or ip6.arpa zone
+// containing the address.
+func Pointer(ip, domain string) ZoneConfigurator {
+	name := reverseName(parse.IP(ip))
+	return func(c *ZoneConfig) {
+		c.Pointers[name] = append(c.Pointers[name], strings.ToLower(domain))
+	}
+}
+
+// CAA adds CAA record to the zone.
+func CAA(domain string, flags uint8, tag, value string) ZoneConfigurator {
+	return func(c *ZoneConfig) {
+		domain = strings.ToLower(domain)
+		c.CAAs[domain] = append(c.CAAs[domain], CAAConfig{
+			Flags: flags,
+			Tag:   tag,
+			Value: value,
+		})
+	}
+}
+
+// UpdateKey allows dynamic updates of the zone authenticated by TSIG key. Secret is base64-encoded.
+// Names restrict the names key is allowed to modify. Name starting with "*." matches all the names below it.
+func UpdateKey(name, secret string, names ...string) ZoneConfigurator {
+	keyConfig := UpdateKeyConfig{
+		Name:   strings.ToLower(name),
+		Secret: lo.Must(base64.StdEncoding.DecodeString(secret)),
+	}
+	for _, n := range names {
+		keyConfig.Names = append(keyConfig.Names, strings.ToLower(n))
+	}
+	return func(c *ZoneConfig) {
+		if c.UpdateKeys == nil {
+			c.UpdateKeys = map[string]UpdateKeyConfig{}
+		}
+		c.UpdateKeys[keyConfig.Name] = keyConfig
+	}
+}
+
+// HTTPHealthCheck drops addresses of the domain from answers if they don't respond to HTTP request
+// with successful status code.
+func HTTPHealthCheck(domain string, port uint16, path string) ZoneConfigurator {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return healthCheck(domain, HealthCheckConfig{
+		Port: port,
+		Path: path,
+	})
+}
+
+// TCPHealthCheck drops addresses of the domain from answers if they don't accept TCP connections.
+func TCPHealthCheck(domain string, port uint16) ZoneConfigurator {
+	return healthCheck(domain, HealthCheckConfig{
+		Port: port,
+	})
+}
+
+func healthCheck(domain string, hcConfig HealthCheckConfig) ZoneConfigurator {
+	return func(c *ZoneConfig) {
+		if c.HealthChecks == nil {
+			c.HealthChecks = map[string]HealthCheckConfig{}
+		}
+		c.HealthChecks[strings.ToLower(domain)] = hcConfig
+	}
+}
+
 // ForwardTo sets DNS servers for forwarding.
 func ForwardTo(servers ...string) Configurator {
 	if len(servers) == 0 {
@@ -161,9 +464,199 @@ func ACME(waveConfig wave.Config) Configurator {
 	}
 }
 
+// TransferTo sets networks allowed to transfer zones.
+func TransferTo(networks ...string) Configurator {
+	parsedNetworks := make([]net.IPNet, 0, len(networks))
+	for _, n := range networks {
+		parsedNetworks = append(parsedNetworks, parse.IPNet4(n))
+	}
+	return func(c *Config) {
+		c.TransferTo = append(c.TransferTo, parsedNetworks...)
+	}
+}
+
+// NotifyTo sets secondary nameservers notified about zone changes.
+func NotifyTo(servers ...string) Configurator {
+	parsedIPs := make([]net.IP, 0, len(servers))
+	for _, ip := range servers {
+		parsedIPs = append(parsedIPs, parse.IP4(ip))
+	}
+	return func(c *Config) {
+		c.NotifyTo = append(c.NotifyTo, parsedIPs...)
+	}
+}
+
+// Secondary serves the zone pulled from the primary nameserver.
+func Secondary(domain, primary string) Configurator {
+	primaryIP := parse.IP4(primary)
+	return func(c *Config) {
+		domain := strings.ToLower(domain)
+		c.Secondaries[domain] = SecondaryConfig{
+			Domain:  domain,
+			Primary: primaryIP,
+		}
+	}
+}
+
+// DynamicUpdates enables dynamic updates of zones having update keys. Updates are stored in the directory of
+// the app and merged with the records defined statically. Static records can't be deleted by updates.
+func DynamicUpdates(appName string) Configurator {
+	return func(c *Config) {
+		c.UpdatesDir = filepath.Join(cloudless.AppDir(appName), "updates")
+	}
+}
+
+// Discovery serves records announced over wave by the service discovery clients under the domain.
+func Discovery(waveConfig wave.Config, domain string) Configurator {
+	return func(c *Config) {
+		c.Discovery = &DiscoveryConfig{
+			WaveConfig: waveConfig,
+			Domain:     strings.ToLower(domain),
+		}
+	}
+}
+
+// RateLimit limits the number of identical responses sent over UDP to the client network per second.
+// Every slip-th limited response is sent truncated instead of being dropped.
+func RateLimit(responsesPerSecond, slip uint32) Configurator {
+	return func(c *Config) {
+		c.RateLimit = &RateLimitConfig{
+			ResponsesPerSecond: responsesPerSecond,
+			Slip:               slip,
+			PrefixLength:       defaultRateLimitPrefixLength,
+		}
+	}
+}
+
+// Cookies enables DNS cookies. Clients presenting valid server cookie are not rate limited.
+func Cookies() Configurator {
+	return func(c *Config) {
+		c.Cookies = true
+	}
+}
+
+// DoT enables DNS-over-TLS listener using ACME certificates of the domains delivered over wave.
+func DoT(waveConfig wave.Config, domains ...string) Configurator {
+	return func(c *Config) {
+		tlsConfig(c, waveConfig, domains).DoTPort = PortDoT
+	}
+}
+
+// DoH enables DNS-over-HTTPS listener using ACME certificates of the domains delivered over wave.
+func DoH(waveConfig wave.Config, domains ...string) Configurator {
+	return func(c *Config) {
+		tlsConfig(c, waveConfig, domains).DoHPort = PortDoH
+	}
+}
+
+func tlsConfig(c *Config, waveConfig wave.Config, domains []string) *TLSConfig {
+	if c.TLS == nil {
+		c.TLS = &TLSConfig{
+			WaveConfig: waveConfig,
+		}
+	}
+	for _, d := range domains {
+		d = strings.ToLower(d)
+		if !lo.Contains(c.TLS.Domains, d) {
+			c.TLS.Domains = append(c.TLS.Domains, d)
+		}
+	}
+	return c.TLS
+}
+
+// QueryLog logs every n-th query.
+func QueryLog(sampleRate uint32) Configurator {
+	return func(c *Config) {
+		c.QueryLog.SampleRate = sampleRate
+	}
+}
+
+// Dnstap writes all the queries and responses in dnstap format to the file or unix socket, prefixed with "unix:".
+func Dnstap(output string) Configurator {
+	return func(c *Config) {
+		c.QueryLog.DnstapOutput = output
+	}
+}
+
 // DKIM enables service required to create DKIM records.
 func DKIM(waveConfig wave.Config) Configurator {
 	return func(c *Config) {
 		c.DKIMWaveConfig = &waveConfig
 	}
 }
+
+func newZoneConfig(domain, nameserver, email string, serialNumber uint32) ZoneConfig {
+	return ZoneConfig{
+		Domain:          strings.ToLower(domain),
+		SerialNumber:    serialNumber,
+		MainNameserver:  strings.ToLower(nameserver),
+		Email:           strings.ToLower(email),
+		Domains:         map[string][]net.IP{},
+		Domains6:        map[string][]net.IP{},
+		Aliases:         map[string]AliasConfig{},
+		MailExchanges:   map[string]uint16{},
+		Texts:           map[string][]string{},
+		ServiceLocators: map[string][]ServiceLocatorConfig{},
+		Pointers:        map[string][]string{},
+		CAAs:            map[string][]CAAConfig{},
+	}
+}
+
+func reverseName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+
+	const hexDigits = "0123456789abcdef"
+	name := make([]byte, 0, 4*len(ip)+len("ip6.arpa"))
+	for i := len(ip) - 1; i >= 0; i-- {
+		name = append(name, hexDigits[ip[i]&0x0f], '.', hexDigits[ip[i]>>4], '.')
+	}
+	return string(append(name, "ip6.arpa"...))
+}
+
+// DNSSEC enables signing of all the zones. Keys are stored in the directory of the app.
+func DNSSEC(appName string, configurators ...DNSSECConfigurator) Configurator {
+	config := DNSSECConfig{
+		KeysDir:     filepath.Join(cloudless.AppDir(appName), "dnssec"),
+		ZSKLifetime: defaultZSKLifetime,
+		PublishedDS: map[string][]uint16{},
+	}
+	for _, configurator := range configurators {
+		configurator(&config)
+	}
+
+	return func(c *Config) {
+		c.DNSSEC = &config
+	}
+}
+
+// NSEC3 uses NSEC3 records instead of NSEC ones to deny existence.
+func NSEC3() DNSSECConfigurator {
+	return func(c *DNSSECConfig) {
+		c.NSEC3 = true
+	}
+}
+
+// ZSKLifetime sets the period after which zone signing key is rolled.
+func ZSKLifetime(lifetime time.Duration) DNSSECConfigurator {
+	return func(c *DNSSECConfig) {
+		c.ZSKLifetime = lifetime
+	}
+}
+
+// KSKLifetime sets the period after which key signing key is rolled.
+func KSKLifetime(lifetime time.Duration) DNSSECConfigurator {
+	return func(c *DNSSECConfig) {
+		c.KSKLifetime = lifetime
+	}
+}
+
+// PublishedDS confirms that DS records of the key signing keys are published in the parent zone of the domain.
+// Tags of the keys are logged when they are generated.
+func PublishedDS(domain string, tags ...uint16) DNSSECConfigurator {
+	return func(c *DNSSECConfig) {
+		domain = strings.ToLower(domain)
+		c.PublishedDS[domain] = append(c.PublishedDS[domain], tags...)
+	}
+}
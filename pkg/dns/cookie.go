@@ -0,0 +1,80 @@
+package dns
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+const (
+	optionCookie = 10
+
+	clientCookieLength    = 8
+	minServerCookieLength = 8
+	maxServerCookieLength = 32
+	serverCookieLength    = 16
+	cookieVersion         = 1
+
+	// cookieLifetime is the period server cookie is valid for.
+	cookieLifetime = time.Hour
+
+	// cookieClockSkew is the allowed difference between clocks of servers sharing the secret.
+	cookieClockSkew = 5 * time.Minute
+)
+
+// readCookie reads COOKIE option defined in RFC 7873 from OPT record data. False is returned if option is malformed.
+func readCookie(rdata []byte) ([]byte, []byte, bool) {
+	for len(rdata) >= 4 {
+		code := binary.BigEndian.Uint16(rdata)
+		length := int(binary.BigEndian.Uint16(rdata[2:]))
+		if len(rdata) < 4+length {
+			return nil, nil, false
+		}
+		if code == optionCookie {
+			if length != clientCookieLength &&
+				(length < clientCookieLength+minServerCookieLength || length > clientCookieLength+maxServerCookieLength) {
+				return nil, nil, false
+			}
+			cookie := rdata[4 : 4+length]
+			return cookie[:clientCookieLength], cookie[clientCookieLength:], true
+		}
+		rdata = rdata[4+length:]
+	}
+	return nil, nil, len(rdata) == 0
+}
+
+// serverCookie computes server cookie using format defined in RFC 9018 with HMAC used as a hash function.
+func (s *server) serverCookie(clientCookie []byte, clientIP net.IP, timestamp uint32) []byte {
+	cookie := []byte{cookieVersion, 0, 0, 0}
+	cookie = binary.BigEndian.AppendUint32(cookie, timestamp)
+
+	mac := hmac.New(sha256.New, s.cookieSecret[:])
+	mac.Write(clientCookie)
+	mac.Write(cookie)
+	mac.Write(clientIP.To4())
+	return mac.Sum(cookie)[:serverCookieLength]
+}
+
+// verifyCookie checks if server cookie has been issued by the server to the client recently.
+func (s *server) verifyCookie(clientCookie, serverCookie []byte, clientIP net.IP, now time.Time) bool {
+	if len(serverCookie) != serverCookieLength || serverCookie[0] != cookieVersion {
+		return false
+	}
+
+	timestamp := binary.BigEndian.Uint32(serverCookie[4:])
+	issued := time.Unix(int64(timestamp), 0)
+	if now.Sub(issued) > cookieLifetime || issued.Sub(now) > cookieClockSkew {
+		return false
+	}
+	return hmac.Equal(serverCookie, s.serverCookie(clientCookie, clientIP, timestamp))
+}
+
+// putCookie adds COOKIE option to the OPT record.
+func putCookie(clientCookie, serverCookie []byte, b []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, optionCookie)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(clientCookie)+len(serverCookie)))
+	b = append(b, clientCookie...)
+	return append(b, serverCookie...)
+}
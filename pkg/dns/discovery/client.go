@@ -0,0 +1,127 @@
+package discovery
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/outofforest/cloudless"
+	"github.com/outofforest/cloudless/pkg/dns/discovery/wire"
+	"github.com/outofforest/cloudless/pkg/host"
+	"github.com/outofforest/cloudless/pkg/parse"
+	cwave "github.com/outofforest/cloudless/pkg/wave"
+	"github.com/outofforest/parallel"
+	"github.com/outofforest/wave"
+)
+
+// Config stores service discovery client config.
+type Config struct {
+	Provider string
+	TTL      time.Duration
+	Hosts    []wire.Host
+	Services []wire.Service
+}
+
+// Configurator defines function setting the service discovery client config.
+type Configurator func(c *Config)
+
+// NewConfig creates new service discovery client config.
+func NewConfig(appName string, configurators ...Configurator) Config {
+	var timeBytes [8]byte
+	binary.BigEndian.PutUint64(timeBytes[:], uint64(time.Now().Unix()))
+
+	config := Config{
+		Provider: appName + "-" + hex.EncodeToString(timeBytes[:]),
+		TTL:      DefaultTTL,
+	}
+	for _, configurator := range configurators {
+		configurator(&config)
+	}
+
+	return config
+}
+
+// Host announces IP address of the name. Name is relative to the discovery domain.
+func Host(name, ip string) Configurator {
+	ip4 := parse.IP4(ip)
+	return func(c *Config) {
+		c.Hosts = append(c.Hosts, wire.Host{
+			Name: name,
+			IP:   [4]byte(ip4.To4()),
+		})
+	}
+}
+
+// ServiceLocator announces SRV record. Name and target are relative to the discovery domain.
+func ServiceLocator(name, target string, port, priority, weight uint16) Configurator {
+	return func(c *Config) {
+		c.Services = append(c.Services, wire.Service{
+			Name:     name,
+			Target:   target,
+			Port:     port,
+			Priority: priority,
+			Weight:   weight,
+		})
+	}
+}
+
+// TTL sets the period after which records expire if not announced again. It is bounded by MinTTL and MaxTTL.
+func TTL(ttl time.Duration) Configurator {
+	return func(c *Config) {
+		c.TTL = ttl
+	}
+}
+
+// Service returns service announcing records to DNS servers.
+func Service(appName string, waveConfig cwave.Config, configurators ...Configurator) host.Configurator {
+	config := NewConfig(appName, configurators...)
+	return cloudless.Service("discovery", func(ctx context.Context) error {
+		return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+			waveClient, _, err := wave.NewClient(wave.ClientConfig{
+				CA:             waveConfig.CA,
+				Servers:        waveConfig.Servers,
+				MaxMessageSize: waveConfig.MaxMessageSize,
+			})
+			if err != nil {
+				return err
+			}
+
+			spawn("wave", parallel.Fail, waveClient.Run)
+			spawn("discovery", parallel.Fail, func(ctx context.Context) error {
+				return RunClient(ctx, waveClient, config)
+			})
+
+			return nil
+		})
+	})
+}
+
+// RunClient runs wave client sending records to DNS servers. Records are announced several times during TTL period,
+// so they don't expire if single message is lost.
+func RunClient(ctx context.Context, waveClient *wave.Client, config Config) error {
+	ttl := announcedTTL(config.TTL)
+	m := wire.NewMarshaller()
+	for {
+		if err := waveClient.Send(&wire.MsgRequest{
+			Provider: config.Provider,
+			TTL:      ttl,
+			Hosts:    config.Hosts,
+			Services: config.Services,
+		}, m); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.WithStack(ctx.Err())
+		case <-time.After(ttl / 3):
+		}
+	}
+}
+
+func announcedTTL(ttl time.Duration) time.Duration {
+	return min(max(ttl, MinTTL), MaxTTL)
+}
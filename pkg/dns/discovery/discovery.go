@@ -0,0 +1,226 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/outofforest/cloudless/pkg/dns/discovery/wire"
+	cwave "github.com/outofforest/cloudless/pkg/wave"
+	"github.com/outofforest/parallel"
+	"github.com/outofforest/wave"
+)
+
+const (
+	// DefaultTTL is the default period after which records expire if not announced again.
+	DefaultTTL = time.Minute
+
+	// MinTTL is the minimum TTL announced by the client, limiting the frequency of announcements.
+	MinTTL = 3 * time.Second
+
+	// MaxTTL is the maximum TTL accepted by the server, so records of dead providers don't live forever.
+	MaxTTL = time.Hour
+)
+
+// Locator stores SRV record.
+type Locator struct {
+	Target   string
+	Port     uint16
+	Priority uint16
+	Weight   uint16
+}
+
+type record struct {
+	Expires         time.Time
+	Hosts           map[string][]net.IP
+	ServiceLocators map[string][]Locator
+}
+
+// Handler is the service discovery handler accepting records announced by providers.
+type Handler struct {
+	waveConfig cwave.Config
+	domain     string
+
+	mu      sync.Mutex
+	records map[string]record
+}
+
+// New creates new service discovery handler serving records under the domain.
+func New(waveConfig cwave.Config, domain string) *Handler {
+	return &Handler{
+		waveConfig: waveConfig,
+		domain:     strings.ToLower(domain),
+		records:    map[string]record{},
+	}
+}
+
+// Domain returns the domain records are served under.
+func (h *Handler) Domain() string {
+	return h.domain
+}
+
+// Run runs service discovery handler.
+func (h *Handler) Run(ctx context.Context) error {
+	m := wire.NewMarshaller()
+
+	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		waveClient, waveCh, err := wave.NewClient(wave.ClientConfig{
+			CA:             h.waveConfig.CA,
+			Servers:        h.waveConfig.Servers,
+			MaxMessageSize: h.waveConfig.MaxMessageSize,
+			Requests: []wave.RequestConfig{
+				{
+					Marshaller: m,
+					Messages:   []any{&wire.MsgRequest{}},
+				},
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		spawn("wave", parallel.Fail, waveClient.Run)
+		spawn("clean", parallel.Fail, func(ctx context.Context) error {
+			for {
+				select {
+				case <-ctx.Done():
+					return errors.WithStack(ctx.Err())
+				case <-time.After(time.Minute):
+					h.cleanRecords(time.Now())
+				}
+			}
+		})
+		spawn("receiver", parallel.Fail, func(ctx context.Context) error {
+			for {
+				select {
+				case <-ctx.Done():
+					return errors.WithStack(ctx.Err())
+				case msg := <-waveCh:
+					reqMsg, ok := msg.(*wire.MsgRequest)
+					if !ok {
+						return errors.New("unexpected message type")
+					}
+
+					h.storeRequest(reqMsg, time.Now())
+				}
+			}
+		})
+
+		return nil
+	})
+}
+
+// IsDiscoveryQuery checks if query is related to service discovery.
+func (h *Handler) IsDiscoveryQuery(query string) bool {
+	return query == h.domain || strings.HasSuffix(query, "."+h.domain)
+}
+
+// IPs returns addresses announced for the name.
+func (h *Handler) IPs(query string) []net.IP {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	var ips []net.IP
+	for _, r := range h.records {
+		if now.Before(r.Expires) {
+			ips = append(ips, r.Hosts[query]...)
+		}
+	}
+	return ips
+}
+
+// ServiceLocators returns SRV records announced for the name.
+func (h *Handler) ServiceLocators(query string) []Locator {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	var srvs []Locator
+	for _, r := range h.records {
+		if now.Before(r.Expires) {
+			srvs = append(srvs, r.ServiceLocators[query]...)
+		}
+	}
+	return srvs
+}
+
+// Exists checks if name or any name below it has been announced.
+func (h *Handler) Exists(query string) bool {
+	if query == h.domain {
+		return true
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	for _, r := range h.records {
+		if !now.Before(r.Expires) {
+			continue
+		}
+		for name := range r.Hosts {
+			if name == query || strings.HasSuffix(name, "."+query) {
+				return true
+			}
+		}
+		for name := range r.ServiceLocators {
+			if name == query || strings.HasSuffix(name, "."+query) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (h *Handler) storeRequest(req *wire.MsgRequest, now time.Time) {
+	r := record{
+		Expires:         now.Add(min(req.TTL, MaxTTL)),
+		Hosts:           map[string][]net.IP{},
+		ServiceLocators: map[string][]Locator{},
+	}
+	for _, host := range req.Hosts {
+		if host.Name == "" {
+			continue
+		}
+		name := h.name(host.Name)
+		r.Hosts[name] = append(r.Hosts[name], net.IPv4(host.IP[0], host.IP[1], host.IP[2], host.IP[3]).To4())
+	}
+	for _, srv := range req.Services {
+		if srv.Name == "" || srv.Target == "" {
+			continue
+		}
+		name := h.name(srv.Name)
+		r.ServiceLocators[name] = append(r.ServiceLocators[name], Locator{
+			Target:   h.name(srv.Target),
+			Port:     srv.Port,
+			Priority: srv.Priority,
+			Weight:   srv.Weight,
+		})
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.records[req.Provider] = r
+}
+
+func (h *Handler) cleanRecords(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for p, r := range h.records {
+		if !now.Before(r.Expires) {
+			delete(h.records, p)
+		}
+	}
+}
+
+// name returns the name relative to the domain as the fully qualified one.
+func (h *Handler) name(name string) string {
+	return strings.ToLower(name) + "." + h.domain
+}
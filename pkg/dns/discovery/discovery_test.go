@@ -0,0 +1,86 @@
+package discovery
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/outofforest/cloudless/pkg/dns/discovery/wire"
+	cwave "github.com/outofforest/cloudless/pkg/wave"
+)
+
+func TestRecords(t *testing.T) {
+	requireT := require.New(t)
+
+	h := New(cwave.Config{}, "SVC.example.com")
+	requireT.True(h.IsDiscoveryQuery("db.svc.example.com"))
+	requireT.False(h.IsDiscoveryQuery("db.example.com"))
+
+	now := time.Now()
+	h.storeRequest(&wire.MsgRequest{
+		Provider: "provider1",
+		TTL:      time.Hour,
+		Hosts: []wire.Host{
+			{Name: "DB", IP: [4]byte{10, 0, 0, 1}},
+		},
+		Services: []wire.Service{
+			{Name: "_pg._tcp", Target: "db", Port: 5432, Priority: 1, Weight: 2},
+		},
+	}, now)
+	h.storeRequest(&wire.MsgRequest{
+		Provider: "provider2",
+		TTL:      time.Hour,
+		Hosts: []wire.Host{
+			{Name: "db", IP: [4]byte{10, 0, 0, 2}},
+		},
+	}, now)
+
+	requireT.ElementsMatch([]net.IP{
+		net.IPv4(10, 0, 0, 1).To4(),
+		net.IPv4(10, 0, 0, 2).To4(),
+	}, h.IPs("db.svc.example.com"))
+	requireT.Equal([]Locator{
+		{Target: "db.svc.example.com", Port: 5432, Priority: 1, Weight: 2},
+	}, h.ServiceLocators("_pg._tcp.svc.example.com"))
+	requireT.True(h.Exists("svc.example.com"))
+	requireT.True(h.Exists("_tcp.svc.example.com"))
+	requireT.False(h.Exists("web.svc.example.com"))
+
+	// Records expire when not announced again.
+	h.storeRequest(&wire.MsgRequest{
+		Provider: "provider2",
+		TTL:      -time.Second,
+		Hosts: []wire.Host{
+			{Name: "db", IP: [4]byte{10, 0, 0, 2}},
+		},
+	}, now)
+	requireT.Equal([]net.IP{net.IPv4(10, 0, 0, 1).To4()}, h.IPs("db.svc.example.com"))
+
+	h.cleanRecords(now.Add(2 * time.Hour))
+	requireT.Empty(h.IPs("db.svc.example.com"))
+	requireT.False(h.Exists("db.svc.example.com"))
+}
+
+func TestTTLBounds(t *testing.T) {
+	requireT := require.New(t)
+
+	h := New(cwave.Config{}, "svc.example.com")
+	now := time.Now()
+	h.storeRequest(&wire.MsgRequest{
+		Provider: "provider",
+		TTL:      100 * 365 * 24 * time.Hour,
+		Hosts: []wire.Host{
+			{Name: "db", IP: [4]byte{10, 0, 0, 1}},
+		},
+	}, now)
+
+	h.mu.Lock()
+	requireT.Equal(now.Add(MaxTTL), h.records["provider"].Expires)
+	h.mu.Unlock()
+
+	requireT.Equal(MinTTL, announcedTTL(0))
+	requireT.Equal(DefaultTTL, announcedTTL(DefaultTTL))
+	requireT.Equal(MaxTTL, announcedTTL(100*MaxTTL))
+}
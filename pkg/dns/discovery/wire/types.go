@@ -0,0 +1,29 @@
+package wire
+
+import "time"
+
+// MsgRequest is used to announce records for service discovery.
+type MsgRequest struct {
+	Provider string
+
+	// TTL is the period after which records expire if not announced again.
+	TTL time.Duration
+
+	Hosts    []Host
+	Services []Service
+}
+
+// Host maps name to IPv4 address.
+type Host struct {
+	Name string
+	IP   [4]byte
+}
+
+// Service is the SRV record.
+type Service struct {
+	Name     string
+	Target   string
+	Port     uint16
+	Priority uint16
+	Weight   uint16
+}
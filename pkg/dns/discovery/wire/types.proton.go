@@ -0,0 +1,565 @@
+package wire
+
+import (
+	"reflect"
+	"unsafe"
+
+	"github.com/outofforest/proton"
+	"github.com/outofforest/proton/helpers"
+	"github.com/pkg/errors"
+)
+
+const (
+	id2 uint64 = iota + 1
+)
+
+var _ proton.Marshaller = Marshaller{}
+
+// NewMarshaller creates marshaller.
+func NewMarshaller() Marshaller {
+	return Marshaller{}
+}
+
+// Marshaller marshals and unmarshals messages.
+type Marshaller struct {
+}
+
+// Messages returns list of the message types supported by marshaller.
+func (m Marshaller) Messages() []any {
+	return []any {
+		MsgRequest{},
+	}
+}
+
+// ID returns ID of message type.
+func (m Marshaller) ID(msg any) (uint64, error) {
+	switch msg.(type) {
+	case *MsgRequest:
+		return id2, nil
+	default:
+		return 0, errors.Errorf("unknown message type %T", msg)
+	}
+}
+
+// Size computes the size of marshalled message.
+func (m Marshaller) Size(msg any) (uint64, error) {
+	switch msg2 := msg.(type) {
+	case *MsgRequest:
+		return size2(msg2), nil
+	default:
+		return 0, errors.Errorf("unknown message type %T", msg)
+	}
+}
+
+// Marshal marshals message.
+func (m Marshaller) Marshal(msg any, buf []byte) (retID, retSize uint64, retErr error) {
+	defer helpers.RecoverMarshal(&retErr)
+
+	switch msg2 := msg.(type) {
+	case *MsgRequest:
+		return id2, marshal2(msg2, buf), nil
+	default:
+		return 0, 0, errors.Errorf("unknown message type %T", msg)
+	}
+}
+
+// Unmarshal unmarshals message.
+func (m Marshaller) Unmarshal(id uint64, buf []byte) (retMsg any, retSize uint64, retErr error) {
+	defer helpers.RecoverUnmarshal(&retErr)
+
+	switch id {
+	case id2:
+		msg := &MsgRequest{}
+		return msg, unmarshal2(msg, buf), nil
+	default:
+		return nil, 0, errors.Errorf("unknown ID %d", id)
+	}
+}
+
+// IsPatchNeeded checks if non-empty patch exists.
+func (m Marshaller) IsPatchNeeded(msgDst, msgSrc any) (bool, error) {
+	switch msg2 := msgDst.(type) {
+	case *MsgRequest:
+		return isPatchNeeded2(msg2, msgSrc.(*MsgRequest)), nil
+	default:
+		return false, errors.Errorf("unknown message type %T", msgDst)
+	}
+}
+
+// MakePatch creates a patch.
+func (m Marshaller) MakePatch(msgDst, msgSrc any, buf []byte) (retID, retSize uint64, retErr error) {
+	defer helpers.RecoverMakePatch(&retErr)
+
+	switch msg2 := msgDst.(type) {
+	case *MsgRequest:
+		return id2, makePatch2(msg2, msgSrc.(*MsgRequest), buf), nil
+	default:
+		return 0, 0, errors.Errorf("unknown message type %T", msgDst)
+	}
+}
+
+// ApplyPatch applies patch.
+func (m Marshaller) ApplyPatch(msg any, buf []byte) (retSize uint64, retErr error) {
+	defer helpers.RecoverApplyPatch(&retErr)
+
+	switch msg2 := msg.(type) {
+	case *MsgRequest:
+		return applyPatch2(msg2, buf), nil
+	default:
+		return 0, errors.Errorf("unknown message type %T", msg)
+	}
+}
+
+func size2(m *MsgRequest) uint64 {
+	var n uint64 = 4
+	{
+		// Provider
+
+		{
+			l := uint64(len(m.Provider))
+			helpers.UInt64Size(l, &n)
+			n += l
+		}
+	}
+	{
+		// TTL
+
+		helpers.Int64Size(m.TTL, &n)
+	}
+	{
+		// Hosts
+
+		l := uint64(len(m.Hosts))
+		helpers.UInt64Size(l, &n)
+		for _, sv1 := range m.Hosts {
+			n += size0(&sv1)
+		}
+	}
+	{
+		// Services
+
+		l := uint64(len(m.Services))
+		helpers.UInt64Size(l, &n)
+		for _, sv1 := range m.Services {
+			n += size1(&sv1)
+		}
+	}
+	return n
+}
+
+func marshal2(m *MsgRequest, b []byte) uint64 {
+	var o uint64
+	{
+		// Provider
+
+		{
+			l := uint64(len(m.Provider))
+			helpers.UInt64Marshal(l, b, &o)
+			copy(b[o:o+l], m.Provider)
+			o += l
+		}
+	}
+	{
+		// TTL
+
+		helpers.Int64Marshal(m.TTL, b, &o)
+	}
+	{
+		// Hosts
+
+		helpers.UInt64Marshal(uint64(len(m.Hosts)), b, &o)
+		for _, sv1 := range m.Hosts {
+			o += marshal0(&sv1, b[o:])
+		}
+	}
+	{
+		// Services
+
+		helpers.UInt64Marshal(uint64(len(m.Services)), b, &o)
+		for _, sv1 := range m.Services {
+			o += marshal1(&sv1, b[o:])
+		}
+	}
+
+	return o
+}
+
+func unmarshal2(m *MsgRequest, b []byte) uint64 {
+	var o uint64
+	{
+		// Provider
+
+		{
+			var l uint64
+			helpers.UInt64Unmarshal(&l, b, &o)
+			if l > 0 {
+				m.Provider = string(b[o:o+l])
+				o += l
+			}
+		}
+	}
+	{
+		// TTL
+
+		helpers.Int64Unmarshal(&m.TTL, b, &o)
+	}
+	{
+		// Hosts
+
+		var l uint64
+		helpers.UInt64Unmarshal(&l, b, &o)
+		if l > 0 {
+			m.Hosts = make([]Host, l)
+			for i1 := range l {
+				o += unmarshal0(&m.Hosts[i1], b[o:])
+			}
+		}
+	}
+	{
+		// Services
+
+		var l uint64
+		helpers.UInt64Unmarshal(&l, b, &o)
+		if l > 0 {
+			m.Services = make([]Service, l)
+			for i1 := range l {
+				o += unmarshal1(&m.Services[i1], b[o:])
+			}
+		}
+	}
+
+	return o
+}
+
+func isPatchNeeded2(m, mSrc *MsgRequest) bool {
+	{
+		// Provider
+
+		if !reflect.DeepEqual(m.Provider, mSrc.Provider) {
+			return true
+		}
+
+	}
+	{
+		// TTL
+
+		if !reflect.DeepEqual(m.TTL, mSrc.TTL) {
+			return true
+		}
+
+	}
+	{
+		// Hosts
+
+		if !reflect.DeepEqual(m.Hosts, mSrc.Hosts) {
+			return true
+		}
+
+	}
+	{
+		// Services
+
+		if !reflect.DeepEqual(m.Services, mSrc.Services) {
+			return true
+		}
+
+	}
+
+	return false
+}
+
+func makePatch2(m, mSrc *MsgRequest, b []byte) uint64 {
+	var o uint64 = 1
+	{
+		// Provider
+
+		if reflect.DeepEqual(m.Provider, mSrc.Provider) {
+			b[0] &= 0xFE
+		} else {
+			b[0] |= 0x01
+			{
+				l := uint64(len(m.Provider))
+				helpers.UInt64Marshal(l, b, &o)
+				copy(b[o:o+l], m.Provider)
+				o += l
+			}
+		}
+	}
+	{
+		// TTL
+
+		if reflect.DeepEqual(m.TTL, mSrc.TTL) {
+			b[0] &= 0xFD
+		} else {
+			b[0] |= 0x02
+			helpers.Int64Marshal(m.TTL, b, &o)
+		}
+	}
+	{
+		// Hosts
+
+		if reflect.DeepEqual(m.Hosts, mSrc.Hosts) {
+			b[0] &= 0xFB
+		} else {
+			b[0] |= 0x04
+			helpers.UInt64Marshal(uint64(len(m.Hosts)), b, &o)
+			for _, sv1 := range m.Hosts {
+				o += marshal0(&sv1, b[o:])
+			}
+		}
+	}
+	{
+		// Services
+
+		if reflect.DeepEqual(m.Services, mSrc.Services) {
+			b[0] &= 0xF7
+		} else {
+			b[0] |= 0x08
+			helpers.UInt64Marshal(uint64(len(m.Services)), b, &o)
+			for _, sv1 := range m.Services {
+				o += marshal1(&sv1, b[o:])
+			}
+		}
+	}
+
+	return o
+}
+
+func applyPatch2(m *MsgRequest, b []byte) uint64 {
+	var o uint64 = 1
+	{
+		// Provider
+
+		if b[0]&0x01 != 0 {
+			{
+				var l uint64
+				helpers.UInt64Unmarshal(&l, b, &o)
+				if l > 0 {
+					m.Provider = string(b[o:o+l])
+					o += l
+				}
+			}
+		}
+	}
+	{
+		// TTL
+
+		if b[0]&0x02 != 0 {
+			helpers.Int64Unmarshal(&m.TTL, b, &o)
+		}
+	}
+	{
+		// Hosts
+
+		if b[0]&0x04 != 0 {
+			var l uint64
+			helpers.UInt64Unmarshal(&l, b, &o)
+			if l > 0 {
+				m.Hosts = make([]Host, l)
+				for i1 := range l {
+					o += unmarshal0(&m.Hosts[i1], b[o:])
+				}
+			}
+		}
+	}
+	{
+		// Services
+
+		if b[0]&0x08 != 0 {
+			var l uint64
+			helpers.UInt64Unmarshal(&l, b, &o)
+			if l > 0 {
+				m.Services = make([]Service, l)
+				for i1 := range l {
+					o += unmarshal1(&m.Services[i1], b[o:])
+				}
+			}
+		}
+	}
+
+	return o
+}
+
+func size1(m *Service) uint64 {
+	var n uint64 = 5
+	{
+		// Name
+
+		{
+			l := uint64(len(m.Name))
+			helpers.UInt64Size(l, &n)
+			n += l
+		}
+	}
+	{
+		// Target
+
+		{
+			l := uint64(len(m.Target))
+			helpers.UInt64Size(l, &n)
+			n += l
+		}
+	}
+	{
+		// Port
+
+		helpers.UInt16Size(m.Port, &n)
+	}
+	{
+		// Priority
+
+		helpers.UInt16Size(m.Priority, &n)
+	}
+	{
+		// Weight
+
+		helpers.UInt16Size(m.Weight, &n)
+	}
+	return n
+}
+
+func marshal1(m *Service, b []byte) uint64 {
+	var o uint64
+	{
+		// Name
+
+		{
+			l := uint64(len(m.Name))
+			helpers.UInt64Marshal(l, b, &o)
+			copy(b[o:o+l], m.Name)
+			o += l
+		}
+	}
+	{
+		// Target
+
+		{
+			l := uint64(len(m.Target))
+			helpers.UInt64Marshal(l, b, &o)
+			copy(b[o:o+l], m.Target)
+			o += l
+		}
+	}
+	{
+		// Port
+
+		helpers.UInt16Marshal(m.Port, b, &o)
+	}
+	{
+		// Priority
+
+		helpers.UInt16Marshal(m.Priority, b, &o)
+	}
+	{
+		// Weight
+
+		helpers.UInt16Marshal(m.Weight, b, &o)
+	}
+
+	return o
+}
+
+func unmarshal1(m *Service, b []byte) uint64 {
+	var o uint64
+	{
+		// Name
+
+		{
+			var l uint64
+			helpers.UInt64Unmarshal(&l, b, &o)
+			if l > 0 {
+				m.Name = string(b[o:o+l])
+				o += l
+			}
+		}
+	}
+	{
+		// Target
+
+		{
+			var l uint64
+			helpers.UInt64Unmarshal(&l, b, &o)
+			if l > 0 {
+				m.Target = string(b[o:o+l])
+				o += l
+			}
+		}
+	}
+	{
+		// Port
+
+		helpers.UInt16Unmarshal(&m.Port, b, &o)
+	}
+	{
+		// Priority
+
+		helpers.UInt16Unmarshal(&m.Priority, b, &o)
+	}
+	{
+		// Weight
+
+		helpers.UInt16Unmarshal(&m.Weight, b, &o)
+	}
+
+	return o
+}
+
+func size0(m *Host) uint64 {
+	var n uint64 = 5
+	{
+		// Name
+
+		{
+			l := uint64(len(m.Name))
+			helpers.UInt64Size(l, &n)
+			n += l
+		}
+	}
+	return n
+}
+
+func marshal0(m *Host, b []byte) uint64 {
+	var o uint64
+	{
+		// Name
+
+		{
+			l := uint64(len(m.Name))
+			helpers.UInt64Marshal(l, b, &o)
+			copy(b[o:o+l], m.Name)
+			o += l
+		}
+	}
+	{
+		// IP
+
+		copy(b[o:o+4], unsafe.Slice(&m.IP[0], 4))
+		o += 4
+	}
+
+	return o
+}
+
+func unmarshal0(m *Host, b []byte) uint64 {
+	var o uint64
+	{
+		// Name
+
+		{
+			var l uint64
+			helpers.UInt64Unmarshal(&l, b, &o)
+			if l > 0 {
+				m.Name = string(b[o:o+l])
+				o += l
+			}
+		}
+	}
+	{
+		// IP
+
+		copy(unsafe.Slice(&m.IP[0], 4), b[o:o+4])
+		o += 4
+	}
+
+	return o
+}
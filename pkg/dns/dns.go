@@ -2,17 +2,28 @@ package dns
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/binary"
+	"io"
+	"maps"
+	"math"
 	"net"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"golang.org/x/net/ipv4"
 
 	"github.com/outofforest/cloudless"
+	"github.com/outofforest/cloudless/pkg/acme/certificate"
 	"github.com/outofforest/cloudless/pkg/dns/acme"
+	"github.com/outofforest/cloudless/pkg/dns/discovery"
 	"github.com/outofforest/cloudless/pkg/dns/dkim"
+	"github.com/outofforest/cloudless/pkg/eye/metrics"
 	"github.com/outofforest/cloudless/pkg/host"
 	"github.com/outofforest/logger"
 	"github.com/outofforest/mass"
@@ -23,22 +34,58 @@ const (
 	// Port is the port DNS listens on.
 	Port = 53
 
+	// PortDoT is the port DNS-over-TLS listens on.
+	PortDoT = 853
+
+	// PortDoH is the port DNS-over-HTTPS listens on.
+	PortDoH = 443
+
+	namespace = "dns"
+
 	bufferSize          = 1500
 	defaultMaxMsgLength = 512
+	maxTCPMsgLength     = math.MaxUint16
 	headerSize          = 12
 	ttl                 = 60
 	forwardChCapacity   = 10
+	maxTCPConnections   = 100
+	tcpIdleTimeout      = 10 * time.Second
 
 	classInternet = 1
-
-	typeA     = 1
-	typeNS    = 2
-	typeSOA   = 6
-	typeCNAME = 5
-	typeMX    = 15
-	typeTXT   = 16
-	typeOPT   = 41
-	typeCAA   = 257
+	classNone     = 254
+	classAny      = 255
+
+	typeA          = 1
+	typeNS         = 2
+	typeSOA        = 6
+	typeCNAME      = 5
+	typePTR        = 12
+	typeMX         = 15
+	typeTXT        = 16
+	typeAAAA       = 28
+	typeSRV        = 33
+	typeOPT        = 41
+	typeTSIG       = 250
+	typeIXFR       = 251
+	typeAXFR       = 252
+	typeANY        = 255
+	typeRRSIG      = 46
+	typeNSEC       = 47
+	typeDNSKEY     = 48
+	typeNSEC3      = 50
+	typeNSEC3PARAM = 51
+	typeCAA        = 257
+
+	opcodeQuery  = 0
+	opcodeNotify = 4
+	opcodeUpdate = 5
+
+	sectionAnswer     = 0
+	sectionAuthority  = 1
+	sectionAdditional = 2
+
+	// flagDO is the DNSSEC OK flag stored in TTL field of OPT record.
+	flagDO = 0x8000
 
 	rCodeOK             = 0
 	rCodeFormatError    = 1
@@ -46,43 +93,92 @@ const (
 	rCodeNameError      = 3
 	rCodeNotImplemented = 4
 	rCodeRefused        = 5
+	rCodeYXDomain       = 6
+	rCodeYXRRSet        = 7
+	rCodeNXRRSet        = 8
+	rCodeNotAuth        = 9
+	rCodeNotZone        = 10
 )
 
 // Service returns DNS service.
 func Service(configurators ...Configurator) host.Configurator {
 	config := Config{
-		DNSPort:  Port,
-		DKIMPort: dkim.Port,
-		Zones:    map[string]ZoneConfig{},
+		DNSPort:     Port,
+		DKIMPort:    dkim.Port,
+		Zones:       map[string]ZoneConfig{},
+		Secondaries: map[string]SecondaryConfig{},
 	}
 	for _, configurator := range configurators {
 		configurator(&config)
 	}
 
-	return cloudless.Service("dns", func(ctx context.Context) error {
-		return run(ctx, config)
-	})
+	set := metrics.NewSet()
+	return cloudless.Join(
+		cloudless.Metrics(set),
+		cloudless.Service("dns", func(ctx context.Context) error {
+			return run(ctx, config, set)
+		}),
+	)
 }
 
-func run(ctx context.Context, config Config) error {
+func run(ctx context.Context, config Config, set *metrics.Set) error {
+	s, err := newServer(ctx, config)
+	if err != nil {
+		return err
+	}
+
 	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
-		var acmeServer *acme.Handler
-		var dkimServer *dkim.Handler
 		var forwardCh chan forwardRequest
 
 		if config.ACMEWaveConfig != nil {
-			acmeServer = acme.New(*config.ACMEWaveConfig)
-			spawn("acme", parallel.Fail, acmeServer.Run)
+			s.acmeServer = acme.New(*config.ACMEWaveConfig)
+			spawn("acme", parallel.Fail, s.acmeServer.Run)
 		}
 		if config.DKIMWaveConfig != nil {
-			dkimServer = dkim.New(*config.DKIMWaveConfig)
-			spawn("dkim", parallel.Fail, dkimServer.Run)
+			s.dkimServer = dkim.New(*config.DKIMWaveConfig)
+			spawn("dkim", parallel.Fail, s.dkimServer.Run)
+		}
+		if config.Discovery != nil {
+			s.discoveryServer = discovery.New(config.Discovery.WaveConfig, config.Discovery.Domain)
+			spawn("discovery", parallel.Fail, s.discoveryServer.Run)
 		}
-		if len(config.ForwardFor) > 0 && len(config.ForwardTo) > 0 {
+		if forwardingEnabled(config) {
 			forwardCh = make(chan forwardRequest, forwardChCapacity)
+			s.forwardCh = forwardCh
+			s.forwarder = newForwarder(config.ForwardTo, Port, set)
 
 			spawn("forwarder", parallel.Fail, func(ctx context.Context) error {
-				return runForwarders(ctx, config.ForwardTo, forwardCh)
+				return s.forwarder.Run(ctx, forwardCh)
+			})
+		}
+		s.observer = newQueryObserver(config.QueryLog, set)
+		if s.observer.tap != nil {
+			spawn("dnstap", parallel.Fail, s.observer.tap.Run)
+		}
+		if config.RateLimit != nil {
+			s.limiter = newRateLimiter(*config.RateLimit, set)
+		}
+		if config.TLS != nil {
+			s.certs = certificate.NewStore(config.TLS.WaveConfig, config.TLS.Domains)
+			spawn("certificates", parallel.Fail, s.certs.Run)
+		}
+		if healthChecksEnabled(config) {
+			s.health = newHealthChecker(set)
+			spawn("health", parallel.Fail, func(ctx context.Context) error {
+				return s.health.Run(ctx, s.healthTargets)
+			})
+		}
+		if config.DNSSEC != nil {
+			spawn("dnssec", parallel.Fail, s.runKeyRolling)
+		}
+		if len(config.NotifyTo) > 0 {
+			s.notifyCh = make(chan struct{}, 1)
+			s.zonesChanged()
+			spawn("notify", parallel.Fail, s.runNotifier)
+		}
+		for _, sec := range s.secondaries {
+			spawn("secondary", parallel.Fail, func(ctx context.Context) error {
+				return s.runSecondary(ctx, sec)
 			})
 		}
 		spawn("resolver", parallel.Fail, func(ctx context.Context) error {
@@ -90,31 +186,185 @@ func run(ctx context.Context, config Config) error {
 				defer close(forwardCh)
 			}
 
-			for {
-				if err := runResolver(ctx, config, forwardCh, acmeServer, dkimServer); err != nil {
-					if errors.Is(err, ctx.Err()) {
-						return err
-					}
-					logger.Get(ctx).Error("DNS server failed", zap.Error(err))
+			return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+				spawn("udp", parallel.Fail, func(ctx context.Context) error {
+					return runListener(ctx, s.runUDP)
+				})
+				spawn("tcp", parallel.Fail, func(ctx context.Context) error {
+					return runListener(ctx, s.runTCP)
+				})
+				if s.certs != nil && config.TLS.DoTPort != 0 {
+					spawn("dot", parallel.Fail, func(ctx context.Context) error {
+						return runListener(ctx, s.runDoT)
+					})
 				}
-			}
+				if s.certs != nil && config.TLS.DoHPort != 0 {
+					spawn("doh", parallel.Fail, func(ctx context.Context) error {
+						return runListener(ctx, s.runDoH)
+					})
+				}
+				return nil
+			})
 		})
 
 		return nil
 	})
 }
 
-//nolint:gocyclo
-func runResolver(
-	ctx context.Context,
-	config Config,
-	forwardCh chan<- forwardRequest,
-	acmeServer *acme.Handler,
-	dkimServer *dkim.Handler,
-) error {
+func runListener(ctx context.Context, listener func(ctx context.Context) error) error {
+	for {
+		if err := listener(ctx); err != nil {
+			if errors.Is(err, ctx.Err()) {
+				return err
+			}
+			logger.Get(ctx).Error("DNS server failed", zap.Error(err))
+		}
+	}
+}
+
+func newServer(ctx context.Context, config Config) (*server, error) {
+	if config.DNSSEC != nil {
+		if err := validateDNSSECConfig(*config.DNSSEC); err != nil {
+			return nil, err
+		}
+	}
+
+	zones := make(map[string]ZoneConfig, len(config.Zones))
+	for domain, zConfig := range config.Zones {
+		zConfig.UpdateKeys = normalizeUpdateKeys(zConfig.UpdateKeys)
+		zones[domain] = zConfig
+	}
+	config.Zones = zones
+
+	s := &server{
+		config:      config,
+		secondaries: map[string]*secondary{},
+		viewSigners: map[string]*zoneSigner{},
+		updates:     map[string]ZoneConfig{},
+	}
+	if config.Cookies {
+		if _, err := rand.Read(s.cookieSecret[:]); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	s.zones.Store(&map[string]*zone{})
+	for _, zConfig := range config.Zones {
+		if config.UpdatesDir != "" && len(zConfig.UpdateKeys) > 0 {
+			records, err := loadUpdates(s.updatesFile(zConfig.Domain), zConfig)
+			if err != nil {
+				return nil, err
+			}
+			s.updates[zConfig.Domain] = records
+			zConfig = mergeZoneConfig(zConfig, records)
+		}
+		if err := s.setZone(ctx, zConfig); err != nil {
+			return nil, err
+		}
+	}
+	for _, vConfig := range config.Views {
+		v := &view{
+			Config: vConfig,
+			Zones:  map[string]*zone{},
+		}
+		for _, zConfig := range vConfig.Zones {
+			z := newZone(zConfig, config.DKIMWaveConfig != nil)
+			switch defaultZone := (*s.zones.Load())[zConfig.Domain]; {
+			case defaultZone != nil:
+				z.Signer = defaultZone.Signer
+			case config.DNSSEC != nil:
+				// Zone served only by views is signed with its own keys shared by all the views.
+				signer := s.viewSigners[zConfig.Domain]
+				if signer == nil {
+					var err error
+					signer, err = newZoneSigner(ctx, zConfig.Domain, *config.DNSSEC)
+					if err != nil {
+						return nil, err
+					}
+					s.viewSigners[zConfig.Domain] = signer
+				}
+				z.Signer = signer
+			}
+			v.Zones[zConfig.Domain] = z
+		}
+		s.views = append(s.views, v)
+	}
+	for domain, sConfig := range config.Secondaries {
+		s.secondaries[domain] = &secondary{
+			Config:   sConfig,
+			NotifyCh: make(chan struct{}, 1),
+		}
+	}
+	return s, nil
+}
+
+// view stores zones served to the clients from specific networks.
+type view struct {
+	Config ViewConfig
+	Zones  map[string]*zone
+}
+
+type server struct {
+	config          Config
+	zones           atomic.Pointer[map[string]*zone]
+	views           []*view
+	zonesMu         sync.Mutex
+	secondaries     map[string]*secondary
+	viewSigners     map[string]*zoneSigner
+	updates         map[string]ZoneConfig
+	updatesMu       sync.Mutex
+	notifyCh        chan struct{}
+	forwarder       *forwarder
+	forwardCh       chan<- forwardRequest
+	acmeServer      *acme.Handler
+	dkimServer      *dkim.Handler
+	discoveryServer *discovery.Handler
+	limiter         *rateLimiter
+	observer        *queryObserver
+	health          *healthChecker
+	certs           *certificate.Store
+	cookieSecret    [32]byte
+	queryID         atomic.Uint64
+}
+
+// setZone adds or replaces the zone served by the server.
+func (s *server) setZone(ctx context.Context, zConfig ZoneConfig) error {
+	s.zonesMu.Lock()
+	defer s.zonesMu.Unlock()
+
+	zones := *s.zones.Load()
+	z := newZone(zConfig, s.config.DKIMWaveConfig != nil)
+	if oldZone := zones[zConfig.Domain]; oldZone != nil {
+		z.Signer = oldZone.Signer
+	} else if signer := s.viewSigners[zConfig.Domain]; signer != nil {
+		z.Signer = signer
+	} else if s.config.DNSSEC != nil {
+		var err error
+		z.Signer, err = newZoneSigner(ctx, zConfig.Domain, *s.config.DNSSEC)
+		if err != nil {
+			return err
+		}
+	}
+
+	zones = maps.Clone(zones)
+	zones[zConfig.Domain] = z
+	s.zones.Store(&zones)
+	return nil
+}
+
+// removeZone stops serving the zone.
+func (s *server) removeZone(domain string) {
+	s.zonesMu.Lock()
+	defer s.zonesMu.Unlock()
+
+	zones := maps.Clone(*s.zones.Load())
+	delete(zones, domain)
+	s.zones.Store(&zones)
+}
+
+func (s *server) runUDP(ctx context.Context) error {
 	conn, err := net.ListenUDP("udp4", &net.UDPAddr{
 		IP:   net.IPv4zero,
-		Port: int(config.DNSPort),
+		Port: int(s.config.DNSPort),
 	})
 	if err != nil {
 		return errors.WithStack(err)
@@ -135,10 +385,8 @@ func runResolver(
 			ooBuff := make([]byte, bufferSize)
 			massBuff := mass.New[byte](100 * bufferSize)
 
-			var queryID uint64
 			cm := &ipv4.ControlMessage{}
 
-		loop:
 			for {
 				n, noob, _, addr, err := conn.ReadMsgUDP(buff, ooBuff)
 				if err != nil {
@@ -152,147 +400,165 @@ func runResolver(
 				}
 				cm.Src, cm.Dst = cm.Dst, nil
 
-				h, ok := readHeader(buff[:n])
-				if !ok || h.QR || h.TC || h.QDCount == 0 || h.RCode != 0x00 || h.ANCount != 0 || h.NSCount != 0 {
-					h.RCode = rCodeFormatError
-					if err := sendError(h, addr, conn, buff, cm); err != nil {
-						return err
+				start := time.Now()
+				logged := s.observer.Query(buff[:n])
+
+				resp, forward := s.handle(ctx, buff, n, addr.IP, false)
+				if forward {
+					query := massBuff.NewSlice(uint64(n))
+					copy(query, buff)
+					if s.forward(query, false, func(b []byte) error {
+						s.observer.Observe(ctx, *s.zones.Load(), logged, b, addr, transportUDP, true, start)
+						_, err := conn.WriteTo(b, addr)
+						return errors.WithStack(err)
+					}) {
+						continue
 					}
-					continue loop
+					resp = failure(buff, n, rCodeServerFailure)
 				}
-				if h.Opcode != 0x00 || h.QDCount > 1 {
-					h.RCode = rCodeNotImplemented
-					if err := sendError(h, addr, conn, buff, cm); err != nil {
-						return err
-					}
-					continue loop
+				if resp == nil {
+					// Response has been dropped by the rate limiter.
+					continue
 				}
+				s.observer.Observe(ctx, *s.zones.Load(), logged, resp, addr, transportUDP, false, start)
 
-				arCount := h.ARCount
-
-				h.QR = true
-				h.AA = true
-				h.RA = h.RD && forwardCh != nil && forwardingAllowed(addr, config.ForwardFor)
-				h.QDCount = 0
-				h.ANCount = 0
-				h.NSCount = 0
-				h.ARCount = 0
-
-				q, b, ok := readQuery(buff[headerSize:n])
-				if !ok || q.QName == "" {
-					h.RCode = rCodeFormatError
-					if err := sendError(h, addr, conn, buff, cm); err != nil {
-						return err
-					}
-					continue loop
+				if _, _, err := conn.WriteMsgUDP(resp, cm.Marshal(), addr); err != nil {
+					return errors.WithStack(err)
 				}
+			}
+		})
 
-				var maxMsgLength uint16 = defaultMaxMsgLength
-
-				var opt *rRecord
-				for range arCount {
-					var r rRecord
-					var ok bool
-
-					r, b, ok = readRecord(b)
-					if !ok || uint16(len(b)) < r.RDLength {
-						h.RCode = rCodeFormatError
-						if err := sendError(h, addr, conn, buff, cm); err != nil {
-							return err
-						}
-						continue loop
-					}
-					b = b[r.RDLength:]
-
-					if r.Type != typeOPT {
-						continue
-					}
-
-					if opt != nil || r.Name != "" || r.Class < defaultMaxMsgLength {
-						h.RCode = rCodeFormatError
-						if err := sendError(h, addr, conn, buff, cm); err != nil {
-							return err
-						}
-						continue loop
-					}
+		return nil
+	})
+}
 
-					opt = &r
+func (s *server) runTCP(ctx context.Context) error {
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{
+		IP:   net.IPv4zero,
+		Port: int(s.config.DNSPort),
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
 
-					opt.TTL = 0
-					opt.RDLength = 0
+	return s.serveStream(ctx, l, transportTCP)
+}
 
-					if opt.Class > bufferSize {
-						opt.Class = bufferSize
+// serveStream serves DNS messages sent over the connections accepted by the listener. Transport is reported
+// in metrics and query logs.
+func (s *server) serveStream(ctx context.Context, l net.Listener, transport string) error {
+	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		spawn("watchdog", parallel.Fail, func(ctx context.Context) error {
+			<-ctx.Done()
+			_ = l.Close()
+			return errors.WithStack(ctx.Err())
+		})
+		spawn("server", parallel.Fail, func(ctx context.Context) error {
+			connCh := make(chan struct{}, maxTCPConnections)
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					if ctx.Err() != nil {
+						return errors.WithStack(ctx.Err())
 					}
+					return errors.WithStack(err)
+				}
 
-					maxMsgLength = opt.Class
+				select {
+				case connCh <- struct{}{}:
+				default:
+					// Too many connections.
+					_ = conn.Close()
+					continue
 				}
 
-				b = putQuery(q, buff[headerSize:headerSize], &h, maxMsgLength)
+				spawn("client", parallel.Continue, func(ctx context.Context) error {
+					defer func() {
+						<-connCh
+					}()
 
-				if q.QClass != classInternet {
-					h.RCode = rCodeNotImplemented
-					if err := sendError(h, addr, conn, b, cm); err != nil {
-						return err
+					if err := s.serveTCP(ctx, conn, transport); err != nil && !errors.Is(err, io.EOF) {
+						logger.Get(ctx).Debug("DNS TCP connection failed", zap.Error(err))
 					}
-					continue loop
-				}
+					return nil
+				})
+			}
+		})
 
-				q.QName = strings.ToLower(q.QName)
-				zConfig, ok := zone(q.QName, config.Zones)
-				//nolint:nestif
-				if !ok {
-					if h.RA {
-						fBuff := massBuff.NewSlice(uint64(n))
-						copy(fBuff, buff)
-						doneCh := make(chan struct{}, 1)
-						doneCh <- struct{}{}
-
-						var successCount uint64
-						for fi := range uint64(len(config.ForwardTo)) {
-							select {
-							case forwardCh <- forwardRequest{
-								ForwardIPIndex: fi,
-								Query:          fBuff,
-								Conn:           conn,
-								Address:        addr,
-								DoneCh:         doneCh,
-							}:
-								successCount++
-							default:
-							}
-						}
-						if successCount == 0 {
-							h.RCode = rCodeServerFailure
-							if err := sendError(h, addr, conn, b, cm); err != nil {
-								return err
-							}
-						}
-						continue loop
-					}
+		return nil
+	})
+}
 
-					h.RCode = rCodeRefused
-					if err := sendError(h, addr, conn, b, cm); err != nil {
-						return err
-					}
+func (s *server) serveTCP(ctx context.Context, conn net.Conn, transport string) error {
+	defer conn.Close()
 
-					continue loop
+	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		spawn("watchdog", parallel.Exit, func(ctx context.Context) error {
+			<-ctx.Done()
+			_ = conn.Close()
+			return errors.WithStack(ctx.Err())
+		})
+		spawn("client", parallel.Exit, func(ctx context.Context) error {
+			// Responses might be sent concurrently by forwarders.
+			var mu sync.Mutex
+			respond := func(b []byte) error {
+				mu.Lock()
+				defer mu.Unlock()
+
+				if err := conn.SetWriteDeadline(time.Now().Add(tcpIdleTimeout)); err != nil {
+					return errors.WithStack(err)
 				}
+				_, err := conn.Write(b)
+				return errors.WithStack(err)
+			}
 
-				queryID++
-				b = resolve(q, zConfig, b, queryID, acmeServer, dkimServer, &h, maxMsgLength)
+			// The first two bytes of each message store its length.
+			tcpBuff := make([]byte, 2+maxTCPMsgLength)
+			buff := tcpBuff[2:]
+			for {
+				if err := conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout)); err != nil {
+					return errors.WithStack(err)
+				}
+				if _, err := io.ReadFull(conn, tcpBuff[:2]); err != nil {
+					return errors.WithStack(err)
+				}
+				n := int(binary.BigEndian.Uint16(tcpBuff))
+				if _, err := io.ReadFull(conn, buff[:n]); err != nil {
+					return errors.WithStack(err)
+				}
 
-				if opt != nil {
-					b = putRecord(*opt, b, &h, maxMsgLength)
+				reply := func(resp []byte) error {
+					binary.BigEndian.PutUint16(tcpBuff, uint16(len(resp)))
+					return respond(tcpBuff[:2+len(resp)])
 				}
 
-				putHeader(h, buff[:0])
+				clientIP := conn.RemoteAddr().(*net.TCPAddr).IP
+				if isTransferQuery(buff[:n]) {
+					if err := s.transfer(buff, n, clientIP, reply); err != nil {
+						return err
+					}
+					continue
+				}
 
-				if h.RCode != rCodeOK {
-					b = nil
+				start := time.Now()
+				logged := s.observer.Query(buff[:n])
+
+				resp, forward := s.handle(ctx, buff, n, clientIP, true)
+				if forward {
+					query := make([]byte, n)
+					copy(query, buff)
+					if s.forward(query, true, func(b []byte) error {
+						s.observer.Observe(ctx, *s.zones.Load(), logged, b, conn.RemoteAddr(), transport, true, start)
+						return respond(append(binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(b)),
+							uint16(len(b))), b...))
+					}) {
+						continue
+					}
+					resp = failure(buff, n, rCodeServerFailure)
 				}
+				s.observer.Observe(ctx, *s.zones.Load(), logged, resp, conn.RemoteAddr(), transport, false, start)
 
-				if _, _, err := conn.WriteMsgUDP(buff[:headerSize+len(b)], cm.Marshal(), addr); err != nil {
+				if err := reply(resp); err != nil {
 					return err
 				}
 			}
@@ -302,70 +568,358 @@ func runResolver(
 	})
 }
 
-func forwardingAllowed(addr *net.UDPAddr, forwardFor []net.IPNet) bool {
-	for _, n := range forwardFor {
-		if n.Contains(addr.IP) {
+// handle processes the query stored in buff[:n] and writes response to the same buffer. If query should be
+// forwarded, buffer is left untouched and true is returned.
+//
+//nolint:gocyclo
+func (s *server) handle(ctx context.Context, buff []byte, n int, clientIP net.IP, tcp bool) ([]byte, bool) {
+	h, ok := readHeader(buff[:n])
+	if !ok || h.QR || h.TC || h.QDCount == 0 || h.RCode != 0x00 {
+		return failure(buff, n, rCodeFormatError), false
+	}
+	if (h.Opcode != opcodeQuery && h.Opcode != opcodeNotify && h.Opcode != opcodeUpdate) || h.QDCount > 1 {
+		return failure(buff, n, rCodeNotImplemented), false
+	}
+
+	q, b, ok := readQuery(buff[headerSize:n])
+	if !ok || q.QName == "" {
+		return failure(buff, n, rCodeFormatError), false
+	}
+
+	switch {
+	case h.Opcode == opcodeNotify:
+		return s.handleNotify(buff, n, h, q, clientIP), false
+	case h.Opcode == opcodeUpdate:
+		return s.handleUpdate(ctx, buff, n, h, q, tcp), false
+	case q.QType == typeAXFR || q.QType == typeIXFR:
+		return s.handleTransferUDP(buff, n, h, q, clientIP), false
+	case h.ANCount != 0 || h.NSCount != 0:
+		return failure(buff, n, rCodeFormatError), false
+	}
+
+	var maxMsgLength uint16 = defaultMaxMsgLength
+
+	var opt *rRecord
+	var clientCookie []byte
+	var cookieValid bool
+	for range h.ARCount {
+		var r rRecord
+		var ok bool
+
+		r, b, ok = readRecord(b)
+		if !ok || uint16(len(b)) < r.RDLength {
+			return failure(buff, n, rCodeFormatError), false
+		}
+		rdata := b[:r.RDLength]
+		b = b[r.RDLength:]
+
+		if r.Type != typeOPT {
+			continue
+		}
+
+		if opt != nil || r.Name != "" || r.Class < defaultMaxMsgLength {
+			return failure(buff, n, rCodeFormatError), false
+		}
+
+		if s.config.Cookies {
+			var serverCookie []byte
+			clientCookie, serverCookie, ok = readCookie(rdata)
+			if !ok {
+				return failure(buff, n, rCodeFormatError), false
+			}
+			// Buffer is reused by the response.
+			clientCookie = slices.Clone(clientCookie)
+			cookieValid = clientCookie != nil &&
+				s.verifyCookie(clientCookie, serverCookie, clientIP, time.Now())
+		}
+
+		opt = &r
+
+		// Only DO flag is copied to the response.
+		opt.TTL &= flagDO
+		opt.RDLength = 0
+
+		if opt.Class > bufferSize {
+			opt.Class = bufferSize
+		}
+
+		maxMsgLength = opt.Class
+	}
+	if tcp {
+		maxMsgLength = maxTCPMsgLength
+	}
+
+	if q.QClass != classInternet {
+		return failure(buff, n, rCodeNotImplemented), false
+	}
+
+	v := s.view(clientIP)
+	ra := h.RD && s.forwardCh != nil && s.forwardingAllowed(clientIP, v)
+	qName := strings.ToLower(q.QName)
+	z, ok := s.findZone(qName, v)
+	if !ok {
+		if ra {
+			return nil, true
+		}
+		if !tcp && !cookieValid &&
+			s.limiter.Limit(clientIP, rCodeRefused, "", 0, time.Now()) == rrlDrop {
+			return nil, false
+		}
+		return failure(buff, n, rCodeRefused), false
+	}
+
+	h.QR = true
+	h.AA = true
+	h.RA = ra
+	h.QDCount = 0
+	h.ANCount = 0
+	h.NSCount = 0
+	h.ARCount = 0
+
+	b = putQuery(q, buff[headerSize:headerSize], &h, maxMsgLength)
+	qLength := len(b)
+
+	if !h.TC {
+		q.QName = qName
+		b = s.resolve(q, z, b, s.queryID.Add(1), &h, maxMsgLength, opt != nil && opt.TTL&flagDO != 0)
+	}
+
+	if !tcp && !cookieValid {
+		// Negative responses are limited per zone.
+		name, qType := z.Config.Domain, uint16(0)
+		if h.RCode == rCodeOK && h.ANCount > 0 {
+			name, qType = q.QName, q.QType
+		}
+		switch s.limiter.Limit(clientIP, h.RCode, name, qType, time.Now()) {
+		case rrlDrop:
+			return nil, false
+		case rrlSlip:
+			h.TC = true
+		}
+	}
+
+	// Only the question is returned if response is truncated or failed.
+	if h.TC || (h.RCode != rCodeOK && h.RCode != rCodeNameError) {
+		b = buff[headerSize : headerSize+qLength]
+		h.ANCount = 0
+		h.NSCount = 0
+		h.ARCount = 0
+	}
+
+	if opt != nil {
+		var serverCookie []byte
+		if clientCookie != nil {
+			serverCookie = s.serverCookie(clientCookie, clientIP, uint32(time.Now().Unix()))
+			opt.RDLength = 4 + uint16(len(clientCookie)+len(serverCookie))
+		}
+
+		h.Section = sectionAdditional
+		if b2 := putRecord(*opt, b, &h, maxMsgLength); b2 != nil {
+			b = b2
+			if clientCookie != nil {
+				b = putCookie(clientCookie, serverCookie, b)
+			}
+		}
+	}
+
+	putHeader(h, buff[:0])
+
+	return buff[:headerSize+len(b)], false
+}
+
+// forward responds to the query using cache or sends it to forwarders. False is returned if query can't be
+// forwarded.
+func (s *server) forward(query []byte, tcp bool, respond func(b []byte) error) bool {
+	q, ok := parseForwardQuery(query, tcp)
+	if !ok {
+		return false
+	}
+	if s.forwarder.Cached(q, respond) {
+		return true
+	}
+
+	select {
+	case s.forwardCh <- forwardRequest{
+		Query:   q,
+		Respond: respond,
+	}:
+		return true
+	default:
+		return false
+	}
+}
+
+// view returns the view matching the client, or nil if there is no such view.
+func (s *server) view(clientIP net.IP) *view {
+	for _, v := range s.views {
+		if ipAllowed(clientIP, v.Config.Networks) {
+			return v
+		}
+	}
+	return nil
+}
+
+// findZone returns zone for the name. Zones of the view are preferred over the default ones.
+func (s *server) findZone(qName string, v *view) (*zone, bool) {
+	if v != nil {
+		if z, ok := findZone(qName, v.Zones); ok {
+			return z, true
+		}
+	}
+	return findZone(qName, *s.zones.Load())
+}
+
+func (s *server) forwardingAllowed(clientIP net.IP, v *view) bool {
+	if v != nil {
+		return v.Config.Forward
+	}
+	return ipAllowed(clientIP, s.config.ForwardFor)
+}
+
+func forwardingEnabled(config Config) bool {
+	if len(config.ForwardTo) == 0 {
+		return false
+	}
+	if len(config.ForwardFor) > 0 {
+		return true
+	}
+	for _, v := range config.Views {
+		if v.Forward {
 			return true
 		}
 	}
 	return false
 }
 
-func sendError(h header, addr *net.UDPAddr, conn *net.UDPConn, b []byte, cm *ipv4.ControlMessage) error {
+func ipAllowed(ip net.IP, networks []net.IPNet) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// failure writes error response to the buffer containing the query of length n.
+func failure(b []byte, n int, rCode uint8) []byte {
+	h, _ := readHeader(b[:n])
 	h.QR = true
 	h.AA = true
 	h.TC = false
 	h.RA = false
+	h.RCode = rCode
 	h.QDCount = 0
 	h.ANCount = 0
 	h.NSCount = 0
 	h.ARCount = 0
 
 	putHeader(h, b[:0])
-	_, _, err := conn.WriteMsgUDP(b[:headerSize], cm.Marshal(), addr)
-	return errors.WithStack(err)
+	return b[:headerSize]
 }
 
 //nolint:gocyclo
-func resolve(
+func (s *server) resolve(
 	q query,
-	zConfig ZoneConfig,
+	z *zone,
 	b []byte,
 	queryID uint64,
-	acmeServer *acme.Handler,
-	dkimServer *dkim.Handler,
 	h *header,
 	maxMsgLength uint16,
+	dnssecOK bool,
 ) []byte {
-	switch q.QType {
-	case typeSOA:
-		if q.QName != zConfig.Domain {
-			h.RCode = rCodeNameError
+	var signer *zoneSigner
+	if dnssecOK {
+		signer = z.Signer
+	}
+
+	for i := 0; q.QType != typeCNAME; i++ {
+		alias := z.Config.Aliases[s.wildcard(z, q.QName)]
+		if alias.Target == "" {
+			break
+		}
+
+		// cycle protection
+		if i >= len(z.Config.Aliases) {
+			h.RCode = rCodeServerFailure
 			return b
 		}
 
-		email := strings.Replace(zConfig.Email, "@", ".", 1)
+		start := len(b)
 		b = putRecord(rRecord{
 			Name:     q.QName,
-			Type:     typeSOA,
+			Type:     typeCNAME,
 			Class:    classInternet,
 			TTL:      ttl,
-			RDLength: nameLen(zConfig.MainNameserver) + nameLen(email) + 20,
+			RDLength: nameLen(alias.Target),
 		}, b, h, maxMsgLength)
 		if h.TC {
 			return b
 		}
-		b = putName(zConfig.MainNameserver, b)
-		b = putName(email, b)
-		b = binary.BigEndian.AppendUint32(b, zConfig.SerialNumber)
-		b = binary.BigEndian.AppendUint32(b, ttl)
-		b = binary.BigEndian.AppendUint32(b, ttl)
-		b = binary.BigEndian.AppendUint32(b, ttl)
-		b = binary.BigEndian.AppendUint32(b, ttl)
+		b = putName(alias.Target, b)
+		b = signer.Sign(q.QName, typeCNAME, b, start, h, maxMsgLength)
+		if h.TC {
+			return b
+		}
 
+		q.QName = alias.Target
+		if !inZone(q.QName, z.Config.Domain) {
+			return b
+		}
+	}
+
+	source := s.wildcard(z, q.QName)
+	start := len(b)
+	b = s.putRRSet(q, source, z, b, queryID, h, maxMsgLength, s.health)
+	if h.TC {
 		return b
+	}
+	if len(b) > start {
+		return signer.Sign(q.QName, q.QType, b, start, h, maxMsgLength)
+	}
+
+	exists := s.exists(z, source)
+	if !exists {
+		h.RCode = rCodeNameError
+	}
+
+	h.Section = sectionAuthority
+	start = len(b)
+	b = putSOA(z.Config, b, h, maxMsgLength)
+	if h.TC {
+		return b
+	}
+	b = signer.Sign(z.Config.Domain, typeSOA, b, start, h, maxMsgLength)
+	if h.TC || signer == nil {
+		return b
+	}
+
+	return signer.PutDenial(q.QName, exists, func(name string) (bool, []uint16) {
+		name = s.wildcard(z, name)
+		return s.exists(z, name), s.types(z, name)
+	}, b, h, maxMsgLength)
+}
+
+//nolint:gocyclo
+func (s *server) putRRSet(
+	q query,
+	source string,
+	z *zone,
+	b []byte,
+	queryID uint64,
+	h *header,
+	maxMsgLength uint16,
+	health *healthChecker,
+) []byte {
+	zConfig := z.Config
+	apex := q.QName == zConfig.Domain
+
+	switch q.QType {
+	case typeSOA:
+		if apex {
+			b = putSOA(zConfig, b, h, maxMsgLength)
+		}
 	case typeNS:
-		if q.QName != zConfig.Domain || len(zConfig.Nameservers) == 0 {
+		if !apex {
 			return b
 		}
 
@@ -383,10 +937,8 @@ func resolve(
 			}
 			b = putName(ns, b)
 		}
-
-		return b
 	case typeMX:
-		if q.QName != zConfig.Domain || len(zConfig.MailExchanges) == 0 {
+		if !apex {
 			return b
 		}
 
@@ -404,24 +956,19 @@ func resolve(
 			b = binary.BigEndian.AppendUint16(b, p)
 			b = putName(d, b)
 		}
-
-		return b
-	}
-
-	for {
-		alias := zConfig.Aliases[q.QName]
-		if alias.Target == "" {
-			break
+	case typeDNSKEY:
+		if apex {
+			b = z.Signer.PutDNSKEYs(b, h, maxMsgLength)
 		}
-
-		// cycle protection
-		if alias.QueryID == queryID {
-			h.RCode = rCodeServerFailure
+	case typeNSEC3PARAM:
+		if apex {
+			b = z.Signer.PutNSEC3Param(b, h, maxMsgLength)
+		}
+	case typeCNAME:
+		alias := zConfig.Aliases[source]
+		if alias.Target == "" {
 			return b
 		}
-		alias.QueryID = queryID
-		zConfig.Aliases[q.QName] = alias
-
 		b = putRecord(rRecord{
 			Name:     q.QName,
 			Type:     typeCNAME,
@@ -433,46 +980,43 @@ func resolve(
 			return b
 		}
 		b = putName(alias.Target, b)
-
-		if q.QType == typeCNAME {
-			return b
-		}
-
-		q.QName = alias.Target
-	}
-
-	switch q.QType {
-	case typeCNAME:
 	case typeA:
-		ips := zConfig.Domains[q.QName]
-		for i := range uint64(len(ips)) {
-			ip := ips[(queryID+i)%uint64(len(ips))]
+		b = putIPs(q.QName, typeA, health.Filter(zConfig, source, s.ips(zConfig, source)), b, queryID, h, maxMsgLength)
+	case typeAAAA:
+		b = putIPs(q.QName, typeAAAA, health.Filter(zConfig, source, zConfig.Domains6[source]), b, queryID, h, maxMsgLength)
+	case typeSRV:
+		for _, srv := range s.serviceLocators(zConfig, source) {
 			b = putRecord(rRecord{
 				Name:     q.QName,
-				Type:     typeA,
+				Type:     typeSRV,
 				Class:    classInternet,
 				TTL:      ttl,
-				RDLength: 4,
+				RDLength: 6 + nameLen(srv.Target),
 			}, b, h, maxMsgLength)
 			if h.TC {
 				return b
 			}
-			b = append(b, ip...)
+			b = binary.BigEndian.AppendUint16(b, srv.Priority)
+			b = binary.BigEndian.AppendUint16(b, srv.Weight)
+			b = binary.BigEndian.AppendUint16(b, srv.Port)
+			b = putName(srv.Target, b)
 		}
-	case typeTXT:
-		values := zConfig.Texts[q.QName]
-		if len(values) == 0 {
-			switch {
-			case acmeServer != nil && acme.IsACMEQuery(q.QName):
-				values = acmeServer.QueryTXT(q.QName)
-			case dkimServer != nil && dkim.IsDKIMQuery(q.QName, zConfig.Domain):
-				publicKey := dkimServer.PublicKey(q.QName, zConfig.Domain)
-				if publicKey != "" {
-					values = []string{"v=DKIM1;k=rsa;p=" + publicKey}
-				}
+	case typePTR:
+		for _, d := range zConfig.Pointers[source] {
+			b = putRecord(rRecord{
+				Name:     q.QName,
+				Type:     typePTR,
+				Class:    classInternet,
+				TTL:      ttl,
+				RDLength: nameLen(d),
+			}, b, h, maxMsgLength)
+			if h.TC {
+				return b
 			}
+			b = putName(d, b)
 		}
-		for _, v := range values {
+	case typeTXT:
+		for _, v := range s.texts(zConfig, source) {
 			iLength := len(v)
 			var oLength uint16
 			for iLength > 0 {
@@ -505,22 +1049,7 @@ func resolve(
 			}
 		}
 	case typeCAA:
-		var values []acme.CAA
-		if acmeServer != nil {
-			values = acmeServer.QueryCAA(q.QName)
-		}
-
-		// FIXME (wojciech): This causes issues if DNS responds to queries but does not receive ACME challenges.
-		if len(values) == 0 {
-			values = append(values, []acme.CAA{
-				{
-					Tag:   "issue",
-					Value: ";",
-				},
-			}...)
-		}
-
-		for _, v := range values {
+		for _, v := range s.caas(zConfig, source) {
 			b = putRecord(rRecord{
 				Name:     q.QName,
 				Type:     typeCAA,
@@ -541,19 +1070,128 @@ func resolve(
 	return b
 }
 
-func zone(qName string, zones map[string]ZoneConfig) (ZoneConfig, bool) {
+func (s *server) texts(zConfig ZoneConfig, name string) []string {
+	values := zConfig.Texts[name]
+	if len(values) > 0 {
+		return values
+	}
+
+	switch {
+	case s.acmeServer != nil && acme.IsACMEQuery(name):
+		return s.acmeServer.QueryTXT(name)
+	case s.dkimServer != nil && dkim.IsDKIMQuery(name, zConfig.Domain):
+		if publicKey := s.dkimServer.PublicKey(name, zConfig.Domain); publicKey != "" {
+			return []string{"v=DKIM1;k=rsa;p=" + publicKey}
+		}
+	}
+	return nil
+}
+
+func (s *server) ips(zConfig ZoneConfig, name string) []net.IP {
+	values := zConfig.Domains[name]
+	if len(values) == 0 && s.discoveryServer != nil && s.discoveryServer.IsDiscoveryQuery(name) {
+		return s.discoveryServer.IPs(name)
+	}
+	return values
+}
+
+func (s *server) serviceLocators(zConfig ZoneConfig, name string) []ServiceLocatorConfig {
+	values := zConfig.ServiceLocators[name]
+	if len(values) == 0 && s.discoveryServer != nil && s.discoveryServer.IsDiscoveryQuery(name) {
+		// Slice is shared by all the queries so it must never be appended to.
+		values = slices.Clone(values)
+		for _, v := range s.discoveryServer.ServiceLocators(name) {
+			values = append(values, ServiceLocatorConfig{
+				Target:   v.Target,
+				Port:     v.Port,
+				Priority: v.Priority,
+				Weight:   v.Weight,
+			})
+		}
+	}
+	return values
+}
+
+func (s *server) caas(zConfig ZoneConfig, name string) []CAAConfig {
+	values := zConfig.CAAs[name]
+	if s.acmeServer != nil {
+		// Slice is shared by all the queries so it must never be appended to.
+		values = slices.Clone(values)
+		for _, v := range s.acmeServer.QueryCAA(name) {
+			values = append(values, CAAConfig{
+				Flags: v.Flags,
+				Tag:   v.Tag,
+				Value: v.Value,
+			})
+		}
+	}
+	return values
+}
+
+func putSOA(zConfig ZoneConfig, b []byte, h *header, maxMsgLength uint16) []byte {
+	email := strings.Replace(zConfig.Email, "@", ".", 1)
+	b = putRecord(rRecord{
+		Name:     zConfig.Domain,
+		Type:     typeSOA,
+		Class:    classInternet,
+		TTL:      ttl,
+		RDLength: nameLen(zConfig.MainNameserver) + nameLen(email) + 20,
+	}, b, h, maxMsgLength)
+	if h.TC {
+		return b
+	}
+	b = putName(zConfig.MainNameserver, b)
+	b = putName(email, b)
+	b = binary.BigEndian.AppendUint32(b, zConfig.SerialNumber)
+	b = binary.BigEndian.AppendUint32(b, ttl)
+	b = binary.BigEndian.AppendUint32(b, ttl)
+	b = binary.BigEndian.AppendUint32(b, ttl)
+	return binary.BigEndian.AppendUint32(b, ttl)
+}
+
+func putIPs(
+	qName string,
+	qType uint16,
+	ips []net.IP,
+	b []byte,
+	queryID uint64,
+	h *header,
+	maxMsgLength uint16,
+) []byte {
+	for i := range uint64(len(ips)) {
+		ip := ips[(queryID+i)%uint64(len(ips))]
+		b = putRecord(rRecord{
+			Name:     qName,
+			Type:     qType,
+			Class:    classInternet,
+			TTL:      ttl,
+			RDLength: uint16(len(ip)),
+		}, b, h, maxMsgLength)
+		if h.TC {
+			return b
+		}
+		b = append(b, ip...)
+	}
+	return b
+}
+
+func findZone(qName string, zones map[string]*zone) (*zone, bool) {
 	for {
 		if zone, ok := zones[qName]; ok {
 			return zone, true
 		}
 		pos := strings.Index(qName, ".")
 		if pos < 0 {
-			return ZoneConfig{}, false
+			return nil, false
 		}
 		qName = qName[pos+1:]
 	}
 }
 
+func inZone(name, domain string) bool {
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
+
 func readHeader(b []byte) (header, bool) {
 	var h header
 
@@ -672,8 +1310,8 @@ func putHeader(h header, b []byte) {
 }
 
 func putQuery(q query, b []byte, h *header, maxMsgLength uint16) []byte {
-	length := uint16(len(b)) + nameLen(q.QName) + 4
-	if length > maxMsgLength {
+	length := len(b) + int(nameLen(q.QName)) + 4 + headerSize
+	if length > int(maxMsgLength) {
 		h.TC = true
 		return nil
 	}
@@ -685,16 +1323,19 @@ func putQuery(q query, b []byte, h *header, maxMsgLength uint16) []byte {
 }
 
 func putRecord(r rRecord, b []byte, h *header, maxMsgLength uint16) []byte {
-	length := uint16(len(b)) + nameLen(r.Name) + 10 + r.RDLength + headerSize
-	if length > maxMsgLength {
+	length := len(b) + int(nameLen(r.Name)) + 10 + int(r.RDLength) + headerSize
+	if length > int(maxMsgLength) {
 		h.TC = true
 		return nil
 	}
 
-	if r.Type == typeOPT {
-		h.ARCount++
-	} else {
+	switch h.Section {
+	case sectionAnswer:
 		h.ANCount++
+	case sectionAuthority:
+		h.NSCount++
+	default:
+		h.ARCount++
 	}
 	b = putName(r.Name, b)
 	b = binary.BigEndian.AppendUint16(b, r.Type)
@@ -721,6 +1362,9 @@ func nameLen(name string) uint16 {
 }
 
 type header struct {
+	// Section is the section new records are added to. It is not sent.
+	Section uint8
+
 	ID      uint16
 	QR      bool
 	Opcode  uint8
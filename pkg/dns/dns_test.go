@@ -0,0 +1,215 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	mdns "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/outofforest/cloudless/pkg/dns/acme"
+	"github.com/outofforest/cloudless/pkg/dns/acme/wire"
+	"github.com/outofforest/cloudless/pkg/wave"
+	"github.com/outofforest/logger"
+)
+
+func newTestContext() context.Context {
+	return logger.WithLogger(context.Background(), zap.NewNop())
+}
+
+func newTestServer(t *testing.T, configurators ...Configurator) *server {
+	config := Config{
+		Zones:       map[string]ZoneConfig{},
+		Secondaries: map[string]SecondaryConfig{},
+	}
+	for _, configurator := range configurators {
+		configurator(&config)
+	}
+	s, err := newServer(newTestContext(), config)
+	require.NoError(t, err)
+	return s
+}
+
+func exchange(t *testing.T, s *server, msg *mdns.Msg, tcp bool) *mdns.Msg {
+	return exchangeFrom(t, s, msg, tcp, net.IPv4(127, 0, 0, 1))
+}
+
+func exchangeFrom(t *testing.T, s *server, msg *mdns.Msg, tcp bool, clientIP net.IP) *mdns.Msg {
+	query, err := msg.Pack()
+	require.NoError(t, err)
+
+	buff := make([]byte, maxTCPMsgLength)
+	if !tcp {
+		buff = buff[:bufferSize]
+	}
+	n := copy(buff, query)
+
+	resp, forward := s.handle(newTestContext(), buff, n, clientIP, tcp)
+	require.False(t, forward)
+
+	respMsg := &mdns.Msg{}
+	require.NoError(t, respMsg.Unpack(resp))
+	return respMsg
+}
+
+func TestTCPLargeResponse(t *testing.T) {
+	values := []string{strings.Repeat("a", 1000), strings.Repeat("b", 1000)}
+	s := newTestServer(t, Zone("example.com", "ns1.example.com", "admin@example.com", 1,
+		Text("example.com", values...),
+	))
+
+	msg := &mdns.Msg{}
+	msg.SetQuestion("example.com.", mdns.TypeTXT)
+
+	resp := exchange(t, s, msg, false)
+	require.True(t, resp.Truncated)
+
+	resp = exchange(t, s, msg, true)
+	require.False(t, resp.Truncated)
+	require.Equal(t, mdns.RcodeSuccess, resp.Rcode)
+	require.Len(t, resp.Answer, 2)
+	require.Equal(t, values[0], strings.Join(resp.Answer[0].(*mdns.TXT).Txt, ""))
+	require.Equal(t, values[1], strings.Join(resp.Answer[1].(*mdns.TXT).Txt, ""))
+}
+
+func TestRecords(t *testing.T) {
+	s := newTestServer(t,
+		Zone("example.com", "ns1.example.com", "admin@example.com", 1,
+			Domain("host.example.com", "10.0.0.1", "2001:db8::1"),
+			ServiceLocator("_sip._tcp.example.com", "host.example.com", 5060, 10, 20),
+			CAA("example.com", 0, "issue", "letsencrypt.org"),
+		),
+		Zone("0.0.10.in-addr.arpa", "ns1.example.com", "admin@example.com", 1,
+			Pointer("10.0.0.1", "host.example.com"),
+		),
+		Zone("8.b.d.0.1.0.0.2.ip6.arpa", "ns1.example.com", "admin@example.com", 1,
+			Pointer("2001:db8::1", "host.example.com"),
+		),
+	)
+
+	query := func(name string, qType uint16) []mdns.RR {
+		msg := &mdns.Msg{}
+		msg.SetQuestion(name, qType)
+		resp := exchange(t, s, msg, false)
+		require.Equal(t, mdns.RcodeSuccess, resp.Rcode)
+		require.Len(t, resp.Answer, 1)
+		return resp.Answer
+	}
+
+	require.Equal(t, "10.0.0.1", query("host.example.com.", mdns.TypeA)[0].(*mdns.A).A.String())
+	require.Equal(t, "2001:db8::1", query("host.example.com.", mdns.TypeAAAA)[0].(*mdns.AAAA).AAAA.String())
+
+	srv := query("_sip._tcp.example.com.", mdns.TypeSRV)[0].(*mdns.SRV)
+	require.Equal(t, "host.example.com.", srv.Target)
+	require.Equal(t, uint16(5060), srv.Port)
+	require.Equal(t, uint16(10), srv.Priority)
+	require.Equal(t, uint16(20), srv.Weight)
+
+	caa := query("example.com.", mdns.TypeCAA)[0].(*mdns.CAA)
+	require.Equal(t, "issue", caa.Tag)
+	require.Equal(t, "letsencrypt.org", caa.Value)
+
+	require.Equal(t, "host.example.com.", query("1.0.0.10.in-addr.arpa.", mdns.TypePTR)[0].(*mdns.PTR).Ptr)
+	reverse, err := mdns.ReverseAddr("2001:db8::1")
+	require.NoError(t, err)
+	require.Equal(t, "host.example.com.", query(reverse, mdns.TypePTR)[0].(*mdns.PTR).Ptr)
+}
+
+func TestCAAConcurrent(t *testing.T) {
+	requireT := require.New(t)
+
+	s := newTestServer(t, Zone("example.com", "ns1.example.com", "admin@example.com", 1,
+		CAA("example.com", 0, "issue", "ca.example.org"),
+	))
+
+	// Spare capacity makes appending into the slice stored in the config visible to other queries.
+	zConfig := (*s.zones.Load())["example.com"].Config
+	zConfig.CAAs["example.com"] = slices.Grow(zConfig.CAAs["example.com"], 10)
+
+	s.acmeServer = acme.New(wave.Config{})
+	requireT.NoError(s.acmeServer.StoreRequest(&wire.MsgRequest{
+		Provider:   "letsencrypt.org",
+		AccountURI: "https://acme.example.org/account",
+		Challenges: []wire.Challenge{{Domain: "example.com", Value: "challenge"}},
+	}))
+
+	msg := &mdns.Msg{}
+	msg.SetQuestion("example.com.", mdns.TypeCAA)
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Go(func() {
+			for range 100 {
+				resp := exchange(t, s, msg, false)
+				require.Len(t, resp.Answer, 2)
+			}
+		})
+	}
+	wg.Wait()
+
+	requireT.Len(zConfig.CAAs["example.com"], 1)
+}
+
+func TestWildcard(t *testing.T) {
+	requireT := require.New(t)
+	s := newTestServer(t,
+		Zone("example.com", "ns1.example.com", "admin@example.com", 1,
+			Domain("*.apps.example.com", "10.0.0.1"),
+			Domain("static.apps.example.com", "10.0.0.2"),
+			Text("static.apps.example.com", "text"),
+			Domain("host.sub.apps.example.com", "10.0.0.3"),
+			Alias("*.web.example.com", "static.apps.example.com"),
+		),
+	)
+
+	query := func(name string, qType uint16) *mdns.Msg {
+		msg := &mdns.Msg{}
+		msg.SetQuestion(name, qType)
+		return exchange(t, s, msg, false)
+	}
+
+	resp := query("app1.apps.example.com.", mdns.TypeA)
+	requireT.Equal(mdns.RcodeSuccess, resp.Rcode)
+	requireT.Len(resp.Answer, 1)
+	requireT.Equal("app1.apps.example.com.", resp.Answer[0].Header().Name)
+	requireT.Equal("10.0.0.1", resp.Answer[0].(*mdns.A).A.String())
+
+	// Wildcard matches more labels.
+	resp = query("a.b.apps.example.com.", mdns.TypeA)
+	requireT.Len(resp.Answer, 1)
+	requireT.Equal("10.0.0.1", resp.Answer[0].(*mdns.A).A.String())
+
+	// Existing names are not replaced by wildcard.
+	resp = query("static.apps.example.com.", mdns.TypeA)
+	requireT.Len(resp.Answer, 1)
+	requireT.Equal("10.0.0.2", resp.Answer[0].(*mdns.A).A.String())
+
+	// Existing name without the type does not use wildcard.
+	resp = query("static.apps.example.com.", mdns.TypeAAAA)
+	requireT.Equal(mdns.RcodeSuccess, resp.Rcode)
+	requireT.Empty(resp.Answer)
+
+	// Wildcard does not match below existing empty non-terminal.
+	resp = query("other.sub.apps.example.com.", mdns.TypeA)
+	requireT.Equal(mdns.RcodeNameError, resp.Rcode)
+
+	// Wildcard without the type.
+	resp = query("app1.apps.example.com.", mdns.TypeTXT)
+	requireT.Equal(mdns.RcodeSuccess, resp.Rcode)
+	requireT.Empty(resp.Answer)
+
+	// Wildcard alias.
+	resp = query("site.web.example.com.", mdns.TypeA)
+	requireT.Len(resp.Answer, 2)
+	requireT.Equal("site.web.example.com.", resp.Answer[0].Header().Name)
+	requireT.Equal("static.apps.example.com.", resp.Answer[0].(*mdns.CNAME).Target)
+	requireT.Equal("10.0.0.2", resp.Answer[1].(*mdns.A).A.String())
+
+	resp = query("host.example.com.", mdns.TypeA)
+	requireT.Equal(mdns.RcodeNameError, resp.Rcode)
+}
@@ -0,0 +1,733 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec // SHA1 is required by NSEC3.
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/outofforest/logger"
+)
+
+const (
+	algorithmECDSAP256SHA256 = 13
+	protocolDNSSEC           = 3
+	flagZoneKey              = 0x0100
+	flagSEP                  = 0x0001
+	nsec3HashSHA1            = 1
+	digestSHA256             = 2
+
+	defaultZSKLifetime = 30 * 24 * time.Hour
+
+	// zskRolloverPeriod is the period new ZSK is published before it is used, and the old one is published after it
+	// is replaced.
+	zskRolloverPeriod = 24 * time.Hour
+
+	// kskRolloverPeriod is the period both old and new KSKs sign the keys, so DS record might be updated.
+	kskRolloverPeriod = 30 * 24 * time.Hour
+
+	keyRollingInterval = time.Hour
+	signatureValidity  = 7 * 24 * time.Hour
+	signatureCacheSize = 10000
+
+	maxNameLength  = 253
+	maxLabelLength = 63
+)
+
+var base32Hex = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+type storedKey struct {
+	KSK     bool      `json:"ksk"`
+	Created time.Time `json:"created"`
+	Key     []byte    `json:"key"`
+}
+
+type signingKey struct {
+	KSK        bool
+	Created    time.Time
+	PrivateKey *ecdsa.PrivateKey
+
+	// RData is the content of DNSKEY record.
+	RData []byte
+	Tag   uint16
+}
+
+type keySet struct {
+	// DNSKEYs are the published keys.
+	DNSKEYs []*signingKey
+
+	// ZSK is the key signing the zone records.
+	ZSK *signingKey
+
+	// KSKs are the keys signing DNSKEY records.
+	KSKs []*signingKey
+}
+
+// zoneSigner signs zone records on the fly.
+type zoneSigner struct {
+	NSEC3 bool
+
+	domain   string
+	config   DNSSECConfig
+	keysFile string
+	keys     atomic.Pointer[keySet]
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte][]byte
+}
+
+func validateDNSSECConfig(config DNSSECConfig) error {
+	if config.KeysDir == "" {
+		return errors.New("keys directory must be set")
+	}
+	if !filepath.IsAbs(config.KeysDir) {
+		return errors.Errorf("keys directory %q must be an absolute path", config.KeysDir)
+	}
+	if config.ZSKLifetime != 0 && config.ZSKLifetime <= zskRolloverPeriod {
+		return errors.Errorf("ZSK lifetime must be greater than %s", zskRolloverPeriod)
+	}
+	if config.KSKLifetime != 0 && config.KSKLifetime <= kskRolloverPeriod {
+		return errors.Errorf("KSK lifetime must be greater than %s", kskRolloverPeriod)
+	}
+	return nil
+}
+
+func newZoneSigner(ctx context.Context, domain string, config DNSSECConfig) (*zoneSigner, error) {
+	zs := &zoneSigner{
+		NSEC3:    config.NSEC3,
+		domain:   domain,
+		config:   config,
+		keysFile: filepath.Join(config.KeysDir, domain+".json"),
+		cache:    map[[sha256.Size]byte][]byte{},
+	}
+	if err := zs.Roll(ctx, time.Now()); err != nil {
+		return nil, err
+	}
+	return zs, nil
+}
+
+func (s *server) runKeyRolling(ctx context.Context) error {
+	log := logger.Get(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return errors.WithStack(ctx.Err())
+		case <-time.After(keyRollingInterval):
+		}
+
+		for _, z := range *s.zones.Load() {
+			if err := z.Signer.Roll(ctx, time.Now()); err != nil {
+				log.Error("Rolling DNSSEC keys failed", zap.String("zone", z.Config.Domain), zap.Error(err))
+			}
+		}
+		for domain, signer := range s.viewSigners {
+			if err := signer.Roll(ctx, time.Now()); err != nil {
+				log.Error("Rolling DNSSEC keys failed", zap.String("zone", domain), zap.Error(err))
+			}
+		}
+	}
+}
+
+// Roll generates new keys and retires the old ones according to the schedule.
+func (zs *zoneSigner) Roll(ctx context.Context, now time.Time) error {
+	stored, err := zs.loadKeys()
+	if err != nil {
+		return err
+	}
+
+	var zsks, ksks []*signingKey
+	for _, sk := range stored {
+		key, err := parseSigningKey(sk)
+		if err != nil {
+			return err
+		}
+		if key.KSK {
+			ksks = append(ksks, key)
+		} else {
+			zsks = append(zsks, key)
+		}
+	}
+
+	zsks, zskChanged, err := rollKeys(zsks, now, zs.config.ZSKLifetime, zskRolloverPeriod, false, nil)
+	if err != nil {
+		return err
+	}
+	ksks, kskChanged, err := rollKeys(ksks, now, zs.config.KSKLifetime, kskRolloverPeriod, true,
+		zs.config.PublishedDS[zs.domain])
+	if err != nil {
+		return err
+	}
+
+	if zskChanged || kskChanged {
+		if err := zs.storeKeys(append(append([]*signingKey{}, ksks...), zsks...)); err != nil {
+			return err
+		}
+	}
+
+	if kskChanged || zs.keys.Load() == nil {
+		for _, key := range ksks {
+			logger.Get(ctx).Info("DNSSEC key signing key", zap.String("zone", zs.domain),
+				zap.Uint16("tag", key.Tag), zap.String("ds", zs.ds(key)),
+				zap.Bool("dsPublished", slices.Contains(zs.config.PublishedDS[zs.domain], key.Tag)))
+		}
+	}
+
+	zs.keys.Store(&keySet{
+		DNSKEYs: append(append([]*signingKey{}, ksks...), zsks...),
+		ZSK:     activeKey(zsks, now, zskRolloverPeriod),
+		KSKs:    ksks,
+	})
+	return nil
+}
+
+// Sign adds RRSIG records for the RRSet stored in b[start:].
+func (zs *zoneSigner) Sign(
+	name string,
+	rrType uint16,
+	b []byte,
+	start int,
+	h *header,
+	maxMsgLength uint16,
+) []byte {
+	if zs == nil || len(b) == start {
+		return b
+	}
+
+	keys := zs.keys.Load()
+	signers := []*signingKey{keys.ZSK}
+	if rrType == typeDNSKEY {
+		signers = keys.KSKs
+	}
+
+	var rdatas [][]byte
+	for rrs := b[start:]; len(rrs) > 0; {
+		r, rest, _ := readRecord(rrs)
+		rdatas = append(rdatas, canonicalRData(rrType, rest[:r.RDLength]))
+		rrs = rest[r.RDLength:]
+	}
+	slices.SortFunc(rdatas, bytes.Compare)
+	rdatas = slices.CompactFunc(rdatas, bytes.Equal)
+
+	inception := time.Now().Truncate(time.Hour).Add(-time.Hour)
+	expiration := inception.Add(signatureValidity)
+	labels := uint8(strings.Count(name, ".") + 1)
+
+	for _, key := range signers {
+		rdata := binary.BigEndian.AppendUint16(nil, rrType)
+		rdata = append(rdata, algorithmECDSAP256SHA256, labels)
+		rdata = binary.BigEndian.AppendUint32(rdata, ttl)
+		rdata = binary.BigEndian.AppendUint32(rdata, uint32(expiration.Unix()))
+		rdata = binary.BigEndian.AppendUint32(rdata, uint32(inception.Unix()))
+		rdata = binary.BigEndian.AppendUint16(rdata, key.Tag)
+		rdata = putName(zs.domain, rdata)
+
+		data := rdata
+		owner := putName(name, nil)
+		for _, rd := range rdatas {
+			data = append(data, owner...)
+			data = binary.BigEndian.AppendUint16(data, rrType)
+			data = binary.BigEndian.AppendUint16(data, classInternet)
+			data = binary.BigEndian.AppendUint32(data, ttl)
+			data = binary.BigEndian.AppendUint16(data, uint16(len(rd)))
+			data = append(data, rd...)
+		}
+
+		signature, err := zs.signature(key, data)
+		if err != nil {
+			h.RCode = rCodeServerFailure
+			return b
+		}
+
+		b = putRecord(rRecord{
+			Name:     name,
+			Type:     typeRRSIG,
+			Class:    classInternet,
+			TTL:      ttl,
+			RDLength: uint16(len(rdata) + len(signature)),
+		}, b, h, maxMsgLength)
+		if h.TC {
+			return b
+		}
+		b = append(b, rdata...)
+		b = append(b, signature...)
+	}
+
+	return b
+}
+
+// PutDNSKEYs adds DNSKEY records.
+func (zs *zoneSigner) PutDNSKEYs(b []byte, h *header, maxMsgLength uint16) []byte {
+	if zs == nil {
+		return b
+	}
+
+	for _, key := range zs.keys.Load().DNSKEYs {
+		b = putRecord(rRecord{
+			Name:     zs.domain,
+			Type:     typeDNSKEY,
+			Class:    classInternet,
+			TTL:      ttl,
+			RDLength: uint16(len(key.RData)),
+		}, b, h, maxMsgLength)
+		if h.TC {
+			return b
+		}
+		b = append(b, key.RData...)
+	}
+	return b
+}
+
+// PutNSEC3Param adds NSEC3PARAM record.
+func (zs *zoneSigner) PutNSEC3Param(b []byte, h *header, maxMsgLength uint16) []byte {
+	if zs == nil || !zs.NSEC3 {
+		return b
+	}
+
+	b = putRecord(rRecord{
+		Name:     zs.domain,
+		Type:     typeNSEC3PARAM,
+		Class:    classInternet,
+		TTL:      ttl,
+		RDLength: 5,
+	}, b, h, maxMsgLength)
+	if h.TC {
+		return b
+	}
+	// Hash algorithm, flags, iterations and salt length.
+	return append(b, nsec3HashSHA1, 0, 0, 0, 0)
+}
+
+// PutDenial adds signed NSEC or NSEC3 records proving that the name or requested type does not exist.
+// Records are generated on the fly, as minimally covering ones.
+func (zs *zoneSigner) PutDenial(
+	qName string,
+	exists bool,
+	lookup func(name string) (bool, []uint16),
+	b []byte,
+	h *header,
+	maxMsgLength uint16,
+) []byte {
+	if exists {
+		_, types := lookup(qName)
+		if zs.NSEC3 {
+			return zs.putNSEC3(nsec3Hash(qName), 0, types, b, h, maxMsgLength)
+		}
+		return zs.putNSEC(qName, "\x00."+qName, types, b, h, maxMsgLength)
+	}
+
+	// Closest encloser is the longest existing ancestor, next closer is its child being an ancestor of the name.
+	closestEncloser, nextCloser := qName, qName
+	for closestEncloser != zs.domain {
+		nextCloser = closestEncloser
+		closestEncloser = parentName(closestEncloser)
+		if exists, _ := lookup(closestEncloser); exists {
+			break
+		}
+	}
+	wildcard := "*." + closestEncloser
+
+	if zs.NSEC3 {
+		_, types := lookup(closestEncloser)
+		b = zs.putNSEC3(nsec3Hash(closestEncloser), 0, types, b, h, maxMsgLength)
+		if h.TC {
+			return b
+		}
+		b = zs.putNSEC3(nsec3Hash(nextCloser), -1, nil, b, h, maxMsgLength)
+		if h.TC {
+			return b
+		}
+		return zs.putNSEC3(nsec3Hash(wildcard), -1, nil, b, h, maxMsgLength)
+	}
+
+	b = zs.putNSEC(prevName(nextCloser), subtreeEnd(nextCloser), nil, b, h, maxMsgLength)
+	if h.TC || wildcard == nextCloser {
+		return b
+	}
+	return zs.putNSEC(prevName(wildcard), subtreeEnd(wildcard), nil, b, h, maxMsgLength)
+}
+
+func (zs *zoneSigner) putNSEC(owner, next string, types []uint16, b []byte, h *header, maxMsgLength uint16) []byte {
+	bitmap := typeBitmap(append(types, typeRRSIG, typeNSEC))
+
+	start := len(b)
+	b = putRecord(rRecord{
+		Name:     owner,
+		Type:     typeNSEC,
+		Class:    classInternet,
+		TTL:      ttl,
+		RDLength: nameLen(next) + uint16(len(bitmap)),
+	}, b, h, maxMsgLength)
+	if h.TC {
+		return b
+	}
+	b = putName(next, b)
+	b = append(b, bitmap...)
+	return zs.Sign(owner, typeNSEC, b, start, h, maxMsgLength)
+}
+
+// putNSEC3 adds NSEC3 record. If offset is 0, record matches the hash. If it is -1, record covers it.
+func (zs *zoneSigner) putNSEC3(
+	hash [sha1.Size]byte,
+	offset int,
+	types []uint16,
+	b []byte,
+	h *header,
+	maxMsgLength uint16,
+) []byte {
+	if len(types) > 0 {
+		types = append(types, typeRRSIG)
+	}
+	bitmap := typeBitmap(types)
+
+	ownerHash := addToHash(hash, offset)
+	nextHash := addToHash(hash, 1)
+	owner := strings.ToLower(base32Hex.EncodeToString(ownerHash[:])) + "." + zs.domain
+
+	start := len(b)
+	b = putRecord(rRecord{
+		Name:     owner,
+		Type:     typeNSEC3,
+		Class:    classInternet,
+		TTL:      ttl,
+		RDLength: 6 + sha1.Size + uint16(len(bitmap)),
+	}, b, h, maxMsgLength)
+	if h.TC {
+		return b
+	}
+	// Hash algorithm, flags, iterations, salt length and hash length.
+	b = append(b, nsec3HashSHA1, 0, 0, 0, 0, sha1.Size)
+	b = append(b, nextHash[:]...)
+	b = append(b, bitmap...)
+	return zs.Sign(owner, typeNSEC3, b, start, h, maxMsgLength)
+}
+
+func (zs *zoneSigner) signature(key *signingKey, data []byte) ([]byte, error) {
+	hash := sha256.Sum256(data)
+
+	zs.mu.Lock()
+	signature, exists := zs.cache[hash]
+	zs.mu.Unlock()
+
+	if exists {
+		return signature, nil
+	}
+
+	// Signing is slow, so it is done outside the lock. Concurrent queries might sign the same data, which is harmless.
+	r, s, err := ecdsa.Sign(rand.Reader, key.PrivateKey, hash[:])
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	signature = make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	zs.mu.Lock()
+	defer zs.mu.Unlock()
+
+	if len(zs.cache) >= signatureCacheSize {
+		clear(zs.cache)
+	}
+	zs.cache[hash] = signature
+
+	return signature, nil
+}
+
+// ds returns DS record of the key in presentation format.
+func (zs *zoneSigner) ds(key *signingKey) string {
+	digest := sha256.Sum256(append(putName(zs.domain, nil), key.RData...))
+	return fmt.Sprintf("%d %d %d %X", key.Tag, algorithmECDSAP256SHA256, digestSHA256, digest)
+}
+
+func (zs *zoneSigner) loadKeys() ([]storedKey, error) {
+	content, err := os.ReadFile(zs.keysFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+
+	var keys []storedKey
+	if err := json.Unmarshal(content, &keys); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return keys, nil
+}
+
+func (zs *zoneSigner) storeKeys(keys []*signingKey) error {
+	stored := make([]storedKey, 0, len(keys))
+	for _, key := range keys {
+		keyRaw, err := x509.MarshalECPrivateKey(key.PrivateKey)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		stored = append(stored, storedKey{
+			KSK:     key.KSK,
+			Created: key.Created,
+			Key:     keyRaw,
+		})
+	}
+
+	content, err := json.Marshal(stored)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(zs.keysFile), 0o700); err != nil {
+		return errors.WithStack(err)
+	}
+	tmpFile := zs.keysFile + ".tmp"
+	if err := os.WriteFile(tmpFile, content, 0o600); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmpFile, zs.keysFile))
+}
+
+// rollKeys generates new key if the newest one is about to expire, and removes keys replaced long time ago.
+// Key signing key is removed only if DS record of its successor is published.
+func rollKeys(
+	keys []*signingKey,
+	now time.Time,
+	lifetime, rolloverPeriod time.Duration,
+	ksk bool,
+	publishedDS []uint16,
+) ([]*signingKey, bool, error) {
+	slices.SortFunc(keys, func(a, b *signingKey) int {
+		return a.Created.Compare(b.Created)
+	})
+
+	var changed bool
+	if len(keys) == 0 {
+		// The first key is used immediately.
+		key, err := newSigningKey(ksk, now.Add(-rolloverPeriod))
+		if err != nil {
+			return nil, false, err
+		}
+		keys = append(keys, key)
+		changed = true
+	}
+
+	// Next key signing key is not generated until the previous rollover is completed by publishing DS record.
+	if lifetime > 0 && (!ksk || len(keys) == 1) && now.Sub(keys[len(keys)-1].Created) >= lifetime-rolloverPeriod {
+		key, err := newSigningKey(ksk, now)
+		if err != nil {
+			return nil, false, err
+		}
+		keys = append(keys, key)
+		changed = true
+	}
+
+	// Key is replaced when its successor becomes active, and it is removed one rollover period later.
+	for len(keys) > 1 && now.Sub(keys[1].Created) >= 2*rolloverPeriod {
+		if ksk && !slices.Contains(publishedDS, keys[1].Tag) {
+			break
+		}
+		keys = keys[1:]
+		changed = true
+	}
+
+	return keys, changed, nil
+}
+
+// activeKey returns the newest key published for at least the rollover period.
+func activeKey(keys []*signingKey, now time.Time, rolloverPeriod time.Duration) *signingKey {
+	for i := len(keys) - 1; i > 0; i-- {
+		if now.Sub(keys[i].Created) >= rolloverPeriod {
+			return keys[i]
+		}
+	}
+	return keys[0]
+}
+
+func newSigningKey(ksk bool, created time.Time) (*signingKey, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return signingKeyFromPrivate(ksk, created, privateKey)
+}
+
+func parseSigningKey(sk storedKey) (*signingKey, error) {
+	privateKey, err := x509.ParseECPrivateKey(sk.Key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return signingKeyFromPrivate(sk.KSK, sk.Created, privateKey)
+}
+
+func signingKeyFromPrivate(ksk bool, created time.Time, privateKey *ecdsa.PrivateKey) (*signingKey, error) {
+	publicKey, err := privateKey.PublicKey.Bytes()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var flags uint16 = flagZoneKey
+	if ksk {
+		flags |= flagSEP
+	}
+
+	rdata := binary.BigEndian.AppendUint16(nil, flags)
+	rdata = append(rdata, protocolDNSSEC, algorithmECDSAP256SHA256)
+	// Uncompressed point prefix is not included.
+	rdata = append(rdata, publicKey[1:]...)
+
+	return &signingKey{
+		KSK:        ksk,
+		Created:    created,
+		PrivateKey: privateKey,
+		RData:      rdata,
+		Tag:        keyTag(rdata),
+	}, nil
+}
+
+// canonicalRData returns the copy of rdata with domain names converted to lowercase, as required by
+// the canonical form of the RR (RFC 4034 section 6.2).
+func canonicalRData(rrType uint16, rdata []byte) []byte {
+	var offset, names int
+	switch rrType {
+	case typeNS, typeCNAME, typePTR:
+		names = 1
+	case typeMX:
+		offset, names = 2, 1
+	case typeSRV:
+		offset, names = 6, 1
+	case typeSOA:
+		names = 2
+	default:
+		return rdata
+	}
+
+	rdata = bytes.Clone(rdata)
+	for ; names > 0; names-- {
+		for offset < len(rdata) && rdata[offset] != 0 {
+			end := min(offset+1+int(rdata[offset]), len(rdata))
+			copy(rdata[offset+1:end], bytes.ToLower(rdata[offset+1:end]))
+			offset = end
+		}
+		offset++
+	}
+	return rdata
+}
+
+func keyTag(rdata []byte) uint16 {
+	var ac uint32
+	for i, b := range rdata {
+		if i&1 == 0 {
+			ac += uint32(b) << 8
+		} else {
+			ac += uint32(b)
+		}
+	}
+	ac += ac >> 16 & 0xffff
+	return uint16(ac)
+}
+
+func typeBitmap(types []uint16) []byte {
+	types = slices.Clone(types)
+	slices.Sort(types)
+	types = slices.Compact(types)
+
+	var bitmap []byte
+	for len(types) > 0 {
+		window := uint8(types[0] >> 8)
+		var bits [32]byte
+		var length int
+		for len(types) > 0 && uint8(types[0]>>8) == window {
+			i := int(types[0] & 0xff)
+			bits[i/8] |= 0x80 >> (i % 8)
+			length = i/8 + 1
+			types = types[1:]
+		}
+		bitmap = append(bitmap, window, uint8(length))
+		bitmap = append(bitmap, bits[:length]...)
+	}
+	return bitmap
+}
+
+func nsec3Hash(name string) [sha1.Size]byte {
+	return sha1.Sum(putName(name, nil)) //nolint:gosec
+}
+
+func addToHash(hash [sha1.Size]byte, delta int) [sha1.Size]byte {
+	for i := len(hash) - 1; i >= 0 && delta != 0; i-- {
+		switch {
+		case delta > 0:
+			hash[i]++
+			if hash[i] != 0 {
+				delta = 0
+			}
+		default:
+			hash[i]--
+			if hash[i] != 0xff {
+				delta = 0
+			}
+		}
+	}
+	return hash
+}
+
+func parentName(name string) string {
+	_, parent, _ := strings.Cut(name, ".")
+	return parent
+}
+
+// prevName returns name preceding the name in canonical order. It is used as an owner of NSEC record covering
+// the name.
+func prevName(name string) string {
+	label, parent, _ := strings.Cut(name, ".")
+
+	l := []byte(label)
+	switch last := l[len(l)-1]; {
+	case last == 0x00:
+		l = l[:len(l)-1]
+	default:
+		last--
+		if last == '.' {
+			last--
+		}
+		// Uppercase letters are not used in canonical names.
+		if last >= 'A' && last <= 'Z' {
+			last = 'A' - 1
+		}
+		l[len(l)-1] = last
+	}
+	for len(l) < maxLabelLength && len(l)+1+len(parent) < maxNameLength {
+		l = append(l, 0xff)
+	}
+
+	if len(l) == 0 {
+		return parent
+	}
+	return string(l) + "." + parent
+}
+
+// subtreeEnd returns name following the name and all its descendants in canonical order.
+func subtreeEnd(name string) string {
+	label, parent, _ := strings.Cut(name, ".")
+	if len(label) < maxLabelLength && len(name) < maxNameLength {
+		return label + "\x00." + parent
+	}
+
+	l := []byte(label)
+	l[len(l)-1]++
+	return string(l) + "." + parent
+}
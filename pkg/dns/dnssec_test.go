@@ -0,0 +1,393 @@
+package dns
+
+import (
+	"bytes"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	mdns "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSignedServer(t *testing.T, nsec3 bool) *server {
+	keysDir := t.TempDir()
+	return newTestServer(t,
+		Zone("example.com", "ns1.example.com", "admin@example.com", 1,
+			Domain("host.example.com", "10.0.0.1"),
+			Domain("a.b.example.com", "10.0.0.2"),
+		),
+		func(c *Config) {
+			c.DNSSEC = &DNSSECConfig{
+				KeysDir:     keysDir,
+				NSEC3:       nsec3,
+				ZSKLifetime: defaultZSKLifetime,
+			}
+		},
+	)
+}
+
+func signedQuery(t *testing.T, s *server, name string, qType uint16) *mdns.Msg {
+	msg := &mdns.Msg{}
+	msg.SetQuestion(name, qType)
+	msg.SetEdns0(4096, true)
+	return exchange(t, s, msg, false)
+}
+
+func dnsKeys(t *testing.T, s *server) map[uint16]*mdns.DNSKEY {
+	resp := signedQuery(t, s, "example.com.", mdns.TypeDNSKEY)
+	require.Equal(t, mdns.RcodeSuccess, resp.Rcode)
+
+	keys := map[uint16]*mdns.DNSKEY{}
+	for _, rr := range resp.Answer {
+		if key, ok := rr.(*mdns.DNSKEY); ok {
+			keys[key.KeyTag()] = key
+		}
+	}
+	require.Len(t, keys, 2)
+
+	verifyRRSets(t, keys, resp.Answer)
+	for _, rr := range resp.Answer {
+		if sig, ok := rr.(*mdns.RRSIG); ok {
+			require.Equal(t, uint16(mdns.SEP|mdns.ZONE), keys[sig.KeyTag].Flags)
+		}
+	}
+	return keys
+}
+
+// verifyRRSets verifies that every RRSet is signed.
+func verifyRRSets(t *testing.T, keys map[uint16]*mdns.DNSKEY, rrs []mdns.RR) {
+	rrSets := map[[2]string][]mdns.RR{}
+	var sigs []*mdns.RRSIG
+	for _, rr := range rrs {
+		if sig, ok := rr.(*mdns.RRSIG); ok {
+			sigs = append(sigs, sig)
+			continue
+		}
+		k := [2]string{rr.Header().Name, mdns.TypeToString[rr.Header().Rrtype]}
+		rrSets[k] = append(rrSets[k], rr)
+	}
+
+	for k, rrSet := range rrSets {
+		var verified bool
+		for _, sig := range sigs {
+			if sig.Header().Name != k[0] || sig.TypeCovered != rrSet[0].Header().Rrtype {
+				continue
+			}
+			key := keys[sig.KeyTag]
+			require.NotNil(t, key)
+			require.NoError(t, sig.Verify(key, rrSet))
+			require.True(t, sig.ValidityPeriod(time.Now()))
+			verified = true
+		}
+		require.True(t, verified, "RRSet %v is not signed", k)
+	}
+}
+
+func TestSignedAnswer(t *testing.T) {
+	s := newTestSignedServer(t, false)
+	keys := dnsKeys(t, s)
+
+	resp := signedQuery(t, s, "host.example.com.", mdns.TypeA)
+	require.Equal(t, mdns.RcodeSuccess, resp.Rcode)
+	require.Len(t, resp.Answer, 2)
+	verifyRRSets(t, keys, resp.Answer)
+
+	resp = signedQuery(t, s, "example.com.", mdns.TypeSOA)
+	require.Len(t, resp.Answer, 2)
+	verifyRRSets(t, keys, resp.Answer)
+
+	// Signatures are not sent if client does not ask for them.
+	msg := &mdns.Msg{}
+	msg.SetQuestion("host.example.com.", mdns.TypeA)
+	resp = exchange(t, s, msg, false)
+	require.Len(t, resp.Answer, 1)
+}
+
+func TestSignedViewZone(t *testing.T) {
+	requireT := require.New(t)
+
+	keysDir := t.TempDir()
+	s := newTestServer(t,
+		View("internal",
+			Networks("10.0.0.0/8"),
+			ViewZone("internal.com", "ns1.internal.com", "admin@internal.com", 1,
+				Domain("host.internal.com", "10.0.0.1"),
+			),
+		),
+		View("office",
+			Networks("192.168.0.0/16"),
+			ViewZone("internal.com", "ns1.internal.com", "admin@internal.com", 1,
+				Domain("host.internal.com", "192.168.0.1"),
+			),
+		),
+		func(c *Config) {
+			c.DNSSEC = &DNSSECConfig{
+				KeysDir:     keysDir,
+				ZSKLifetime: defaultZSKLifetime,
+			}
+		},
+	)
+	requireT.Same(s.views[0].Zones["internal.com"].Signer, s.views[1].Zones["internal.com"].Signer)
+
+	query := func(name string, qType uint16) *mdns.Msg {
+		msg := &mdns.Msg{}
+		msg.SetQuestion(name, qType)
+		msg.SetEdns0(4096, true)
+		return exchangeFrom(t, s, msg, false, net.IPv4(10, 1, 1, 1))
+	}
+
+	resp := query("internal.com.", mdns.TypeDNSKEY)
+	requireT.Equal(mdns.RcodeSuccess, resp.Rcode)
+	keys := map[uint16]*mdns.DNSKEY{}
+	for _, rr := range resp.Answer {
+		if key, ok := rr.(*mdns.DNSKEY); ok {
+			keys[key.KeyTag()] = key
+		}
+	}
+	requireT.Len(keys, 2)
+	verifyRRSets(t, keys, resp.Answer)
+
+	resp = query("host.internal.com.", mdns.TypeA)
+	requireT.Equal(mdns.RcodeSuccess, resp.Rcode)
+	requireT.Len(resp.Answer, 2)
+	verifyRRSets(t, keys, resp.Answer)
+}
+
+func TestNSECDenial(t *testing.T) {
+	s := newTestSignedServer(t, false)
+	keys := dnsKeys(t, s)
+
+	// Name exists but type doesn't.
+	resp := signedQuery(t, s, "host.example.com.", mdns.TypeTXT)
+	require.Equal(t, mdns.RcodeSuccess, resp.Rcode)
+	require.Empty(t, resp.Answer)
+	verifyRRSets(t, keys, resp.Ns)
+	nsec := findNSEC(resp.Ns, "host.example.com.")
+	require.NotNil(t, nsec)
+	require.Contains(t, nsec.TypeBitMap, mdns.TypeA)
+	require.NotContains(t, nsec.TypeBitMap, mdns.TypeTXT)
+	require.Zero(t, canonicalCompare(t, "\\000.host.example.com.", nsec.NextDomain))
+
+	// Empty non-terminal.
+	resp = signedQuery(t, s, "b.example.com.", mdns.TypeA)
+	require.Equal(t, mdns.RcodeSuccess, resp.Rcode)
+	verifyRRSets(t, keys, resp.Ns)
+	nsec = findNSEC(resp.Ns, "b.example.com.")
+	require.NotNil(t, nsec)
+	require.Equal(t, []uint16{mdns.TypeRRSIG, mdns.TypeNSEC}, nsec.TypeBitMap)
+
+	// Name doesn't exist.
+	resp = signedQuery(t, s, "x.y.example.com.", mdns.TypeA)
+	require.Equal(t, mdns.RcodeNameError, resp.Rcode)
+	verifyRRSets(t, keys, resp.Ns)
+
+	var coversName, coversWildcard bool
+	for _, rr := range resp.Ns {
+		if nsec, ok := rr.(*mdns.NSEC); ok {
+			coversName = coversName || nsecCovers(t, nsec, "x.y.example.com.")
+			coversWildcard = coversWildcard || nsecCovers(t, nsec, "*.example.com.")
+			// Existing names must not be covered.
+			require.False(t, nsecCovers(t, nsec, "example.com."))
+			require.False(t, nsecCovers(t, nsec, "host.example.com."))
+			require.False(t, nsecCovers(t, nsec, "b.example.com."))
+		}
+	}
+	require.True(t, coversName)
+	require.True(t, coversWildcard)
+}
+
+func TestNSEC3Denial(t *testing.T) {
+	s := newTestSignedServer(t, true)
+	keys := dnsKeys(t, s)
+
+	resp := signedQuery(t, s, "example.com.", mdns.TypeNSEC3PARAM)
+	require.Len(t, resp.Answer, 2)
+	verifyRRSets(t, keys, resp.Answer)
+
+	// Name exists but type doesn't.
+	resp = signedQuery(t, s, "host.example.com.", mdns.TypeTXT)
+	require.Equal(t, mdns.RcodeSuccess, resp.Rcode)
+	verifyRRSets(t, keys, resp.Ns)
+	var matches bool
+	for _, rr := range resp.Ns {
+		if nsec3, ok := rr.(*mdns.NSEC3); ok && nsec3.Match("host.example.com.") {
+			matches = true
+			require.Contains(t, nsec3.TypeBitMap, mdns.TypeA)
+			require.NotContains(t, nsec3.TypeBitMap, mdns.TypeTXT)
+		}
+	}
+	require.True(t, matches)
+
+	// Name doesn't exist.
+	resp = signedQuery(t, s, "x.y.example.com.", mdns.TypeA)
+	require.Equal(t, mdns.RcodeNameError, resp.Rcode)
+	verifyRRSets(t, keys, resp.Ns)
+
+	var matchesEncloser, coversName, coversWildcard bool
+	for _, rr := range resp.Ns {
+		if nsec3, ok := rr.(*mdns.NSEC3); ok {
+			matchesEncloser = matchesEncloser || nsec3.Match("example.com.")
+			coversName = coversName || nsec3.Cover("y.example.com.")
+			coversWildcard = coversWildcard || nsec3.Cover("*.example.com.")
+		}
+	}
+	require.True(t, matchesEncloser)
+	require.True(t, coversName)
+	require.True(t, coversWildcard)
+}
+
+func TestKeyRolling(t *testing.T) {
+	now := time.Now()
+	zs := &zoneSigner{
+		domain: "example.com",
+		config: DNSSECConfig{
+			ZSKLifetime: defaultZSKLifetime,
+		},
+		keysFile: t.TempDir() + "/example.com.json",
+	}
+	ctx := newTestContext()
+
+	require.NoError(t, zs.Roll(ctx, now))
+	keys := zs.keys.Load()
+	require.Len(t, keys.DNSKEYs, 2)
+	require.Len(t, keys.KSKs, 1)
+	zsk, ksk := keys.ZSK, keys.KSKs[0]
+
+	// Keys are loaded from file.
+	require.NoError(t, zs.Roll(ctx, now))
+	require.Equal(t, zsk.Tag, zs.keys.Load().ZSK.Tag)
+
+	// New ZSK is published before it is used.
+	now = now.Add(defaultZSKLifetime - zskRolloverPeriod)
+	require.NoError(t, zs.Roll(ctx, now))
+	keys = zs.keys.Load()
+	require.Len(t, keys.DNSKEYs, 3)
+	require.Equal(t, zsk.Tag, keys.ZSK.Tag)
+
+	// New ZSK is used, old one is still published.
+	now = now.Add(zskRolloverPeriod)
+	require.NoError(t, zs.Roll(ctx, now))
+	keys = zs.keys.Load()
+	require.Len(t, keys.DNSKEYs, 3)
+	require.NotEqual(t, zsk.Tag, keys.ZSK.Tag)
+
+	// Old ZSK is removed.
+	now = now.Add(zskRolloverPeriod)
+	require.NoError(t, zs.Roll(ctx, now))
+	keys = zs.keys.Load()
+	require.Len(t, keys.DNSKEYs, 2)
+	require.Equal(t, ksk.Tag, keys.KSKs[0].Tag)
+	for _, key := range keys.DNSKEYs {
+		require.NotEqual(t, zsk.Tag, key.Tag)
+	}
+}
+
+func TestKSKRolling(t *testing.T) {
+	now := time.Now()
+	zs := &zoneSigner{
+		domain: "example.com",
+		config: DNSSECConfig{
+			KSKLifetime: 2 * kskRolloverPeriod,
+			PublishedDS: map[string][]uint16{},
+		},
+		keysFile: t.TempDir() + "/example.com.json",
+	}
+	ctx := newTestContext()
+
+	require.NoError(t, zs.Roll(ctx, now))
+	ksk := zs.keys.Load().KSKs[0]
+
+	// New KSK is published.
+	now = now.Add(kskRolloverPeriod)
+	require.NoError(t, zs.Roll(ctx, now))
+	ksks := zs.keys.Load().KSKs
+	require.Len(t, ksks, 2)
+	newKSK := ksks[1]
+
+	// Old KSK is not removed until DS of the new one is published.
+	now = now.Add(10 * kskRolloverPeriod)
+	require.NoError(t, zs.Roll(ctx, now))
+	require.Len(t, zs.keys.Load().KSKs, 2)
+
+	zs.config.PublishedDS["example.com"] = []uint16{ksk.Tag, newKSK.Tag}
+	require.NoError(t, zs.Roll(ctx, now))
+	ksks = zs.keys.Load().KSKs
+	require.Len(t, ksks, 1)
+	require.Equal(t, newKSK.Tag, ksks[0].Tag)
+}
+
+func TestDNSSECConfigValidation(t *testing.T) {
+	requireT := require.New(t)
+
+	keysDir := t.TempDir()
+	for _, config := range []DNSSECConfig{
+		{ZSKLifetime: defaultZSKLifetime},
+		{KeysDir: "dnssec", ZSKLifetime: defaultZSKLifetime},
+		{KeysDir: keysDir, ZSKLifetime: zskRolloverPeriod},
+		{KeysDir: keysDir, ZSKLifetime: defaultZSKLifetime, KSKLifetime: kskRolloverPeriod},
+	} {
+		_, err := newServer(newTestContext(), Config{
+			Zones:  map[string]ZoneConfig{},
+			DNSSEC: &config,
+		})
+		requireT.Error(err)
+	}
+
+	requireT.NoError(validateDNSSECConfig(DNSSECConfig{KeysDir: keysDir, ZSKLifetime: defaultZSKLifetime}))
+}
+
+func TestCanonicalRData(t *testing.T) {
+	requireT := require.New(t)
+
+	name := putName("Mail.Example.COM", nil)
+	canonical := putName("mail.example.com", nil)
+	numbers := []byte{0x00, 0x0a, 0x00, 0x05, 0x01, 0xbb}
+
+	requireT.Equal(canonical, canonicalRData(typeCNAME, name))
+	requireT.Equal(canonical, canonicalRData(typeNS, name))
+	requireT.Equal(canonical, canonicalRData(typePTR, name))
+	requireT.Equal(append(numbers[:2:2], canonical...), canonicalRData(typeMX, append(numbers[:2:2], name...)))
+	requireT.Equal(append(slices.Clone(numbers), canonical...),
+		canonicalRData(typeSRV, append(slices.Clone(numbers), name...)))
+
+	soa := append(append(slices.Clone(name), name...), numbers...)
+	requireT.Equal(append(append(slices.Clone(canonical), canonical...), numbers...), canonicalRData(typeSOA, soa))
+	requireT.Equal(putName("Mail.Example.COM", nil), name)
+
+	txt := []byte("\x05ABCDE")
+	requireT.Equal(txt, canonicalRData(typeTXT, txt))
+}
+
+func findNSEC(rrs []mdns.RR, owner string) *mdns.NSEC {
+	for _, rr := range rrs {
+		if nsec, ok := rr.(*mdns.NSEC); ok && nsec.Header().Name == owner {
+			return nsec
+		}
+	}
+	return nil
+}
+
+func nsecCovers(t *testing.T, nsec *mdns.NSEC, name string) bool {
+	return canonicalCompare(t, nsec.Header().Name, name) < 0 && canonicalCompare(t, name, nsec.NextDomain) < 0
+}
+
+// canonicalCompare compares names using the canonical DNS name order.
+func canonicalCompare(t *testing.T, name1, name2 string) int {
+	return slices.CompareFunc(canonicalLabels(t, name1), canonicalLabels(t, name2), bytes.Compare)
+}
+
+func canonicalLabels(t *testing.T, name string) [][]byte {
+	wire := make([]byte, 256)
+	n, err := mdns.PackDomainName(strings.ToLower(name), wire, 0, nil, false)
+	require.NoError(t, err)
+
+	var labels [][]byte
+	for wire = wire[:n]; wire[0] > 0; wire = wire[wire[0]+1:] {
+		labels = append(labels, wire[1:wire[0]+1])
+	}
+	slices.Reverse(labels)
+	return labels
+}
@@ -0,0 +1,277 @@
+package dns
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	vmetrics "github.com/VictoriaMetrics/metrics"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/outofforest/cloudless/pkg/eye/metrics"
+	"github.com/outofforest/logger"
+)
+
+const (
+	dnstapChCapacity    = 10000
+	dnstapRetryInterval = 5 * time.Second
+	dnstapSocketPrefix  = "unix:"
+	dnstapContentType   = "protobuf:dnstap.Dnstap"
+	dnstapVersion       = "cloudless"
+
+	subsystemDnstap = "dnstap"
+
+	// Frame Streams control frame types.
+	fstrmControlAccept = 0x01
+	fstrmControlStart  = 0x02
+	fstrmControlStop   = 0x03
+	fstrmControlReady  = 0x04
+	fstrmControlFinish = 0x05
+
+	fstrmFieldContentType = 0x01
+
+	// Values defined by dnstap.proto.
+	dnstapTypeMessage                = 1
+	dnstapMessageAuthResponse        = 2
+	dnstapMessageClientResponse      = 6
+	dnstapSocketFamilyINET           = 1
+	dnstapSocketProtocolUDP          = 1
+	dnstapSocketProtocolTCP          = 2
+	dnstapSocketProtocolDOT          = 3
+	dnstapSocketProtocolDOH          = 4
+	dnstapFieldVersion               = 2
+	dnstapFieldMessage               = 14
+	dnstapFieldType                  = 15
+	dnstapMessageFieldType           = 1
+	dnstapMessageFieldSocketFamily   = 2
+	dnstapMessageFieldSocketProtocol = 3
+	dnstapMessageFieldQueryAddress   = 4
+	dnstapMessageFieldQueryPort      = 6
+	dnstapMessageFieldQueryTimeSec   = 8
+	dnstapMessageFieldQueryTimeNSec  = 9
+	dnstapMessageFieldQueryMessage   = 10
+	dnstapMessageFieldRespTimeSec    = 12
+	dnstapMessageFieldRespTimeNSec   = 13
+	dnstapMessageFieldRespMessage    = 14
+
+	protobufVarint  = 0
+	protobufBytes   = 2
+	protobufFixed32 = 5
+)
+
+func newDnstapWriter(output string, set *metrics.Set) *dnstapWriter {
+	return &dnstapWriter{
+		output: output,
+		ch:     make(chan []byte, dnstapChCapacity),
+		// "Number of dnstap messages dropped because writer is not able to keep up".
+		mDropped: set.NewCounter(metrics.N(namespace, subsystemDnstap, "dropped")),
+	}
+}
+
+// dnstapWriter writes dnstap messages to the file or unix socket using Frame Streams protocol.
+type dnstapWriter struct {
+	output string
+	ch     chan []byte
+
+	mDropped *vmetrics.Counter
+}
+
+// Write schedules message to be written. Message is dropped if writer is not able to keep up.
+func (w *dnstapWriter) Write(msg []byte) {
+	select {
+	case w.ch <- msg:
+	default:
+		w.mDropped.Inc()
+	}
+}
+
+// Run writes messages until context is canceled. Output is reopened if writing fails.
+func (w *dnstapWriter) Run(ctx context.Context) error {
+	log := logger.Get(ctx)
+	for {
+		err := w.run(ctx)
+		if ctx.Err() != nil {
+			return errors.WithStack(ctx.Err())
+		}
+		log.Error("Writing dnstap messages failed", zap.String("output", w.output), zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return errors.WithStack(ctx.Err())
+		case <-time.After(dnstapRetryInterval):
+		}
+	}
+}
+
+func (w *dnstapWriter) run(ctx context.Context) error {
+	var conn io.ReadWriteCloser
+	socket := strings.HasPrefix(w.output, dnstapSocketPrefix)
+	if socket {
+		var err error
+		conn, err = net.Dial("unix", strings.TrimPrefix(w.output, dnstapSocketPrefix))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	} else {
+		var err error
+		conn, err = os.OpenFile(w.output, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	defer conn.Close()
+
+	// Sockets use bidirectional mode requiring handshake.
+	if socket {
+		if _, err := conn.Write(fstrmControlFrame(fstrmControlReady)); err != nil {
+			return errors.WithStack(err)
+		}
+		if err := readControlFrame(conn, fstrmControlAccept); err != nil {
+			return err
+		}
+	}
+
+	buff := bufio.NewWriter(conn)
+	if _, err := buff.Write(fstrmControlFrame(fstrmControlStart)); err != nil {
+		return errors.WithStack(err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			if _, err := buff.Write(fstrmControlFrame(fstrmControlStop)); err != nil {
+				return errors.WithStack(err)
+			}
+			if err := buff.Flush(); err != nil {
+				return errors.WithStack(err)
+			}
+			if socket {
+				if err := readControlFrame(conn, fstrmControlFinish); err != nil {
+					return err
+				}
+			}
+			return errors.WithStack(ctx.Err())
+		case msg := <-w.ch:
+			if _, err := buff.Write(binary.BigEndian.AppendUint32(nil, uint32(len(msg)))); err != nil {
+				return errors.WithStack(err)
+			}
+			if _, err := buff.Write(msg); err != nil {
+				return errors.WithStack(err)
+			}
+			if len(w.ch) == 0 {
+				if err := buff.Flush(); err != nil {
+					return errors.WithStack(err)
+				}
+			}
+		}
+	}
+}
+
+// fstrmControlFrame returns control frame of Frame Streams protocol.
+func fstrmControlFrame(controlType uint32) []byte {
+	var control []byte
+	control = binary.BigEndian.AppendUint32(control, controlType)
+	if controlType == fstrmControlReady || controlType == fstrmControlStart {
+		control = binary.BigEndian.AppendUint32(control, fstrmFieldContentType)
+		control = binary.BigEndian.AppendUint32(control, uint32(len(dnstapContentType)))
+		control = append(control, dnstapContentType...)
+	}
+
+	// Zero length escapes the control frame.
+	frame := binary.BigEndian.AppendUint32(nil, 0)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(control)))
+	return append(frame, control...)
+}
+
+func readControlFrame(r io.Reader, controlType uint32) error {
+	var header [12]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return errors.WithStack(err)
+	}
+	length := binary.BigEndian.Uint32(header[4:])
+	if binary.BigEndian.Uint32(header[:]) != 0 || length < 4 || binary.BigEndian.Uint32(header[8:]) != controlType {
+		return errors.Errorf("unexpected control frame, expected type %d", controlType)
+	}
+	_, err := io.CopyN(io.Discard, r, int64(length-4))
+	return errors.WithStack(err)
+}
+
+// dnstapFrame encodes dnstap message describing the query and its response.
+func dnstapFrame(
+	query, resp []byte,
+	clientAddr net.Addr,
+	transport string,
+	forwarded bool,
+	start, end time.Time,
+) []byte {
+	var msgType uint64 = dnstapMessageAuthResponse
+	if forwarded {
+		msgType = dnstapMessageClientResponse
+	}
+	var protocol uint64
+	switch transport {
+	case transportTCP:
+		protocol = dnstapSocketProtocolTCP
+	case transportDoT:
+		protocol = dnstapSocketProtocolDOT
+	case transportDoH:
+		protocol = dnstapSocketProtocolDOH
+	default:
+		protocol = dnstapSocketProtocolUDP
+	}
+
+	var msg []byte
+	msg = protobufVarintField(msg, dnstapMessageFieldType, msgType)
+	msg = protobufVarintField(msg, dnstapMessageFieldSocketFamily, dnstapSocketFamilyINET)
+	msg = protobufVarintField(msg, dnstapMessageFieldSocketProtocol, protocol)
+	if ip, port := addrIPPort(clientAddr); ip != nil {
+		msg = protobufBytesField(msg, dnstapMessageFieldQueryAddress, ip)
+		msg = protobufVarintField(msg, dnstapMessageFieldQueryPort, uint64(port))
+	}
+	msg = protobufVarintField(msg, dnstapMessageFieldQueryTimeSec, uint64(start.Unix()))
+	msg = protobufFixed32Field(msg, dnstapMessageFieldQueryTimeNSec, uint32(start.Nanosecond()))
+	if query != nil {
+		msg = protobufBytesField(msg, dnstapMessageFieldQueryMessage, query)
+	}
+	msg = protobufVarintField(msg, dnstapMessageFieldRespTimeSec, uint64(end.Unix()))
+	msg = protobufFixed32Field(msg, dnstapMessageFieldRespTimeNSec, uint32(end.Nanosecond()))
+	msg = protobufBytesField(msg, dnstapMessageFieldRespMessage, resp)
+
+	var frame []byte
+	frame = protobufBytesField(frame, dnstapFieldVersion, []byte(dnstapVersion))
+	frame = protobufBytesField(frame, dnstapFieldMessage, msg)
+	return protobufVarintField(frame, dnstapFieldType, dnstapTypeMessage)
+}
+
+func addrIPPort(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP.To4(), a.Port
+	case *net.TCPAddr:
+		return a.IP.To4(), a.Port
+	default:
+		return nil, 0
+	}
+}
+
+func protobufVarintField(b []byte, field, value uint64) []byte {
+	b = binary.AppendUvarint(b, field<<3|protobufVarint)
+	return binary.AppendUvarint(b, value)
+}
+
+func protobufBytesField(b []byte, field uint64, value []byte) []byte {
+	b = binary.AppendUvarint(b, field<<3|protobufBytes)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+func protobufFixed32Field(b []byte, field uint64, value uint32) []byte {
+	b = binary.AppendUvarint(b, field<<3|protobufFixed32)
+	return binary.LittleEndian.AppendUint32(b, value)
+}
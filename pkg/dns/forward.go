@@ -1,75 +1,107 @@
 package dns
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"encoding/binary"
+	"io"
+	"math/rand/v2"
 	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	vmetrics "github.com/VictoriaMetrics/metrics"
 	"github.com/pkg/errors"
 
+	"github.com/outofforest/cloudless/pkg/eye/metrics"
 	"github.com/outofforest/parallel"
 )
 
-const numOfForwarders = 10
+const (
+	numOfForwarders = 10
+	forwardTimeout  = 2 * time.Second
+
+	// Query is sent to the next upstream if the previous one does not respond within the hedge delay.
+	defaultHedgeDelay = 200 * time.Millisecond
+	minHedgeDelay     = 20 * time.Millisecond
+	maxHedgeDelay     = 500 * time.Millisecond
+
+	// Upstream is considered unhealthy for the backoff period after this number of consecutive failures.
+	maxUpstreamFailures = 3
+	upstreamBackoff     = 30 * time.Second
+
+	subsystemForwarder = "forwarder"
+	labelUpstream      = "upstream"
+)
 
 type forwardRequest struct {
-	ForwardIPIndex uint64
-	Query          []byte
-	Conn           *net.UDPConn
-	Address        net.Addr
-	DoneCh         chan struct{}
+	Query   forwardQuery
+	Respond func(b []byte) error
 }
 
-func runForwarders(ctx context.Context, forwardIPs []net.IP, ch <-chan forwardRequest) error {
-	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
-		for range numOfForwarders {
-			spawn("forwarder", parallel.Fail, func(ctx context.Context) error {
-				b := make([]byte, bufferSize)
-				conns := make([]*net.UDPConn, 0, len(forwardIPs))
-				defer func() {
-					for _, conn := range conns {
-						_ = conn.Close()
-					}
-				}()
+// forwardQuery is the query forwarded to upstream servers.
+type forwardQuery struct {
+	Msg []byte
 
-				for _, ip := range forwardIPs {
-					conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{
-						IP:   ip,
-						Port: 53,
-					})
-					if err != nil {
-						return errors.WithStack(err)
-					}
-					conns = append(conns, conn)
-				}
+	// Key identifies the response in the cache.
+	Key string
 
-				for req := range ch {
-					conn := conns[req.ForwardIPIndex]
+	// QuestionEnd is the offset where the question ends.
+	QuestionEnd int
 
-					if _, err := conn.Write(req.Query); err != nil {
-						continue
-					}
+	// MaxMsgLength is the maximum length of the response accepted by the client.
+	MaxMsgLength uint16
+}
 
-					if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
-						continue
-					}
-					n, err := conn.Read(b)
-					if err != nil {
-						continue
-					}
+func newForwarder(upstreamIPs []net.IP, port int, set *metrics.Set) *forwarder {
+	f := &forwarder{
+		cache: newCache(set),
+		// "Number of truncated responses repeated over TCP".
+		mTCPFallbacks: set.NewCounter(metrics.N(namespace, subsystemForwarder, "tcp_fallbacks")),
+	}
+	for _, ip := range upstreamIPs {
+		label := metrics.L(labelUpstream, ip.String())
+		u := &upstream{
+			Addr: &net.UDPAddr{IP: ip, Port: port},
+			// "Number of queries sent to upstream".
+			mQueries: set.NewCounter(metrics.N(namespace, subsystemForwarder, "queries"), label),
+			// "Number of queries not answered by upstream".
+			mFailures: set.NewCounter(metrics.N(namespace, subsystemForwarder, "failures"), label),
+			// "Equals 1 if upstream is healthy".
+			mHealthy: set.NewGauge(metrics.N(namespace, subsystemForwarder, "healthy"), label),
+		}
+		u.mHealthy.Set(1)
+		f.upstreams = append(f.upstreams, u)
+	}
+	return f
+}
+
+// forwarder forwards queries to upstream servers and caches responses.
+type forwarder struct {
+	upstreams []*upstream
+	cache     *cache
+
+	mTCPFallbacks *vmetrics.Counter
+}
 
-					select {
-					case <-req.DoneCh:
-						if n < headerSize {
-							continue
-						}
-						// Reset AA flag.
-						b[2] &= 0xfb
-						if _, err := req.Conn.WriteTo(b[:n], req.Address); err != nil {
-							continue
-						}
-					default:
+// Run runs workers forwarding requests to upstreams.
+func (f *forwarder) Run(ctx context.Context, ch <-chan forwardRequest) error {
+	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		for range numOfForwarders {
+			spawn("forwarder", parallel.Fail, func(ctx context.Context) error {
+				b := make([]byte, maxTCPMsgLength)
+				for req := range ch {
+					resp, err := f.exchange(ctx, b, req.Query)
+					if err != nil {
+						resp = failure(slices.Clone(req.Query.Msg), len(req.Query.Msg), rCodeServerFailure)
+					} else {
+						f.cache.Put(req.Query.Key, resp, time.Now())
 					}
+					_ = req.Respond(f.response(req.Query, resp))
 				}
 
 				return errors.WithStack(ctx.Err())
@@ -79,3 +111,325 @@ func runForwarders(ctx context.Context, forwardIPs []net.IP, ch <-chan forwardRe
 		return nil
 	})
 }
+
+// Cached responds to the query using cached response. False is returned if response is not cached.
+func (f *forwarder) Cached(q forwardQuery, respond func(b []byte) error) bool {
+	resp, exists := f.cache.Get(q.Key, time.Now())
+	if !exists {
+		return false
+	}
+	_ = respond(f.response(q, resp))
+	return true
+}
+
+// response prepares upstream response to be sent to the client.
+func (f *forwarder) response(q forwardQuery, resp []byte) []byte {
+	// Client's ID and letter case of the question are restored.
+	copy(resp, q.Msg[:2])
+	copy(resp[headerSize:], q.Msg[headerSize:q.QuestionEnd])
+	// Reset AA flag.
+	resp[2] &= 0xfb
+
+	if len(resp) > int(q.MaxMsgLength) {
+		// Response is truncated, so client repeats the query over TCP.
+		h, _ := readHeader(resp)
+		h.TC = true
+		h.ANCount = 0
+		h.NSCount = 0
+		h.ARCount = 0
+		putHeader(h, resp[:0])
+		resp = resp[:q.QuestionEnd]
+	}
+	return resp
+}
+
+// exchange sends query to upstreams and returns the first valid response. Query is sent to the healthiest upstream
+// first. Next upstreams are queried if response is not received within the hedge delay.
+func (f *forwarder) exchange(ctx context.Context, b []byte, q forwardQuery) ([]byte, error) {
+	// New socket is used for each query, so source port is random.
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer conn.Close()
+
+	msg := slices.Clone(q.Msg)
+	binary.BigEndian.PutUint16(msg, uint16(rand.Uint32()))
+	randomizeCase(msg[headerSize:q.QuestionEnd])
+
+	type sentQuery struct {
+		Upstream *upstream
+		SentAt   time.Time
+		Done     bool
+	}
+
+	upstreams := f.order(time.Now())
+	sent := make([]sentQuery, 0, len(upstreams))
+
+	// Upstreams which haven't responded yet are failed only if none of them responded on time. Hedged queries
+	// outrun by another upstream are not failures.
+	var timedOut bool
+	defer func() {
+		if !timedOut {
+			return
+		}
+		for _, sq := range sent {
+			if !sq.Done {
+				sq.Upstream.Failure(time.Now())
+			}
+		}
+	}()
+
+	// failedResp is the failure reported by upstream, returned if no other upstream responds.
+	var failedResp []byte
+
+	deadline := time.Now().Add(forwardTimeout)
+	nextSend := time.Now()
+	for {
+		now := time.Now()
+		pending := slices.ContainsFunc(sent, func(sq sentQuery) bool {
+			return !sq.Done
+		})
+		if !now.Before(deadline) || ctx.Err() != nil || (len(upstreams) == 0 && !pending) {
+			timedOut = ctx.Err() == nil && !now.Before(deadline)
+			if failedResp != nil {
+				return failedResp, nil
+			}
+			return nil, errors.New("no response from upstream servers")
+		}
+
+		if len(upstreams) > 0 && !now.Before(nextSend) {
+			u := upstreams[0]
+			upstreams = upstreams[1:]
+
+			u.mQueries.Inc()
+			if _, err := conn.WriteToUDP(msg, u.Addr); err != nil {
+				u.Failure(now)
+				continue
+			}
+			sent = append(sent, sentQuery{Upstream: u, SentAt: now})
+			nextSend = now.Add(u.HedgeDelay())
+		}
+
+		wait := deadline
+		if len(upstreams) > 0 && nextSend.Before(wait) {
+			wait = nextSend
+		}
+		if err := conn.SetReadDeadline(wait); err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		n, addr, err := conn.ReadFromUDP(b)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return nil, errors.WithStack(err)
+		}
+
+		i := slices.IndexFunc(sent, func(sq sentQuery) bool {
+			return !sq.Done && sq.Upstream.Addr.IP.Equal(addr.IP) && sq.Upstream.Addr.Port == addr.Port
+		})
+		if i < 0 || !validResponse(b[:n], msg, q.QuestionEnd) {
+			continue
+		}
+
+		sq := &sent[i]
+		sq.Done = true
+		now = time.Now()
+
+		h, _ := readHeader(b[:n])
+		switch {
+		case h.RCode == rCodeServerFailure || h.RCode == rCodeRefused:
+			// Next upstream is asked immediately.
+			sq.Upstream.Failure(now)
+			failedResp = slices.Clone(b[:n])
+			nextSend = now
+			continue
+		case h.TC:
+			f.mTCPFallbacks.Inc()
+			resp, err := exchangeTCP(ctx, sq.Upstream, msg, q.QuestionEnd)
+			if err != nil {
+				sq.Upstream.Failure(now)
+				nextSend = now
+				continue
+			}
+			sq.Upstream.Success(now.Sub(sq.SentAt))
+			return resp, nil
+		default:
+			sq.Upstream.Success(now.Sub(sq.SentAt))
+			return slices.Clone(b[:n]), nil
+		}
+	}
+}
+
+// order returns upstreams ordered by their health and response time.
+func (f *forwarder) order(now time.Time) []*upstream {
+	upstreams := slices.Clone(f.upstreams)
+	slices.SortStableFunc(upstreams, func(a, b *upstream) int {
+		if aHealthy, bHealthy := a.Healthy(now), b.Healthy(now); aHealthy != bHealthy {
+			if aHealthy {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Compare(a.rtt.Load(), b.rtt.Load())
+	})
+	return upstreams
+}
+
+func exchangeTCP(ctx context.Context, u *upstream, msg []byte, questionEnd int) ([]byte, error) {
+	dialer := net.Dialer{Timeout: forwardTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp4", net.JoinHostPort(u.Addr.IP.String(), strconv.Itoa(u.Addr.Port)))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(forwardTimeout)); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if _, err := conn.Write(append(binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(msg)),
+		uint16(len(msg))), msg...)); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if !validResponse(resp, msg, questionEnd) {
+		return nil, errors.New("invalid response")
+	}
+	if h, _ := readHeader(resp); h.TC || h.RCode == rCodeServerFailure || h.RCode == rCodeRefused {
+		return nil, errors.Errorf("upstream failed with rcode %d", h.RCode)
+	}
+	return resp, nil
+}
+
+// validResponse checks if response matches the query. Question must match exactly, including the randomized case.
+func validResponse(resp, msg []byte, questionEnd int) bool {
+	h, ok := readHeader(resp)
+	return ok && h.ID == binary.BigEndian.Uint16(msg) && h.QR && h.QDCount == 1 && len(resp) >= questionEnd &&
+		bytes.Equal(resp[headerSize:questionEnd], msg[headerSize:questionEnd])
+}
+
+// randomizeCase randomizes the case of letters in the question (DNS 0x20 encoding), making spoofed responses harder
+// to guess. Label lengths never exceed 63, so they are never mistaken for letters.
+func randomizeCase(question []byte) {
+	var bits uint64
+	for i, c := range question {
+		if i%64 == 0 {
+			bits = rand.Uint64()
+		}
+		if ((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')) && bits&(1<<(i%64)) != 0 {
+			question[i] = c ^ 0x20
+		}
+	}
+}
+
+// parseForwardQuery parses the query to be forwarded.
+func parseForwardQuery(msg []byte, tcp bool) (forwardQuery, bool) {
+	h, ok := readHeader(msg)
+	if !ok || h.QDCount != 1 {
+		return forwardQuery{}, false
+	}
+
+	r := &msgReader{msg: msg, offset: headerSize}
+	qName, ok := r.name()
+	if !ok {
+		return forwardQuery{}, false
+	}
+	qTypeClass, ok := r.bytes(4)
+	if !ok {
+		return forwardQuery{}, false
+	}
+
+	q := forwardQuery{
+		Msg:          msg,
+		QuestionEnd:  r.offset,
+		MaxMsgLength: defaultMaxMsgLength,
+	}
+
+	// Responses differ depending on EDNS support, DO and CD flags.
+	var flags byte
+	if msg[3]&0x10 != 0 {
+		flags |= 0x01
+	}
+	for i := range uint32(h.ANCount) + uint32(h.NSCount) + uint32(h.ARCount) {
+		rec, end, ok := r.record()
+		if !ok {
+			return forwardQuery{}, false
+		}
+		r.offset = end
+
+		if rec.Type != typeOPT || i < uint32(h.ANCount)+uint32(h.NSCount) {
+			continue
+		}
+		flags |= 0x02
+		if rec.TTL&flagDO != 0 {
+			flags |= 0x04
+		}
+		q.MaxMsgLength = max(rec.Class, defaultMaxMsgLength)
+	}
+	if tcp {
+		q.MaxMsgLength = maxTCPMsgLength
+	}
+
+	q.Key = strings.ToLower(qName) + string(qTypeClass) + string(flags)
+	return q, true
+}
+
+// upstream is the server queries are forwarded to.
+type upstream struct {
+	Addr *net.UDPAddr
+
+	// rtt is the moving average of the response time in nanoseconds.
+	rtt       atomic.Int64
+	failures  atomic.Uint32
+	downUntil atomic.Int64
+
+	mQueries  *vmetrics.Counter
+	mFailures *vmetrics.Counter
+	mHealthy  *vmetrics.Gauge
+}
+
+// Healthy checks if upstream is healthy.
+func (u *upstream) Healthy(now time.Time) bool {
+	return now.UnixNano() >= u.downUntil.Load()
+}
+
+// HedgeDelay returns the time after which next upstream is queried.
+func (u *upstream) HedgeDelay() time.Duration {
+	rtt := time.Duration(u.rtt.Load())
+	if rtt == 0 {
+		return defaultHedgeDelay
+	}
+	return min(max(2*rtt, minHedgeDelay), maxHedgeDelay)
+}
+
+// Success records the successful response.
+func (u *upstream) Success(rtt time.Duration) {
+	if oldRTT := u.rtt.Load(); oldRTT > 0 {
+		rtt = (7*time.Duration(oldRTT) + rtt) / 8
+	}
+	u.rtt.Store(int64(rtt))
+	u.failures.Store(0)
+	u.downUntil.Store(0)
+	u.mHealthy.Set(1)
+}
+
+// Failure records the failed query.
+func (u *upstream) Failure(now time.Time) {
+	u.mFailures.Inc()
+	if u.failures.Add(1) >= maxUpstreamFailures {
+		u.downUntil.Store(now.Add(upstreamBackoff).UnixNano())
+		u.mHealthy.Set(0)
+	}
+}
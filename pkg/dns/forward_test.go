@@ -0,0 +1,228 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mdns "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+
+	"github.com/outofforest/cloudless/pkg/eye/metrics"
+)
+
+func runUpstream(t *testing.T, ip string, port int, handler mdns.HandlerFunc) int {
+	pc, err := net.ListenPacket("udp4", net.JoinHostPort(ip, strconv.Itoa(port)))
+	require.NoError(t, err)
+	port = pc.LocalAddr().(*net.UDPAddr).Port
+	l, err := net.Listen("tcp4", net.JoinHostPort(ip, strconv.Itoa(port)))
+	require.NoError(t, err)
+
+	udpServer := &mdns.Server{PacketConn: pc, Handler: handler}
+	tcpServer := &mdns.Server{Listener: l, Handler: handler}
+	go udpServer.ActivateAndServe() //nolint:errcheck
+	go tcpServer.ActivateAndServe() //nolint:errcheck
+	t.Cleanup(func() {
+		_ = udpServer.Shutdown()
+		_ = tcpServer.Shutdown()
+	})
+	return port
+}
+
+func forwardExchange(t *testing.T, f *forwarder, name string, bufSize uint16) *mdns.Msg {
+	msg := &mdns.Msg{}
+	msg.SetQuestion(name, mdns.TypeA)
+	if bufSize > 0 {
+		msg.SetEdns0(bufSize, false)
+	}
+	query, err := msg.Pack()
+	require.NoError(t, err)
+
+	q, ok := parseForwardQuery(query, false)
+	require.True(t, ok)
+
+	var resp []byte
+	if !f.Cached(q, func(b []byte) error {
+		resp = b
+		return nil
+	}) {
+		var err error
+		resp, err = f.exchange(context.Background(), make([]byte, maxTCPMsgLength), q)
+		require.NoError(t, err)
+		f.cache.Put(q.Key, resp, time.Now())
+		resp = f.response(q, resp)
+	}
+
+	respMsg := &mdns.Msg{}
+	require.NoError(t, respMsg.Unpack(resp))
+	require.Equal(t, msg.Id, respMsg.Id)
+	return respMsg
+}
+
+func TestForwarder(t *testing.T) {
+	handler := func(w mdns.ResponseWriter, r *mdns.Msg) {
+		resp := &mdns.Msg{}
+		resp.SetReply(r)
+		// Letter case of the question is randomized by the forwarder.
+		switch strings.ToLower(r.Question[0].Name) {
+		case "missing.example.com.":
+			resp.Rcode = mdns.RcodeNameError
+			resp.Ns = []mdns.RR{&mdns.SOA{
+				Hdr:    mdns.RR_Header{Name: "example.com.", Rrtype: mdns.TypeSOA, Class: mdns.ClassINET, Ttl: 300},
+				Ns:     "ns1.example.com.",
+				Mbox:   "admin.example.com.",
+				Minttl: 30,
+			}}
+		case "large.example.com.":
+			for i := range 50 {
+				resp.Answer = append(resp.Answer, &mdns.A{
+					Hdr: mdns.RR_Header{Name: r.Question[0].Name, Rrtype: mdns.TypeA, Class: mdns.ClassINET, Ttl: 60},
+					A:   net.IPv4(10, 0, 0, byte(i)),
+				})
+			}
+			if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+				resp.Truncate(512)
+			}
+		default:
+			resp.Answer = []mdns.RR{&mdns.A{
+				Hdr: mdns.RR_Header{Name: r.Question[0].Name, Rrtype: mdns.TypeA, Class: mdns.ClassINET, Ttl: 60},
+				A:   net.IPv4(10, 0, 0, 1),
+			}}
+		}
+		_ = w.WriteMsg(resp)
+	}
+
+	port := runUpstream(t, "127.0.0.1", 0, handler)
+
+	// This upstream never responds.
+	deadConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: port})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = deadConn.Close()
+	})
+
+	f := newForwarder([]net.IP{net.IPv4(127, 0, 0, 2), net.IPv4(127, 0, 0, 1)}, port, metrics.NewSet())
+
+	// Query is hedged to the second upstream. Upstream outrun by the hedged one is not failed.
+	resp := forwardExchange(t, f, "host.example.com.", 0)
+	require.Equal(t, mdns.RcodeSuccess, resp.Rcode)
+	require.Len(t, resp.Answer, 1)
+	require.Equal(t, uint64(1), f.cache.mMisses.Get())
+	require.Zero(t, f.upstreams[0].failures.Load())
+
+	// Response is cached.
+	resp = forwardExchange(t, f, "HOST.example.com.", 0)
+	require.Equal(t, "HOST.example.com.", resp.Question[0].Name)
+	require.Len(t, resp.Answer, 1)
+	require.Equal(t, uint64(1), f.cache.mHits.Get())
+
+	// TTLs are decreased.
+	q, _ := parseForwardQuery(mustPack(t, "host.example.com."), false)
+	cached, exists := f.cache.Get(q.Key, time.Now().Add(10*time.Second))
+	require.True(t, exists)
+	cachedMsg := &mdns.Msg{}
+	require.NoError(t, cachedMsg.Unpack(cached))
+	require.LessOrEqual(t, cachedMsg.Answer[0].Header().Ttl, uint32(50))
+
+	// Cached responses expire.
+	_, exists = f.cache.Get(q.Key, time.Now().Add(time.Minute))
+	require.False(t, exists)
+
+	// Negative responses are cached for the SOA minimum.
+	resp = forwardExchange(t, f, "missing.example.com.", 0)
+	require.Equal(t, mdns.RcodeNameError, resp.Rcode)
+	q, _ = parseForwardQuery(mustPack(t, "missing.example.com."), false)
+	_, exists = f.cache.Get(q.Key, time.Now().Add(20*time.Second))
+	require.True(t, exists)
+	_, exists = f.cache.Get(q.Key, time.Now().Add(31*time.Second))
+	require.False(t, exists)
+
+	// Truncated response is repeated over TCP, client gets truncated response until it uses TCP.
+	resp = forwardExchange(t, f, "large.example.com.", 0)
+	require.True(t, resp.Truncated)
+	require.Equal(t, uint64(1), f.mTCPFallbacks.Get())
+	resp = forwardExchange(t, f, "large.example.com.", 4096)
+	require.False(t, resp.Truncated)
+	require.Len(t, resp.Answer, 50)
+
+	// Unhealthy upstream is not asked first.
+	f.upstreams[0].failures.Store(maxUpstreamFailures - 1)
+	f.upstreams[0].Failure(time.Now())
+	require.False(t, f.upstreams[0].Healthy(time.Now()))
+	require.Equal(t, f.upstreams[1], f.order(time.Now())[0])
+}
+
+func TestForwarderTimeout(t *testing.T) {
+	requireT := require.New(t)
+
+	// This upstream never responds.
+	deadConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	requireT.NoError(err)
+	t.Cleanup(func() {
+		_ = deadConn.Close()
+	})
+
+	f := newForwarder([]net.IP{net.IPv4(127, 0, 0, 1)}, deadConn.LocalAddr().(*net.UDPAddr).Port, metrics.NewSet())
+	q, _ := parseForwardQuery(mustPack(t, "host.example.com."), false)
+	_, err = f.exchange(context.Background(), make([]byte, maxTCPMsgLength), q)
+	requireT.Error(err)
+	requireT.Equal(uint32(1), f.upstreams[0].failures.Load())
+}
+
+func TestForwarderCaseRandomization(t *testing.T) {
+	requireT := require.New(t)
+
+	var mu sync.Mutex
+	var names []string
+	var sourcePorts []int
+	port := runUpstream(t, "127.0.0.1", 0, func(w mdns.ResponseWriter, r *mdns.Msg) {
+		mu.Lock()
+		names = append(names, r.Question[0].Name)
+		sourcePorts = append(sourcePorts, w.RemoteAddr().(*net.UDPAddr).Port)
+		mu.Unlock()
+
+		resp := &mdns.Msg{}
+		resp.SetReply(r)
+		if strings.HasPrefix(strings.ToLower(r.Question[0].Name), "mangled.") {
+			resp.Question[0].Name = strings.ToLower(r.Question[0].Name)
+		}
+		_ = w.WriteMsg(resp)
+	})
+	f := newForwarder([]net.IP{net.IPv4(127, 0, 0, 1)}, port, metrics.NewSet())
+
+	name := strings.Repeat("a", 63) + ".example.com."
+	for range 10 {
+		q, _ := parseForwardQuery(mustPack(t, name), false)
+		_, err := f.exchange(context.Background(), make([]byte, maxTCPMsgLength), q)
+		requireT.NoError(err)
+	}
+
+	// Response not matching the case of the query is rejected.
+	q, _ := parseForwardQuery(mustPack(t, "mangled."+name), false)
+	_, err := f.exchange(context.Background(), make([]byte, maxTCPMsgLength), q)
+	requireT.Error(err)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// Each query uses different case and source port.
+	names = names[:10]
+	requireT.Len(slices.Compact(slices.Sorted(slices.Values(names))), 10)
+	requireT.Greater(len(slices.Compact(slices.Sorted(slices.Values(sourcePorts)))), 1)
+	for _, n := range names {
+		requireT.True(strings.EqualFold(name, n))
+	}
+}
+
+func mustPack(t *testing.T, name string) []byte {
+	msg := &mdns.Msg{}
+	msg.SetQuestion(name, mdns.TypeA)
+	query, err := msg.Pack()
+	require.NoError(t, err)
+	return query
+}
@@ -0,0 +1,230 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/outofforest/cloudless/pkg/eye/metrics"
+	"github.com/outofforest/logger"
+	"github.com/outofforest/parallel"
+)
+
+const (
+	healthCheckInterval = 5 * time.Second
+	healthCheckTimeout  = 2 * time.Second
+
+	// Address is considered unhealthy after this number of consecutive failed probes.
+	maxHealthCheckFailures = 2
+
+	subsystemHealth = "health"
+	labelAddress    = "address"
+	labelPort       = "port"
+)
+
+// healthTarget is the address probed by the health check.
+type healthTarget struct {
+	Check HealthCheckConfig
+	IP    string
+}
+
+func newHealthChecker(set *metrics.Set) *healthChecker {
+	return &healthChecker{
+		set:       set,
+		unhealthy: map[healthTarget]struct{}{},
+		failures:  map[healthTarget]int{},
+		client: &http.Client{
+			Timeout: healthCheckTimeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// healthChecker probes addresses of the domains periodically.
+type healthChecker struct {
+	set    *metrics.Set
+	client *http.Client
+
+	mu        sync.RWMutex
+	unhealthy map[healthTarget]struct{}
+
+	// failures is accessed by the Run goroutine only.
+	failures map[healthTarget]int
+}
+
+// Filter returns healthy addresses of the domain. If none of them is healthy, all of them are returned,
+// because answering with unhealthy address is better than no answer.
+func (hc *healthChecker) Filter(zConfig ZoneConfig, name string, ips []net.IP) []net.IP {
+	if hc == nil || len(ips) == 0 {
+		return ips
+	}
+	check, exists := zConfig.HealthChecks[name]
+	if !exists {
+		return ips
+	}
+
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+
+	healthy := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if _, unhealthy := hc.unhealthy[healthTarget{Check: check, IP: ip.String()}]; !unhealthy {
+			healthy = append(healthy, ip)
+		}
+	}
+	if len(healthy) == 0 {
+		return ips
+	}
+	return healthy
+}
+
+// Run probes the addresses returned by targets periodically.
+func (hc *healthChecker) Run(ctx context.Context, targets func() []healthTarget) error {
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		hc.check(ctx, targets())
+
+		select {
+		case <-ctx.Done():
+			return errors.WithStack(ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// check probes all the targets once and updates their health.
+func (hc *healthChecker) check(ctx context.Context, targets []healthTarget) {
+	results := make([]error, len(targets))
+	_ = parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		for i, t := range targets {
+			spawn("probe", parallel.Continue, func(ctx context.Context) error {
+				results[i] = hc.probe(ctx, t)
+				return nil
+			})
+		}
+		return nil
+	})
+	if ctx.Err() != nil {
+		return
+	}
+
+	log := logger.Get(ctx)
+	failures := make(map[healthTarget]int, len(targets))
+	for i, t := range targets {
+		if results[i] != nil {
+			failures[t] = hc.failures[t] + 1
+			if failures[t] == maxHealthCheckFailures {
+				log.Warn("Address is unhealthy", zap.String("address", t.IP), zap.Uint16("port", t.Check.Port),
+					zap.Error(results[i]))
+			}
+		}
+
+		// "Equals 1 if address passes health check".
+		hc.set.GetOrCreateGauge(metrics.N(namespace, subsystemHealth, "healthy"),
+			metrics.L(labelAddress, t.IP),
+			metrics.L(labelPort, strconv.Itoa(int(t.Check.Port))),
+		).Set(healthGaugeValue(failures[t]))
+	}
+	hc.failures = failures
+
+	unhealthy := map[healthTarget]struct{}{}
+	for t, n := range failures {
+		if n >= maxHealthCheckFailures {
+			unhealthy[t] = struct{}{}
+		}
+	}
+
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	hc.unhealthy = unhealthy
+}
+
+// probe checks if target is healthy.
+func (hc *healthChecker) probe(ctx context.Context, t healthTarget) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	addr := net.JoinHostPort(t.IP, strconv.Itoa(int(t.Check.Port)))
+	if t.Check.Path == "" {
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return errors.WithStack(conn.Close())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+t.Check.Path, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	resp, err := hc.client.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
+		return errors.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func healthGaugeValue(failures int) float64 {
+	if failures >= maxHealthCheckFailures {
+		return 0
+	}
+	return 1
+}
+
+func healthChecksEnabled(config Config) bool {
+	for _, zConfig := range config.Zones {
+		if len(zConfig.HealthChecks) > 0 {
+			return true
+		}
+	}
+	for _, v := range config.Views {
+		for _, zConfig := range v.Zones {
+			if len(zConfig.HealthChecks) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// healthTargets returns addresses probed by health checks defined in zones.
+func (s *server) healthTargets() []healthTarget {
+	zones := []map[string]*zone{*s.zones.Load()}
+	for _, v := range s.views {
+		zones = append(zones, v.Zones)
+	}
+
+	var targets []healthTarget
+	seen := map[healthTarget]struct{}{}
+	for _, zs := range zones {
+		for _, z := range zs {
+			for name, check := range z.Config.HealthChecks {
+				for _, ip := range slices.Concat(z.Config.Domains[name], z.Config.Domains6[name]) {
+					t := healthTarget{Check: check, IP: ip.String()}
+					if _, exists := seen[t]; !exists {
+						seen[t] = struct{}{}
+						targets = append(targets, t)
+					}
+				}
+			}
+		}
+	}
+	return targets
+}
@@ -0,0 +1,61 @@
+package dns
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/outofforest/cloudless/pkg/eye/metrics"
+)
+
+func TestHealthCheck(t *testing.T) {
+	requireT := require.New(t)
+
+	var healthy atomic.Bool
+	healthy.Store(true)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() || r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(httpServer.Close)
+
+	_, portStr, err := net.SplitHostPort(httpServer.Listener.Addr().String())
+	requireT.NoError(err)
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	requireT.NoError(err)
+
+	// Second address does not accept connections.
+	s := newTestServer(t,
+		Zone("example.com", "ns1.example.com", "admin@example.com", 1,
+			Domain("http.example.com", "127.0.0.1", "127.0.0.2"),
+			HTTPHealthCheck("http.example.com", uint16(port), "health"),
+			Domain("tcp.example.com", "127.0.0.1", "127.0.0.2"),
+			TCPHealthCheck("tcp.example.com", uint16(port)),
+			Domain("unchecked.example.com", "127.0.0.1", "127.0.0.2"),
+		),
+	)
+	s.health = newHealthChecker(metrics.NewSet())
+
+	check := func() {
+		for range maxHealthCheckFailures {
+			s.health.check(newTestContext(), s.healthTargets())
+		}
+	}
+
+	check()
+	requireT.Equal([]string{"127.0.0.1"}, resolveA(t, s, "http.example.com."))
+	requireT.Equal([]string{"127.0.0.1"}, resolveA(t, s, "tcp.example.com."))
+	requireT.ElementsMatch([]string{"127.0.0.1", "127.0.0.2"}, resolveA(t, s, "unchecked.example.com."))
+
+	// All the addresses are returned if none of them is healthy.
+	healthy.Store(false)
+	check()
+	requireT.ElementsMatch([]string{"127.0.0.1", "127.0.0.2"}, resolveA(t, s, "http.example.com."))
+	requireT.Equal([]string{"127.0.0.1"}, resolveA(t, s, "tcp.example.com."))
+}
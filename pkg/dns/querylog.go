@@ -0,0 +1,189 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	vmetrics "github.com/VictoriaMetrics/metrics"
+	"go.uber.org/zap"
+
+	"github.com/outofforest/cloudless/pkg/eye/metrics"
+	"github.com/outofforest/logger"
+)
+
+const (
+	subsystemServer = "server"
+
+	labelQType     = "qtype"
+	labelRCode     = "rcode"
+	labelZone      = "zone"
+	labelTransport = "transport"
+
+	transportUDP = "udp"
+	transportTCP = "tcp"
+	transportDoT = "dot"
+	transportDoH = "doh"
+
+	labelNone  = "none"
+	labelOther = "other"
+)
+
+var typeNames = map[uint16]string{
+	typeA:          "A",
+	typeNS:         "NS",
+	typeCNAME:      "CNAME",
+	typeSOA:        "SOA",
+	typePTR:        "PTR",
+	typeMX:         "MX",
+	typeTXT:        "TXT",
+	typeAAAA:       "AAAA",
+	typeSRV:        "SRV",
+	typeDNSKEY:     "DNSKEY",
+	typeNSEC3PARAM: "NSEC3PARAM",
+	typeCAA:        "CAA",
+	typeIXFR:       "IXFR",
+	typeAXFR:       "AXFR",
+	typeANY:        "ANY",
+}
+
+var rCodeNames = map[uint8]string{
+	rCodeOK:             "NOERROR",
+	rCodeFormatError:    "FORMERR",
+	rCodeServerFailure:  "SERVFAIL",
+	rCodeNameError:      "NXDOMAIN",
+	rCodeNotImplemented: "NOTIMP",
+	rCodeRefused:        "REFUSED",
+	rCodeYXDomain:       "YXDOMAIN",
+	rCodeYXRRSet:        "YXRRSET",
+	rCodeNXRRSet:        "NXRRSET",
+	rCodeNotAuth:        "NOTAUTH",
+	rCodeNotZone:        "NOTZONE",
+}
+
+func newQueryObserver(config QueryLogConfig, set *metrics.Set) *queryObserver {
+	o := &queryObserver{
+		config: config,
+		set:    set,
+		// "Time spent on answering UDP queries".
+		mLatencyUDP: set.NewHistogram(metrics.N(namespace, subsystemServer, "latency"),
+			metrics.L(labelTransport, transportUDP)),
+		// "Time spent on answering TCP queries".
+		mLatencyTCP: set.NewHistogram(metrics.N(namespace, subsystemServer, "latency"),
+			metrics.L(labelTransport, transportTCP)),
+		// "Time spent on answering DNS-over-TLS queries".
+		mLatencyDoT: set.NewHistogram(metrics.N(namespace, subsystemServer, "latency"),
+			metrics.L(labelTransport, transportDoT)),
+		// "Time spent on answering DNS-over-HTTPS queries".
+		mLatencyDoH: set.NewHistogram(metrics.N(namespace, subsystemServer, "latency"),
+			metrics.L(labelTransport, transportDoH)),
+	}
+	if config.DnstapOutput != "" {
+		o.tap = newDnstapWriter(config.DnstapOutput, set)
+	}
+	return o
+}
+
+// queryObserver collects metrics of the answered queries and logs them.
+type queryObserver struct {
+	config  QueryLogConfig
+	set     *metrics.Set
+	tap     *dnstapWriter
+	counter atomic.Uint64
+
+	mLatencyUDP *vmetrics.Histogram
+	mLatencyTCP *vmetrics.Histogram
+	mLatencyDoT *vmetrics.Histogram
+	mLatencyDoH *vmetrics.Histogram
+}
+
+// Query returns copy of the query if it is needed to log it, because buffer is reused by the response.
+func (o *queryObserver) Query(query []byte) []byte {
+	if o == nil || o.tap == nil {
+		return nil
+	}
+	return slices.Clone(query)
+}
+
+// Observe records the query answered with the response.
+func (o *queryObserver) Observe(
+	ctx context.Context,
+	zones map[string]*zone,
+	query, resp []byte,
+	clientAddr net.Addr,
+	transport string,
+	forwarded bool,
+	start time.Time,
+) {
+	if o == nil {
+		return
+	}
+
+	now := time.Now()
+	var mLatency *vmetrics.Histogram
+	switch transport {
+	case transportTCP:
+		mLatency = o.mLatencyTCP
+	case transportDoT:
+		mLatency = o.mLatencyDoT
+	case transportDoH:
+		mLatency = o.mLatencyDoH
+	default:
+		mLatency = o.mLatencyUDP
+	}
+	mLatency.Update(now.Sub(start).Seconds())
+
+	h, _ := readHeader(resp)
+	qName, qType, zoneName := "", labelNone, labelNone
+	if h.QDCount > 0 {
+		if q, _, ok := readQuery(resp[headerSize:]); ok {
+			qName = strings.ToLower(q.QName)
+			qType = typeName(q.QType)
+			if z, ok := findZone(qName, zones); ok {
+				zoneName = z.Config.Domain
+			}
+		}
+	}
+	rCode := rCodeName(h.RCode)
+
+	// "Number of answered queries".
+	o.set.GetOrCreateCounter(metrics.N(namespace, subsystemServer, "queries"),
+		metrics.L(labelQType, qType),
+		metrics.L(labelRCode, rCode),
+		metrics.L(labelZone, zoneName),
+		metrics.L(labelTransport, transport),
+	).Inc()
+
+	if o.config.SampleRate > 0 && o.counter.Add(1)%uint64(o.config.SampleRate) == 0 {
+		logger.Get(ctx).Info("DNS query answered",
+			zap.Stringer("client", clientAddr),
+			zap.String("transport", transport),
+			zap.String("name", qName),
+			zap.String("type", qType),
+			zap.String("rcode", rCode),
+			zap.String("zone", zoneName),
+			zap.Bool("forwarded", forwarded),
+			zap.Duration("duration", now.Sub(start)))
+	}
+
+	if o.tap != nil {
+		o.tap.Write(dnstapFrame(query, resp, clientAddr, transport, forwarded, start, now))
+	}
+}
+
+func typeName(qType uint16) string {
+	if name, exists := typeNames[qType]; exists {
+		return name
+	}
+	return labelOther
+}
+
+func rCodeName(rCode uint8) string {
+	if name, exists := rCodeNames[rCode]; exists {
+		return name
+	}
+	return labelOther
+}
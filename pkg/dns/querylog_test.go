@@ -0,0 +1,96 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	mdns "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+
+	"github.com/outofforest/cloudless/pkg/eye/metrics"
+	"github.com/outofforest/parallel"
+)
+
+func TestQueryObserver(t *testing.T) {
+	requireT := require.New(t)
+
+	s := newTestServer(t, Zone("example.com", "ns1.example.com", "admin@example.com", 1,
+		Domain("host.example.com", "10.0.0.1"),
+	))
+	set := metrics.NewSet()
+	output := filepath.Join(t.TempDir(), "dnstap")
+	o := newQueryObserver(QueryLogConfig{DnstapOutput: output}, set)
+
+	msg := &mdns.Msg{}
+	msg.SetQuestion("host.example.com.", mdns.TypeA)
+	query, err := msg.Pack()
+	requireT.NoError(err)
+
+	buff := make([]byte, bufferSize)
+	n := copy(buff, query)
+	start := time.Now()
+	logged := o.Query(buff[:n])
+	resp, _ := s.handle(newTestContext(), buff, n, net.IPv4(127, 0, 0, 1), false)
+	o.Observe(newTestContext(), *s.zones.Load(), logged, resp,
+		&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}, transportUDP, false, start)
+
+	b := &bytes.Buffer{}
+	set.WritePrometheus(b)
+	requireT.Contains(b.String(),
+		`dns_server_queries{qtype="A",rcode="NOERROR",zone="example.com",transport="udp"} 1`)
+	requireT.Contains(b.String(), `dns_server_latency_bucket{transport="udp"`)
+
+	err = parallel.Run(newTestContext(), func(ctx context.Context, spawn parallel.SpawnFn) error {
+		spawn("dnstap", parallel.Fail, o.tap.Run)
+		spawn("wait", parallel.Exit, func(ctx context.Context) error {
+			for {
+				info, err := os.Stat(output)
+				if err == nil && info.Size() > int64(len(fstrmControlFrame(fstrmControlStart))) {
+					return nil
+				}
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+		})
+		return nil
+	})
+	requireT.NoError(err)
+
+	content, err := os.ReadFile(output)
+	requireT.NoError(err)
+
+	startFrame := fstrmControlFrame(fstrmControlStart)
+	stopFrame := fstrmControlFrame(fstrmControlStop)
+	requireT.True(bytes.HasPrefix(content, startFrame))
+	requireT.True(bytes.HasSuffix(content, stopFrame))
+
+	frame := content[len(startFrame) : len(content)-len(stopFrame)]
+	requireT.EqualValues(len(frame)-4, binary.BigEndian.Uint32(frame))
+	requireT.True(bytes.Contains(frame, query))
+	requireT.True(bytes.Contains(frame, resp))
+	requireT.True(strings.Contains(string(frame), dnstapVersion))
+}
+
+func TestDnstapSocketProtocol(t *testing.T) {
+	requireT := require.New(t)
+
+	for transport, protocol := range map[string]byte{
+		transportUDP: dnstapSocketProtocolUDP,
+		transportTCP: dnstapSocketProtocolTCP,
+		transportDoT: dnstapSocketProtocolDOT,
+		transportDoH: dnstapSocketProtocolDOH,
+	} {
+		frame := dnstapFrame(nil, []byte{0x01}, nil, transport, false, time.Now(), time.Now())
+		requireT.True(bytes.Contains(frame, []byte{dnstapMessageFieldSocketProtocol << 3, protocol}), transport)
+	}
+}
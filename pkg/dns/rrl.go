@@ -0,0 +1,128 @@
+package dns
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	vmetrics "github.com/VictoriaMetrics/metrics"
+
+	"github.com/outofforest/cloudless/pkg/eye/metrics"
+)
+
+const (
+	defaultRateLimitPrefixLength = 24
+	rateLimiterCapacity          = 100000
+
+	subsystemRRL = "rrl"
+)
+
+type rrlAction int
+
+const (
+	rrlAllow rrlAction = iota
+	rrlSlip
+	rrlDrop
+)
+
+// rrlKey identifies responses sent to the client network.
+type rrlKey struct {
+	Network [net.IPv4len]byte
+	RCode   uint8
+	Name    string
+	Type    uint16
+}
+
+type rrlBucket struct {
+	Tokens  float64
+	Updated time.Time
+
+	// Limited is the number of responses limited so far.
+	Limited uint32
+}
+
+func newRateLimiter(config RateLimitConfig, set *metrics.Set) *rateLimiter {
+	return &rateLimiter{
+		config:  config,
+		mask:    net.CIDRMask(config.PrefixLength, 8*net.IPv4len),
+		buckets: map[rrlKey]rrlBucket{},
+		// "Number of responses dropped by the rate limiter".
+		mDropped: set.NewCounter(metrics.N(namespace, subsystemRRL, "dropped")),
+		// "Number of responses truncated by the rate limiter".
+		mTruncated: set.NewCounter(metrics.N(namespace, subsystemRRL, "truncated")),
+	}
+}
+
+// rateLimiter limits identical responses sent to client networks using token buckets.
+type rateLimiter struct {
+	config RateLimitConfig
+	mask   net.IPMask
+
+	mu      sync.Mutex
+	buckets map[rrlKey]rrlBucket
+
+	mDropped   *vmetrics.Counter
+	mTruncated *vmetrics.Counter
+}
+
+// Limit decides if response might be sent to the client. Positive responses are identified by the name and type,
+// negative ones by the zone, so random names don't bypass the limit.
+func (l *rateLimiter) Limit(clientIP net.IP, rCode uint8, name string, qType uint16, now time.Time) rrlAction {
+	if l == nil {
+		return rrlAllow
+	}
+	ip4 := clientIP.To4()
+	if ip4 == nil {
+		return rrlAllow
+	}
+
+	key := rrlKey{
+		RCode: rCode,
+		Name:  name,
+		Type:  qType,
+	}
+	copy(key.Network[:], ip4.Mask(l.mask))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rate := float64(l.config.ResponsesPerSecond)
+	bucket, exists := l.buckets[key]
+	if exists {
+		bucket.Tokens = min(rate, bucket.Tokens+now.Sub(bucket.Updated).Seconds()*rate)
+	} else {
+		if len(l.buckets) >= rateLimiterCapacity {
+			l.clean(now)
+		}
+		bucket.Tokens = rate
+	}
+	bucket.Updated = now
+
+	if bucket.Tokens >= 1 {
+		bucket.Tokens--
+		l.buckets[key] = bucket
+		return rrlAllow
+	}
+
+	bucket.Limited++
+	l.buckets[key] = bucket
+	if l.config.Slip > 0 && bucket.Limited%l.config.Slip == 0 {
+		l.mTruncated.Inc()
+		return rrlSlip
+	}
+	l.mDropped.Inc()
+	return rrlDrop
+}
+
+// clean removes buckets which have been refilled completely.
+func (l *rateLimiter) clean(now time.Time) {
+	rate := float64(l.config.ResponsesPerSecond)
+	for key, bucket := range l.buckets {
+		if bucket.Tokens+now.Sub(bucket.Updated).Seconds()*rate >= rate {
+			delete(l.buckets, key)
+		}
+	}
+	if len(l.buckets) >= rateLimiterCapacity {
+		clear(l.buckets)
+	}
+}
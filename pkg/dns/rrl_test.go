@@ -0,0 +1,93 @@
+package dns
+
+import (
+	"net"
+	"testing"
+
+	mdns "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+
+	"github.com/outofforest/cloudless/pkg/eye/metrics"
+)
+
+func TestRateLimit(t *testing.T) {
+	requireT := require.New(t)
+
+	s := newTestServer(t,
+		Zone("example.com", "ns1.example.com", "admin@example.com", 1,
+			Domain("host.example.com", "10.0.0.1"),
+		),
+		RateLimit(2, 2),
+		Cookies(),
+	)
+	s.limiter = newRateLimiter(*s.config.RateLimit, metrics.NewSet())
+
+	query := func(name string, clientIP net.IP, cookie string) *mdns.Msg {
+		msg := &mdns.Msg{}
+		msg.SetQuestion(name, mdns.TypeA)
+		msg.SetEdns0(bufferSize, false)
+		if cookie != "" {
+			opt := msg.IsEdns0()
+			opt.Option = append(opt.Option, &mdns.EDNS0_COOKIE{Code: mdns.EDNS0COOKIE, Cookie: cookie})
+		}
+		query, err := msg.Pack()
+		requireT.NoError(err)
+
+		buff := make([]byte, bufferSize)
+		n := copy(buff, query)
+		resp, forward := s.handle(newTestContext(), buff, n, clientIP, false)
+		requireT.False(forward)
+		if resp == nil {
+			return nil
+		}
+
+		respMsg := &mdns.Msg{}
+		requireT.NoError(respMsg.Unpack(resp))
+		return respMsg
+	}
+
+	clientIP := net.IPv4(10, 1, 0, 1)
+	for range 2 {
+		resp := query("host.example.com.", clientIP, "")
+		requireT.NotNil(resp)
+		requireT.Len(resp.Answer, 1)
+	}
+	requireT.Nil(query("host.example.com.", clientIP, ""))
+	resp := query("host.example.com.", net.IPv4(10, 1, 0, 2), "")
+	requireT.NotNil(resp)
+	requireT.True(resp.Truncated)
+	requireT.Empty(resp.Answer)
+	requireT.Nil(query("host.example.com.", clientIP, ""))
+	requireT.EqualValues(2, s.limiter.mDropped.Get())
+	requireT.EqualValues(1, s.limiter.mTruncated.Get())
+
+	// Other networks are not affected.
+	resp = query("host.example.com.", net.IPv4(10, 2, 0, 1), "")
+	requireT.NotNil(resp)
+	requireT.Len(resp.Answer, 1)
+
+	// Negative responses are limited per zone.
+	for _, name := range []string{"a.example.com.", "b.example.com."} {
+		resp := query(name, clientIP, "")
+		requireT.NotNil(resp)
+		requireT.Equal(mdns.RcodeNameError, resp.Rcode)
+	}
+	requireT.Nil(query("c.example.com.", clientIP, ""))
+
+	// Clients presenting valid cookie are not limited.
+	resp = query("host.example.com.", clientIP, "0102030405060708")
+	requireT.NotNil(resp)
+	requireT.True(resp.Truncated)
+	cookie := resp.IsEdns0().Option[0].(*mdns.EDNS0_COOKIE).Cookie
+	requireT.Len(cookie, 2*(clientCookieLength+serverCookieLength))
+	requireT.Equal("0102030405060708", cookie[:2*clientCookieLength])
+
+	for range 5 {
+		resp := query("host.example.com.", clientIP, cookie)
+		requireT.NotNil(resp)
+		requireT.Len(resp.Answer, 1)
+	}
+
+	// Cookie issued to other client is invalid.
+	requireT.Nil(query("host.example.com.", net.IPv4(10, 1, 0, 3), cookie))
+}
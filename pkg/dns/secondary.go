@@ -0,0 +1,492 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/outofforest/logger"
+)
+
+const (
+	minRefreshInterval   = 30 * time.Second
+	maxRefreshInterval   = time.Hour
+	defaultRetryInterval = time.Minute
+)
+
+// secondary is the zone pulled from the primary nameserver.
+type secondary struct {
+	Config SecondaryConfig
+
+	// NotifyCh receives signal when NOTIFY message is received from the primary.
+	NotifyCh chan struct{}
+}
+
+// soaRecord stores the content of SOA record.
+type soaRecord struct {
+	MainNameserver string
+	Email          string
+	Serial         uint32
+	Refresh        uint32
+	Retry          uint32
+	Expire         uint32
+	Minimum        uint32
+}
+
+func (s *server) runSecondary(ctx context.Context, sec *secondary) error {
+	log := logger.Get(ctx).With(zap.String("zone", sec.Config.Domain))
+
+	var soa soaRecord
+	var refreshed time.Time
+	for {
+		interval := defaultRetryInterval
+		newSOA, err := s.refreshSecondary(ctx, sec)
+		switch {
+		case err == nil:
+			soa = newSOA
+			refreshed = time.Now()
+			interval = refreshInterval(soa.Refresh)
+		case ctx.Err() != nil:
+			return errors.WithStack(ctx.Err())
+		default:
+			log.Error("Refreshing secondary zone failed", zap.Error(err))
+
+			if !refreshed.IsZero() {
+				interval = refreshInterval(soa.Retry)
+				if time.Since(refreshed) > time.Duration(soa.Expire)*time.Second {
+					log.Error("Secondary zone expired")
+					s.removeZone(sec.Config.Domain)
+					refreshed = time.Time{}
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.WithStack(ctx.Err())
+		case <-sec.NotifyCh:
+		case <-time.After(interval):
+		}
+	}
+}
+
+// refreshSecondary checks the serial number of the zone on primary and transfers the zone if it is newer.
+func (s *server) refreshSecondary(ctx context.Context, sec *secondary) (soaRecord, error) {
+	dialer := net.Dialer{Timeout: tcpIdleTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp4",
+		net.JoinHostPort(sec.Config.Primary.String(), strconv.Itoa(Port)))
+	if err != nil {
+		return soaRecord{}, errors.WithStack(err)
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	buff := make([]byte, 2+maxTCPMsgLength)
+	readMessage := func() ([]byte, error) {
+		if err := conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout)); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if _, err := io.ReadFull(conn, buff[:2]); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		n := binary.BigEndian.Uint16(buff)
+		if _, err := io.ReadFull(conn, buff[2:2+n]); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return buff[2 : 2+n], nil
+	}
+
+	id, err := sendTCPQuery(conn, sec.Config.Domain, typeSOA)
+	if err != nil {
+		return soaRecord{}, err
+	}
+	var soa *soaRecord
+	if err := readAnswers(id, readMessage, func(r rRecord, rd *msgReader) (bool, error) {
+		if r.Type == typeSOA && strings.ToLower(r.Name) == sec.Config.Domain {
+			record, ok := rd.soa()
+			if !ok {
+				return false, errors.New("invalid SOA record")
+			}
+			soa = &record
+		}
+		return false, nil
+	}); err != nil {
+		return soaRecord{}, err
+	}
+	if soa == nil {
+		return soaRecord{}, errors.New("primary nameserver returned no SOA record")
+	}
+
+	if z, exists := (*s.zones.Load())[sec.Config.Domain]; exists && !serialNewer(soa.Serial, z.Config.SerialNumber) {
+		return *soa, nil
+	}
+
+	id, err = sendTCPQuery(conn, sec.Config.Domain, typeAXFR)
+	if err != nil {
+		return soaRecord{}, err
+	}
+	zConfig, ignored, err := readTransfer(sec.Config.Domain, id, readMessage)
+	if err != nil {
+		return soaRecord{}, err
+	}
+
+	if err := s.setZone(ctx, zConfig); err != nil {
+		return soaRecord{}, err
+	}
+	s.zonesChanged()
+
+	logger.Get(ctx).Info("Secondary zone transferred", zap.String("zone", zConfig.Domain),
+		zap.Uint32("serial", zConfig.SerialNumber), zap.Int("ignoredRecords", ignored))
+
+	return *soa, nil
+}
+
+// readTransfer reads the zone sent by the primary in response to AXFR query. Number of records which are not
+// supported, and ignored, is returned.
+func readTransfer(domain string, id uint16, readMessage func() ([]byte, error)) (ZoneConfig, int, error) {
+	var zConfig ZoneConfig
+	var soaCount, ignored int
+
+	err := readAnswers(id, readMessage, func(r rRecord, rd *msgReader) (bool, error) {
+		name := strings.ToLower(r.Name)
+		if soaCount == 0 {
+			if r.Type != typeSOA || name != domain {
+				return false, errors.New("transfer does not start with SOA record")
+			}
+
+			soa, ok := rd.soa()
+			if !ok {
+				return false, errors.New("invalid SOA record")
+			}
+			zConfig = newZoneConfig(domain, soa.MainNameserver, soa.Email, soa.Serial)
+			soaCount++
+			return true, nil
+		}
+
+		if r.Type == typeSOA && name == domain {
+			soaCount++
+			return false, nil
+		}
+		if r.Class != classInternet || !inZone(name, domain) {
+			ignored++
+			return true, nil
+		}
+
+		supported, ok := addRecord(&zConfig, name, r.Type, rd)
+		if !ok {
+			return false, errors.Errorf("invalid record %s/%d", name, r.Type)
+		}
+		if !supported {
+			ignored++
+		}
+		return true, nil
+	})
+	if err != nil {
+		return ZoneConfig{}, 0, err
+	}
+	if soaCount != 2 {
+		return ZoneConfig{}, 0, errors.New("transfer is incomplete")
+	}
+	return zConfig, ignored, nil
+}
+
+// addRecord adds record to the zone configuration. False is returned if record type is not supported.
+//
+//nolint:gocyclo
+func addRecord(zConfig *ZoneConfig, name string, rType uint16, rd *msgReader) (bool, bool) {
+	apex := name == zConfig.Domain
+
+	switch rType {
+	case typeNS:
+		if !apex {
+			// Delegations are not supported.
+			return false, true
+		}
+		ns, ok := rd.name()
+		zConfig.Nameservers = append(zConfig.Nameservers, strings.ToLower(ns))
+		return true, ok
+	case typeA, typeAAAA:
+		length := net.IPv4len
+		if rType == typeAAAA {
+			length = net.IPv6len
+		}
+		ip, ok := rd.bytes(length)
+		if !ok {
+			return true, false
+		}
+		if rType == typeA {
+			zConfig.Domains[name] = append(zConfig.Domains[name], net.IP(slices.Clone(ip)))
+		} else {
+			zConfig.Domains6[name] = append(zConfig.Domains6[name], net.IP(slices.Clone(ip)))
+		}
+		return true, true
+	case typeCNAME:
+		target, ok := rd.name()
+		zConfig.Aliases[name] = AliasConfig{Target: strings.ToLower(target)}
+		return true, ok
+	case typeMX:
+		if !apex {
+			return false, true
+		}
+		priority, ok := rd.uint16()
+		if !ok {
+			return true, false
+		}
+		exchange, ok := rd.name()
+		zConfig.MailExchanges[strings.ToLower(exchange)] = priority
+		return true, ok
+	case typeTXT:
+		var value string
+		for rd.offset < len(rd.msg) {
+			length, ok := rd.bytes(1)
+			if !ok {
+				return true, false
+			}
+			v, ok := rd.bytes(int(length[0]))
+			if !ok {
+				return true, false
+			}
+			value += string(v)
+		}
+		zConfig.Texts[name] = append(zConfig.Texts[name], value)
+		return true, true
+	case typeSRV:
+		var srv ServiceLocatorConfig
+		var ok1, ok2, ok3, ok4 bool
+		srv.Priority, ok1 = rd.uint16()
+		srv.Weight, ok2 = rd.uint16()
+		srv.Port, ok3 = rd.uint16()
+		srv.Target, ok4 = rd.name()
+		srv.Target = strings.ToLower(srv.Target)
+		zConfig.ServiceLocators[name] = append(zConfig.ServiceLocators[name], srv)
+		return true, ok1 && ok2 && ok3 && ok4
+	case typePTR:
+		target, ok := rd.name()
+		zConfig.Pointers[name] = append(zConfig.Pointers[name], strings.ToLower(target))
+		return true, ok
+	case typeCAA:
+		header, ok := rd.bytes(2)
+		if !ok {
+			return true, false
+		}
+		tag, ok := rd.bytes(int(header[1]))
+		if !ok {
+			return true, false
+		}
+		value := rd.msg[rd.offset:]
+		zConfig.CAAs[name] = append(zConfig.CAAs[name], CAAConfig{
+			Flags: header[0],
+			Tag:   string(tag),
+			Value: string(value),
+		})
+		return true, true
+	default:
+		return false, true
+	}
+}
+
+// readAnswers reads answer records from response messages. Callback returns true if next message is expected.
+// Record data passed to the callback ends where the record ends.
+func readAnswers(
+	id uint16,
+	readMessage func() ([]byte, error),
+	onRecord func(r rRecord, rd *msgReader) (bool, error),
+) error {
+	for {
+		msg, err := readMessage()
+		if err != nil {
+			return err
+		}
+
+		h, ok := readHeader(msg)
+		if !ok || h.ID != id || !h.QR {
+			return errors.New("invalid response")
+		}
+		if h.RCode != rCodeOK {
+			return errors.Errorf("query failed with rcode %d", h.RCode)
+		}
+
+		r := &msgReader{msg: msg, offset: headerSize}
+		for range h.QDCount {
+			if _, ok := r.name(); !ok {
+				return errors.New("invalid question")
+			}
+			if _, ok := r.bytes(4); !ok {
+				return errors.New("invalid question")
+			}
+		}
+
+		var more bool
+		for range h.ANCount {
+			rec, end, ok := r.record()
+			if !ok {
+				return errors.New("invalid record")
+			}
+
+			rd := &msgReader{msg: msg[:end], offset: r.offset}
+			more, err = onRecord(rec, rd)
+			if err != nil {
+				return err
+			}
+			r.offset = end
+		}
+		if !more {
+			return nil
+		}
+	}
+}
+
+func sendTCPQuery(conn net.Conn, name string, qType uint16) (uint16, error) {
+	h := header{
+		ID: uint16(rand.Uint32()),
+	}
+	msg := make([]byte, 2+headerSize, 2+bufferSize)
+	b := putQuery(query{
+		QName:  name,
+		QType:  qType,
+		QClass: classInternet,
+	}, msg[2+headerSize:], &h, bufferSize)
+	putHeader(h, msg[2:2])
+	msg = msg[:2+headerSize+len(b)]
+	binary.BigEndian.PutUint16(msg, uint16(len(msg)-2))
+
+	if err := conn.SetWriteDeadline(time.Now().Add(tcpIdleTimeout)); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	_, err := conn.Write(msg)
+	return h.ID, errors.WithStack(err)
+}
+
+func refreshInterval(seconds uint32) time.Duration {
+	return min(max(time.Duration(seconds)*time.Second, minRefreshInterval), maxRefreshInterval)
+}
+
+// msgReader reads data from the message, supporting compressed names.
+type msgReader struct {
+	msg    []byte
+	offset int
+}
+
+func (r *msgReader) name() (string, bool) {
+	var labels []string
+	offset := r.offset
+	jumped := false
+
+	// Limit protects against pointer loops.
+	for range maxNameLength {
+		if offset >= len(r.msg) {
+			return "", false
+		}
+
+		l := int(r.msg[offset])
+		switch {
+		case l == 0:
+			if !jumped {
+				r.offset = offset + 1
+			}
+			return strings.Join(labels, "."), true
+		case l&0xc0 == 0xc0:
+			if offset+1 >= len(r.msg) {
+				return "", false
+			}
+			if !jumped {
+				r.offset = offset + 2
+				jumped = true
+			}
+			offset = int(binary.BigEndian.Uint16(r.msg[offset:]) & 0x3fff)
+		case l&0xc0 != 0:
+			return "", false
+		default:
+			if offset+1+l > len(r.msg) {
+				return "", false
+			}
+			labels = append(labels, string(r.msg[offset+1:offset+1+l]))
+			offset += 1 + l
+		}
+	}
+	return "", false
+}
+
+func (r *msgReader) bytes(n int) ([]byte, bool) {
+	if r.offset+n > len(r.msg) {
+		return nil, false
+	}
+	b := r.msg[r.offset : r.offset+n]
+	r.offset += n
+	return b, true
+}
+
+func (r *msgReader) uint16() (uint16, bool) {
+	b, ok := r.bytes(2)
+	if !ok {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(b), true
+}
+
+func (r *msgReader) uint32() (uint32, bool) {
+	b, ok := r.bytes(4)
+	if !ok {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(b), true
+}
+
+// record reads record header and returns the offset where record data ends. Reader is left at the beginning of
+// record data.
+func (r *msgReader) record() (rRecord, int, bool) {
+	var rec rRecord
+	var ok bool
+
+	if rec.Name, ok = r.name(); !ok {
+		return rRecord{}, 0, false
+	}
+	b, ok := r.bytes(10)
+	if !ok {
+		return rRecord{}, 0, false
+	}
+	rec.Type = binary.BigEndian.Uint16(b)
+	rec.Class = binary.BigEndian.Uint16(b[2:])
+	rec.TTL = binary.BigEndian.Uint32(b[4:])
+	rec.RDLength = binary.BigEndian.Uint16(b[8:])
+
+	end := r.offset + int(rec.RDLength)
+	if end > len(r.msg) {
+		return rRecord{}, 0, false
+	}
+	return rec, end, true
+}
+
+func (r *msgReader) soa() (soaRecord, bool) {
+	var soa soaRecord
+	var ok bool
+
+	if soa.MainNameserver, ok = r.name(); !ok {
+		return soaRecord{}, false
+	}
+	email, ok := r.name()
+	if !ok {
+		return soaRecord{}, false
+	}
+	soa.Email = strings.Replace(email, ".", "@", 1)
+
+	for _, v := range []*uint32{&soa.Serial, &soa.Refresh, &soa.Retry, &soa.Expire, &soa.Minimum} {
+		if *v, ok = r.uint32(); !ok {
+			return soaRecord{}, false
+		}
+	}
+	return soa, true
+}
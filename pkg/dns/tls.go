@@ -0,0 +1,142 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/outofforest/cloudless/pkg/thttp"
+)
+
+const (
+	// DoHPath is the path DNS-over-HTTPS queries are accepted on.
+	DoHPath = "/dns-query"
+
+	dohContentType = "application/dns-message"
+	dohQueryParam  = "dns"
+)
+
+// runDoT serves DNS-over-TLS (RFC 7858).
+func (s *server) runDoT(ctx context.Context) error {
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{
+		IP:   net.IPv4zero,
+		Port: int(s.config.TLS.DoTPort),
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return s.serveStream(ctx, tls.NewListener(l, s.tlsConfig()), transportDoT)
+}
+
+// runDoH serves DNS-over-HTTPS (RFC 8484).
+func (s *server) runDoH(ctx context.Context) error {
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{
+		IP:   net.IPv4zero,
+		Port: int(s.config.TLS.DoHPort),
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return thttp.NewServer(l, thttp.Config{
+		Handler:        http.HandlerFunc(s.serveDoH),
+		GetCertificate: s.certs.GetCertificate,
+	}, thttp.Middleware(thttp.Recover)).Run(ctx)
+}
+
+func (s *server) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: s.certs.GetCertificate,
+		NextProtos:     []string{"dot"},
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// serveDoH answers the query received over HTTPS.
+func (s *server) serveDoH(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != DoHPath {
+		http.NotFound(w, r)
+		return
+	}
+
+	buff := make([]byte, maxTCPMsgLength)
+	var n int
+	switch r.Method {
+	case http.MethodGet:
+		query, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get(dohQueryParam))
+		if err != nil || len(query) > len(buff) {
+			http.Error(w, "invalid query", http.StatusBadRequest)
+			return
+		}
+		n = copy(buff, query)
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		query, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(len(buff))))
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				http.Error(w, "query too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "invalid query", http.StatusBadRequest)
+			return
+		}
+		n = copy(buff, query)
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if n == 0 {
+		http.Error(w, "invalid query", http.StatusBadRequest)
+		return
+	}
+
+	clientAddr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		http.Error(w, "invalid client address", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	start := time.Now()
+	logged := s.observer.Query(buff[:n])
+
+	resp, forward := s.handle(ctx, buff, n, clientAddr.IP, true)
+	if forward {
+		// Forwarder responds asynchronously.
+		respCh := make(chan []byte, 1)
+		if s.forward(slices.Clone(buff[:n]), true, func(b []byte) error {
+			respCh <- slices.Clone(b)
+			return nil
+		}) {
+			select {
+			case <-ctx.Done():
+				return
+			case resp = <-respCh:
+			}
+			s.observer.Observe(ctx, *s.zones.Load(), logged, resp, clientAddr, transportDoH, true, start)
+			writeDoH(w, resp)
+			return
+		}
+		resp = failure(buff, n, rCodeServerFailure)
+	}
+	s.observer.Observe(ctx, *s.zones.Load(), logged, resp, clientAddr, transportDoH, false, start)
+	writeDoH(w, resp)
+}
+
+func writeDoH(w http.ResponseWriter, resp []byte) {
+	w.Header().Set("Content-Type", dohContentType)
+	_, _ = w.Write(resp)
+}
@@ -0,0 +1,159 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	mdns "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+
+	"github.com/outofforest/cloudless/pkg/acme/certificate"
+	"github.com/outofforest/cloudless/pkg/eye/metrics"
+	"github.com/outofforest/cloudless/pkg/wave"
+	"github.com/outofforest/parallel"
+)
+
+func newTLSTestServer(t *testing.T) (*server, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	certDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns.example.com"},
+		DNSNames:     []string{"dns.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns.example.com"},
+	}, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	leaf, err := x509.ParseCertificate(certDER)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	s := newTestServer(t,
+		Zone("example.com", "ns1.example.com", "admin@example.com", 1,
+			Domain("host.example.com", "10.0.0.1"),
+		),
+		DoT(wave.Config{}, "dns.example.com"),
+		DoH(wave.Config{}, "dns.example.com"),
+	)
+	s.certs = certificate.NewStore(s.config.TLS.WaveConfig, s.config.TLS.Domains)
+	require.NoError(t, s.certs.Set(append(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})...,
+	)))
+	return s, pool
+}
+
+func TestDoT(t *testing.T) {
+	requireT := require.New(t)
+	s, pool := newTLSTestServer(t)
+	set := metrics.NewSet()
+	s.observer = newQueryObserver(QueryLogConfig{}, set)
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	requireT.NoError(err)
+
+	ctx, cancel := context.WithCancel(newTestContext())
+	t.Cleanup(cancel)
+	group := parallel.NewGroup(ctx)
+	group.Spawn("server", parallel.Fail, func(ctx context.Context) error {
+		return s.serveStream(ctx, tls.NewListener(l, s.tlsConfig()), transportDoT)
+	})
+	t.Cleanup(func() {
+		group.Exit(nil)
+		_ = group.Wait()
+	})
+
+	client := &mdns.Client{
+		Net: "tcp-tls",
+		TLSConfig: &tls.Config{
+			ServerName: "dns.example.com",
+			RootCAs:    pool,
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+	msg := &mdns.Msg{}
+	msg.SetQuestion("host.example.com.", mdns.TypeA)
+	resp, _, err := client.Exchange(msg, l.Addr().String())
+	requireT.NoError(err)
+	requireT.Len(resp.Answer, 1)
+	requireT.Equal("10.0.0.1", resp.Answer[0].(*mdns.A).A.String())
+
+	// Queries are reported as DoT.
+	b := &bytes.Buffer{}
+	set.WritePrometheus(b)
+	requireT.Contains(b.String(),
+		`dns_server_queries{qtype="A",rcode="NOERROR",zone="example.com",transport="dot"} 1`)
+}
+
+func TestDoH(t *testing.T) {
+	requireT := require.New(t)
+	s, _ := newTLSTestServer(t)
+	set := metrics.NewSet()
+	s.observer = newQueryObserver(QueryLogConfig{}, set)
+
+	msg := &mdns.Msg{}
+	msg.SetQuestion("host.example.com.", mdns.TypeA)
+	query, err := msg.Pack()
+	requireT.NoError(err)
+
+	exchangeDoH := func(r *http.Request) *mdns.Msg {
+		r.RemoteAddr = "127.0.0.1:1234"
+		w := httptest.NewRecorder()
+		s.serveDoH(w, r)
+		requireT.Equal(http.StatusOK, w.Code)
+		requireT.Equal(dohContentType, w.Header().Get("Content-Type"))
+
+		resp := &mdns.Msg{}
+		requireT.NoError(resp.Unpack(w.Body.Bytes()))
+		return resp
+	}
+
+	r := httptest.NewRequest(http.MethodPost, DoHPath, bytes.NewReader(query))
+	r.Header.Set("Content-Type", dohContentType)
+	resp := exchangeDoH(r)
+	requireT.Len(resp.Answer, 1)
+	requireT.Equal("10.0.0.1", resp.Answer[0].(*mdns.A).A.String())
+
+	r = httptest.NewRequest(http.MethodGet, DoHPath+"?dns="+base64.RawURLEncoding.EncodeToString(query), nil)
+	resp = exchangeDoH(r)
+	requireT.Len(resp.Answer, 1)
+	requireT.Equal("10.0.0.1", resp.Answer[0].(*mdns.A).A.String())
+
+	w := httptest.NewRecorder()
+	s.serveDoH(w, httptest.NewRequest(http.MethodPost, DoHPath, bytes.NewReader(query)))
+	requireT.Equal(http.StatusUnsupportedMediaType, w.Code)
+
+	// Query exceeding the maximum message length is rejected instead of being cut.
+	r = httptest.NewRequest(http.MethodPost, DoHPath, bytes.NewReader(make([]byte, maxTCPMsgLength+1)))
+	r.Header.Set("Content-Type", dohContentType)
+	w = httptest.NewRecorder()
+	s.serveDoH(w, r)
+	requireT.Equal(http.StatusRequestEntityTooLarge, w.Code)
+
+	// Queries are reported as DoH.
+	b := &bytes.Buffer{}
+	set.WritePrometheus(b)
+	requireT.Contains(b.String(),
+		`dns_server_queries{qtype="A",rcode="NOERROR",zone="example.com",transport="doh"} 2`)
+}
@@ -0,0 +1,310 @@
+package dns
+
+import (
+	"context"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/outofforest/logger"
+	"github.com/outofforest/parallel"
+)
+
+const (
+	notifyRetries = 5
+	notifyTimeout = 2 * time.Second
+)
+
+// isTransferQuery checks if message is the AXFR or IXFR query.
+func isTransferQuery(b []byte) bool {
+	h, ok := readHeader(b)
+	if !ok || h.QR || h.Opcode != opcodeQuery || h.QDCount != 1 {
+		return false
+	}
+	q, _, ok := readQuery(b[headerSize:])
+	return ok && (q.QType == typeAXFR || q.QType == typeIXFR)
+}
+
+// transfer sends the zone requested by the AXFR or IXFR query stored in buff[:n]. Incremental transfers are not
+// supported, so the full zone is sent in response to IXFR query if client's version is outdated.
+// Records generated by DNSSEC signer are not transferred, secondaries are expected to sign the zone on their own.
+func (s *server) transfer(buff []byte, n int, clientIP net.IP, reply func(b []byte) error) error {
+	h, _ := readHeader(buff[:n])
+	q, _, _ := readQuery(buff[headerSize:n])
+
+	z, ok := (*s.zones.Load())[strings.ToLower(q.QName)]
+	if !ok || !ipAllowed(clientIP, s.config.TransferTo) {
+		return reply(failure(buff, n, rCodeRefused))
+	}
+
+	if q.QType == typeIXFR {
+		if serial, ok := ixfrSerial(buff[:n], h); ok && !serialNewer(z.Config.SerialNumber, serial) {
+			return reply(soaResponse(buff, h, q, z.Config, maxTCPMsgLength))
+		}
+	}
+
+	h.QR = true
+	h.AA = true
+	h.RA = false
+	msgHeader := h
+
+	var b []byte
+	newMessage := func(first bool) {
+		h = msgHeader
+		h.QDCount = 0
+		h.ANCount = 0
+		h.NSCount = 0
+		h.ARCount = 0
+		b = buff[headerSize:headerSize]
+		if first {
+			b = putQuery(q, b, &h, maxTCPMsgLength)
+		}
+	}
+	sendMessage := func() error {
+		putHeader(h, buff[:0])
+		return reply(buff[:headerSize+len(b)])
+	}
+
+	newMessage(true)
+	for _, rrSet := range s.transferRRSets(z) {
+		count := h.ANCount
+		b2 := s.putRRSet(rrSet, rrSet.QName, z, b, 0, &h, maxTCPMsgLength, nil)
+		if h.TC {
+			if count == 0 {
+				return errors.Errorf("RRSet %s/%d does not fit into the message", rrSet.QName, rrSet.QType)
+			}
+
+			h.TC = false
+			h.ANCount = count
+			if err := sendMessage(); err != nil {
+				return err
+			}
+			newMessage(false)
+			b2 = s.putRRSet(rrSet, rrSet.QName, z, b, 0, &h, maxTCPMsgLength, nil)
+			if h.TC {
+				return errors.Errorf("RRSet %s/%d does not fit into the message", rrSet.QName, rrSet.QType)
+			}
+		}
+		b = b2
+	}
+
+	return sendMessage()
+}
+
+// transferRRSets returns RRSets of the zone in the order they are transferred.
+func (s *server) transferRRSets(z *zone) []query {
+	soa := query{QName: z.Config.Domain, QType: typeSOA, QClass: classInternet}
+
+	rrSets := []query{soa}
+	for _, name := range slices.Sorted(maps.Keys(z.Names)) {
+		for _, qType := range s.types(z, name) {
+			switch qType {
+			case typeSOA, typeDNSKEY, typeNSEC3PARAM:
+			default:
+				rrSets = append(rrSets, query{QName: name, QType: qType, QClass: classInternet})
+			}
+		}
+	}
+	return append(rrSets, soa)
+}
+
+// handleTransferUDP responds to transfer query received over UDP. Only the SOA record is returned, so client knows
+// if zone should be transferred over TCP.
+func (s *server) handleTransferUDP(buff []byte, n int, h header, q query, clientIP net.IP) []byte {
+	if q.QType == typeAXFR {
+		return failure(buff, n, rCodeNotImplemented)
+	}
+
+	z, ok := (*s.zones.Load())[strings.ToLower(q.QName)]
+	if !ok || !ipAllowed(clientIP, s.config.TransferTo) {
+		return failure(buff, n, rCodeRefused)
+	}
+
+	return soaResponse(buff, h, q, z.Config, defaultMaxMsgLength)
+}
+
+// handleNotify processes NOTIFY message sent by the primary nameserver of the secondary zone.
+func (s *server) handleNotify(buff []byte, n int, h header, q query, clientIP net.IP) []byte {
+	sec, ok := s.secondaries[strings.ToLower(q.QName)]
+	if !ok || q.QType != typeSOA || !sec.Config.Primary.Equal(clientIP) {
+		return failure(buff, n, rCodeRefused)
+	}
+
+	select {
+	case sec.NotifyCh <- struct{}{}:
+	default:
+	}
+
+	h.QR = true
+	h.AA = true
+	h.RA = false
+	h.QDCount = 0
+	h.ANCount = 0
+	h.NSCount = 0
+	h.ARCount = 0
+
+	b := putQuery(q, buff[headerSize:headerSize], &h, defaultMaxMsgLength)
+	putHeader(h, buff[:0])
+	return buff[:headerSize+len(b)]
+}
+
+// zonesChanged triggers sending NOTIFY messages for zones whose serial number changed.
+func (s *server) zonesChanged() {
+	select {
+	case s.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (s *server) runNotifier(ctx context.Context) error {
+	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		spawn("changes", parallel.Fail, func(ctx context.Context) error {
+			log := logger.Get(ctx)
+
+			notified := map[string]uint32{}
+			for {
+				select {
+				case <-ctx.Done():
+					return errors.WithStack(ctx.Err())
+				case <-s.notifyCh:
+				}
+
+				for domain, z := range *s.zones.Load() {
+					if serial, exists := notified[domain]; exists && serial == z.Config.SerialNumber {
+						continue
+					}
+					notified[domain] = z.Config.SerialNumber
+
+					for _, ip := range s.config.NotifyTo {
+						spawn("notify", parallel.Continue, func(ctx context.Context) error {
+							if err := sendNotify(ctx, z.Config, ip); err != nil && ctx.Err() == nil {
+								log.Error("Sending DNS NOTIFY failed", zap.String("zone", domain),
+									zap.Stringer("server", ip), zap.Error(err))
+							}
+							return nil
+						})
+					}
+				}
+			}
+		})
+
+		return nil
+	})
+}
+
+func sendNotify(ctx context.Context, zConfig ZoneConfig, ip net.IP) error {
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{
+		IP:   ip,
+		Port: Port,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer conn.Close()
+
+	h := header{
+		ID:     uint16(rand.Uint32()),
+		Opcode: opcodeNotify,
+		AA:     true,
+	}
+	msg := make([]byte, headerSize, bufferSize)
+	b := putQuery(query{
+		QName:  zConfig.Domain,
+		QType:  typeSOA,
+		QClass: classInternet,
+	}, msg[headerSize:], &h, bufferSize)
+	b = putSOA(zConfig, b, &h, bufferSize)
+	putHeader(h, msg[:0])
+	msg = msg[:headerSize+len(b)]
+
+	resp := make([]byte, bufferSize)
+	for range notifyRetries {
+		if err := ctx.Err(); err != nil {
+			return errors.WithStack(err)
+		}
+		if _, err := conn.Write(msg); err != nil {
+			return errors.WithStack(err)
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(notifyTimeout)); err != nil {
+			return errors.WithStack(err)
+		}
+
+		for {
+			n, err := conn.Read(resp)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return errors.WithStack(err)
+			}
+
+			rh, ok := readHeader(resp[:n])
+			if !ok || rh.ID != h.ID || !rh.QR {
+				continue
+			}
+			if rh.RCode != rCodeOK {
+				return errors.Errorf("NOTIFY rejected with rcode %d", rh.RCode)
+			}
+			return nil
+		}
+	}
+
+	return errors.New("no response to NOTIFY")
+}
+
+// soaResponse writes response containing SOA record of the zone.
+func soaResponse(buff []byte, h header, q query, zConfig ZoneConfig, maxMsgLength uint16) []byte {
+	h.QR = true
+	h.AA = true
+	h.RA = false
+	h.QDCount = 0
+	h.ANCount = 0
+	h.NSCount = 0
+	h.ARCount = 0
+
+	b := putQuery(q, buff[headerSize:headerSize], &h, maxMsgLength)
+	if !h.TC {
+		if b2 := putSOA(zConfig, b, &h, maxMsgLength); !h.TC {
+			b = b2
+		}
+	}
+
+	putHeader(h, buff[:0])
+	return buff[:headerSize+len(b)]
+}
+
+// ixfrSerial returns the serial number of client's zone version sent in the authority section of the IXFR query.
+func ixfrSerial(msg []byte, h header) (uint32, bool) {
+	r := &msgReader{msg: msg, offset: headerSize}
+	if _, ok := r.name(); !ok {
+		return 0, false
+	}
+	if _, ok := r.bytes(4); !ok {
+		return 0, false
+	}
+
+	for range uint32(h.ANCount) + uint32(h.NSCount) {
+		rec, end, ok := r.record()
+		if !ok {
+			return 0, false
+		}
+		if rec.Type == typeSOA {
+			soa, ok := r.soa()
+			return soa.Serial, ok
+		}
+		r.offset = end
+	}
+	return 0, false
+}
+
+// serialNewer checks if serial number a is newer than b, using serial number arithmetic.
+func serialNewer(a, b uint32) bool {
+	return int32(a-b) > 0
+}
@@ -0,0 +1,133 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+
+	mdns "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func transferQuery(t *testing.T, qType uint16, serial uint32) ([]byte, int, uint16) {
+	msg := &mdns.Msg{}
+	msg.SetQuestion("example.com.", qType)
+	if qType == mdns.TypeIXFR {
+		msg.Ns = []mdns.RR{&mdns.SOA{
+			Hdr:    mdns.RR_Header{Name: "example.com.", Rrtype: mdns.TypeSOA, Class: mdns.ClassINET},
+			Ns:     "ns1.example.com.",
+			Mbox:   "admin.example.com.",
+			Serial: serial,
+		}}
+	}
+	query, err := msg.Pack()
+	require.NoError(t, err)
+
+	buff := make([]byte, maxTCPMsgLength)
+	return buff, copy(buff, query), msg.Id
+}
+
+func transferZone(t *testing.T, s *server, qType uint16, serial uint32, clientIP net.IP) ([][]byte, uint16) {
+	buff, n, id := transferQuery(t, qType, serial)
+	require.True(t, isTransferQuery(buff[:n]))
+
+	var msgs [][]byte
+	require.NoError(t, s.transfer(buff, n, clientIP, func(b []byte) error {
+		msgs = append(msgs, slices.Clone(b))
+		return nil
+	}))
+	return msgs, id
+}
+
+func TestTransfer(t *testing.T) {
+	configurators := []ZoneConfigurator{
+		Nameservers("ns1.example.com", "ns2.example.com"),
+		Domain("host.example.com", "10.0.0.1", "10.0.0.2", "2001:db8::1"),
+		Alias("www.example.com", "host.example.com"),
+		MailExchange("mail.example.com", 10),
+		ServiceLocator("_sip._tcp.example.com", "host.example.com", 5060, 10, 20),
+		CAA("example.com", 0, "issue", "letsencrypt.org"),
+	}
+	// Zone doesn't fit into single message.
+	for i := range 100 {
+		configurators = append(configurators, Text(fmt.Sprintf("txt%d.example.com", i), strings.Repeat("a", 1000)))
+	}
+
+	s := newTestServer(t,
+		Zone("example.com", "ns1.example.com", "admin@example.com", 10, configurators...),
+		TransferTo("10.0.0.0/24"),
+	)
+
+	msgs, id := transferZone(t, s, mdns.TypeAXFR, 0, net.IPv4(10, 0, 0, 5))
+	require.Greater(t, len(msgs), 1)
+
+	var rrs []mdns.RR
+	for _, msg := range msgs {
+		resp := &mdns.Msg{}
+		require.NoError(t, resp.Unpack(msg))
+		require.Equal(t, mdns.RcodeSuccess, resp.Rcode)
+		rrs = append(rrs, resp.Answer...)
+	}
+	require.Equal(t, mdns.TypeSOA, rrs[0].Header().Rrtype)
+	require.Equal(t, mdns.TypeSOA, rrs[len(rrs)-1].Header().Rrtype)
+
+	// Zone received by secondary is the same.
+	zConfig, ignored, err := readTransfer("example.com", id, func() ([]byte, error) {
+		msg := msgs[0]
+		msgs = msgs[1:]
+		return msg, nil
+	})
+	require.NoError(t, err)
+	require.Zero(t, ignored)
+	require.Empty(t, msgs)
+	require.Equal(t, (*s.zones.Load())["example.com"].Config, zConfig)
+
+	// Client has current version of the zone.
+	msgs, _ = transferZone(t, s, mdns.TypeIXFR, 10, net.IPv4(10, 0, 0, 5))
+	require.Len(t, msgs, 1)
+	resp := &mdns.Msg{}
+	require.NoError(t, resp.Unpack(msgs[0]))
+	require.Len(t, resp.Answer, 1)
+	require.Equal(t, uint32(10), resp.Answer[0].(*mdns.SOA).Serial)
+
+	// Client has outdated version of the zone.
+	msgs, _ = transferZone(t, s, mdns.TypeIXFR, 9, net.IPv4(10, 0, 0, 5))
+	require.Greater(t, len(msgs), 1)
+
+	// Client is not allowed to transfer the zone.
+	msgs, _ = transferZone(t, s, mdns.TypeAXFR, 0, net.IPv4(10, 0, 1, 5))
+	require.Len(t, msgs, 1)
+	resp = &mdns.Msg{}
+	require.NoError(t, resp.Unpack(msgs[0]))
+	require.Equal(t, mdns.RcodeRefused, resp.Rcode)
+}
+
+func TestNotify(t *testing.T) {
+	s := newTestServer(t, Secondary("example.com", "10.0.0.1"))
+
+	notify := func(clientIP net.IP) int {
+		msg := &mdns.Msg{}
+		msg.SetNotify("example.com.")
+		query, err := msg.Pack()
+		require.NoError(t, err)
+
+		buff := make([]byte, bufferSize)
+		n := copy(buff, query)
+		resp, forward := s.handle(newTestContext(), buff, n, clientIP, false)
+		require.False(t, forward)
+
+		respMsg := &mdns.Msg{}
+		require.NoError(t, respMsg.Unpack(resp))
+		require.True(t, respMsg.Response)
+		require.Equal(t, mdns.OpcodeNotify, respMsg.Opcode)
+		return respMsg.Rcode
+	}
+
+	require.Equal(t, mdns.RcodeRefused, notify(net.IPv4(10, 0, 0, 2)))
+	require.Empty(t, s.secondaries["example.com"].NotifyCh)
+
+	require.Equal(t, mdns.RcodeSuccess, notify(net.IPv4(10, 0, 0, 1)))
+	require.Len(t, s.secondaries["example.com"].NotifyCh, 1)
+}
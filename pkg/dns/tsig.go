@@ -0,0 +1,216 @@
+package dns
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"hash"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	tsigErrorBadSig  = 16
+	tsigErrorBadKey  = 17
+	tsigErrorBadTime = 18
+
+	tsigFudge = 300
+)
+
+var tsigAlgorithms = map[string]func() hash.Hash{
+	"hmac-sha256": sha256.New,
+	"hmac-sha512": sha512.New,
+}
+
+// tsigRecord stores the content of TSIG record.
+type tsigRecord struct {
+	Name       string
+	Algorithm  string
+	TimeSigned uint64
+	Fudge      uint16
+	MAC        []byte
+	OriginalID uint16
+	Error      uint16
+	OtherData  []byte
+}
+
+// readTSIG reads TSIG record which must be the last one in the message. Offset where it starts is returned.
+func readTSIG(msg []byte, h header) (tsigRecord, int, bool) {
+	if h.ARCount == 0 {
+		return tsigRecord{}, 0, false
+	}
+
+	r := &msgReader{msg: msg, offset: headerSize}
+	for range h.QDCount {
+		if _, ok := r.name(); !ok {
+			return tsigRecord{}, 0, false
+		}
+		if _, ok := r.bytes(4); !ok {
+			return tsigRecord{}, 0, false
+		}
+	}
+
+	count := uint32(h.ANCount) + uint32(h.NSCount) + uint32(h.ARCount)
+	for range count - 1 {
+		if _, end, ok := r.record(); ok {
+			r.offset = end
+		} else {
+			return tsigRecord{}, 0, false
+		}
+	}
+
+	start := r.offset
+	rec, end, ok := r.record()
+	if !ok || rec.Type != typeTSIG || rec.Class != classAny || end != len(msg) {
+		return tsigRecord{}, 0, false
+	}
+
+	t := tsigRecord{
+		Name: strings.ToLower(rec.Name),
+	}
+	if t.Algorithm, ok = r.name(); !ok {
+		return tsigRecord{}, 0, false
+	}
+	t.Algorithm = strings.ToLower(t.Algorithm)
+
+	b, ok := r.bytes(10)
+	if !ok {
+		return tsigRecord{}, 0, false
+	}
+	t.TimeSigned = uint64(binary.BigEndian.Uint16(b))<<32 | uint64(binary.BigEndian.Uint32(b[2:]))
+	t.Fudge = binary.BigEndian.Uint16(b[6:])
+	if t.MAC, ok = r.bytes(int(binary.BigEndian.Uint16(b[8:]))); !ok {
+		return tsigRecord{}, 0, false
+	}
+	// Message buffer is reused by the response.
+	t.MAC = slices.Clone(t.MAC)
+	if b, ok = r.bytes(6); !ok {
+		return tsigRecord{}, 0, false
+	}
+	t.OriginalID = binary.BigEndian.Uint16(b)
+	t.Error = binary.BigEndian.Uint16(b[2:])
+	if t.OtherData, ok = r.bytes(int(binary.BigEndian.Uint16(b[4:]))); !ok || r.offset != end {
+		return tsigRecord{}, 0, false
+	}
+
+	return t, start, true
+}
+
+// verifyTSIG verifies the request signed with TSIG record starting at offset. TSIG error code is returned.
+// normalizeUpdateKeys returns keys indexed by lowercase names, because key names received in TSIG records are
+// converted to lowercase.
+func normalizeUpdateKeys(keys map[string]UpdateKeyConfig) map[string]UpdateKeyConfig {
+	if keys == nil {
+		return nil
+	}
+
+	normalized := make(map[string]UpdateKeyConfig, len(keys))
+	for name, key := range keys {
+		key.Name = strings.ToLower(name)
+		names := make([]string, 0, len(key.Names))
+		for _, n := range key.Names {
+			names = append(names, strings.ToLower(n))
+		}
+		key.Names = names
+		normalized[key.Name] = key
+	}
+	return normalized
+}
+
+func verifyTSIG(msg []byte, offset int, t tsigRecord, keys map[string]UpdateKeyConfig, now time.Time) uint16 {
+	key, exists := keys[t.Name]
+	if !exists || tsigAlgorithms[t.Algorithm] == nil {
+		return tsigErrorBadKey
+	}
+
+	// MAC is computed for the message without TSIG record, having the original ID.
+	signed := append([]byte{}, msg[:offset]...)
+	binary.BigEndian.PutUint16(signed, t.OriginalID)
+	binary.BigEndian.PutUint16(signed[10:], binary.BigEndian.Uint16(signed[10:])-1)
+
+	mac := tsigMAC(key.Secret, nil, signed, t)
+	if !hmac.Equal(mac, t.MAC) {
+		return tsigErrorBadSig
+	}
+
+	timeSigned := time.Unix(int64(t.TimeSigned), 0)
+	if now.Sub(timeSigned).Abs() > time.Duration(t.Fudge)*time.Second {
+		return tsigErrorBadTime
+	}
+	return 0
+}
+
+// putTSIG signs the response stored in buff[:headerSize+len(b)] and adds TSIG record to it. If request failed the
+// verification, response is not signed.
+func putTSIG(
+	buff, b []byte,
+	h *header,
+	request tsigRecord,
+	tsigError uint16,
+	keys map[string]UpdateKeyConfig,
+	now time.Time,
+	maxMsgLength uint16,
+) []byte {
+	t := tsigRecord{
+		Name:       request.Name,
+		Algorithm:  request.Algorithm,
+		TimeSigned: uint64(now.Unix()),
+		Fudge:      tsigFudge,
+		OriginalID: request.OriginalID,
+		Error:      tsigError,
+	}
+	if tsigError == tsigErrorBadTime {
+		t.OtherData = binary.BigEndian.AppendUint16(nil, uint16(t.TimeSigned>>32))
+		t.OtherData = binary.BigEndian.AppendUint32(t.OtherData, uint32(t.TimeSigned))
+	}
+
+	if tsigError != tsigErrorBadSig && tsigError != tsigErrorBadKey {
+		putHeader(*h, buff[:0])
+		prefix := binary.BigEndian.AppendUint16(nil, uint16(len(request.MAC)))
+		prefix = append(prefix, request.MAC...)
+		t.MAC = tsigMAC(keys[t.Name].Secret, prefix, buff[:headerSize+len(b)], t)
+	}
+
+	h.Section = sectionAdditional
+	b2 := putRecord(rRecord{
+		Name:     t.Name,
+		Type:     typeTSIG,
+		Class:    classAny,
+		RDLength: nameLen(t.Algorithm) + 16 + uint16(len(t.MAC)) + uint16(len(t.OtherData)),
+	}, b, h, maxMsgLength)
+	if h.TC {
+		return b
+	}
+	b = putName(t.Algorithm, b2)
+	b = binary.BigEndian.AppendUint16(b, uint16(t.TimeSigned>>32))
+	b = binary.BigEndian.AppendUint32(b, uint32(t.TimeSigned))
+	b = binary.BigEndian.AppendUint16(b, t.Fudge)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(t.MAC)))
+	b = append(b, t.MAC...)
+	b = binary.BigEndian.AppendUint16(b, t.OriginalID)
+	b = binary.BigEndian.AppendUint16(b, t.Error)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(t.OtherData)))
+	return append(b, t.OtherData...)
+}
+
+func tsigMAC(secret, prefix, msg []byte, t tsigRecord) []byte {
+	mac := hmac.New(tsigAlgorithms[t.Algorithm], secret)
+	mac.Write(prefix)
+	mac.Write(msg)
+
+	variables := putName(t.Name, nil)
+	variables = binary.BigEndian.AppendUint16(variables, classAny)
+	variables = binary.BigEndian.AppendUint32(variables, 0)
+	variables = putName(t.Algorithm, variables)
+	variables = binary.BigEndian.AppendUint16(variables, uint16(t.TimeSigned>>32))
+	variables = binary.BigEndian.AppendUint32(variables, uint32(t.TimeSigned))
+	variables = binary.BigEndian.AppendUint16(variables, t.Fudge)
+	variables = binary.BigEndian.AppendUint16(variables, t.Error)
+	variables = binary.BigEndian.AppendUint16(variables, uint16(len(t.OtherData)))
+	variables = append(variables, t.OtherData...)
+	mac.Write(variables)
+
+	return mac.Sum(nil)
+}
@@ -0,0 +1,470 @@
+package dns
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/outofforest/logger"
+)
+
+// updateTypes are the types of records which might be modified by dynamic updates.
+var updateTypes = []uint16{typeA, typeAAAA, typeCNAME, typeMX, typeTXT, typeSRV, typePTR, typeCAA}
+
+// updateRecord is the record read from prerequisite or update section of the update message.
+type updateRecord struct {
+	Name     string
+	Type     uint16
+	Class    uint16
+	TTL      uint32
+	RDLength uint16
+
+	// Data stores the record data, if present.
+	Data ZoneConfig
+}
+
+// handleUpdate processes dynamic update defined by RFC 2136. Update must be signed by one of the zone keys.
+func (s *server) handleUpdate(ctx context.Context, buff []byte, n int, h header, q query, tcp bool) []byte {
+	if q.QType != typeSOA || q.QClass != classInternet {
+		return failure(buff, n, rCodeFormatError)
+	}
+	zConfig, exists := s.config.Zones[strings.ToLower(q.QName)]
+	if !exists {
+		return failure(buff, n, rCodeNotAuth)
+	}
+
+	msg := buff[:n]
+	t, tsigOffset, signed := readTSIG(msg, h)
+	if !signed {
+		return failure(buff, n, rCodeRefused)
+	}
+
+	var maxMsgLength uint16 = defaultMaxMsgLength
+	if tcp {
+		maxMsgLength = maxTCPMsgLength
+	}
+
+	now := time.Now()
+	if tsigError := verifyTSIG(msg, tsigOffset, t, zConfig.UpdateKeys, now); tsigError != 0 {
+		return updateResponse(buff, h, q, rCodeNotAuth, t, tsigError, zConfig.UpdateKeys, now, maxMsgLength)
+	}
+
+	rCode := s.update(ctx, msg, h, zConfig, zConfig.UpdateKeys[t.Name])
+	return updateResponse(buff, h, q, rCode, t, 0, zConfig.UpdateKeys, now, maxMsgLength)
+}
+
+// update verifies prerequisites and applies updates to the zone. Records defined statically are not affected.
+func (s *server) update(ctx context.Context, msg []byte, h header, static ZoneConfig, key UpdateKeyConfig) uint8 {
+	s.updatesMu.Lock()
+	defer s.updatesMu.Unlock()
+
+	records, exists := s.updates[static.Domain]
+	if !exists {
+		return rCodeRefused
+	}
+
+	// Zone section has been already verified.
+	r := &msgReader{msg: msg, offset: headerSize}
+	if _, ok := r.name(); !ok {
+		return rCodeFormatError
+	}
+	r.offset += 4
+
+	prerequisites, offset, rCode := readUpdateRecords(msg, r.offset, h.ANCount, static.Domain)
+	if rCode != rCodeOK {
+		return rCode
+	}
+	updates, _, rCode := readUpdateRecords(msg, offset, h.NSCount, static.Domain)
+	if rCode != rCodeOK {
+		return rCode
+	}
+
+	if rCode := s.checkPrerequisites((*s.zones.Load())[static.Domain], prerequisites); rCode != rCodeOK {
+		return rCode
+	}
+	for _, u := range updates {
+		if rCode := prescanUpdate(u, key); rCode != rCodeOK {
+			return rCode
+		}
+	}
+
+	newRecords := s.applyUpdates(static, records, updates)
+	if reflect.DeepEqual(newRecords, records) {
+		return rCodeOK
+	}
+	newRecords.SerialNumber = max(static.SerialNumber, records.SerialNumber) + 1
+
+	log := logger.Get(ctx).With(zap.String("zone", static.Domain))
+	if err := storeUpdates(s.updatesFile(static.Domain), newRecords); err != nil {
+		log.Error("Storing DNS updates failed", zap.Error(err))
+		return rCodeServerFailure
+	}
+	if err := s.setZone(ctx, mergeZoneConfig(static, newRecords)); err != nil {
+		log.Error("Updating DNS zone failed", zap.Error(err))
+		return rCodeServerFailure
+	}
+	s.updates[static.Domain] = newRecords
+	s.zonesChanged()
+
+	log.Info("DNS zone updated", zap.Uint32("serial", newRecords.SerialNumber))
+	return rCodeOK
+}
+
+// checkPrerequisites verifies prerequisites defined in section 3.2 of RFC 2136.
+func (s *server) checkPrerequisites(z *zone, prerequisites []updateRecord) uint8 {
+	required := newZoneConfig(z.Config.Domain, "", "", 0)
+	rrSets := map[query]struct{}{}
+	for _, p := range prerequisites {
+		if p.TTL != 0 {
+			return rCodeFormatError
+		}
+
+		types := s.types(z, p.Name)
+		switch p.Class {
+		case classAny:
+			switch {
+			case p.RDLength != 0:
+				return rCodeFormatError
+			case p.Type == typeANY:
+				if len(types) == 0 {
+					return rCodeNameError
+				}
+			case !slices.Contains(types, p.Type):
+				return rCodeNXRRSet
+			}
+		case classNone:
+			switch {
+			case p.RDLength != 0:
+				return rCodeFormatError
+			case p.Type == typeANY:
+				if len(types) > 0 {
+					return rCodeYXDomain
+				}
+			case slices.Contains(types, p.Type):
+				return rCodeYXRRSet
+			}
+		case classInternet:
+			required = mergeZoneConfig(required, p.Data)
+			rrSets[query{QName: p.Name, QType: p.Type}] = struct{}{}
+		default:
+			return rCodeFormatError
+		}
+	}
+
+	requiredZone := newZone(required, false)
+	for q := range rrSets {
+		if !slices.Equal(s.rdatas(requiredZone, q.QName, q.QType), s.rdatas(z, q.QName, q.QType)) {
+			return rCodeNXRRSet
+		}
+	}
+	return rCodeOK
+}
+
+// prescanUpdate verifies the update as defined in section 3.4.1 of RFC 2136, and checks if key is allowed to apply it.
+func prescanUpdate(u updateRecord, key UpdateKeyConfig) uint8 {
+	switch u.Class {
+	case classInternet:
+		if u.RDLength == 0 {
+			return rCodeFormatError
+		}
+	case classAny:
+		if u.TTL != 0 || u.RDLength != 0 {
+			return rCodeFormatError
+		}
+	case classNone:
+		if u.TTL != 0 || u.RDLength == 0 {
+			return rCodeFormatError
+		}
+	default:
+		return rCodeFormatError
+	}
+
+	if (u.Class != classAny || u.Type != typeANY) && !slices.Contains(updateTypes, u.Type) {
+		return rCodeRefused
+	}
+	if !keyAllows(key, u.Name) {
+		return rCodeRefused
+	}
+	return rCodeOK
+}
+
+// applyUpdates returns new dynamic records of the zone.
+func (s *server) applyUpdates(static, records ZoneConfig, updates []updateRecord) ZoneConfig {
+	// Records are copied to keep the stored ones untouched.
+	records = mergeZoneConfig(records, ZoneConfig{})
+
+	for _, u := range updates {
+		switch u.Class {
+		case classInternet:
+			current := newZone(mergeZoneConfig(static, records), false)
+			types := s.types(current, u.Name)
+
+			// CNAME can't coexist with other records.
+			if u.Type == typeCNAME && slices.ContainsFunc(types, func(t uint16) bool { return t != typeCNAME }) {
+				continue
+			}
+			if u.Type != typeCNAME && slices.Contains(types, typeCNAME) {
+				continue
+			}
+
+			rdatas := s.rdatas(newZone(u.Data, false), u.Name, u.Type)
+			if len(rdatas) == 0 || slices.Contains(s.rdatas(current, u.Name, u.Type), rdatas[0]) {
+				continue
+			}
+			records = mergeZoneConfig(records, u.Data)
+		case classAny:
+			if u.Type != typeANY {
+				removeRecords(&records, u.Name, u.Type, nil)
+				continue
+			}
+			for _, t := range updateTypes {
+				removeRecords(&records, u.Name, t, nil)
+			}
+		case classNone:
+			removeRecords(&records, u.Name, u.Type, &u.Data)
+		}
+	}
+
+	return records
+}
+
+// rdatas returns sorted data of records in the RRSet.
+func (s *server) rdatas(z *zone, name string, rType uint16) []string {
+	var h header
+	b := s.putRRSet(query{QName: name, QType: rType, QClass: classInternet}, name, z, nil, 0, &h,
+		maxTCPMsgLength, nil)
+
+	r := &msgReader{msg: b}
+	rdatas := make([]string, 0, h.ANCount)
+	for range h.ANCount {
+		_, end, ok := r.record()
+		if !ok {
+			break
+		}
+		rdatas = append(rdatas, string(b[r.offset:end]))
+		r.offset = end
+	}
+	slices.Sort(rdatas)
+	return rdatas
+}
+
+// readUpdateRecords reads records from prerequisite or update section.
+func readUpdateRecords(msg []byte, offset int, count uint16, domain string) ([]updateRecord, int, uint8) {
+	r := &msgReader{msg: msg, offset: offset}
+	records := make([]updateRecord, 0, count)
+	for range count {
+		rec, end, ok := r.record()
+		if !ok {
+			return nil, 0, rCodeFormatError
+		}
+
+		u := updateRecord{
+			Name:     strings.ToLower(rec.Name),
+			Type:     rec.Type,
+			Class:    rec.Class,
+			TTL:      rec.TTL,
+			RDLength: rec.RDLength,
+		}
+		if !inZone(u.Name, domain) {
+			return nil, 0, rCodeNotZone
+		}
+		if u.RDLength > 0 {
+			u.Data = newZoneConfig(domain, "", "", 0)
+			supported, ok := addRecord(&u.Data, u.Name, u.Type, &msgReader{msg: msg[:end], offset: r.offset})
+			switch {
+			case !ok:
+				return nil, 0, rCodeFormatError
+			case !supported:
+				return nil, 0, rCodeRefused
+			}
+		}
+
+		records = append(records, u)
+		r.offset = end
+	}
+	return records, r.offset, rCodeOK
+}
+
+// removeRecords removes records of the type from the name. If match is nil, whole RRSet is removed.
+func removeRecords(zConfig *ZoneConfig, name string, rType uint16, match *ZoneConfig) {
+	all := match == nil
+	if all {
+		match = &ZoneConfig{}
+	}
+
+	switch rType {
+	case typeA:
+		removeValues(zConfig.Domains, name, match.Domains[name], all, net.IP.Equal)
+	case typeAAAA:
+		removeValues(zConfig.Domains6, name, match.Domains6[name], all, net.IP.Equal)
+	case typeTXT:
+		removeValues(zConfig.Texts, name, match.Texts[name], all, equal)
+	case typeSRV:
+		removeValues(zConfig.ServiceLocators, name, match.ServiceLocators[name], all, equal)
+	case typePTR:
+		removeValues(zConfig.Pointers, name, match.Pointers[name], all, equal)
+	case typeCAA:
+		removeValues(zConfig.CAAs, name, match.CAAs[name], all, equal)
+	case typeCNAME:
+		if all || zConfig.Aliases[name] == match.Aliases[name] {
+			delete(zConfig.Aliases, name)
+		}
+	case typeMX:
+		if name != zConfig.Domain {
+			return
+		}
+		for exchange, priority := range zConfig.MailExchanges {
+			if all || match.MailExchanges[exchange] == priority {
+				delete(zConfig.MailExchanges, exchange)
+			}
+		}
+	}
+}
+
+func removeValues[T any](m map[string][]T, name string, values []T, all bool, equal func(a, b T) bool) {
+	if !all {
+		m[name] = slices.DeleteFunc(slices.Clone(m[name]), func(v T) bool {
+			return slices.ContainsFunc(values, func(v2 T) bool {
+				return equal(v, v2)
+			})
+		})
+	}
+	if all || len(m[name]) == 0 {
+		delete(m, name)
+	}
+}
+
+func equal[T comparable](a, b T) bool {
+	return a == b
+}
+
+// keyAllows checks if key is allowed to modify the name.
+func keyAllows(key UpdateKeyConfig, name string) bool {
+	if len(key.Names) == 0 {
+		return true
+	}
+	for _, n := range key.Names {
+		if n == name || (strings.HasPrefix(n, "*.") && strings.HasSuffix(name, n[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+func updateResponse(
+	buff []byte,
+	h header,
+	q query,
+	rCode uint8,
+	request tsigRecord,
+	tsigError uint16,
+	keys map[string]UpdateKeyConfig,
+	now time.Time,
+	maxMsgLength uint16,
+) []byte {
+	h.QR = true
+	h.AA = false
+	h.TC = false
+	h.RA = false
+	h.RCode = rCode
+	h.QDCount = 0
+	h.ANCount = 0
+	h.NSCount = 0
+	h.ARCount = 0
+
+	b := putQuery(q, buff[headerSize:headerSize], &h, maxMsgLength)
+	b = putTSIG(buff, b, &h, request, tsigError, keys, now, maxMsgLength)
+	putHeader(h, buff[:0])
+	return buff[:headerSize+len(b)]
+}
+
+// mergeZoneConfig returns the zone config containing records of both configs. Aliases defined by the dynamic config
+// override the static ones.
+func mergeZoneConfig(static, dynamic ZoneConfig) ZoneConfig {
+	zConfig := static
+	zConfig.SerialNumber = max(static.SerialNumber, dynamic.SerialNumber)
+	zConfig.Nameservers = slices.Clone(static.Nameservers)
+	zConfig.Domains = mergeLists(static.Domains, dynamic.Domains)
+	zConfig.Domains6 = mergeLists(static.Domains6, dynamic.Domains6)
+	zConfig.Aliases = mergeMaps(static.Aliases, dynamic.Aliases)
+	zConfig.MailExchanges = mergeMaps(static.MailExchanges, dynamic.MailExchanges)
+	zConfig.Texts = mergeLists(static.Texts, dynamic.Texts)
+	zConfig.ServiceLocators = mergeLists(static.ServiceLocators, dynamic.ServiceLocators)
+	zConfig.Pointers = mergeLists(static.Pointers, dynamic.Pointers)
+	zConfig.CAAs = mergeLists(static.CAAs, dynamic.CAAs)
+	return zConfig
+}
+
+func mergeLists[T any](a, b map[string][]T) map[string][]T {
+	m := make(map[string][]T, len(a)+len(b))
+	for k, v := range a {
+		m[k] = slices.Concat(v, b[k])
+	}
+	for k, v := range b {
+		if _, exists := a[k]; !exists {
+			m[k] = slices.Clone(v)
+		}
+	}
+	return m
+}
+
+func mergeMaps[T any](a, b map[string]T) map[string]T {
+	m := make(map[string]T, len(a)+len(b))
+	maps.Copy(m, a)
+	maps.Copy(m, b)
+	return m
+}
+
+func (s *server) updatesFile(domain string) string {
+	return filepath.Join(s.config.UpdatesDir, domain+".json")
+}
+
+// loadUpdates loads records added to the zone dynamically.
+func loadUpdates(file string, zConfig ZoneConfig) (ZoneConfig, error) {
+	records := newZoneConfig(zConfig.Domain, zConfig.MainNameserver, zConfig.Email, 0)
+	content, err := os.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return records, nil
+		}
+		return ZoneConfig{}, errors.WithStack(err)
+	}
+
+	if err := json.Unmarshal(content, &records); err != nil {
+		return ZoneConfig{}, errors.WithStack(err)
+	}
+
+	// IPv4 addresses are decoded to 16-byte form.
+	for _, ips := range records.Domains {
+		for i, ip := range ips {
+			ips[i] = ip.To4()
+		}
+	}
+	return records, nil
+}
+
+func storeUpdates(file string, records ZoneConfig) error {
+	content, err := json.Marshal(records)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return errors.WithStack(err)
+	}
+	tmpFile := file + ".tmp"
+	if err := os.WriteFile(tmpFile, content, 0o600); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmpFile, file))
+}
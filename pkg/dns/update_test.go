@@ -0,0 +1,167 @@
+package dns
+
+import (
+	"encoding/base64"
+	"net"
+	"testing"
+	"time"
+
+	mdns "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	updateSecret  = base64.StdEncoding.EncodeToString([]byte("update-secret"))
+	limitedSecret = base64.StdEncoding.EncodeToString([]byte("limited-secret"))
+)
+
+func newUpdateTestServer(t *testing.T, dir string) *server {
+	return newTestServer(t,
+		Zone("example.com", "ns1.example.com", "admin@example.com", 10,
+			Domain("host.example.com", "10.0.0.1"),
+			UpdateKey("update", updateSecret),
+			UpdateKey("limited", limitedSecret, "*.dyn.example.com"),
+		),
+		func(c *Config) {
+			c.UpdatesDir = dir
+		},
+	)
+}
+
+func update(t *testing.T, s *server, key, secret string, configure func(msg *mdns.Msg)) *mdns.Msg {
+	msg := &mdns.Msg{}
+	msg.SetUpdate("example.com.")
+	configure(msg)
+	msg.SetTsig(key+".", mdns.HmacSHA256, 300, time.Now().Unix())
+	query, mac, err := mdns.TsigGenerate(msg, secret, "", false)
+	require.NoError(t, err)
+
+	buff := make([]byte, bufferSize)
+	n := copy(buff, query)
+	resp, forward := s.handle(newTestContext(), buff, n, net.IPv4(127, 0, 0, 1), false)
+	require.False(t, forward)
+
+	respMsg := &mdns.Msg{}
+	require.NoError(t, respMsg.Unpack(resp))
+	if respMsg.Rcode != mdns.RcodeNotAuth {
+		require.NoError(t, mdns.TsigVerify(resp, secret, mac, false))
+	}
+	return respMsg
+}
+
+func resolveA(t *testing.T, s *server, name string) []string {
+	msg := &mdns.Msg{}
+	msg.SetQuestion(name, mdns.TypeA)
+	resp := exchange(t, s, msg, false)
+
+	var ips []string
+	for _, rr := range resp.Answer {
+		ips = append(ips, rr.(*mdns.A).A.String())
+	}
+	return ips
+}
+
+func serial(t *testing.T, s *server) uint32 {
+	msg := &mdns.Msg{}
+	msg.SetQuestion("example.com.", mdns.TypeSOA)
+	resp := exchange(t, s, msg, false)
+	require.Len(t, resp.Answer, 1)
+	return resp.Answer[0].(*mdns.SOA).Serial
+}
+
+func newRR(t *testing.T, rr string) mdns.RR {
+	r, err := mdns.NewRR(rr)
+	require.NoError(t, err)
+	return r
+}
+
+func TestUpdateKeyNamesNormalized(t *testing.T) {
+	requireT := require.New(t)
+	dir := t.TempDir()
+	s := newTestServer(t,
+		Zone("example.com", "ns1.example.com", "admin@example.com", 10),
+		func(c *Config) {
+			c.UpdatesDir = dir
+			zConfig := c.Zones["example.com"]
+			zConfig.UpdateKeys = map[string]UpdateKeyConfig{
+				"Update": {
+					Name:   "Update",
+					Secret: []byte("update-secret"),
+					Names:  []string{"*.Dyn.Example.com"},
+				},
+			}
+			c.Zones["example.com"] = zConfig
+		},
+	)
+
+	resp := update(t, s, "update", updateSecret, func(msg *mdns.Msg) {
+		msg.Insert([]mdns.RR{newRR(t, "host.dyn.example.com. 60 IN A 10.0.0.2")})
+	})
+	requireT.Equal(mdns.RcodeSuccess, resp.Rcode)
+	requireT.Equal([]string{"10.0.0.2"}, resolveA(t, s, "host.dyn.example.com."))
+}
+
+func TestUpdate(t *testing.T) {
+	requireT := require.New(t)
+	dir := t.TempDir()
+	s := newUpdateTestServer(t, dir)
+
+	resp := update(t, s, "update", updateSecret, func(msg *mdns.Msg) {
+		msg.Insert([]mdns.RR{
+			newRR(t, "new.example.com. 60 IN A 10.0.0.2"),
+			newRR(t, "host.example.com. 60 IN A 10.0.0.3"),
+		})
+	})
+	requireT.Equal(mdns.RcodeSuccess, resp.Rcode)
+	requireT.Equal([]string{"10.0.0.2"}, resolveA(t, s, "new.example.com."))
+	requireT.ElementsMatch([]string{"10.0.0.1", "10.0.0.3"}, resolveA(t, s, "host.example.com."))
+	requireT.EqualValues(11, serial(t, s))
+
+	// Duplicates don't change the zone.
+	resp = update(t, s, "update", updateSecret, func(msg *mdns.Msg) {
+		msg.Insert([]mdns.RR{newRR(t, "host.example.com. 60 IN A 10.0.0.1")})
+	})
+	requireT.Equal(mdns.RcodeSuccess, resp.Rcode)
+	requireT.EqualValues(11, serial(t, s))
+
+	// Updates survive restart.
+	s = newUpdateTestServer(t, dir)
+	requireT.Equal([]string{"10.0.0.2"}, resolveA(t, s, "new.example.com."))
+	requireT.EqualValues(11, serial(t, s))
+
+	// Static records are not deleted.
+	resp = update(t, s, "update", updateSecret, func(msg *mdns.Msg) {
+		msg.RemoveRRset([]mdns.RR{newRR(t, "host.example.com. 0 IN A 0.0.0.0")})
+		msg.Remove([]mdns.RR{newRR(t, "new.example.com. 0 IN A 10.0.0.2")})
+	})
+	requireT.Equal(mdns.RcodeSuccess, resp.Rcode)
+	requireT.Empty(resolveA(t, s, "new.example.com."))
+	requireT.Equal([]string{"10.0.0.1"}, resolveA(t, s, "host.example.com."))
+	requireT.EqualValues(12, serial(t, s))
+
+	// Prerequisites.
+	resp = update(t, s, "update", updateSecret, func(msg *mdns.Msg) {
+		msg.RRsetUsed([]mdns.RR{newRR(t, "new.example.com. 0 IN A 0.0.0.0")})
+		msg.Insert([]mdns.RR{newRR(t, "new.example.com. 60 IN A 10.0.0.2")})
+	})
+	requireT.Equal(mdns.RcodeNXRrset, resp.Rcode)
+	requireT.Empty(resolveA(t, s, "new.example.com."))
+
+	// ACL.
+	resp = update(t, s, "limited", limitedSecret, func(msg *mdns.Msg) {
+		msg.Insert([]mdns.RR{newRR(t, "new.example.com. 60 IN A 10.0.0.2")})
+	})
+	requireT.Equal(mdns.RcodeRefused, resp.Rcode)
+	resp = update(t, s, "limited", limitedSecret, func(msg *mdns.Msg) {
+		msg.Insert([]mdns.RR{newRR(t, "host.dyn.example.com. 60 IN A 10.0.0.4")})
+	})
+	requireT.Equal(mdns.RcodeSuccess, resp.Rcode)
+	requireT.Equal([]string{"10.0.0.4"}, resolveA(t, s, "host.dyn.example.com."))
+
+	// Wrong secret.
+	resp = update(t, s, "update", limitedSecret, func(msg *mdns.Msg) {
+		msg.Insert([]mdns.RR{newRR(t, "new.example.com. 60 IN A 10.0.0.2")})
+	})
+	requireT.Equal(mdns.RcodeNotAuth, resp.Rcode)
+	requireT.Empty(resolveA(t, s, "new.example.com."))
+}
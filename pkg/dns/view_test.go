@@ -0,0 +1,67 @@
+package dns
+
+import (
+	"net"
+	"testing"
+
+	mdns "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestViews(t *testing.T) {
+	requireT := require.New(t)
+
+	s := newTestServer(t,
+		Zone("example.com", "ns1.example.com", "admin@example.com", 1,
+			Domain("host.example.com", "1.2.3.4"),
+		),
+		Zone("other.com", "ns1.example.com", "admin@example.com", 1,
+			Domain("host.other.com", "1.2.3.5"),
+		),
+		View("internal",
+			Networks("10.0.0.0/8"),
+			ViewZone("example.com", "ns1.example.com", "admin@example.com", 1,
+				Domain("host.example.com", "10.0.0.1"),
+			),
+			ViewForward(),
+		),
+		View("isolated",
+			Networks("192.168.0.0/16"),
+		),
+		ForwardTo("127.0.0.1"),
+		ForwardFor("192.168.0.0/16", "172.16.0.0/12"),
+	)
+	s.forwardCh = make(chan forwardRequest)
+
+	resolve := func(name string, clientIP net.IP) string {
+		msg := &mdns.Msg{}
+		msg.SetQuestion(name, mdns.TypeA)
+		resp := exchangeFrom(t, s, msg, false, clientIP)
+		requireT.Len(resp.Answer, 1)
+		return resp.Answer[0].(*mdns.A).A.String()
+	}
+
+	requireT.Equal("10.0.0.1", resolve("host.example.com.", net.IPv4(10, 1, 1, 1)))
+	requireT.Equal("1.2.3.4", resolve("host.example.com.", net.IPv4(8, 8, 8, 8)))
+	requireT.Equal("1.2.3.4", resolve("host.example.com.", net.IPv4(192, 168, 0, 1)))
+
+	// Zones missing in the view are served from the default ones.
+	requireT.Equal("1.2.3.5", resolve("host.other.com.", net.IPv4(10, 1, 1, 1)))
+
+	forwarded := func(clientIP net.IP) bool {
+		msg := &mdns.Msg{}
+		msg.SetQuestion("example.org.", mdns.TypeA)
+		query, err := msg.Pack()
+		requireT.NoError(err)
+
+		buff := make([]byte, bufferSize)
+		n := copy(buff, query)
+		_, forward := s.handle(newTestContext(), buff, n, clientIP, false)
+		return forward
+	}
+
+	requireT.True(forwarded(net.IPv4(10, 1, 1, 1)))
+	requireT.True(forwarded(net.IPv4(172, 16, 0, 1)))
+	requireT.False(forwarded(net.IPv4(192, 168, 0, 1)))
+	requireT.False(forwarded(net.IPv4(8, 8, 8, 8)))
+}
@@ -0,0 +1,150 @@
+package dns
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/outofforest/cloudless/pkg/dns/dkim"
+)
+
+const wildcardPrefix = "*."
+
+// zone stores zone configuration together with data derived from it.
+type zone struct {
+	Config ZoneConfig
+
+	// Names contains all the names existing in the zone, including empty non-terminals.
+	Names map[string]struct{}
+
+	// Signer signs the zone if DNSSEC is enabled.
+	Signer *zoneSigner
+
+	// Wildcards is true if zone contains wildcard names.
+	Wildcards bool
+}
+
+func newZone(zConfig ZoneConfig, dkimEnabled bool) *zone {
+	z := &zone{
+		Config: zConfig,
+		Names:  map[string]struct{}{},
+	}
+
+	z.addName(zConfig.Domain)
+	for name := range zConfig.Domains {
+		z.addName(name)
+	}
+	for name := range zConfig.Domains6 {
+		z.addName(name)
+	}
+	for name := range zConfig.Aliases {
+		z.addName(name)
+	}
+	for name := range zConfig.Texts {
+		z.addName(name)
+	}
+	for name := range zConfig.ServiceLocators {
+		z.addName(name)
+	}
+	for name := range zConfig.Pointers {
+		z.addName(name)
+	}
+	for name := range zConfig.CAAs {
+		z.addName(name)
+	}
+	if dkimEnabled {
+		// Records are added dynamically below this name.
+		z.addName(strings.TrimPrefix(dkim.Domain("", zConfig.Domain), "."))
+	}
+
+	return z
+}
+
+// addName adds name and all its ancestors inside zone.
+func (z *zone) addName(name string) {
+	if strings.HasPrefix(name, wildcardPrefix) {
+		z.Wildcards = true
+	}
+	for inZone(name, z.Config.Domain) {
+		z.Names[name] = struct{}{}
+		if name == z.Config.Domain {
+			return
+		}
+		name = name[strings.Index(name, ".")+1:]
+	}
+}
+
+// wildcard returns the name whose records are used to answer the query for the name. If the name does not exist,
+// the wildcard defined directly below its closest encloser is returned (RFC 4592).
+func (s *server) wildcard(z *zone, name string) string {
+	if !z.Wildcards || s.exists(z, name) {
+		return name
+	}
+
+	for encloser := name; encloser != z.Config.Domain && inZone(encloser, z.Config.Domain); {
+		encloser = encloser[strings.Index(encloser, ".")+1:]
+		if _, exists := z.Names[encloser]; exists {
+			if _, exists := z.Names[wildcardPrefix+encloser]; exists {
+				return wildcardPrefix + encloser
+			}
+			return name
+		}
+	}
+	return name
+}
+
+// exists checks if name exists in the zone.
+func (s *server) exists(z *zone, name string) bool {
+	if _, exists := z.Names[name]; exists {
+		return true
+	}
+	if s.discoveryServer != nil && s.discoveryServer.IsDiscoveryQuery(name) && s.discoveryServer.Exists(name) {
+		return true
+	}
+	return len(s.types(z, name)) > 0
+}
+
+// types returns types of records existing for the name.
+func (s *server) types(z *zone, name string) []uint16 {
+	zConfig := z.Config
+
+	var types []uint16
+	if name == zConfig.Domain {
+		types = append(types, typeSOA)
+		if len(zConfig.Nameservers) > 0 {
+			types = append(types, typeNS)
+		}
+		if len(zConfig.MailExchanges) > 0 {
+			types = append(types, typeMX)
+		}
+		if z.Signer != nil {
+			types = append(types, typeDNSKEY)
+			if z.Signer.NSEC3 {
+				types = append(types, typeNSEC3PARAM)
+			}
+		}
+	}
+	if len(s.ips(zConfig, name)) > 0 {
+		types = append(types, typeA)
+	}
+	if len(zConfig.Domains6[name]) > 0 {
+		types = append(types, typeAAAA)
+	}
+	if zConfig.Aliases[name].Target != "" {
+		types = append(types, typeCNAME)
+	}
+	if len(s.texts(zConfig, name)) > 0 {
+		types = append(types, typeTXT)
+	}
+	if len(s.serviceLocators(zConfig, name)) > 0 {
+		types = append(types, typeSRV)
+	}
+	if len(zConfig.Pointers[name]) > 0 {
+		types = append(types, typePTR)
+	}
+	if len(s.caas(zConfig, name)) > 0 {
+		types = append(types, typeCAA)
+	}
+
+	slices.Sort(types)
+	return types
+}
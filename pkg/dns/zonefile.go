@@ -0,0 +1,543 @@
+package dns
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+)
+
+// zoneFileToken is the token of the zone file.
+type zoneFileToken struct {
+	Value  string
+	Quoted bool
+}
+
+// zoneFileEntry is the entry of the zone file which might span many lines if parentheses are used.
+type zoneFileEntry struct {
+	Line       int
+	BlankOwner bool
+	Tokens     []zoneFileToken
+}
+
+// ZoneFile adds records defined in the zone file stored in RFC 1035 master format. Relative names are resolved
+// against the domain of the zone. It panics if file can't be parsed.
+func ZoneFile(file string) ZoneConfigurator {
+	return func(c *ZoneConfig) {
+		f := lo.Must(os.Open(file))
+		defer f.Close()
+
+		for _, configurator := range lo.Must(ParseZoneFile(f, c.Domain)) {
+			configurator(c)
+		}
+	}
+}
+
+// ParseZoneFile parses zone file stored in RFC 1035 master format and returns configurators adding its records
+// to the zone. SOA record overrides main nameserver, email and serial number of the zone. TTLs are ignored,
+// because all the records are served with the same TTL. Delegations and $INCLUDE directives are not supported.
+func ParseZoneFile(r io.Reader, origin string) ([]ZoneConfigurator, error) {
+	entries, err := readZoneFile(r)
+	if err != nil {
+		return nil, err
+	}
+
+	domain := strings.ToLower(strings.TrimSuffix(origin, "."))
+	origin = domain
+
+	var configurators []ZoneConfigurator
+	var owner string
+	for _, e := range entries {
+		tokens := e.Tokens
+		if !e.BlankOwner && strings.HasPrefix(tokens[0].Value, "$") && !tokens[0].Quoted {
+			switch strings.ToUpper(tokens[0].Value) {
+			case "$ORIGIN":
+				if len(tokens) != 2 {
+					return nil, errors.Errorf("line %d: invalid $ORIGIN directive", e.Line)
+				}
+				origin = zoneFileName(tokens[1].Value, origin)
+			case "$TTL":
+				if len(tokens) != 2 || !isTTL(tokens[1].Value) {
+					return nil, errors.Errorf("line %d: invalid $TTL directive", e.Line)
+				}
+			default:
+				return nil, errors.Errorf("line %d: unsupported directive %s", e.Line, tokens[0].Value)
+			}
+			continue
+		}
+
+		if !e.BlankOwner {
+			owner = zoneFileName(tokens[0].Value, origin)
+			tokens = tokens[1:]
+		}
+		if owner == "" {
+			return nil, errors.Errorf("line %d: owner is not defined", e.Line)
+		}
+		if !inZone(owner, domain) {
+			return nil, errors.Errorf("line %d: name %s does not belong to zone %s", e.Line, owner, domain)
+		}
+
+		// TTL and class might be specified in any order.
+		for range 2 {
+			if len(tokens) == 0 {
+				break
+			}
+			v := strings.ToUpper(tokens[0].Value)
+			if v == "CH" || v == "HS" || v == "CS" {
+				return nil, errors.Errorf("line %d: unsupported class %s", e.Line, tokens[0].Value)
+			}
+			if v != "IN" && !isTTL(v) {
+				break
+			}
+			tokens = tokens[1:]
+		}
+		if len(tokens) == 0 {
+			return nil, errors.Errorf("line %d: record type is missing", e.Line)
+		}
+
+		configurator, err := zoneFileRecord(owner, domain, origin, strings.ToUpper(tokens[0].Value), tokens[1:])
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", e.Line)
+		}
+		configurators = append(configurators, configurator)
+	}
+
+	return configurators, nil
+}
+
+//nolint:gocyclo
+func zoneFileRecord(owner, domain, origin, rType string, rdata []zoneFileToken) (ZoneConfigurator, error) {
+	args := func(n int) error {
+		if len(rdata) != n {
+			return errors.Errorf("%s record requires %d values, got %d", rType, n, len(rdata))
+		}
+		return nil
+	}
+	apex := func() error {
+		if owner != domain {
+			return errors.Errorf("%s record is supported at zone apex only", rType)
+		}
+		return nil
+	}
+
+	switch rType {
+	case "SOA":
+		if err := apex(); err != nil {
+			return nil, err
+		}
+		if err := args(7); err != nil {
+			return nil, err
+		}
+		serial, err := strconv.ParseUint(rdata[2].Value, 10, 32)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid serial number")
+		}
+		nameserver := zoneFileName(rdata[0].Value, origin)
+		email := zoneFileEmail(rdata[1].Value, origin)
+		return func(c *ZoneConfig) {
+			c.MainNameserver = nameserver
+			c.Email = email
+			c.SerialNumber = uint32(serial)
+		}, nil
+	case "NS":
+		if owner != domain {
+			return nil, errors.New("delegations are not supported")
+		}
+		if err := args(1); err != nil {
+			return nil, err
+		}
+		return Nameservers(zoneFileName(rdata[0].Value, origin)), nil
+	case "A", "AAAA":
+		if err := args(1); err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(rdata[0].Value)
+		if ip == nil || (rType == "A") != (ip.To4() != nil) {
+			return nil, errors.Errorf("invalid address %s", rdata[0].Value)
+		}
+		return Domain(owner, ip.String()), nil
+	case "CNAME":
+		if err := args(1); err != nil {
+			return nil, err
+		}
+		return Alias(owner, zoneFileName(rdata[0].Value, origin)), nil
+	case "MX":
+		if err := apex(); err != nil {
+			return nil, err
+		}
+		if err := args(2); err != nil {
+			return nil, err
+		}
+		priority, err := strconv.ParseUint(rdata[0].Value, 10, 16)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid priority")
+		}
+		return MailExchange(zoneFileName(rdata[1].Value, origin), uint16(priority)), nil
+	case "TXT":
+		if len(rdata) == 0 {
+			return nil, errors.New("TXT record requires value")
+		}
+		var value string
+		for _, t := range rdata {
+			value += zoneFileText(t)
+		}
+		return Text(owner, value), nil
+	case "SRV":
+		if err := args(4); err != nil {
+			return nil, err
+		}
+		var values [3]uint16
+		for i := range values {
+			v, err := strconv.ParseUint(rdata[i].Value, 10, 16)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid SRV value")
+			}
+			values[i] = uint16(v)
+		}
+		return ServiceLocator(owner, zoneFileName(rdata[3].Value, origin), values[2], values[0], values[1]), nil
+	case "PTR":
+		if err := args(1); err != nil {
+			return nil, err
+		}
+		target := zoneFileName(rdata[0].Value, origin)
+		return func(c *ZoneConfig) {
+			c.Pointers[owner] = append(c.Pointers[owner], target)
+		}, nil
+	case "CAA":
+		if err := args(3); err != nil {
+			return nil, err
+		}
+		flags, err := strconv.ParseUint(rdata[0].Value, 10, 8)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid flags")
+		}
+		return CAA(owner, uint8(flags), strings.ToLower(rdata[1].Value), zoneFileText(rdata[2])), nil
+	default:
+		return nil, errors.Errorf("unsupported record type %s", rType)
+	}
+}
+
+// readZoneFile splits zone file into entries.
+func readZoneFile(r io.Reader) ([]zoneFileEntry, error) {
+	br := bufio.NewReader(r)
+
+	var entries []zoneFileEntry
+	var entry zoneFileEntry
+	var token []byte
+	var inToken, quoted, comment bool
+	var depth int
+	line, column := 1, 0
+
+	endToken := func() {
+		if inToken {
+			entry.Tokens = append(entry.Tokens, zoneFileToken{Value: string(token), Quoted: quoted})
+		}
+		token = token[:0]
+		inToken = false
+		quoted = false
+	}
+
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				return nil, errors.WithStack(err)
+			}
+			break
+		}
+
+		if quoted && inToken {
+			switch c {
+			case '"':
+				endToken()
+			case '\\':
+				b, err := readEscape(br)
+				if err != nil {
+					return nil, errors.Wrapf(err, "line %d", line)
+				}
+				token = append(token, b)
+			case '\n':
+				return nil, errors.Errorf("line %d: unterminated quoted string", line)
+			default:
+				token = append(token, c)
+			}
+			continue
+		}
+
+		column++
+		switch {
+		case c == '\n':
+			endToken()
+			if depth == 0 && len(entry.Tokens) > 0 {
+				entries = append(entries, entry)
+				entry = zoneFileEntry{}
+			}
+			line++
+			column = 0
+			comment = false
+		case comment:
+		case c == ';':
+			endToken()
+			comment = true
+		case c == ' ' || c == '\t' || c == '\r':
+			if column == 1 && depth == 0 && len(entry.Tokens) == 0 {
+				entry.BlankOwner = true
+			}
+			endToken()
+		case c == '(':
+			endToken()
+			depth++
+		case c == ')':
+			endToken()
+			if depth == 0 {
+				return nil, errors.Errorf("line %d: unbalanced parentheses", line)
+			}
+			depth--
+		case c == '"' && !inToken:
+			if len(entry.Tokens) == 0 {
+				entry.Line = line
+			}
+			inToken = true
+			quoted = true
+		default:
+			if len(entry.Tokens) == 0 && !inToken {
+				entry.Line = line
+			}
+			inToken = true
+			token = append(token, c)
+			if c == '\\' {
+				// Escaped character is kept as is, because meaning of escapes depends on the field.
+				b, err := br.ReadByte()
+				if err != nil {
+					return nil, errors.Errorf("line %d: invalid escape sequence", line)
+				}
+				token = append(token, b)
+			}
+		}
+	}
+
+	if quoted && inToken {
+		return nil, errors.Errorf("line %d: unterminated quoted string", line)
+	}
+	if depth != 0 {
+		return nil, errors.Errorf("line %d: unbalanced parentheses", line)
+	}
+	endToken()
+	if len(entry.Tokens) > 0 {
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// readEscape reads character escaped by "\X" or "\DDD".
+func readEscape(br *bufio.Reader) (byte, error) {
+	c, err := br.ReadByte()
+	if err != nil {
+		return 0, errors.New("invalid escape sequence")
+	}
+	if c < '0' || c > '9' {
+		return c, nil
+	}
+
+	digits := []byte{c}
+	for range 2 {
+		c, err := br.ReadByte()
+		if err != nil || c < '0' || c > '9' {
+			return 0, errors.New("invalid escape sequence")
+		}
+		digits = append(digits, c)
+	}
+	v, err := strconv.ParseUint(string(digits), 10, 8)
+	if err != nil {
+		return 0, errors.New("invalid escape sequence")
+	}
+	return byte(v), nil
+}
+
+// zoneFileText returns the value of character string.
+func zoneFileText(t zoneFileToken) string {
+	if t.Quoted {
+		return t.Value
+	}
+
+	br := bufio.NewReader(strings.NewReader(t.Value))
+	var b []byte
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return string(b)
+		}
+		if c == '\\' {
+			if c, err = readEscape(br); err != nil {
+				return t.Value
+			}
+		}
+		b = append(b, c)
+	}
+}
+
+// zoneFileName returns the absolute name without the trailing dot.
+func zoneFileName(name, origin string) string {
+	name = strings.ToLower(name)
+	switch {
+	case name == "@":
+		return origin
+	case strings.HasSuffix(name, ".") && !strings.HasSuffix(name, `\.`):
+		return strings.TrimSuffix(name, ".")
+	default:
+		return name + "." + origin
+	}
+}
+
+// zoneFileEmail converts mailbox name to email address. The first unescaped dot separates local part.
+func zoneFileEmail(name, origin string) string {
+	name = zoneFileName(name, origin)
+	for i := 0; i < len(name); i++ {
+		switch name[i] {
+		case '\\':
+			i++
+		case '.':
+			return strings.ReplaceAll(name[:i], `\.`, ".") + "@" + name[i+1:]
+		}
+	}
+	return name
+}
+
+func isTTL(v string) bool {
+	if v == "" || v[0] < '0' || v[0] > '9' {
+		return false
+	}
+	for _, c := range strings.ToLower(v) {
+		if (c < '0' || c > '9') && !strings.ContainsRune("smhdw", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// zoneFileRecordTypes defines the order of record types in the exported zone file.
+var zoneFileRecordTypes = []string{"SOA", "NS", "MX", "A", "AAAA", "CNAME", "TXT", "SRV", "PTR", "CAA"}
+
+// WriteZoneFile writes static records of the zone in RFC 1035 master format.
+func WriteZoneFile(w io.Writer, zConfig ZoneConfig) error {
+	type record struct {
+		Name  string
+		Type  string
+		RData string
+	}
+
+	domain := zConfig.Domain
+	var records []record
+	add := func(name, rType string, rdata string) {
+		records = append(records, record{Name: name, Type: rType, RData: rdata})
+	}
+	absolute := func(name string) string {
+		return name + "."
+	}
+
+	localPart, mailDomain, _ := strings.Cut(zConfig.Email, "@")
+	add(domain, "SOA", fmt.Sprintf("%s %s %d %d %d %d %d", absolute(zConfig.MainNameserver),
+		absolute(strings.ReplaceAll(localPart, ".", `\.`)+"."+mailDomain), zConfig.SerialNumber, ttl, ttl, ttl, ttl))
+	for _, ns := range zConfig.Nameservers {
+		add(domain, "NS", absolute(ns))
+	}
+	for _, mx := range slices.SortedFunc(maps.Keys(zConfig.MailExchanges), func(a, b string) int {
+		return cmp.Or(cmp.Compare(zConfig.MailExchanges[a], zConfig.MailExchanges[b]), cmp.Compare(a, b))
+	}) {
+		add(domain, "MX", fmt.Sprintf("%d %s", zConfig.MailExchanges[mx], absolute(mx)))
+	}
+	for name, ips := range zConfig.Domains {
+		for _, ip := range ips {
+			add(name, "A", ip.String())
+		}
+	}
+	for name, ips := range zConfig.Domains6 {
+		for _, ip := range ips {
+			add(name, "AAAA", ip.String())
+		}
+	}
+	for name, alias := range zConfig.Aliases {
+		add(name, "CNAME", absolute(alias.Target))
+	}
+	for name, values := range zConfig.Texts {
+		for _, v := range values {
+			add(name, "TXT", zoneFileQuote(v))
+		}
+	}
+	for name, values := range zConfig.ServiceLocators {
+		for _, v := range values {
+			add(name, "SRV", fmt.Sprintf("%d %d %d %s", v.Priority, v.Weight, v.Port, absolute(v.Target)))
+		}
+	}
+	for name, values := range zConfig.Pointers {
+		for _, v := range values {
+			add(name, "PTR", absolute(v))
+		}
+	}
+	for name, values := range zConfig.CAAs {
+		for _, v := range values {
+			add(name, "CAA", fmt.Sprintf("%d %s %s", v.Flags, v.Tag, zoneFileQuote(v.Value)))
+		}
+	}
+
+	// Records of the same RRSet are kept in the configured order.
+	slices.SortStableFunc(records, func(a, b record) int {
+		return cmp.Or(
+			cmp.Compare(lo.Ternary(a.Name == domain, 0, 1), lo.Ternary(b.Name == domain, 0, 1)),
+			cmp.Compare(a.Name, b.Name),
+			cmp.Compare(slices.Index(zoneFileRecordTypes, a.Type), slices.Index(zoneFileRecordTypes, b.Type)),
+		)
+	})
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "$ORIGIN %s\n$TTL %d\n", absolute(domain), ttl)
+	for _, r := range records {
+		name := "@"
+		if r.Name != domain {
+			name = strings.TrimSuffix(r.Name, "."+domain)
+		}
+		fmt.Fprintf(buf, "%s\tIN\t%s\t%s\n", name, r.Type, r.RData)
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return errors.WithStack(err)
+}
+
+// zoneFileQuote returns the value as quoted character strings, split into chunks of 255 bytes.
+func zoneFileQuote(v string) string {
+	var chunks []string
+	for {
+		chunk := v[:min(len(v), 255)]
+		v = v[len(chunk):]
+
+		var b strings.Builder
+		b.WriteByte('"')
+		for i := range len(chunk) {
+			switch c := chunk[i]; {
+			case c == '"' || c == '\\':
+				b.WriteByte('\\')
+				b.WriteByte(c)
+			case c < 0x20 || c > 0x7e:
+				fmt.Fprintf(&b, "\\%03d", c)
+			default:
+				b.WriteByte(c)
+			}
+		}
+		b.WriteByte('"')
+		chunks = append(chunks, b.String())
+
+		if len(v) == 0 {
+			return strings.Join(chunks, " ")
+		}
+	}
+}
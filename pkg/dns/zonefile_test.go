@@ -0,0 +1,100 @@
+package dns
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testZoneFile = `$ORIGIN example.com.
+$TTL 1h
+@	IN	SOA	ns1 john\.doe.example.com. (
+		2024010101 ; serial
+		3600 600 86400 60 )
+	IN	NS	ns1.example.com.
+	3600 IN	MX	10 mail
+host	IN	A	10.0.0.1
+	60	AAAA	2001:db8::1
+www	CNAME	host
+@	TXT	"v=spf1 mx -all"
+long	TXT	"part1 " "part2" unquoted\032text
+_sip._tcp	SRV	10 20 5060 host.example.com.
+@	CAA	0 issue "letsencrypt.org"
+$ORIGIN apps.example.com.
+*	A	10.0.0.2
+`
+
+func parseZoneFile(t *testing.T, zoneFile string) ZoneConfig {
+	configurators, err := ParseZoneFile(strings.NewReader(zoneFile), "example.com")
+	require.NoError(t, err)
+
+	zConfig := newZoneConfig("example.com", "", "", 0)
+	for _, configurator := range configurators {
+		configurator(&zConfig)
+	}
+	return zConfig
+}
+
+func TestParseZoneFile(t *testing.T) {
+	requireT := require.New(t)
+
+	zConfig := parseZoneFile(t, testZoneFile)
+	requireT.Equal("ns1.example.com", zConfig.MainNameserver)
+	requireT.Equal("john.doe@example.com", zConfig.Email)
+	requireT.EqualValues(2024010101, zConfig.SerialNumber)
+	requireT.Equal([]string{"ns1.example.com"}, zConfig.Nameservers)
+	requireT.Equal(map[string]uint16{"mail.example.com": 10}, zConfig.MailExchanges)
+	requireT.Equal([]net.IP{net.ParseIP("10.0.0.1").To4()}, zConfig.Domains["host.example.com"])
+	requireT.Equal([]net.IP{net.ParseIP("2001:db8::1")}, zConfig.Domains6["host.example.com"])
+	requireT.Equal([]net.IP{net.ParseIP("10.0.0.2").To4()}, zConfig.Domains["*.apps.example.com"])
+	requireT.Equal(AliasConfig{Target: "host.example.com"}, zConfig.Aliases["www.example.com"])
+	requireT.Equal([]string{"v=spf1 mx -all"}, zConfig.Texts["example.com"])
+	requireT.Equal([]string{"part1 part2unquoted text"}, zConfig.Texts["long.example.com"])
+	requireT.Equal([]ServiceLocatorConfig{{
+		Target:   "host.example.com",
+		Port:     5060,
+		Priority: 10,
+		Weight:   20,
+	}}, zConfig.ServiceLocators["_sip._tcp.example.com"])
+	requireT.Equal([]CAAConfig{{Tag: "issue", Value: "letsencrypt.org"}}, zConfig.CAAs["example.com"])
+
+	for _, zoneFile := range []string{
+		"host.example.org. IN A 10.0.0.1",
+		"sub IN NS ns1.example.com.",
+		"host IN A 2001:db8::1",
+		"host IN HINFO a b",
+		"host CH A 10.0.0.1",
+		"$INCLUDE other.zone",
+		"host IN TXT \"unterminated",
+		"host IN A ( 10.0.0.1",
+	} {
+		_, err := ParseZoneFile(strings.NewReader(zoneFile), "example.com")
+		requireT.Error(err, zoneFile)
+	}
+}
+
+func TestZoneFileRoundTrip(t *testing.T) {
+	requireT := require.New(t)
+
+	zConfig := newZoneConfig("example.com", "ns1.example.com", "john.doe@example.com", 7)
+	for _, configurator := range []ZoneConfigurator{
+		Nameservers("ns1.example.com", "ns2.example.com"),
+		MailExchange("mail.example.com", 10),
+		Domain("host.example.com", "10.0.0.1", "10.0.0.2", "2001:db8::1"),
+		Domain("*.apps.example.com", "10.0.0.3"),
+		Alias("www.example.com", "host.example.com"),
+		Text("example.com", "v=spf1 mx -all", `quote " and \ backslash`),
+		Text("long.example.com", strings.Repeat("a", 300)),
+		ServiceLocator("_sip._tcp.example.com", "host.example.com", 5060, 10, 20),
+		CAA("example.com", 0, "issue", "letsencrypt.org"),
+	} {
+		configurator(&zConfig)
+	}
+
+	buf := &bytes.Buffer{}
+	requireT.NoError(WriteZoneFile(buf, zConfig))
+	requireT.Equal(zConfig, parseZoneFile(t, buf.String()))
+}
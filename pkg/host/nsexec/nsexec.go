@@ -0,0 +1,375 @@
+package nsexec
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/outofforest/parallel"
+)
+
+const (
+	// EnvVar is set for the process running as an agent inside container.
+	EnvVar = "CLOUDLESS_NSEXEC"
+
+	// controlFD is the file descriptor of the control socket passed to the container.
+	controlFD = 3
+
+	maxRequestSize = 1024 * 1024
+	maxFDs         = 64
+)
+
+// Commands can't join user namespace of the container from the host, because kernel refuses to do that for
+// multithreaded processes, and each Go process is multithreaded. That's why commands are started by the agent
+// running inside all the namespaces of the container. Host sends requests to the agent over the control socket
+// passed to the container when it is created.
+
+// request is sent to the agent to start command. It is accompanied by file descriptors of the session socket,
+// standard input, output and error, followed by extra files.
+type request struct {
+	Path    string
+	Args    []string
+	Env     []string
+	Dir     string
+	Setctty bool
+	Ctty    int
+}
+
+// response is sent by the agent over the session socket once command is started and then once it exits.
+type response struct {
+	Error string
+}
+
+// NewControl creates control socket. First file is kept by the host, the second one is passed to container
+// as the first extra file.
+func NewControl() (*net.UnixConn, *os.File, error) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	hostFile := os.NewFile(uintptr(fds[0]), "nsexec")
+	defer hostFile.Close()
+
+	conn, err := net.FileConn(hostFile)
+	if err != nil {
+		_ = unix.Close(fds[1])
+		return nil, nil, errors.WithStack(err)
+	}
+
+	return conn.(*net.UnixConn), os.NewFile(uintptr(fds[1]), "nsexec"), nil
+}
+
+// IsAgent checks if process is expected to run as the agent.
+func IsAgent() bool {
+	return os.Getenv(EnvVar) != ""
+}
+
+// containerControl returns control socket received by container. It is marked as close-on-exec, so it is not
+// leaked to other processes started inside container.
+var containerControl = sync.OnceValues(func() (*os.File, error) {
+	if _, err := unix.FcntlInt(controlFD, unix.F_SETFD, unix.FD_CLOEXEC); err != nil {
+		return nil, errors.Wrap(err, "control socket of the agent is not available")
+	}
+	return os.NewFile(controlFD, "nsexec"), nil
+})
+
+// Run runs the agent inside container.
+func Run(ctx context.Context) error {
+	control, err := containerControl()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("/proc/self/exe")
+	cmd.Env = append(os.Environ(), EnvVar+"=1")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{control}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Pdeathsig: syscall.SIGKILL,
+	}
+
+	if err := cmd.Start(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		spawn("agent", parallel.Exit, func(ctx context.Context) error {
+			return errors.WithStack(cmd.Wait())
+		})
+		spawn("ctx", parallel.Fail, func(ctx context.Context) error {
+			<-ctx.Done()
+			_ = cmd.Process.Signal(syscall.SIGTERM)
+			return errors.WithStack(ctx.Err())
+		})
+		return nil
+	})
+	if ctx.Err() != nil {
+		return errors.WithStack(ctx.Err())
+	}
+	return err
+}
+
+// Agent serves requests received over the control socket until it is closed.
+func Agent(ctx context.Context) error {
+	if err := os.Unsetenv(EnvVar); err != nil {
+		return errors.WithStack(err)
+	}
+
+	controlFile := os.NewFile(controlFD, "nsexec")
+	conn, err := net.FileConn(controlFile)
+	_ = controlFile.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	control := conn.(*net.UnixConn)
+	defer control.Close()
+
+	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		spawn("watchdog", parallel.Fail, func(ctx context.Context) error {
+			defer control.Close()
+
+			<-ctx.Done()
+			return errors.WithStack(ctx.Err())
+		})
+		spawn("server", parallel.Exit, func(ctx context.Context) error {
+			buf := make([]byte, maxRequestSize)
+			oob := make([]byte, unix.CmsgSpace(maxFDs*4))
+			for {
+				n, oobn, _, _, err := control.ReadMsgUnix(buf, oob)
+				if err != nil {
+					if ctx.Err() != nil || errors.Is(err, io.EOF) {
+						return errors.WithStack(ctx.Err())
+					}
+					return errors.WithStack(err)
+				}
+				if n == 0 && oobn == 0 {
+					// Host closed the control socket.
+					return nil
+				}
+
+				files, err := receiveFiles(oob[:oobn])
+				if err != nil {
+					return err
+				}
+
+				var req request
+				if err := json.Unmarshal(buf[:n], &req); err != nil || len(files) < 4 {
+					closeFiles(files)
+					continue
+				}
+
+				spawn("session", parallel.Continue, func(ctx context.Context) error {
+					return serveSession(ctx, req, files)
+				})
+			}
+		})
+		return nil
+	})
+}
+
+// Exec sends request to the agent to execute command and waits until it exits. Command is terminated gracefully
+// if context is canceled.
+func Exec(ctx context.Context, control *net.UnixConn, cmd *exec.Cmd) error {
+	stdio, err := newStdio(cmd)
+	if err != nil {
+		return err
+	}
+	defer stdio.Close()
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	sessionFile := os.NewFile(uintptr(fds[0]), "session")
+	remoteFile := os.NewFile(uintptr(fds[1]), "session")
+	defer remoteFile.Close()
+
+	conn, err := net.FileConn(sessionFile)
+	_ = sessionFile.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	session := conn.(*net.UnixConn)
+	defer session.Close()
+
+	req := request{
+		Path: cmd.Path,
+		Args: cmd.Args,
+		Env:  cmd.Env,
+		Dir:  cmd.Dir,
+	}
+	if cmd.SysProcAttr != nil {
+		req.Setctty = cmd.SysProcAttr.Setctty
+		req.Ctty = cmd.SysProcAttr.Ctty
+	}
+	reqRaw, err := json.Marshal(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	files := append([]*os.File{remoteFile}, stdio.Files...)
+	files = append(files, cmd.ExtraFiles...)
+	if len(files) > maxFDs {
+		return errors.Errorf("too many files passed to command: %d", len(files))
+	}
+	rights := make([]int, 0, len(files))
+	for _, f := range files {
+		rights = append(rights, int(f.Fd()))
+	}
+
+	if _, _, err := control.WriteMsgUnix(reqRaw, unix.UnixRights(rights...), nil); err != nil {
+		return errors.Wrap(err, "sending request to the agent failed")
+	}
+
+	// Descriptors are now owned by the agent, so session socket receives EOF if agent exits, and output
+	// pipes receive EOF once command exits.
+	_ = remoteFile.Close()
+	stdio.CloseChildFiles()
+
+	if err := receiveResponse(session); err != nil {
+		return errors.Wrap(err, "starting command failed")
+	}
+
+	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		for i, copyFn := range stdio.CopyFns {
+			spawn(fmt.Sprintf("copy%d", i), parallel.Continue, copyFn)
+		}
+		spawn("cmd", parallel.Exit, func(ctx context.Context) error {
+			err := receiveResponse(session)
+			if ctx.Err() != nil {
+				return errors.WithStack(ctx.Err())
+			}
+			return err
+		})
+		spawn("ctx", parallel.Fail, func(ctx context.Context) error {
+			<-ctx.Done()
+
+			// Any message sent over the session socket makes agent terminate the command.
+			_, _ = session.Write([]byte{0x00})
+			return errors.WithStack(ctx.Err())
+		})
+		return nil
+	})
+}
+
+func serveSession(ctx context.Context, req request, files []*os.File) error {
+	conn, err := net.FileConn(files[0])
+	if err != nil {
+		closeFiles(files)
+		return errors.WithStack(err)
+	}
+	session := conn.(*net.UnixConn)
+	defer session.Close()
+
+	cmd := &exec.Cmd{
+		Path:       req.Path,
+		Args:       req.Args,
+		Env:        req.Env,
+		Dir:        req.Dir,
+		Stdin:      files[1],
+		Stdout:     files[2],
+		Stderr:     files[3],
+		ExtraFiles: files[4:],
+		SysProcAttr: &syscall.SysProcAttr{
+			Setsid:    true,
+			Setctty:   req.Setctty,
+			Ctty:      req.Ctty,
+			Pdeathsig: syscall.SIGKILL,
+		},
+	}
+
+	err = cmd.Start()
+	closeFiles(files)
+	if err := sendResponse(session, err); err != nil || cmd.Process == nil {
+		return err
+	}
+
+	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		spawn("cmd", parallel.Exit, func(ctx context.Context) error {
+			return sendResponse(session, cmd.Wait())
+		})
+		spawn("session", parallel.Continue, func(ctx context.Context) error {
+			// Host sends message or closes the socket when command should be terminated.
+			// It also happens if agent is terminated.
+			_, _ = session.Read(make([]byte, 1))
+			_ = cmd.Process.Signal(syscall.SIGTERM)
+			_ = cmd.Process.Signal(syscall.SIGINT)
+			return nil
+		})
+		spawn("watchdog", parallel.Continue, func(ctx context.Context) error {
+			<-ctx.Done()
+			return errors.WithStack(session.CloseRead())
+		})
+		return nil
+	})
+}
+
+func sendResponse(session *net.UnixConn, err error) error {
+	var resp response
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	respRaw, err := json.Marshal(resp)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = session.Write(respRaw)
+	return errors.WithStack(err)
+}
+
+func receiveResponse(session *net.UnixConn) error {
+	buf := make([]byte, maxRequestSize)
+	n, err := session.Read(buf)
+	switch {
+	case errors.Is(err, io.EOF) || (err == nil && n == 0):
+		return errors.New("agent closed the session")
+	case err != nil:
+		return errors.WithStack(err)
+	}
+
+	var resp response
+	if err := json.Unmarshal(buf[:n], &resp); err != nil {
+		return errors.WithStack(err)
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
+
+func receiveFiles(oob []byte) ([]*os.File, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var files []*os.File
+	for _, msg := range msgs {
+		fds, err := unix.ParseUnixRights(&msg)
+		if err != nil {
+			closeFiles(files)
+			return nil, errors.WithStack(err)
+		}
+		for _, fd := range fds {
+			files = append(files, os.NewFile(uintptr(fd), "nsexec"))
+		}
+	}
+	return files, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		_ = f.Close()
+	}
+}
@@ -0,0 +1,128 @@
+package nsexec
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/pkg/errors"
+
+	"github.com/outofforest/parallel"
+)
+
+// stdio prepares files used as standard input, output and error of the command. Streams which are not files
+// are copied through pipes, in the same way exec package does it.
+type stdio struct {
+	// Files are passed to the command.
+	Files []*os.File
+
+	// CopyFns copy the output of the command. They finish once command exits.
+	CopyFns []parallel.Task
+
+	childFiles []*os.File
+	hostFiles  []*os.File
+}
+
+func newStdio(cmd *exec.Cmd) (*stdio, error) {
+	s := &stdio{}
+
+	stdin, err := s.input(cmd.Stdin)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	stdout, err := s.output(cmd.Stdout)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	stderr := stdout
+	if !sameWriter(cmd.Stdout, cmd.Stderr) {
+		stderr, err = s.output(cmd.Stderr)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+
+	s.Files = []*os.File{stdin, stdout, stderr}
+	return s, nil
+}
+
+// CloseChildFiles closes the ends of pipes passed to the command.
+func (s *stdio) CloseChildFiles() {
+	closeFiles(s.childFiles)
+	s.childFiles = nil
+}
+
+// Close closes all the files.
+func (s *stdio) Close() {
+	s.CloseChildFiles()
+	closeFiles(s.hostFiles)
+}
+
+func (s *stdio) input(r io.Reader) (*os.File, error) {
+	switch f := r.(type) {
+	case nil:
+		null, err := os.Open(os.DevNull)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		s.childFiles = append(s.childFiles, null)
+		return null, nil
+	case *os.File:
+		return f, nil
+	}
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	s.childFiles = append(s.childFiles, pr)
+
+	// Copying is not awaited, because reader might block forever. Write fails once command exits.
+	go func() {
+		defer pw.Close()
+		_, _ = io.Copy(pw, r)
+	}()
+
+	return pr, nil
+}
+
+func (s *stdio) output(w io.Writer) (*os.File, error) {
+	switch f := w.(type) {
+	case nil:
+		null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		s.childFiles = append(s.childFiles, null)
+		return null, nil
+	case *os.File:
+		return f, nil
+	}
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	s.childFiles = append(s.childFiles, pw)
+	s.hostFiles = append(s.hostFiles, pr)
+	s.CopyFns = append(s.CopyFns, func(ctx context.Context) error {
+		_, err := io.Copy(w, pr)
+		return errors.WithStack(err)
+	})
+
+	return pw, nil
+}
+
+func sameWriter(w1, w2 io.Writer) (same bool) {
+	// Comparison panics if writers are of uncomparable type.
+	defer func() {
+		if recover() != nil {
+			same = false
+		}
+	}()
+	return w1 == w2
+}
@@ -5,6 +5,7 @@ import (
 	"compress/gzip"
 	"context"
 	_ "embed"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
@@ -28,6 +29,7 @@ import (
 
 	"github.com/outofforest/cloudless/pkg/eye/metrics"
 	"github.com/outofforest/cloudless/pkg/host/firewall"
+	"github.com/outofforest/cloudless/pkg/host/nsexec"
 	"github.com/outofforest/cloudless/pkg/host/zombie"
 	"github.com/outofforest/cloudless/pkg/kernel"
 	"github.com/outofforest/cloudless/pkg/mount"
@@ -176,6 +178,32 @@ type mountConfig struct {
 
 type logLabels struct {
 	Box string `json:"box"`
+
+	// Labels used to split output of processes running inside containers into separate streams.
+	Container string `json:"cloudless_container"`
+	Process   string `json:"cloudless_process"`
+	Stream    string `json:"cloudless_stream"`
+}
+
+// UnmarshalJSON takes labels from the log record. Log sender panics on error, so values which are not strings
+// are ignored instead of being reported.
+func (ll *logLabels) UnmarshalJSON(data []byte) error {
+	var record map[string]any
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil //nolint:nilerr
+	}
+
+	label := func(key string) string {
+		v, _ := record[key].(string)
+		return v
+	}
+	*ll = logLabels{
+		Box:       label("box"),
+		Container: label("cloudless_container"),
+		Process:   label("cloudless_process"),
+		Stream:    label("cloudless_stream"),
+	}
+	return nil
 }
 
 // Route defines static route.
@@ -445,6 +473,10 @@ type Configurator func(c *Configuration) error
 //
 //nolint:gocyclo
 func Run(ctx context.Context, configurators ...Configurator) error {
+	if nsexec.IsAgent() {
+		return nsexec.Agent(ctx)
+	}
+
 	set := metrics.NewSet()
 	cfg := &Configuration{
 		isContainer:         IsContainer(),
@@ -623,7 +655,12 @@ func Run(ctx context.Context, configurators ...Configurator) error {
 			if err := runPrepares(ctx, cfg.prepare); err != nil {
 				return err
 			}
-			return runServices(ctx, cfg.services)
+			services := cfg.services
+			if cfg.isContainer && len(services) > 0 {
+				// Agent executes commands requested by the host inside all the namespaces of the container.
+				services = append(services, ServiceConfig{Name: "nsexec", TaskFn: nsexec.Run})
+			}
+			return runServices(ctx, services)
 		})
 		return nil
 	})
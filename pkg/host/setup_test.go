@@ -0,0 +1,23 @@
+package host
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogLabelsUnmarshal(t *testing.T) {
+	requireT := require.New(t)
+
+	var labels logLabels
+	requireT.NoError(json.Unmarshal([]byte(`{"box":"box","cloudless_container":"container",`+
+		`"cloudless_process":"process","cloudless_stream":"stdout","process":"main"}`), &labels))
+	requireT.Equal(logLabels{Box: "box", Container: "container", Process: "process", Stream: "stdout"}, labels)
+
+	// Values which are not strings are ignored.
+	labels = logLabels{}
+	requireT.NoError(json.Unmarshal([]byte(`{"box":"box","cloudless_process":{"name":"main"},"cloudless_stream":1}`),
+		&labels))
+	requireT.Equal(logLabels{Box: "box"}, labels)
+}
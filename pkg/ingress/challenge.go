@@ -0,0 +1,200 @@
+package ingress
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/outofforest/cloudless/pkg/acme/certificate"
+	"github.com/outofforest/cloudless/pkg/acme/wire"
+	cwave "github.com/outofforest/cloudless/pkg/wave"
+	"github.com/outofforest/parallel"
+	"github.com/outofforest/wave"
+)
+
+const (
+	acmeChallengePath = "/.well-known/acme-challenge/"
+	acmeTLSALPNProto  = "acme-tls/1"
+	challengeTTL      = time.Minute
+)
+
+type httpChallengeKey struct {
+	Domain string
+	Token  string
+}
+
+type httpChallenge struct {
+	TimeAdded        time.Time
+	KeyAuthorization string
+}
+
+type tlsALPNChallenge struct {
+	TimeAdded   time.Time
+	Certificate *tls.Certificate
+}
+
+func newChallenges(waveConfig cwave.Config) *challenges {
+	return &challenges{
+		waveConfig: waveConfig,
+		http:       map[httpChallengeKey]httpChallenge{},
+		tlsALPN:    map[string]tlsALPNChallenge{},
+	}
+}
+
+// challenges stores responses to ACME challenges validated by the ingress.
+type challenges struct {
+	waveConfig cwave.Config
+
+	mu      sync.RWMutex
+	http    map[httpChallengeKey]httpChallenge
+	tlsALPN map[string]tlsALPNChallenge
+}
+
+// Run receives challenges.
+func (c *challenges) Run(ctx context.Context) error {
+	waveClient, waveCh, err := wave.NewClient(wave.ClientConfig{
+		CA:             c.waveConfig.CA,
+		Servers:        c.waveConfig.Servers,
+		MaxMessageSize: c.waveConfig.MaxMessageSize,
+		Requests: []wave.RequestConfig{
+			{
+				Marshaller: wire.NewMarshaller(),
+				Messages:   []any{&wire.MsgChallenge{}},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		spawn("wave", parallel.Fail, waveClient.Run)
+		spawn("clean", parallel.Fail, func(ctx context.Context) error {
+			for {
+				select {
+				case <-ctx.Done():
+					return errors.WithStack(ctx.Err())
+				case <-time.After(challengeTTL):
+					c.clean(time.Now())
+				}
+			}
+		})
+		spawn("receiver", parallel.Fail, func(ctx context.Context) error {
+			for {
+				select {
+				case <-ctx.Done():
+					return errors.WithStack(ctx.Err())
+				case msg := <-waveCh:
+					challengeMsg, ok := msg.(*wire.MsgChallenge)
+					if !ok {
+						return errors.New("unexpected message type")
+					}
+
+					if err := c.store(challengeMsg, time.Now()); err != nil {
+						return err
+					}
+				}
+			}
+		})
+
+		return nil
+	})
+}
+
+// Handler serves responses to HTTP-01 challenges and passes other requests to the next handler.
+func (c *challenges) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.URL.Path, acmeChallengePath)
+		if !ok || r.Method != http.MethodGet {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		c.mu.RLock()
+		ch, exists := c.http[httpChallengeKey{
+			Domain: strings.ToLower(strings.SplitN(r.Host, ":", 2)[0]),
+			Token:  token,
+		}]
+		c.mu.RUnlock()
+
+		if !exists {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write([]byte(ch.KeyAuthorization))
+	})
+}
+
+// GetCertificate returns certificate responding to TLS-ALPN-01 challenge if client requests it. Otherwise,
+// the certificate returned by next is used.
+func (c *challenges) GetCertificate(
+	next func(*tls.ClientHelloInfo) (*tls.Certificate, error),
+) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if !slices.Contains(info.SupportedProtos, acmeTLSALPNProto) {
+			return next(info)
+		}
+
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+
+		ch, exists := c.tlsALPN[strings.ToLower(info.ServerName)]
+		if !exists {
+			return nil, errors.Errorf("no TLS-ALPN-01 challenge for %q", info.ServerName)
+		}
+		return ch.Certificate, nil
+	}
+}
+
+func (c *challenges) store(msg *wire.MsgChallenge, now time.Time) error {
+	certs := make([]*tls.Certificate, 0, len(msg.TLSALPN))
+	for _, ch := range msg.TLSALPN {
+		cert, err := certificate.Parse(ch.Certificate)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, ch := range msg.HTTP {
+		c.http[httpChallengeKey{Domain: strings.ToLower(ch.Domain), Token: ch.Token}] = httpChallenge{
+			TimeAdded:        now,
+			KeyAuthorization: ch.KeyAuthorization,
+		}
+	}
+	for i, ch := range msg.TLSALPN {
+		c.tlsALPN[strings.ToLower(ch.Domain)] = tlsALPNChallenge{
+			TimeAdded:   now,
+			Certificate: certs[i],
+		}
+	}
+
+	return nil
+}
+
+func (c *challenges) clean(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, ch := range c.http {
+		if now.Sub(ch.TimeAdded) > challengeTTL {
+			delete(c.http, k)
+		}
+	}
+	for k, ch := range c.tlsALPN {
+		if now.Sub(ch.TimeAdded) > challengeTTL {
+			delete(c.tlsALPN, k)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package ingress
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/outofforest/cloudless/pkg/acme/wire"
+	"github.com/outofforest/cloudless/pkg/wave"
+)
+
+func TestChallenges(t *testing.T) {
+	requireT := require.New(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	requireT.NoError(err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"tls.example.com"},
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	requireT.NoError(err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	requireT.NoError(err)
+
+	now := time.Now()
+	c := newChallenges(wave.Config{})
+	requireT.NoError(c.store(&wire.MsgChallenge{
+		HTTP: []wire.HTTPChallenge{{
+			Domain:           "http.example.com",
+			Token:            "token",
+			KeyAuthorization: "token.key",
+		}},
+		TLSALPN: []wire.TLSALPNChallenge{{
+			Domain: "tls.example.com",
+			Certificate: append(
+				pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+				pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})...,
+			),
+		}},
+	}, now))
+
+	handler := c.Handler(http.NotFoundHandler())
+	request := func(host, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "http://"+host+path, nil)
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := request("http.example.com", acmeChallengePath+"token")
+	requireT.Equal(http.StatusOK, w.Code)
+	requireT.Equal("token.key", w.Body.String())
+	requireT.Equal(http.StatusNotFound, request("other.example.com", acmeChallengePath+"token").Code)
+	requireT.Equal(http.StatusNotFound, request("http.example.com", "/").Code)
+
+	defaultCert := &tls.Certificate{}
+	getCertificate := c.GetCertificate(func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return defaultCert, nil
+	})
+
+	cert, err := getCertificate(&tls.ClientHelloInfo{
+		ServerName:      "tls.example.com",
+		SupportedProtos: []string{acmeTLSALPNProto},
+	})
+	requireT.NoError(err)
+	requireT.Equal(certDER, cert.Certificate[0])
+
+	cert, err = getCertificate(&tls.ClientHelloInfo{
+		ServerName:      "tls.example.com",
+		SupportedProtos: []string{"h2", "http/1.1"},
+	})
+	requireT.NoError(err)
+	requireT.Same(defaultCert, cert)
+
+	// Challenges expire.
+	c.clean(now.Add(2 * challengeTTL))
+	requireT.Equal(http.StatusNotFound, request("http.example.com", acmeChallengePath+"token").Code)
+	_, err = getCertificate(&tls.ClientHelloInfo{
+		ServerName:      "tls.example.com",
+		SupportedProtos: []string{acmeTLSALPNProto},
+	})
+	requireT.Error(err)
+}
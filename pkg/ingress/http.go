@@ -5,9 +5,6 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
-	"crypto/tls"
-	"crypto/x509"
-	"encoding/pem"
 	"io"
 	"math/rand"
 	"net"
@@ -22,11 +19,10 @@ import (
 	"github.com/samber/lo"
 	"go.uber.org/zap"
 
-	"github.com/outofforest/cloudless/pkg/acme/wire"
+	"github.com/outofforest/cloudless/pkg/acme/certificate"
 	"github.com/outofforest/cloudless/pkg/thttp"
 	"github.com/outofforest/logger"
 	"github.com/outofforest/parallel"
-	"github.com/outofforest/wave"
 )
 
 // New creates new http ingress.
@@ -34,7 +30,6 @@ func New(cfg Config) *HTTPIngress {
 	return &HTTPIngress{
 		cfg:       cfg,
 		endpoints: map[EndpointID][]*endpoint{},
-		certs:     map[string]*tls.Certificate{},
 	}
 }
 
@@ -42,10 +37,6 @@ func New(cfg Config) *HTTPIngress {
 type HTTPIngress struct {
 	cfg       Config
 	endpoints map[EndpointID][]*endpoint
-	domains   []string
-
-	mu    sync.RWMutex
-	certs map[string]*tls.Certificate
 }
 
 // Run runs the ingress servers.
@@ -95,54 +86,23 @@ func (i *HTTPIngress) Run(ctx context.Context) error {
 		}
 	}
 
-	i.domains = lo.Keys(allowedDomains)
-
-	m := wire.NewMarshaller()
+	certs := certificate.NewStore(i.cfg.WaveConfig, lo.Keys(allowedDomains))
+	challenges := newChallenges(i.cfg.WaveConfig)
 	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
 		if enableHttps {
-			waveClient, waveCh, err := wave.NewClient(wave.ClientConfig{
-				CA:             i.cfg.WaveConfig.CA,
-				Servers:        i.cfg.WaveConfig.Servers,
-				MaxMessageSize: i.cfg.WaveConfig.MaxMessageSize,
-				Requests: []wave.RequestConfig{
-					{
-						Marshaller: m,
-						Messages:   []any{&wire.MsgCertificate{}},
-					},
-				},
-			})
-			if err != nil {
-				return err
-			}
-
-			spawn("wave", parallel.Fail, waveClient.Run)
-			spawn("certificate", parallel.Fail, func(ctx context.Context) error {
-				for {
-					select {
-					case <-ctx.Done():
-						return errors.WithStack(ctx.Err())
-					case msg := <-waveCh:
-						certMsg, ok := msg.(*wire.MsgCertificate)
-						if !ok {
-							return errors.New("unexpected message type")
-						}
-
-						if err := i.setCertificate(certMsg.Certificate); err != nil {
-							return err
-						}
-					}
-				}
-			})
+			spawn("certificates", parallel.Fail, certs.Run)
+		}
+		// Challenges are delivered by the wave servers only if certificates are issued.
+		if enableHttps {
+			spawn("challenges", parallel.Fail, challenges.Run)
 		}
 		for _, b := range bindings {
 			cfg := thttp.Config{Handler: b.handler()}
 			if b.Secure {
-				cfg.GetCertificate = func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
-					i.mu.RLock()
-					defer i.mu.RUnlock()
-
-					return i.certs[info.ServerName], nil
-				}
+				cfg.GetCertificate = challenges.GetCertificate(certs.GetCertificate)
+				cfg.NextProtos = []string{acmeTLSALPNProto}
+			} else {
+				cfg.Handler = challenges.Handler(cfg.Handler)
 			}
 
 			spawn("server", parallel.Fail, func(ctx context.Context) error {
@@ -171,53 +131,6 @@ func (i *HTTPIngress) registerTargets(endpointID EndpointID, targets []TargetCon
 	return nil
 }
 
-func (i *HTTPIngress) setCertificate(cert []byte) error {
-	tlsCert, err := parseCertificate(cert)
-	if err != nil {
-		return err
-	}
-
-	supportedDomains := map[string]struct{}{}
-	if tlsCert.Leaf.Subject.CommonName != "" {
-		supportedDomains[tlsCert.Leaf.Subject.CommonName] = struct{}{}
-	}
-	for _, n := range tlsCert.Leaf.DNSNames {
-		if n != "" {
-			supportedDomains[n] = struct{}{}
-		}
-	}
-
-	i.mu.Lock()
-	defer i.mu.Unlock()
-
-	for _, d := range i.domains {
-		if containsDomain(d, supportedDomains) {
-			existingCert, exists := i.certs[d]
-			if !exists || tlsCert.Leaf.NotAfter.After(existingCert.Leaf.NotAfter) {
-				i.certs[d] = tlsCert
-			}
-		}
-	}
-
-	return nil
-}
-
-func containsDomain(domain string, domains map[string]struct{}) bool {
-	if _, exists := domains[domain]; exists {
-		return true
-	}
-	for {
-		pos := strings.Index(domain, ".")
-		if pos < 0 {
-			return false
-		}
-		domain = domain[pos+1:]
-		if _, exists := domains["*."+domain]; exists {
-			return true
-		}
-	}
-}
-
 type cacheItem struct {
 	ContentType string
 	Content     []byte
@@ -630,40 +543,3 @@ func newEndpoint(secure bool, id EndpointID, cfg EndpointConfig) *endpoint {
 		cache:              map[string]*cacheItem{},
 	}
 }
-
-func parseCertificate(cert []byte) (*tls.Certificate, error) {
-	tlsCert := &tls.Certificate{}
-	for {
-		var block *pem.Block
-		block, cert = pem.Decode(cert)
-		if block == nil {
-			break
-		}
-
-		switch block.Type {
-		case "EC PRIVATE KEY":
-			var err error
-			tlsCert.PrivateKey, err = x509.ParseECPrivateKey(block.Bytes)
-			if err != nil {
-				return nil, errors.WithStack(err)
-			}
-		case "CERTIFICATE":
-			tlsCert.Certificate = append(tlsCert.Certificate, block.Bytes)
-		}
-	}
-
-	if tlsCert.PrivateKey == nil {
-		return nil, errors.New("private key not present")
-	}
-	if len(tlsCert.Certificate) == 0 {
-		return nil, errors.New("certificate chain not present")
-	}
-
-	var err error
-	tlsCert.Leaf, err = x509.ParseCertificate(tlsCert.Certificate[0])
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-
-	return tlsCert, nil
-}
@@ -0,0 +1,66 @@
+package ingress
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/outofforest/logger"
+	"github.com/outofforest/parallel"
+)
+
+func TestIngressWithoutWaveServers(t *testing.T) {
+	requireT := require.New(t)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("target"))
+	}))
+	t.Cleanup(target.Close)
+	targetAddr := target.Listener.Addr().(*net.TCPAddr)
+
+	ls, err := net.Listen("tcp4", "127.0.0.1:0")
+	requireT.NoError(err)
+
+	// Wave config is empty, so nothing requiring wave servers may be started.
+	ingress := New(Config{
+		Endpoints: map[EndpointID]EndpointConfig{
+			"test": {
+				Path:           "/",
+				HTTPSMode:      HTTPSModeDisabled,
+				AllowedMethods: []string{http.MethodGet},
+				AllowedDomains: []string{"localhost"},
+				PlainListeners: []net.Listener{ls},
+			},
+		},
+		Targets: map[EndpointID][]TargetConfig{
+			"test": {{Host: targetAddr.IP.String(), Port: uint16(targetAddr.Port), Path: "/"}},
+		},
+	})
+
+	ctx, cancel := context.WithCancel(logger.WithLogger(context.Background(), zap.NewNop()))
+	t.Cleanup(cancel)
+	group := parallel.NewGroup(ctx)
+	group.Spawn("ingress", parallel.Fail, ingress.Run)
+	t.Cleanup(func() {
+		group.Exit(nil)
+		_ = group.Wait()
+	})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+ls.Addr().String(), nil)
+	requireT.NoError(err)
+	req.Host = "localhost"
+	resp, err := http.DefaultClient.Do(req)
+	requireT.NoError(err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	requireT.NoError(err)
+	requireT.Equal(http.StatusOK, resp.StatusCode)
+	requireT.Equal("target", string(body))
+}
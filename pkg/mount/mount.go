@@ -1,18 +1,29 @@
 package mount
 
 import (
+	"bufio"
 	"encoding/pem"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"syscall"
 
 	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
 
 	"github.com/outofforest/archive"
 )
 
-const caCertFile = "etc/ssl/cert.pem"
+const (
+	caCertFile = "etc/ssl/cert.pem"
+
+	// maxOverlayLowerDirs is the maximum number of lower directories supported by overlayfs.
+	maxOverlayLowerDirs = 500
+)
 
 // ProcFS mounts procfs.
 func ProcFS(dir string) error {
@@ -142,6 +153,193 @@ func ContainerRoot() error {
 	return pivotRoot()
 }
 
+// Overlay mounts overlay filesystem. Lower directories are ordered from the top one to the bottom one.
+func Overlay(dir string, lowerDirs []string, upperDir, workDir string) error {
+	if len(lowerDirs) == 0 {
+		return errors.New("no lower directories")
+	}
+	if len(lowerDirs) > maxOverlayLowerDirs {
+		return errors.Errorf("overlay supports at most %d lower directories, got %d", maxOverlayLowerDirs,
+			len(lowerDirs))
+	}
+	for _, d := range []string{dir, upperDir, workDir} {
+		if err := os.MkdirAll(d, 0o700); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	options, ok := overlayOptions(lowerDirs, upperDir, workDir)
+	if ok {
+		return errors.WithStack(syscall.Mount("overlay", dir, "overlay", 0, options))
+	}
+
+	// Options don't fit into the single page accepted by the mount syscall, so lower directories are passed
+	// one by one using the new mount API.
+	return overlayFSConfig(dir, lowerDirs, upperDir, workDir)
+}
+
+// overlayOptions returns options of the overlay mount and reports if they fit into the mount syscall.
+func overlayOptions(lowerDirs []string, upperDir, workDir string) (string, bool) {
+	// Container runs in user namespace, so overlay must store its attributes in user.* extended attributes.
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s,userxattr",
+		strings.Join(lowerDirs, ":"), upperDir, workDir)
+	return options, len(options) < os.Getpagesize()
+}
+
+func overlayFSConfig(dir string, lowerDirs []string, upperDir, workDir string) error {
+	fd, err := unix.Fsopen("overlay", unix.FSOPEN_CLOEXEC)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer unix.Close(fd)
+
+	for _, d := range lowerDirs {
+		if err := unix.FsconfigSetString(fd, "lowerdir+", d); err != nil {
+			return errors.Wrapf(err, "adding lower directory %s failed, kernel might not support that many layers",
+				d)
+		}
+	}
+	if err := unix.FsconfigSetString(fd, "upperdir", upperDir); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := unix.FsconfigSetString(fd, "workdir", workDir); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := unix.FsconfigSetFlag(fd, "userxattr"); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := unix.FsconfigCreate(fd); err != nil {
+		return errors.WithStack(err)
+	}
+
+	mfd, err := unix.Fsmount(fd, unix.FSMOUNT_CLOEXEC, 0)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer unix.Close(mfd)
+
+	return errors.WithStack(unix.MoveMount(mfd, "", unix.AT_FDCWD, dir, unix.MOVE_MOUNT_F_EMPTY_PATH))
+}
+
+// ContainerPivotRoot replaces root filesystem of the running container with the one mounted in the directory.
+// Filesystems mounted inside the current root are moved to the new one.
+func ContainerPivotRoot(dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	mountPoints, err := topMountPoints(dir)
+	if err != nil {
+		return err
+	}
+	for _, mp := range mountPoints {
+		info, err := os.Stat(mp)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		target := filepath.Join(dir, mp)
+		if info.IsDir() {
+			if err := os.MkdirAll(target, info.Mode().Perm()); err != nil {
+				return errors.WithStack(err)
+			}
+		} else {
+			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				return errors.WithStack(err)
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDONLY, info.Mode().Perm())
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if err := f.Close(); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+
+		if err := syscall.Mount(mp, target, "", syscall.MS_MOVE, ""); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if err := os.Chdir(dir); err != nil {
+		return errors.WithStack(err)
+	}
+	return pivotRoot()
+}
+
+// topMountPoints returns mount points existing in the root filesystem, skipping the ones mounted inside other
+// mount points and inside the excluded directory.
+func topMountPoints(excludeDir string) ([]string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	var mountPoints []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			return nil, errors.Errorf("invalid mountinfo entry %q", scanner.Text())
+		}
+		mp, err := unescapeMountPoint(fields[4])
+		if err != nil {
+			return nil, err
+		}
+		if mp == "/" || isInDir(mp, excludeDir) {
+			continue
+		}
+		mountPoints = append(mountPoints, mp)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	sort.Slice(mountPoints, func(i, j int) bool {
+		return len(mountPoints[i]) < len(mountPoints[j])
+	})
+
+	top := make([]string, 0, len(mountPoints))
+loop:
+	for _, mp := range mountPoints {
+		for _, t := range top {
+			if isInDir(mp, t) {
+				continue loop
+			}
+		}
+		top = append(top, mp)
+	}
+	return top, nil
+}
+
+func isInDir(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// unescapeMountPoint decodes octal sequences used by kernel to escape special characters in mountinfo.
+func unescapeMountPoint(mp string) (string, error) {
+	if !strings.Contains(mp, `\`) {
+		return mp, nil
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(mp); i++ {
+		if mp[i] != '\\' || i+3 >= len(mp) {
+			sb.WriteByte(mp[i])
+			continue
+		}
+		c, err := strconv.ParseUint(mp[i+1:i+4], 8, 8)
+		if err != nil {
+			return "", errors.Wrapf(err, "invalid mount point %q", mp)
+		}
+		sb.WriteByte(byte(c))
+		i += 3
+	}
+	return sb.String(), nil
+}
+
 func untarDistro() error {
 	f, err := os.Open("/oldroot/distro.tar")
 	if err != nil {
@@ -0,0 +1,31 @@
+package mount
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOverlayOptions(t *testing.T) {
+	requireT := require.New(t)
+
+	layer := func(i int) string {
+		return filepath.Join("/cloudless/layers/sha256", strconv.Itoa(i))
+	}
+
+	options, ok := overlayOptions([]string{layer(2), layer(1)}, "/upper", "/work")
+	requireT.True(ok)
+	requireT.Equal("lowerdir=/cloudless/layers/sha256/2:/cloudless/layers/sha256/1,upperdir=/upper,workdir=/work,"+
+		"userxattr", options)
+
+	lowerDirs := make([]string, 0, 500)
+	for i := range 500 {
+		lowerDirs = append(lowerDirs, layer(i))
+	}
+	_, ok = overlayOptions(lowerDirs, "/upper", "/work")
+	requireT.False(ok)
+
+	requireT.Error(Overlay(t.TempDir(), append(lowerDirs, layer(500)), "/upper", "/work"))
+}
@@ -4,13 +4,19 @@ import (
 	"bytes"
 	"context"
 	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
 	"unsafe"
 
@@ -20,20 +26,70 @@ import (
 	"golang.org/x/crypto/ssh"
 
 	"github.com/outofforest/cloudless"
+	"github.com/outofforest/cloudless/pkg/container"
 	"github.com/outofforest/cloudless/pkg/host"
 	"github.com/outofforest/libexec"
 	"github.com/outofforest/logger"
 	"github.com/outofforest/parallel"
 )
 
-// Port SSH server listens on.
-const Port = 2021
+const (
+	// Port SSH server listens on.
+	Port = 2021
+
+	containerSeparator = "+"
+	containerExtension = "container"
+	sftpEnvVar         = "CLOUDLESS_SFTP"
+	sftpTokenFD        = 3
+)
 
 var shells = []string{
 	"/usr/bin/bash",
 	"/bin/sh",
 }
 
+// IsSFTP checks if process has been started by the SFTP subsystem to access files inside container.
+func IsSFTP() bool {
+	return os.Getenv(sftpEnvVar) != ""
+}
+
+// SFTP serves SFTP session over standard input and output and exits. Host binary must call it at the beginning
+// of main if IsSFTP returns true.
+func SFTP() {
+	if err := serveSFTP(); err != nil {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func serveSFTP() error {
+	// Session is served only if the token passed by the subsystem over the inherited pipe matches the one
+	// set in environment, so process started with the variable alone is not turned into SFTP server.
+	token := os.Getenv(sftpEnvVar)
+	if err := os.Unsetenv(sftpEnvVar); err != nil {
+		return errors.WithStack(err)
+	}
+
+	tokenFile := os.NewFile(sftpTokenFD, "token")
+	receivedToken, err := io.ReadAll(io.LimitReader(tokenFile, int64(len(token))+1))
+	_ = tokenFile.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if subtle.ConstantTimeCompare(receivedToken, []byte(token)) != 1 {
+		return errors.New("invalid token")
+	}
+
+	s, err := sftp.NewServer(stdio{})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := s.Serve(); err != nil && !errors.Is(err, io.EOF) {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
 // Service returns SSH service.
 func Service(authorizedKeys ...string) host.Configurator {
 	return cloudless.Service("ssh", func(ctx context.Context) error {
@@ -76,20 +132,6 @@ func run(ctx context.Context, authorizedKeys []string) error {
 }
 
 func runServer(ctx context.Context, signer ssh.Signer, authKeys [][]byte) error {
-	var shell string
-loop:
-	for _, sh := range shells {
-		_, err := os.Stat(sh)
-		switch {
-		case err == nil:
-			shell = sh
-			break loop
-		case os.IsNotExist(err):
-		default:
-			return errors.WithStack(err)
-		}
-	}
-
 	l, err := net.Listen("tcp", ":"+strconv.Itoa(Port))
 	if err != nil {
 		return errors.WithStack(err)
@@ -107,7 +149,13 @@ loop:
 			mKey := key.Marshal()
 			for _, k := range authKeys {
 				if bytes.Equal(mKey, k) {
-					return &ssh.Permissions{}, nil
+					// User might be specified as root+container to open session inside container.
+					_, containerName, _ := strings.Cut(conn.User(), containerSeparator)
+					return &ssh.Permissions{
+						Extensions: map[string]string{
+							containerExtension: containerName,
+						},
+					}, nil
 				}
 			}
 			return nil, errors.Errorf("unauthorized key %q", base64.RawStdEncoding.EncodeToString(mKey))
@@ -132,7 +180,7 @@ loop:
 				}
 
 				spawn("client", parallel.Continue, func(ctx context.Context) error {
-					if err := client(ctx, conn, config, shell); err != nil {
+					if err := client(ctx, conn, config); err != nil {
 						logger.Get(ctx).Error("SSH connection failed.", zap.Error(err))
 					}
 
@@ -145,7 +193,7 @@ loop:
 	})
 }
 
-func client(ctx context.Context, conn net.Conn, config *ssh.ServerConfig, shell string) error {
+func client(ctx context.Context, conn net.Conn, config *ssh.ServerConfig) error {
 	defer conn.Close()
 
 	sConn, newCh, reqCh, err := ssh.NewServerConn(conn, config)
@@ -153,6 +201,17 @@ func client(ctx context.Context, conn net.Conn, config *ssh.ServerConfig, shell
 		return errors.WithStack(err)
 	}
 
+	// Shell is looked up when session requests it, so port forwarding works even if there is no shell.
+	root := "/"
+	containerName := sConn.Permissions.Extensions[containerExtension]
+	if containerName != "" {
+		pid, err := container.PID(containerName)
+		if err != nil {
+			return err
+		}
+		root = fmt.Sprintf("/proc/%d/root", pid)
+	}
+
 	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
 		spawn("req", parallel.Exit, func(ctx context.Context) error {
 			defer sConn.Close()
@@ -178,7 +237,7 @@ func client(ctx context.Context, conn net.Conn, config *ssh.ServerConfig, shell
 				spawn("channel", parallel.Continue, func(ctx context.Context) error {
 					switch chReq.ChannelType() {
 					case "session":
-						if err := sessionHandler(ctx, chReq, shell, reqCh); err != nil {
+						if err := sessionHandler(ctx, chReq, root, containerName, reqCh); err != nil {
 							logger.Get(ctx).Error("SSH session failed.", zap.Error(err))
 						}
 					case "direct-tcpip":
@@ -207,7 +266,8 @@ func client(ctx context.Context, conn net.Conn, config *ssh.ServerConfig, shell
 func sessionHandler(
 	ctx context.Context,
 	chReq ssh.NewChannel,
-	shell string,
+	root string,
+	containerName string,
 	reqCh <-chan *ssh.Request,
 ) error {
 	ch, reqCh, err := chReq.Accept()
@@ -232,6 +292,15 @@ func sessionHandler(
 
 				switch sys {
 				case "sftp":
+					if containerName != "" {
+						spawn("sftp", parallel.Exit, func(ctx context.Context) error {
+							defer ch.Close()
+
+							return sftpContainer(ctx, ch, containerName)
+						})
+						break
+					}
+
 					s, err := sftp.NewServer(ch)
 					if err != nil {
 						return errors.WithStack(err)
@@ -272,12 +341,17 @@ func sessionHandler(
 				spawn("cmd", parallel.Exit, func(ctx context.Context) error {
 					defer ch.Close()
 
-					cmd := exec.Command("sh", "-c", cmdStr)
+					shell, err := findShell(root)
+					if err != nil {
+						return err
+					}
+
+					cmd := exec.Command(shell, "-c", cmdStr)
 					cmd.Stdin = r
 					cmd.Stdout = ch
 					cmd.Stderr = ch
 
-					return libexec.Exec(ctx, cmd)
+					return execCommand(ctx, cmd, containerName)
 				})
 				spawn("copy", parallel.Fail, func(ctx context.Context) error {
 					_, err := io.Copy(w, ch)
@@ -341,8 +415,15 @@ func sessionHandler(
 					defer ptm.Close()
 					defer pts.Close()
 
+					shell, err := findShell(root)
+					if err != nil {
+						return err
+					}
+
 					cmd := exec.Command(shell)
-					cmd.Dir = "/root"
+					if containerName == "" {
+						cmd.Dir = "/root"
+					}
 					cmd.SysProcAttr = &syscall.SysProcAttr{
 						Ctty: int(pts.Fd()),
 					}
@@ -350,7 +431,7 @@ func sessionHandler(
 					cmd.Stdout = pts
 					cmd.Stderr = pts
 
-					return libexec.Exec(ctx, cmd)
+					return execCommand(ctx, cmd, containerName)
 				})
 				spawn("copy1", parallel.Fail, func(ctx context.Context) error {
 					_, err := io.Copy(ptm, ch)
@@ -443,6 +524,55 @@ func forwardHandler(ctx context.Context, chReq ssh.NewChannel, reqCh <-chan *ssh
 	})
 }
 
+func sftpContainer(ctx context.Context, ch ssh.Channel, containerName string) error {
+	tokenRaw := make([]byte, 32)
+	if _, err := rand.Read(tokenRaw); err != nil {
+		return errors.WithStack(err)
+	}
+	token := hex.EncodeToString(tokenRaw)
+
+	tokenReader, tokenWriter, err := os.Pipe()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer tokenReader.Close()
+
+	_, err = tokenWriter.WriteString(token)
+	_ = tokenWriter.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	cmd := exec.Command("/proc/self/exe")
+	cmd.Env = []string{sftpEnvVar + "=" + token}
+	cmd.Stdin = ch
+	cmd.Stdout = ch
+	cmd.ExtraFiles = []*os.File{tokenReader}
+
+	return container.Exec(ctx, containerName, cmd)
+}
+
+func findShell(root string) (string, error) {
+	for _, sh := range shells {
+		_, err := os.Stat(filepath.Join(root, sh))
+		switch {
+		case err == nil:
+			return sh, nil
+		case os.IsNotExist(err):
+		default:
+			return "", errors.WithStack(err)
+		}
+	}
+	return "", errors.Errorf("no shell found in %s", root)
+}
+
+func execCommand(ctx context.Context, cmd *exec.Cmd, containerName string) error {
+	if containerName == "" {
+		return libexec.Exec(ctx, cmd)
+	}
+	return container.Exec(ctx, containerName, cmd)
+}
+
 type winSize struct {
 	Height uint16
 	Width  uint16
@@ -496,3 +626,17 @@ type directTCPData struct {
 	OriginAddr string
 	OriginPort uint32
 }
+
+type stdio struct{}
+
+func (stdio) Read(p []byte) (int, error) {
+	return os.Stdin.Read(p)
+}
+
+func (stdio) Write(p []byte) (int, error) {
+	return os.Stdout.Write(p)
+}
+
+func (stdio) Close() error {
+	return os.Stdout.Close()
+}
@@ -0,0 +1,29 @@
+package ssh
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindShell(t *testing.T) {
+	requireT := require.New(t)
+
+	root := t.TempDir()
+	_, err := findShell(root)
+	requireT.Error(err)
+
+	requireT.NoError(os.MkdirAll(filepath.Join(root, "bin"), 0o700))
+	requireT.NoError(os.WriteFile(filepath.Join(root, "bin", "sh"), nil, 0o700))
+	shell, err := findShell(root)
+	requireT.NoError(err)
+	requireT.Equal("/bin/sh", shell)
+
+	requireT.NoError(os.MkdirAll(filepath.Join(root, "usr", "bin"), 0o700))
+	requireT.NoError(os.WriteFile(filepath.Join(root, "usr", "bin", "bash"), nil, 0o700))
+	shell, err = findShell(root)
+	requireT.NoError(err)
+	requireT.Equal("/usr/bin/bash", shell)
+}
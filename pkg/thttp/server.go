@@ -34,6 +34,9 @@ type Config struct {
 
 	// GetCertificate if non-nil turns on TLS and returns certificate for request.
 	GetCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+	// NextProtos are the protocols negotiated using TLS ALPN extension in addition to the HTTP ones.
+	NextProtos []string
 }
 
 // An Option is a server configuration mixin.
@@ -79,6 +82,7 @@ func (s *Server) Run(ctx context.Context) error {
 			if s.cfg.GetCertificate != nil {
 				server.TLSConfig = &tls.Config{
 					GetCertificate: s.cfg.GetCertificate,
+					NextProtos:     s.cfg.NextProtos,
 				}
 				err = server.ServeTLS(s.listener, "", "")
 			} else {